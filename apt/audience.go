@@ -0,0 +1,87 @@
+//  Copyright 2021 Google LLC
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package apt
+
+import (
+	"errors"
+	"sync"
+
+	"golang.org/x/oauth2"
+)
+
+// hostTokenSource is a token source whose tokens are bound to the host they
+// are sent to, such as self-signed JWTs, whose audience is that host.
+// authHostTransport asks it for a source for the host of each request.
+type hostTokenSource interface {
+	oauth2.TokenSource
+	forHost(host string) oauth2.TokenSource
+}
+
+// audienceTokenSource mints tokens for an audience derived from the host
+// they are sent to, so that a token stolen from one repository's host
+// isn't accepted by another's. It makes a token source for each audience
+// on first use and keeps it, so that the tokens of each are cached apart.
+// Token mints them for defaultAudience, e.g. for health checks.
+type audienceTokenSource struct {
+	newSource       func(audience string) (oauth2.TokenSource, error)
+	audience        func(host string) string
+	defaultAudience string
+
+	mu      sync.Mutex
+	sources map[string]oauth2.TokenSource
+}
+
+// Token implements oauth2.TokenSource.
+func (ts *audienceTokenSource) Token() (*oauth2.Token, error) {
+	if ts.defaultAudience == "" {
+		return nil, errors.New("tokens are only minted for the host of a request")
+	}
+	return ts.tokenFor(ts.defaultAudience)
+}
+
+// forHost implements hostTokenSource.
+func (ts *audienceTokenSource) forHost(host string) oauth2.TokenSource {
+	return boundTokenSource{ts: ts, audience: ts.audience(host)}
+}
+
+// tokenFor returns a token for audience from its source.
+func (ts *audienceTokenSource) tokenFor(audience string) (*oauth2.Token, error) {
+	ts.mu.Lock()
+	source, ok := ts.sources[audience]
+	if !ok {
+		var err error
+		if source, err = ts.newSource(audience); err != nil {
+			ts.mu.Unlock()
+			return nil, err
+		}
+		if ts.sources == nil {
+			ts.sources = make(map[string]oauth2.TokenSource)
+		}
+		ts.sources[audience] = source
+	}
+	ts.mu.Unlock()
+	return source.Token()
+}
+
+// boundTokenSource is the source of an audienceTokenSource's tokens for a
+// single audience.
+type boundTokenSource struct {
+	ts       *audienceTokenSource
+	audience string
+}
+
+func (b boundTokenSource) Token() (*oauth2.Token, error) {
+	return b.ts.tokenFor(b.audience)
+}
@@ -0,0 +1,49 @@
+//  Copyright 2021 Google LLC
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package apt
+
+import (
+	"testing"
+
+	"golang.org/x/oauth2"
+)
+
+func TestAudienceTokenSource(t *testing.T) {
+	made := map[string]int{}
+	ts := &audienceTokenSource{
+		newSource: func(audience string) (oauth2.TokenSource, error) {
+			made[audience]++
+			return oauth2.StaticTokenSource(&oauth2.Token{AccessToken: audience}), nil
+		},
+		audience: func(host string) string { return "https://" + host + "/" },
+	}
+	if _, err := ts.Token(); err == nil {
+		t.Error("failed, expected an error without a default audience")
+	}
+	for _, host := range []string{"a.pkg.dev", "b.pkg.dev", "a.pkg.dev"} {
+		tok, err := ts.forHost(host).Token()
+		if err != nil || tok.AccessToken != "https://"+host+"/" {
+			t.Errorf("failed, %v: got %v for %s", err, tok, host)
+		}
+	}
+	if made["https://a.pkg.dev/"] != 1 || made["https://b.pkg.dev/"] != 1 {
+		t.Errorf("failed, expected a source per audience, made %v", made)
+	}
+
+	ts.defaultAudience = "default"
+	if tok, err := ts.Token(); err != nil || tok.AccessToken != "default" {
+		t.Errorf("failed, %v: got %v for the default audience", err, tok)
+	}
+}
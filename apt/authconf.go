@@ -0,0 +1,192 @@
+//  Copyright 2021 Google LLC
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package apt
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"golang.org/x/oauth2"
+)
+
+// authConfFile is the file in auth.conf.d which Auth-Conf-Write keeps up to
+// date. It is skipped when reading entries, so that the method never
+// authenticates with a token it wrote itself.
+const authConfFile = "90artifact-registry.conf"
+
+// authConfLogin is the login with which Artifact Registry accepts an
+// access token as a password.
+const authConfLogin = "oauth2accesstoken"
+
+// authConfEntry is a machine entry from apt's auth.conf, in netrc format.
+type authConfEntry struct {
+	machine, login, password string
+}
+
+// authConfFiles returns apt's auth.conf and the .conf files in auth.conf.d.
+func (d aptDirs) authConfFiles() []string {
+	etc := resolve(d.root, d.etc)
+	files := []string{resolve(etc, d.netrc)}
+	parts := resolve(etc, d.netrcParts)
+	entries, err := os.ReadDir(parts)
+	if err != nil {
+		return files
+	}
+	var names []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.IsDir() && strings.HasSuffix(name, ".conf") && name != authConfFile {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		files = append(files, filepath.Join(parts, name))
+	}
+	return files
+}
+
+// readAuthConf parses all the given files, skipping any which can't be read.
+func readAuthConf(files []string) []authConfEntry {
+	var entries []authConfEntry
+	for _, file := range files {
+		f, err := os.Open(file)
+		if err != nil {
+			continue
+		}
+		entries = append(entries, parseAuthConf(f)...)
+		f.Close()
+	}
+	return entries
+}
+
+// parseAuthConf parses netrc format, e.g.
+// `machine europe-apt.pkg.dev login oauth2accesstoken password TOKEN`,
+// possibly split across lines.
+func parseAuthConf(r io.Reader) []authConfEntry {
+	var entries []authConfEntry
+	var tokens []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(strings.TrimSpace(line), "#") {
+			continue
+		}
+		tokens = append(tokens, strings.Fields(line)...)
+	}
+	for i := 0; i+1 < len(tokens); i += 2 {
+		switch tokens[i] {
+		case "machine":
+			entries = append(entries, authConfEntry{machine: tokens[i+1]})
+		case "login", "password":
+			if len(entries) == 0 {
+				continue
+			}
+			if tokens[i] == "login" {
+				entries[len(entries)-1].login = tokens[i+1]
+			} else {
+				entries[len(entries)-1].password = tokens[i+1]
+			}
+		}
+	}
+	return entries
+}
+
+// matchAuthConf returns the first entry for u, as apt matches them: the
+// machine is a host, with a port if u has one, optionally followed by a
+// path which u's path must start with.
+func matchAuthConf(entries []authConfEntry, u *url.URL) *authConfEntry {
+	for i, entry := range entries {
+		machine := strings.TrimPrefix(entry.machine, "https://")
+		host, path := machine, ""
+		if i := strings.Index(machine, "/"); i >= 0 {
+			host, path = machine[:i], machine[i:]
+		}
+		if strings.EqualFold(host, u.Host) && strings.HasPrefix(u.Path, path) && entry.login != "" {
+			return &entries[i]
+		}
+	}
+	return nil
+}
+
+// authConfWriter writes each new token from base to a file in auth.conf.d,
+// as entries for hosts, so that other tooling can use them.
+type authConfWriter struct {
+	base  oauth2.TokenSource
+	path  string
+	hosts []string
+	log   func(string)
+
+	mu   sync.Mutex
+	last string
+}
+
+func (w *authConfWriter) Token() (*oauth2.Token, error) {
+	tok, err := w.base.Token()
+	if err != nil {
+		return nil, err
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if tok.AccessToken != w.last {
+		if err := w.write(tok.AccessToken); err != nil {
+			w.log(fmt.Sprintf("failed to write %s: %v", w.path, err))
+		} else {
+			w.last = tok.AccessToken
+		}
+	}
+	return tok, nil
+}
+
+func (w *authConfWriter) write(token string) error {
+	var b strings.Builder
+	b.WriteString("# Written by the Artifact Registry apt transport; changes are overwritten.\n")
+	for _, host := range w.hosts {
+		fmt.Fprintf(&b, "machine %s login %s password %s\n", host, authConfLogin, token)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(w.path), ".auth-conf-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.WriteString(b.String()); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), w.path)
+}
+
+// newAuthConfWriter wraps ts to write its tokens for the Artifact Registry
+// hosts in the sources files.
+func (m *Method) newAuthConfWriter(ts oauth2.TokenSource) oauth2.TokenSource {
+	var hosts []string
+	for _, host := range sourceHosts(readSources(m.config.dirs.sourceFiles())) {
+		if m.config.authHostAllowed(host) {
+			hosts = append(hosts, host)
+		}
+	}
+	path := filepath.Join(resolve(resolve(m.config.dirs.root, m.config.dirs.etc), m.config.dirs.netrcParts), authConfFile)
+	return &authConfWriter{base: ts, path: path, hosts: hosts, log: func(msg string) { m.writer.Log(msg) }}
+}
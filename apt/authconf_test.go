@@ -0,0 +1,143 @@
+//  Copyright 2021 Google LLC
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package apt
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"golang.org/x/oauth2"
+)
+
+func TestParseAuthConf(t *testing.T) {
+	input := `# comment
+machine europe-apt.pkg.dev login oauth2accesstoken password token1
+machine https://us-apt.pkg.dev/projects/p
+  login oauth2accesstoken
+  password token2
+`
+	expected := []authConfEntry{
+		{"europe-apt.pkg.dev", "oauth2accesstoken", "token1"},
+		{"https://us-apt.pkg.dev/projects/p", "oauth2accesstoken", "token2"},
+	}
+	if res := parseAuthConf(strings.NewReader(input)); !reflect.DeepEqual(res, expected) {
+		t.Errorf("failed, expected %v, got %v", expected, res)
+	}
+}
+
+func TestMatchAuthConf(t *testing.T) {
+	entries := []authConfEntry{
+		{"https://us-apt.pkg.dev/projects/p", "oauth2accesstoken", "p-token"},
+		{"us-apt.pkg.dev", "oauth2accesstoken", "host-token"},
+		{"mirror.example.com:8443", "user", "secret"},
+	}
+	var tests = []struct {
+		uri, expected string
+	}{
+		{"https://us-apt.pkg.dev/projects/p/dists/repo/InRelease", "p-token"},
+		{"https://us-apt.pkg.dev/projects/q/dists/repo/InRelease", "host-token"},
+		{"https://mirror.example.com:8443/debian/InRelease", "secret"},
+		{"https://mirror.example.com/debian/InRelease", ""},
+		{"https://europe-apt.pkg.dev/projects/p/dists/repo/InRelease", ""},
+	}
+
+	for _, tt := range tests {
+		u, _ := url.Parse(tt.uri)
+		res := ""
+		if entry := matchAuthConf(entries, u); entry != nil {
+			res = entry.password
+		}
+		if res != tt.expected {
+			t.Errorf("failed, %s matched %q, expected %q", tt.uri, res, tt.expected)
+		}
+	}
+}
+
+func TestAptMethodAuthConf(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, password, _ := r.BasicAuth()
+		fmt.Fprintf(w, "%s:%s", user, password)
+	}))
+	defer server.Close()
+	serverURL, _ := url.Parse(server.URL)
+
+	root := t.TempDir()
+	parts := filepath.Join(root, "etc/apt/auth.conf.d")
+	os.MkdirAll(parts, 0755)
+	os.WriteFile(filepath.Join(parts, "ar.conf"), []byte("machine "+serverURL.Host+" login oauth2accesstoken password conf-token\n"), 0600)
+	// A file written by Auth-Conf-Write is never read back.
+	os.WriteFile(filepath.Join(parts, authConfFile), []byte("machine "+serverURL.Host+" login oauth2accesstoken password stale-token\n"), 0600)
+	setenv(t, "GOOGLE_APPLICATION_CREDENTIALS", "")
+	setenv(t, "HOME", root)
+	setenv(t, "GCE_METADATA_HOST", "127.0.0.1:1")
+
+	var buffer bytes.Buffer
+	method := NewAptMethod(bufio.NewReader(&bytes.Buffer{}), &buffer)
+	method.handleConfigure(&Message{code: 601, description: "Configuration", fields: map[string][]string{
+		"Config-Item": {"Dir=" + root + "/"},
+	}})
+	ctx := context.WithValue(context.Background(), oauth2.HTTPClient, server.Client())
+	filename := filepath.Join(root, "pkg.deb")
+	msg := &Message{
+		code:        600,
+		description: "URI Acquire",
+		fields:      map[string][]string{"URI": {"ar+" + server.URL + "/pool/pkg.deb"}, "Filename": {filename}},
+	}
+	if err := method.handleAcquire(ctx, msg); err != nil {
+		t.Fatalf("failed, %v: %q", err, buffer.String())
+	}
+	if b, _ := os.ReadFile(filename); string(b) != "oauth2accesstoken:conf-token" {
+		t.Errorf("failed, expected the auth.conf entry to be used, got %q", b)
+	}
+}
+
+func TestAuthConfWriter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), authConfFile)
+	token := &oauth2.Token{AccessToken: "token1"}
+	w := &authConfWriter{
+		base:  oauth2.StaticTokenSource(token),
+		path:  path,
+		hosts: []string{"us-apt.pkg.dev", "europe-apt.pkg.dev"},
+		log:   func(msg string) { t.Error(msg) },
+	}
+	w.Token()
+	token.AccessToken = "token2"
+	w.Token()
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed, %v", err)
+	}
+	expected := []authConfEntry{
+		{"us-apt.pkg.dev", authConfLogin, "token2"},
+		{"europe-apt.pkg.dev", authConfLogin, "token2"},
+	}
+	if res := parseAuthConf(bytes.NewReader(b)); !reflect.DeepEqual(res, expected) {
+		t.Errorf("failed, expected %v, got %v", expected, res)
+	}
+	if fi, err := os.Stat(path); err != nil || fi.Mode().Perm() != 0600 {
+		t.Errorf("failed, expected the file to be private, got %v", fi.Mode())
+	}
+}
@@ -0,0 +1,133 @@
+//  Copyright 2021 Google LLC
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package apt
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"golang.org/x/oauth2"
+)
+
+// defaultAuthHosts are the hosts bearer tokens are sent to unless more are
+// allowed by Auth-Hosts: Artifact Registry's repositories and its API.
+var defaultAuthHosts = []string{"*.pkg.dev", "artifactregistry.googleapis.com"}
+
+// matchAuthHost reports whether host matches pattern, which is either a
+// host name or "*." followed by a domain, matching any host within it.
+func matchAuthHost(pattern, host string) bool {
+	pattern, host = strings.ToLower(pattern), strings.ToLower(strings.TrimSuffix(host, "."))
+	if strings.HasPrefix(pattern, "*.") {
+		return strings.HasSuffix(host, pattern[1:])
+	}
+	return pattern == host
+}
+
+// authHostAllowed reports whether bearer tokens may be sent to host.
+func (c *aptMethodConfig) authHostAllowed(host string) bool {
+	for _, patterns := range [][]string{defaultAuthHosts, c.authHosts} {
+		for _, pattern := range patterns {
+			if matchAuthHost(pattern, host) {
+				return true
+			}
+		}
+	}
+	return c.fallbackEndpoint != "" && host == c.fallbackHost()
+}
+
+// authHostTransport attaches tokens only to requests for allowed hosts. As
+// the client calls it for each hop of a redirect, a redirect to a host that
+// isn't allowed is followed without the token. Hosts with an auth.conf
+// entry are authenticated with it instead. Without auth, no tokens are
+// attached at all. Tokens bound to a host are those of its source for the
+// host of the request; see hostTokenSource.
+type authHostTransport struct {
+	base     http.RoundTripper
+	auth     *oauth2.Transport
+	allowed  func(host string) bool
+	authConf []authConfEntry
+}
+
+func (t *authHostTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if entry := matchAuthConf(t.authConf, req.URL); entry != nil {
+		req = req.Clone(req.Context())
+		req.SetBasicAuth(entry.login, entry.password)
+		return t.base.RoundTrip(req)
+	}
+	if t.auth != nil && t.allowed(req.URL.Hostname()) {
+		if hts, ok := t.auth.Source.(hostTokenSource); ok {
+			auth := &oauth2.Transport{Source: hts.forHost(req.URL.Host), Base: t.auth.Base}
+			return auth.RoundTrip(req)
+		}
+		return t.auth.RoundTrip(req)
+	}
+	return t.base.RoundTrip(req)
+}
+
+// newAuthClient returns a client which authenticates requests to the hosts
+// allowed by the config with tokens from ts, or with their entry in
+// authConf. ts is asked for a token for every request, so it should cache
+// them, as tokenManager does. A nil ts makes requests anonymous. If
+// proxyTokens is set, its tokens authenticate tunnels through the proxy.
+// Requests are sent with the transport of the client in ctx, as with
+// oauth2.NewClient.
+func (c *aptMethodConfig) newAuthClient(ctx context.Context, ts, proxyTokens oauth2.TokenSource, authConf []authConfEntry) *http.Client {
+	base := oauth2.NewClient(ctx, nil).Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	if transport, ok := base.(*http.Transport); ok {
+		transport = transport.Clone()
+		// Keep a connection for each worker between acquires. Otherwise
+		// all but two of those opened for a pipelined batch, such as the
+		// indexes of every architecture, are closed after one use.
+		if transport.MaxIdleConnsPerHost < c.workers() {
+			transport.MaxIdleConnsPerHost = c.workers()
+		}
+		if proxyTokens != nil {
+			transport.GetProxyConnectHeader = proxyConnectHeader(proxyTokens)
+		}
+		base = transport
+	}
+	t := &authHostTransport{base: base, allowed: c.authHostAllowed, authConf: authConf}
+	if ts != nil {
+		t.auth = &oauth2.Transport{Source: ts, Base: base}
+	}
+	client := &http.Client{Transport: t}
+	if c.passRedirects {
+		// Leave redirects to apt; see redirectURI.
+		client.CheckRedirect = func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		}
+	}
+	return client
+}
+
+// redirectURI returns the URI apt should fetch in place of one redirected
+// from req to location. A target this method would send credentials to is
+// kept on the ar+https scheme; any other is left to apt's own https method,
+// which fetches it anonymously and applies apt's policy for redirects.
+func (c *aptMethodConfig) redirectURI(req *http.Request, location string) (string, error) {
+	target, err := req.URL.Parse(location)
+	if err != nil {
+		return "", fmt.Errorf("invalid redirect location %q: %v", location, err)
+	}
+	if target.Scheme == "https" && c.authHostAllowed(target.Hostname()) {
+		target.Scheme = "ar+https"
+	}
+	return target.String(), nil
+}
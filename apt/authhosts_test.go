@@ -0,0 +1,122 @@
+//  Copyright 2021 Google LLC
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package apt
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/oauth2"
+)
+
+func TestAuthHostAllowed(t *testing.T) {
+	config := &aptMethodConfig{authHosts: []string{"mirror.example.com", "*.corp.example"}}
+	var tests = []struct {
+		host     string
+		expected bool
+	}{
+		{"us-apt.pkg.dev", true},
+		{"US-APT.PKG.DEV", true},
+		{"us-apt.pkg.dev.", true},
+		{"artifactregistry.googleapis.com", true},
+		{"pkg.dev.evil.com", false},
+		{"evilpkg.dev", false},
+		{"storage.googleapis.com", false},
+		{"mirror.example.com", true},
+		{"other.example.com", false},
+		{"a.b.corp.example", true},
+		{"corp.example", false},
+	}
+
+	for _, tt := range tests {
+		if res := config.authHostAllowed(tt.host); res != tt.expected {
+			t.Errorf("failed, authHostAllowed(%q) = %v, expected %v", tt.host, res, tt.expected)
+		}
+	}
+}
+
+func TestAuthHostRedirect(t *testing.T) {
+	thirdParty := "unreached"
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		thirdParty = r.Header.Get("Authorization")
+	}))
+	defer other.Close()
+	var repo string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		repo = r.Header.Get("Authorization")
+		http.Redirect(w, r, strings.Replace(other.URL, "127.0.0.1", "localhost", 1)+"/blob", http.StatusFound)
+	}))
+	defer server.Close()
+
+	config := &aptMethodConfig{authHosts: []string{"127.0.0.1"}}
+	client := config.newAuthClient(context.Background(), oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "token"}), nil, nil)
+	resp, err := client.Get(server.URL + "/pool/pkg.deb")
+	if err != nil {
+		t.Fatalf("failed, %v", err)
+	}
+	resp.Body.Close()
+	if repo != "Bearer token" {
+		t.Errorf("failed, expected the allowed host to get the token, got %q", repo)
+	}
+	if thirdParty != "" {
+		t.Errorf("failed, the redirect target got %q", thirdParty)
+	}
+}
+
+func TestAptMethodPassRedirects(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/pool/moved.deb":
+			http.Redirect(w, r, "/pool/new.deb", http.StatusMovedPermanently)
+		case "/pool/blob.deb":
+			http.Redirect(w, r, "https://storage.example.com/blob?sig=abc", http.StatusFound)
+		default:
+			t.Errorf("failed, redirect to %s was followed", r.URL.Path)
+		}
+	}))
+	defer server.Close()
+	var tests = []struct {
+		path, expected string
+	}{
+		{"/pool/moved.deb", "ar+" + server.URL + "/pool/new.deb"},
+		{"/pool/blob.deb", "https://storage.example.com/blob?sig=abc"},
+	}
+
+	for _, tt := range tests {
+		var buffer bytes.Buffer
+		method := NewAptMethod(bufio.NewReader(&bytes.Buffer{}), &buffer)
+		method.handleConfigure(&Message{code: 601, description: "Configuration", fields: map[string][]string{
+			"Config-Item": {"Acquire::gar::Access-Token=token", "Acquire::gar::Auth-Hosts::=127.0.0.1", "Acquire::gar::Follow-Redirects=false"},
+		}})
+		ctx := context.WithValue(context.Background(), oauth2.HTTPClient, server.Client())
+		uri := "ar+" + server.URL + tt.path
+		if err := method.handleAcquire(ctx, &Message{
+			code:        600,
+			description: "URI Acquire",
+			fields:      map[string][]string{"URI": {uri}, "Filename": {filepath.Join(t.TempDir(), "pkg.deb")}},
+		}); err != nil {
+			t.Fatalf("failed, %v: %q", err, buffer.String())
+		}
+		if expected := "103 Redirect\nNew-URI: " + tt.expected + "\nURI: " + uri + "\n\n"; buffer.String() != expected {
+			t.Errorf("failed, expected %q, got %q", expected, buffer.String())
+		}
+	}
+}
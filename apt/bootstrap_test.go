@@ -0,0 +1,171 @@
+//  Copyright 2021 Google LLC
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package apt
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"golang.org/x/oauth2"
+)
+
+// setenv sets an environment variable for the duration of a test, unsetting
+// it if value is empty.
+func setenv(t *testing.T, key, value string) {
+	t.Helper()
+	prev, ok := os.LookupEnv(key)
+	if value == "" {
+		os.Unsetenv(key)
+	} else {
+		os.Setenv(key, value)
+	}
+	t.Cleanup(func() {
+		if ok {
+			os.Setenv(key, prev)
+		} else {
+			os.Unsetenv(key)
+		}
+	})
+}
+
+// writeServiceAccountKey writes a service account key which mints tokens
+// from tokenURI.
+func writeServiceAccountKey(t *testing.T, path, tokenURI string) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := json.Marshal(map[string]string{
+		"type":           "service_account",
+		"client_email":   "builder@p.iam.gserviceaccount.com",
+		"private_key_id": "1",
+		"private_key":    string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+		"token_uri":      tokenURI,
+	})
+	if err := os.WriteFile(path, b, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestBootstrapFlow runs the method the way mmdebstrap and debootstrap do
+// when building an image: in a chroot-like directory with a minimal
+// environment, no metadata server, credentials only from the environment and
+// a relative partial directory.
+func TestBootstrapFlow(t *testing.T) {
+	var fetches int32
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/token" {
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprint(w, `{"access_token": "bootstrap-token", "token_type": "Bearer", "expires_in": 3600}`)
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer bootstrap-token" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		atomic.AddInt32(&fetches, 1)
+		w.Header().Set("Last-Modified", "Mon, 01 Mar 2021 03:05:06 GMT")
+		fmt.Fprint(w, "package contents")
+	}))
+	defer server.Close()
+
+	chroot := t.TempDir()
+	partial := filepath.Join(chroot, "var", "cache", "apt", "archives", "partial")
+	if err := os.MkdirAll(partial, 0755); err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(chroot, "key.json")
+	writeServiceAccountKey(t, keyFile, server.URL+"/token")
+
+	setenv(t, "HOME", "")
+	setenv(t, "GOOGLE_APPLICATION_CREDENTIALS", keyFile)
+	// Nothing listens here, so any use of the metadata server fails.
+	setenv(t, "GCE_METADATA_HOST", "127.0.0.1:1")
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(chroot); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	stdinreader, stdinwriter := io.Pipe()
+	stdoutreader, stdoutwriter := io.Pipe()
+	defer stdinwriter.Close()
+	defer stdoutreader.Close()
+	method := NewAptMethod(bufio.NewReader(stdinreader), stdoutwriter)
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), oauth2.HTTPClient, server.Client()))
+	defer cancel()
+	go method.Run(ctx)
+
+	uri := "ar+https://" + strings.TrimPrefix(server.URL, "https://") + "/projects/p/pool/main/p/pkg.deb"
+	relative := filepath.Join("var", "cache", "apt", "archives", "partial", "pkg.deb")
+	go func() {
+		writer := NewAptMessageWriter(stdinwriter)
+		writer.WriteMessage(Message{
+			code:        601,
+			description: "Configuration",
+			fields:      map[string][]string{"Config-Item": {"Dir=" + chroot + "/", "Dir::Etc=etc/apt/", "Acquire::gar::Auth-Hosts::=127.0.0.1"}},
+		})
+		writer.WriteMessage(Message{code: 600, description: "URI Acquire", fields: map[string][]string{"URI": {uri}, "Filename": {relative}}})
+		// The same file, named by its absolute path.
+		writer.WriteMessage(Message{code: 600, description: "URI Acquire", fields: map[string][]string{"URI": {uri}, "Filename": {filepath.Join(partial, "pkg.deb")}}})
+	}()
+
+	reader := NewAptMessageReader(bufio.NewReader(stdoutreader))
+	for done := 0; done < 2; {
+		msg, err := reader.ReadMessage(ctx)
+		if err != nil {
+			t.Fatalf("failed reading from method: %v", err)
+		}
+		switch msg.code {
+		case 201:
+			if msg.Get("Size") != "16" {
+				t.Errorf("failed, unexpected URI Done %v", msg)
+			}
+			done++
+		case 400, 401:
+			t.Fatalf("failed, %v", msg)
+		}
+	}
+
+	if contents, err := os.ReadFile(filepath.Join(partial, "pkg.deb")); err != nil || string(contents) != "package contents" {
+		t.Errorf("failed, unexpected file contents %q, %v", contents, err)
+	}
+	if n := atomic.LoadInt32(&fetches); n != 1 {
+		t.Errorf("failed, expected 1 fetch, got %d", n)
+	}
+}
@@ -0,0 +1,155 @@
+//  Copyright 2021 Google LLC
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package apt
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// runUntilCancelled runs a method on input, which is left open, cancels it
+// once cancelled is closed, and returns what it wrote.
+func runUntilCancelled(t *testing.T, ctx context.Context, input string, cancelled <-chan struct{}) string {
+	t.Helper()
+	stdin, stdinWriter := io.Pipe()
+	defer stdinWriter.Close()
+	go io.WriteString(stdinWriter, input)
+	var output bytes.Buffer
+	method := NewAptMethod(bufio.NewReader(stdin), &output)
+	ctx, cancel := context.WithCancel(ctx)
+	go func() {
+		<-cancelled
+		cancel()
+	}()
+	done := make(chan error, 1)
+	go func() { done <- method.Run(ctx) }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("failed, expected Run to return nil when cancelled, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("failed, Run didn't return after cancellation")
+	}
+	return output.String()
+}
+
+func TestRunCancelWaitingForInput(t *testing.T) {
+	cancelled := make(chan struct{})
+	time.AfterFunc(10*time.Millisecond, func() { close(cancelled) })
+	output := runUntilCancelled(t, context.Background(), "601 Configuration\nConfig-Item: Acquire::gar::Access-Token=token\n\n", cancelled)
+	if !strings.HasPrefix(output, "100 Capabilities") || strings.Count(output, "\n\n") != 1 {
+		t.Errorf("failed, expected only the capabilities, got %q", output)
+	}
+}
+
+func TestRunCancelAcquire(t *testing.T) {
+	const partial = "first half of the package"
+	for _, stage := range []string{"response", "body", "mapped body"} {
+		entered := make(chan struct{})
+		var once sync.Once
+		server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if stage != "response" {
+				w.Header().Set("Content-Length", "1000")
+				io.WriteString(w, partial)
+				w.(http.Flusher).Flush()
+			}
+			once.Do(func() { close(entered) })
+			<-r.Context().Done()
+		}))
+
+		filename := filepath.Join(t.TempDir(), "pkg.deb")
+		cancelled := make(chan struct{})
+		go func() {
+			<-entered
+			if stage != "response" {
+				// Give the client time to receive what was sent, which
+				// is held in its buffers rather than written out.
+				time.Sleep(100 * time.Millisecond)
+			}
+			close(cancelled)
+		}()
+		// Without pipelining, the second acquire waits for the first.
+		config := "Acquire::gar::Access-Token=token\nConfig-Item: Acquire::gar::Auth-Hosts::=127.0.0.1\nConfig-Item: Acquire::gar::Pipeline-Depth=1\n"
+		if stage == "mapped body" {
+			config += "Config-Item: Acquire::gar::Mmap-Threshold=1\n"
+		}
+		input := "601 Configuration\nConfig-Item: " + config + "\n" +
+			"600 URI Acquire\nURI: ar+" + server.URL + "/pool/pkg.deb\nFilename: " + filename + "\n\n" +
+			"600 URI Acquire\nURI: ar+" + server.URL + "/pool/other.deb\nFilename: " + filename + ".other\n\n"
+		ctx := context.WithValue(context.Background(), oauth2.HTTPClient, server.Client())
+		output := runUntilCancelled(t, ctx, input, cancelled)
+		server.Close()
+
+		if !strings.Contains(output, "400 URI Failure\n") || !strings.Contains(output, "URI: ar+"+server.URL+"/pool/pkg.deb\n") {
+			t.Errorf("%s: failed, expected a URI Failure for the aborted acquire, got %q", stage, output)
+		}
+		if strings.Contains(output, "other.deb") {
+			t.Errorf("%s: failed, expected the next acquire not to be handled, got %q", stage, output)
+		}
+		if strings.Contains(output, "201 URI Done") {
+			t.Errorf("%s: failed, expected no URI Done, got %q", stage, output)
+		}
+		expected := ""
+		if stage != "response" {
+			expected = partial
+		}
+		if b, err := os.ReadFile(filename); (err == nil || expected != "") && string(b) != expected {
+			t.Errorf("%s: failed, expected the file to hold %q, got %q, %v", stage, expected, b, err)
+		}
+		if matches, _ := filepath.Glob(filepath.Join(filepath.Dir(filename), ".*")); len(matches) != 0 {
+			t.Errorf("%s: failed, expected no temporary files, got %v", stage, matches)
+		}
+	}
+}
+
+func TestRunCancelSavesStats(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "package contents")
+	}))
+	defer server.Close()
+	dir := t.TempDir()
+	statsFile := filepath.Join(dir, "egress.json")
+	input := "601 Configuration\nConfig-Item: Acquire::gar::Access-Token=token\nConfig-Item: Acquire::gar::Auth-Hosts::=127.0.0.1\nConfig-Item: Acquire::gar::Egress-Stats-File=" + statsFile + "\n\n" +
+		"600 URI Acquire\nURI: ar+" + server.URL + "/pool/pkg.deb\nFilename: " + filepath.Join(dir, "pkg.deb") + "\n\n"
+	ctx := context.WithValue(context.Background(), oauth2.HTTPClient, server.Client())
+	done := make(chan struct{})
+	go func() {
+		for {
+			if b, _ := os.ReadFile(filepath.Join(dir, "pkg.deb")); string(b) == "package contents" {
+				close(done)
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}()
+	output := runUntilCancelled(t, ctx, input, done)
+	if b, err := os.ReadFile(statsFile); err != nil || !strings.Contains(string(b), server.Listener.Addr().String()) {
+		t.Errorf("failed, expected egress stats to be saved, got %q, %v: %q", b, err, output)
+	}
+}
@@ -0,0 +1,80 @@
+//  Copyright 2021 Google LLC
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package apt
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var errChaos = errors.New("chaos: injected failure")
+
+// chaosConfig describes artificial faults to inject into requests, so that
+// staging fleets can exercise apt-level retry behavior and alerting. It is
+// only ever enabled by an explicit Acquire::gar::Chaos config item, in a
+// build with the chaos tag; see chaosBuilt.
+type chaosConfig struct {
+	latency   time.Duration
+	errorRate float64
+}
+
+// parseChaos parses a spec of the form "latency:200ms,errorrate:0.05".
+func parseChaos(spec string) (*chaosConfig, error) {
+	c := &chaosConfig{}
+	for _, item := range strings.Split(spec, ",") {
+		parts := strings.SplitN(strings.TrimSpace(item), ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("malformed chaos item %q", item)
+		}
+		value := strings.TrimSpace(parts[1])
+		switch strings.ToLower(strings.TrimSpace(parts[0])) {
+		case "latency":
+			latency, err := time.ParseDuration(value)
+			if err != nil || latency < 0 {
+				return nil, fmt.Errorf("invalid chaos latency %q", value)
+			}
+			c.latency = latency
+		case "errorrate":
+			rate, err := strconv.ParseFloat(value, 64)
+			if err != nil || rate < 0 || rate > 1 {
+				return nil, fmt.Errorf("invalid chaos error rate %q", value)
+			}
+			c.errorRate = rate
+		default:
+			return nil, fmt.Errorf("unknown chaos item %q", item)
+		}
+	}
+	return c, nil
+}
+
+// injectChaos delays and possibly fails a request according to the chaos
+// config, if any.
+func (m *Method) injectChaos() error {
+	c := m.config.chaos
+	if !chaosBuilt || c == nil {
+		return nil
+	}
+	if c.latency > 0 {
+		m.timeSource().Sleep(c.latency)
+	}
+	if c.errorRate > 0 && rand.Float64() < c.errorRate {
+		return errChaos
+	}
+	return nil
+}
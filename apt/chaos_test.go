@@ -0,0 +1,55 @@
+//  Copyright 2021 Google LLC
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+//go:build chaos
+// +build chaos
+
+package apt
+
+import (
+	"bufio"
+	"bytes"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAptMethodChaos(t *testing.T) {
+	var buffer bytes.Buffer
+	var calls int
+	clock := newFakeClock()
+	method := NewAptMethod(bufio.NewReader(&bytes.Buffer{}), &buffer)
+	method.SetClock(clock)
+	method.client = fakeHTTPClient{calls: &calls}
+	method.handleConfigure(&Message{
+		code:        601,
+		description: "Configuration",
+		fields:      map[string][]string{"Config-Item": {"Acquire::gar::Chaos=latency:200ms,errorrate:1"}},
+	})
+
+	req, _ := http.NewRequest("GET", "https://fake.uri/", nil)
+	if _, err := method.do(req); err != errChaos {
+		t.Errorf("expected injected failure, got %v", err)
+	}
+	if calls != 0 {
+		t.Errorf("expected the request not to be sent, got %d calls", calls)
+	}
+	if len(clock.sleeps) != 1 || clock.sleeps[0] != 200*time.Millisecond {
+		t.Errorf("expected injected latency, got sleeps %v", clock.sleeps)
+	}
+	if !strings.Contains(buffer.String(), "chaos testing enabled") {
+		t.Errorf("expected a warning that chaos is enabled, got %q", buffer.String())
+	}
+}
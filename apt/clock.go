@@ -0,0 +1,66 @@
+//  Copyright 2021 Google LLC
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package apt
+
+import "time"
+
+// Clock is the source of time for retries, backoff, timeouts and latency
+// measurements, so that tests can control time-based behavior.
+type Clock interface {
+	Now() time.Time
+	Sleep(time.Duration)
+	NewTimer(time.Duration) Timer
+}
+
+// Timer is a single event created by a Clock, like time.Timer.
+type Timer interface {
+	C() <-chan time.Time
+	Stop() bool
+}
+
+// SystemClock is the Clock backed by the time package.
+type SystemClock struct{}
+
+// Now implements Clock.
+func (SystemClock) Now() time.Time { return time.Now() }
+
+// Sleep implements Clock.
+func (SystemClock) Sleep(d time.Duration) { time.Sleep(d) }
+
+// NewTimer implements Clock.
+func (SystemClock) NewTimer(d time.Duration) Timer { return systemTimer{time.NewTimer(d)} }
+
+type systemTimer struct {
+	t *time.Timer
+}
+
+func (t systemTimer) C() <-chan time.Time { return t.t.C }
+func (t systemTimer) Stop() bool          { return t.t.Stop() }
+
+func (m *Method) timeSource() Clock {
+	if m.clock == nil {
+		return SystemClock{}
+	}
+	return m.clock
+}
+
+// SetClock replaces the Clock used by the method. It must be called before
+// Run.
+func (m *Method) SetClock(c Clock) {
+	m.clock = c
+	m.writer.mu.Lock()
+	defer m.writer.mu.Unlock()
+	m.writer.clock = c
+}
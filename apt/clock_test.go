@@ -0,0 +1,140 @@
+//  Copyright 2021 Google LLC
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package apt
+
+import (
+	"io"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock is a Clock whose time only moves when Sleep or Advance is called.
+type fakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	sleeps []time.Duration
+	timers []*fakeTimer
+	// advanceTimers makes new timers fire at once, moving time to their
+	// deadline and recording it in sleeps, for code that waits on timers as
+	// other code calls Sleep.
+	advanceTimers bool
+}
+
+type fakeTimer struct {
+	c        chan time.Time
+	deadline time.Time
+	done     bool
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2021, 3, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Sleep(d time.Duration) {
+	c.mu.Lock()
+	c.sleeps = append(c.sleeps, d)
+	c.mu.Unlock()
+	c.Advance(d)
+}
+
+func (c *fakeClock) NewTimer(d time.Duration) Timer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &fakeTimer{c: make(chan time.Time, 1), deadline: c.now.Add(d)}
+	c.timers = append(c.timers, t)
+	if c.advanceTimers {
+		c.sleeps = append(c.sleeps, d)
+		c.now = t.deadline
+	}
+	c.fire()
+	return &fakeTimerHandle{clock: c, timer: t}
+}
+
+// Advance moves time forward, firing any timers which become due.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	c.fire()
+}
+
+// waitForTimers blocks until at least n timers have been created.
+func (c *fakeClock) waitForTimers(n int) {
+	for {
+		c.mu.Lock()
+		count := len(c.timers)
+		c.mu.Unlock()
+		if count >= n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func (c *fakeClock) fire() {
+	for _, t := range c.timers {
+		if !t.done && !c.now.Before(t.deadline) {
+			t.done = true
+			t.c <- c.now
+		}
+	}
+}
+
+type fakeTimerHandle struct {
+	clock *fakeClock
+	timer *fakeTimer
+}
+
+func (h *fakeTimerHandle) C() <-chan time.Time { return h.timer.c }
+
+func (h *fakeTimerHandle) Stop() bool {
+	h.clock.mu.Lock()
+	defer h.clock.mu.Unlock()
+	active := !h.timer.done
+	h.timer.done = true
+	return active
+}
+
+func TestAptWriterTimeoutFakeClock(t *testing.T) {
+	_, pipeWriter := io.Pipe()
+	defer pipeWriter.Close()
+	clock := newFakeClock()
+	writer := NewAptMessageWriter(pipeWriter)
+	writer.clock = clock
+	writer.timeout = time.Minute
+
+	errChan := make(chan error)
+	go func() {
+		errChan <- writer.Log("some log message")
+	}()
+	clock.waitForTimers(1)
+	clock.Advance(59 * time.Second)
+	select {
+	case err := <-errChan:
+		t.Fatalf("write returned early: %v", err)
+	case <-time.After(10 * time.Millisecond):
+	}
+	clock.Advance(time.Second)
+	if err := <-errChan; err != errWriteTimeout {
+		t.Errorf("failed, expected %v got %v", errWriteTimeout, err)
+	}
+}
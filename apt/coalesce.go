@@ -0,0 +1,105 @@
+//  Copyright 2021 Google LLC
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package apt
+
+import (
+	"context"
+	"os"
+)
+
+// uriFetch is an acquire in progress, which acquires of the same URI
+// arriving meanwhile wait for, to be answered from its download rather
+// than fetching the URI again.
+type uriFetch struct {
+	// done is closed once the acquire has been answered.
+	done chan struct{}
+	// file and result are the download, set before done is closed if the
+	// URI was delivered while acquires were waiting. file is open so that
+	// apt moving the file once told it is done doesn't matter.
+	file   *os.File
+	result completedDownload
+	// waiting counts the acquires waiting for, or reading, the download.
+	waiting int
+}
+
+// sharedFetchKey is the context key under which an acquire which waited
+// for another of the same URI finds it; see reuseCompleted.
+type sharedFetchKey struct{}
+
+// joinFetch registers an acquire of uri. The first becomes the leader and
+// fetches it; the rest are handed the leader's fetch to wait for. The
+// leader must call finishFetch once it is done, and the rest leaveFetch.
+func (m *Method) joinFetch(uri string) (fetch *uriFetch, leader bool) {
+	m.fetchesMu.Lock()
+	defer m.fetchesMu.Unlock()
+	if fetch, ok := m.fetches[uri]; ok {
+		fetch.waiting++
+		return fetch, false
+	}
+	if m.fetches == nil {
+		m.fetches = make(map[string]*uriFetch)
+	}
+	fetch = &uriFetch{done: make(chan struct{})}
+	m.fetches[uri] = fetch
+	return fetch, true
+}
+
+// shareFetch keeps filename, which uri was just downloaded to, open for the
+// acquires waiting for the download, if there are any.
+func (m *Method) shareFetch(uri, filename string, prev completedDownload) {
+	m.fetchesMu.Lock()
+	defer m.fetchesMu.Unlock()
+	fetch, ok := m.fetches[uri]
+	if !ok || fetch.waiting == 0 || fetch.file != nil {
+		return
+	}
+	f, err := os.Open(filename)
+	if err != nil {
+		return
+	}
+	fetch.file, fetch.result = f, prev
+}
+
+// finishFetch releases the acquires waiting for the leader's fetch.
+func (m *Method) finishFetch(uri string, fetch *uriFetch) {
+	m.fetchesMu.Lock()
+	defer m.fetchesMu.Unlock()
+	delete(m.fetches, uri)
+	close(fetch.done)
+	if fetch.waiting == 0 && fetch.file != nil {
+		fetch.file.Close()
+	}
+}
+
+// leaveFetch marks an acquire waiting for fetch as done with it, closing
+// its file after the last.
+func (m *Method) leaveFetch(fetch *uriFetch) {
+	m.fetchesMu.Lock()
+	defer m.fetchesMu.Unlock()
+	fetch.waiting--
+	if fetch.waiting == 0 && fetch.file != nil {
+		fetch.file.Close()
+	}
+}
+
+// sharedFetch returns the fetch of uri an acquire waited for, if it
+// delivered a file.
+func sharedFetch(ctx context.Context) (*uriFetch, bool) {
+	fetch, ok := ctx.Value(sharedFetchKey{}).(*uriFetch)
+	if !ok || fetch.file == nil || fetch.result.filename == "" {
+		return nil, false
+	}
+	return fetch, true
+}
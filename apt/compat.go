@@ -0,0 +1,109 @@
+//  Copyright 2021 Google LLC
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package apt
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// aptVersion is a release of apt, by major and minor version. The zero value
+// stands for an apt of unknown version, which is assumed to be current.
+type aptVersion struct {
+	major, minor int
+}
+
+// oldestAptVersion stands for an apt older than any aptVersionMarkers shows.
+var oldestAptVersion = aptVersion{1, 0}
+
+// minWarningVersion is the first apt release relied on to handle 104 Warning
+// messages. Older ones are sent warnings as 101 Log messages instead, which
+// every apt handles.
+var minWarningVersion = aptVersion{1, 5}
+
+// aptVersionMarkers are configuration items apt sets by default from the
+// given release on, so that finding them in the configuration apt sends
+// shows it is at least that new. They are heuristics; Apt-Version overrides
+// them.
+var aptVersionMarkers = []struct {
+	item    string
+	version aptVersion
+}{
+	// auth.conf.d was added in apt 1.5.
+	{"Dir::Etc::netrcparts", aptVersion{1, 5}},
+}
+
+// parseAptVersion parses an apt version such as "2.4" or "2.4.11ubuntu1".
+func parseAptVersion(s string) (aptVersion, bool) {
+	parts := strings.SplitN(strings.TrimSpace(s), ".", 3)
+	if len(parts) < 2 {
+		return aptVersion{}, false
+	}
+	major, err := strconv.Atoi(parts[0])
+	if err != nil || major <= 0 {
+		return aptVersion{}, false
+	}
+	minor := parts[1]
+	if i := strings.IndexFunc(minor, func(r rune) bool { return r < '0' || r > '9' }); i >= 0 {
+		minor = minor[:i]
+	}
+	n, err := strconv.Atoi(minor)
+	if err != nil {
+		return aptVersion{}, false
+	}
+	return aptVersion{major, n}, true
+}
+
+func (v aptVersion) String() string {
+	if v == (aptVersion{}) {
+		return "unknown"
+	}
+	return fmt.Sprintf("%d.%d", v.major, v.minor)
+}
+
+// supports reports whether an apt of version v handles a part of the
+// protocol added in release min.
+func (v aptVersion) supports(min aptVersion) bool {
+	if v == (aptVersion{}) {
+		return true
+	}
+	return v.major > min.major || v.major == min.major && v.minor >= min.minor
+}
+
+// detectAptVersion works out the version of the apt driving the method from
+// the configuration items it sent, unless Apt-Version gave it, and stops
+// using messages it wouldn't understand. Items are keyed by name.
+func (m *Method) detectAptVersion(items map[string]string) {
+	version := m.config.aptVersion
+	if version == (aptVersion{}) {
+		// Every apt sends its architecture. Configuration without it
+		// comes from something else, and says nothing of apt's version.
+		if _, ok := items["APT::Architecture"]; !ok {
+			return
+		}
+		version = oldestAptVersion
+		for _, marker := range aptVersionMarkers {
+			if _, ok := items[marker.item]; ok && !version.supports(marker.version) {
+				version = marker.version
+			}
+		}
+	}
+	m.aptVersion = version
+	m.writer.setWarnings(version.supports(minWarningVersion))
+	if m.config.debug {
+		m.writer.Log(fmt.Sprintf("assuming apt %s", version))
+	}
+}
@@ -0,0 +1,90 @@
+//  Copyright 2021 Google LLC
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package apt
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseAptVersion(t *testing.T) {
+	var tests = []struct {
+		input    string
+		expected aptVersion
+		ok       bool
+	}{
+		{"1.6", aptVersion{1, 6}, true},
+		{"2.4.11ubuntu1", aptVersion{2, 4}, true},
+		{"2.0~beta1", aptVersion{2, 0}, true},
+		{" 2.7 ", aptVersion{2, 7}, true},
+		{"2", aptVersion{}, false},
+		{"latest", aptVersion{}, false},
+	}
+	for _, tt := range tests {
+		if res, ok := parseAptVersion(tt.input); res != tt.expected || ok != tt.ok {
+			t.Errorf("failed, %q: expected %v, %v, got %v, %v", tt.input, tt.expected, tt.ok, res, ok)
+		}
+	}
+}
+
+// aptConfigurations hold, for releases of apt, the items of the
+// configuration it sends methods which tell them apart.
+var aptConfigurations = map[string][]string{
+	"1.2": {"APT::Architecture=amd64", "APT::Architectures::=amd64", "Dir=/", "Dir::Etc::netrc=auth.conf", "APT::Sandbox::User=_apt"},
+	"1.6": {"APT::Architecture=amd64", "APT::Architectures::=amd64", "Dir=/", "Dir::Etc::netrc=auth.conf", "Dir::Etc::netrcparts=auth.conf.d", "APT::Sandbox::User=_apt"},
+	"2.0": {"APT::Architecture=amd64", "APT::Architectures::=amd64", "APT::Architectures::=i386", "Dir=/", "Dir::Etc::netrc=auth.conf", "Dir::Etc::netrcparts=auth.conf.d", "APT::Sandbox::User=_apt"},
+	"2.4": {"APT::Architecture=arm64", "APT::Architectures::=arm64", "Dir=/", "Dir::Etc::netrc=auth.conf", "Dir::Etc::netrcparts=auth.conf.d", "APT::Sandbox::User=_apt"},
+}
+
+func TestAptCompatibility(t *testing.T) {
+	var tests = []struct {
+		release string
+		extra   []string
+		// warnings is whether apt is sent 104 Warning messages.
+		warnings bool
+	}{
+		{"1.2", nil, false},
+		{"1.6", nil, true},
+		{"2.0", nil, true},
+		{"2.4", nil, true},
+		{"1.2", []string{"Acquire::gar::Apt-Version=2.4"}, true},
+		{"2.4", []string{"Acquire::gar::Apt-Version=1.2"}, false},
+	}
+
+	for _, tt := range tests {
+		items := append(append([]string{"Acquire::gar::Expected-Size-Mismatch=warn"}, aptConfigurations[tt.release]...), tt.extra...)
+		acquire := acquireMessage("ar+https://fake.uri/dists/repo/main/binary-amd64/Packages")
+		// The fake download is 200 bytes, so this makes for a warning.
+		acquire.fields["Expected-Size"] = []string{"100"}
+		transcript := runTranscript(t, fakeHTTPClient{}, []Message{
+			{code: 601, description: "Configuration", fields: map[string][]string{"Config-Item": items}},
+			acquire,
+		})
+		checkConformance(t, transcript)
+
+		var warnings, logged int
+		for _, msg := range transcript {
+			switch {
+			case msg.code == 104:
+				warnings++
+			case msg.code == 101 && strings.HasPrefix(msg.Get("Message"), "Warning: "):
+				logged++
+			}
+		}
+		if tt.warnings && (warnings != 1 || logged != 0) || !tt.warnings && (warnings != 0 || logged != 1) {
+			t.Errorf("failed, apt %s %v: expected warnings to be sent as 104 %v, got %d sent as 104 and %d as 101", tt.release, tt.extra, tt.warnings, warnings, logged)
+		}
+	}
+}
@@ -0,0 +1,186 @@
+//  Copyright 2021 Google LLC
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package apt
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const configPrefix = "Acquire::gar::"
+
+// Options which may be set for all hosts (Acquire::gar::<Option>) or scoped
+// to hosts matching a pattern (Acquire::gar::<pattern>::<Option>).
+const (
+	scopedTimeout     = "Timeout"
+	scopedExtraHeader = "Extra-Header"
+)
+
+var scopedOptions = map[string]bool{
+	scopedTimeout:     true,
+	scopedExtraHeader: true,
+}
+
+// setScoped records a host-scoped config item. key is the config item name
+// without the Acquire::gar:: prefix. It returns false if key does not name a
+// host-scoped option.
+func (c *aptMethodConfig) setScoped(key, value string) bool {
+	parts := strings.Split(key, "::")
+	list := false
+	if len(parts) > 1 && parts[len(parts)-1] == "" {
+		// apt sends list items with an empty trailing key.
+		list = true
+		parts = parts[:len(parts)-1]
+	}
+	var pattern, option string
+	switch len(parts) {
+	case 1:
+		option = parts[0]
+	case 2:
+		pattern, option = parts[0], parts[1]
+	default:
+		return false
+	}
+	if !scopedOptions[option] {
+		return false
+	}
+
+	if c.scopedOptions == nil {
+		c.scopedOptions = make(map[string]map[string][]string)
+	}
+	options, ok := c.scopedOptions[pattern]
+	if !ok {
+		options = make(map[string][]string)
+		c.scopedOptions[pattern] = options
+	}
+	if list {
+		options[option] = append(options[option], value)
+	} else {
+		options[option] = []string{value}
+	}
+	return true
+}
+
+// scoped returns the values of option for host from the most specific
+// matching scope: an exact host match, then wildcard patterns with the most
+// literal characters, then the unscoped option.
+func (c *aptMethodConfig) scoped(host, option string) []string {
+	best, bestPattern := -1, ""
+	var values []string
+	for pattern, options := range c.scopedOptions {
+		v, ok := options[option]
+		if !ok {
+			continue
+		}
+		spec := specificity(pattern, host)
+		if spec < 0 || spec < best || (spec == best && pattern > bestPattern) {
+			continue
+		}
+		best, bestPattern, values = spec, pattern, v
+	}
+	return values
+}
+
+// specificity ranks how closely pattern matches host, or returns -1 if it
+// does not match at all.
+func specificity(pattern, host string) int {
+	switch {
+	case pattern == "":
+		return 0
+	case pattern == host:
+		return len(host) + 1
+	}
+	if ok, err := path.Match(pattern, host); err != nil || !ok {
+		return -1
+	}
+	// Count the literal characters, which are always fewer than an exact
+	// match would have.
+	return 1 + len(strings.NewReplacer("*", "", "?", "").Replace(pattern))
+}
+
+// timeout returns the configured time to wait for a response from host, or
+// 0 if there is none.
+func (c *aptMethodConfig) timeout(host string) time.Duration {
+	values := c.scoped(host, scopedTimeout)
+	if len(values) == 0 {
+		return 0
+	}
+	seconds, err := strconv.Atoi(values[len(values)-1])
+	if err != nil || seconds <= 0 {
+		return 0
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// extraHeaders returns the headers to add to requests to host, parsed from
+// "Name: value" strings.
+func (c *aptMethodConfig) extraHeaders(host string) http.Header {
+	header := make(http.Header)
+	for _, value := range c.scoped(host, scopedExtraHeader) {
+		if name, val, ok := parseHeader(value); ok {
+			header.Add(name, val)
+		}
+	}
+	return header
+}
+
+func parseHeader(value string) (string, string, bool) {
+	parts := strings.SplitN(value, ":", 2)
+	if len(parts) != 2 {
+		return "", "", false
+	}
+	name := strings.TrimSpace(parts[0])
+	if name == "" || strings.ContainsAny(name, " \t") {
+		return "", "", false
+	}
+	return name, strings.TrimSpace(parts[1]), true
+}
+
+// errUnknownConfigItem is returned by handleScopedConfig for an
+// Acquire::gar item which names no option.
+var errUnknownConfigItem = errors.New("unknown config item")
+
+// handleScopedConfig applies a config item that isn't a global option. It
+// returns an error if the item names a host-scoped option with an invalid
+// value, or is an Acquire::gar item naming no option at all; items outside
+// Acquire::gar are ignored.
+func (m *Method) handleScopedConfig(key, value string) error {
+	if !strings.HasPrefix(key, configPrefix) {
+		return nil
+	}
+	key = strings.TrimPrefix(key, configPrefix)
+	value = strings.TrimSpace(value)
+
+	valid := true
+	switch option := strings.TrimSuffix(key, "::"); {
+	case option == scopedTimeout || strings.HasSuffix(option, "::"+scopedTimeout):
+		seconds, err := strconv.Atoi(value)
+		valid = err == nil && seconds > 0
+	case option == scopedExtraHeader || strings.HasSuffix(option, "::"+scopedExtraHeader):
+		_, _, valid = parseHeader(value)
+	}
+	if !valid {
+		return fmt.Errorf("invalid value in config item: %v=%v", configPrefix+key, value)
+	}
+	if !m.config.setScoped(key, value) {
+		return fmt.Errorf("%w: %v", errUnknownConfigItem, configPrefix+key)
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+//  Copyright 2021 Google LLC
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package apt
+
+import (
+	"bufio"
+	"bytes"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestScopedTimeout(t *testing.T) {
+	configItems := []string{
+		"Acquire::gar::Timeout=10",
+		"Acquire::gar::*.pkg.dev::Timeout=20",
+		"Acquire::gar::*-apt.pkg.dev::Timeout=30",
+		"Acquire::gar::us-apt.pkg.dev::Timeout=40",
+		"Acquire::gar::bad.pkg.dev::Timeout=soon",
+	}
+	var tests = []struct {
+		host     string
+		expected time.Duration
+	}{
+		{"us-apt.pkg.dev", 40 * time.Second},
+		{"europe-apt.pkg.dev", 30 * time.Second},
+		{"us-python.pkg.dev", 20 * time.Second},
+		{"bad.pkg.dev", 20 * time.Second},
+		{"example.com", 10 * time.Second},
+	}
+
+	var buffer bytes.Buffer
+	method := NewAptMethod(bufio.NewReader(&bytes.Buffer{}), &buffer)
+	method.handleConfigure(&Message{
+		code:        601,
+		description: "Configuration",
+		fields:      map[string][]string{"Config-Item": configItems},
+	})
+	for _, tt := range tests {
+		if res := method.config.timeout(tt.host); res != tt.expected {
+			t.Errorf("timeout(%q) = %v, expected %v", tt.host, res, tt.expected)
+		}
+	}
+	if buffer.Len() == 0 {
+		t.Errorf("expected invalid timeout to be logged")
+	}
+}
+
+func TestScopedExtraHeaders(t *testing.T) {
+	configItems := []string{
+		"Acquire::gar::Extra-Header::=X-Route: default",
+		"Acquire::gar::*-apt.pkg.dev::Extra-Header::=X-Route: regional",
+		"Acquire::gar::*-apt.pkg.dev::Extra-Header::=X-Team: infra",
+		"Acquire::gar::*-apt.pkg.dev::Extra-Header::=not a header",
+	}
+	var tests = []struct {
+		host     string
+		expected http.Header
+	}{
+		{"us-apt.pkg.dev", http.Header{"X-Route": {"regional"}, "X-Team": {"infra"}}},
+		{"example.com", http.Header{"X-Route": {"default"}}},
+	}
+
+	var buffer bytes.Buffer
+	method := NewAptMethod(bufio.NewReader(&bytes.Buffer{}), &buffer)
+	method.handleConfigure(&Message{
+		code:        601,
+		description: "Configuration",
+		fields:      map[string][]string{"Config-Item": configItems},
+	})
+	for _, tt := range tests {
+		if res := method.config.extraHeaders(tt.host); !reflect.DeepEqual(res, tt.expected) {
+			t.Errorf("extraHeaders(%q) = %v, expected %v", tt.host, res, tt.expected)
+		}
+	}
+	if !strings.Contains(buffer.String(), "not a header") {
+		t.Errorf("expected invalid header to be logged, got %q", buffer.String())
+	}
+}
+
+func TestScopedUnset(t *testing.T) {
+	config := &aptMethodConfig{}
+	if res := config.timeout("us-apt.pkg.dev"); res != 0 {
+		t.Errorf("expected no timeout, got %v", res)
+	}
+	if config.setScoped("us-apt.pkg.dev::Unknown-Option", "1") {
+		t.Errorf("expected unknown option to be rejected")
+	}
+	if config.setScoped("a::b::Timeout", "1") {
+		t.Errorf("expected malformed key to be rejected")
+	}
+}
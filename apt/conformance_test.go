@@ -0,0 +1,226 @@
+//  Copyright 2021 Google LLC
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package apt
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"testing"
+)
+
+// messageSpec describes a message the method may send, following apt's
+// method interface documentation (doc/method.dbk in the apt sources).
+type messageSpec struct {
+	description string
+	required    []string
+	// terminal messages end the handling of a URI.
+	terminal bool
+}
+
+var methodSpec = map[int]messageSpec{
+	100: {description: "Capabilities", required: []string{"Version"}},
+	101: {description: "Log", required: []string{"Message"}},
+	102: {description: "Status", required: []string{"Message"}},
+	103: {description: "Redirect", required: []string{"URI", "New-URI"}, terminal: true},
+	104: {description: "Warning", required: []string{"Message"}},
+	200: {description: "URI Start", required: []string{"URI"}},
+	201: {description: "URI Done", required: []string{"URI", "Filename"}, terminal: true},
+	400: {description: "URI Failure", required: []string{"URI", "Message"}, terminal: true},
+	401: {description: "General Failure", required: []string{"Message"}},
+}
+
+// runTranscript runs a method against the given input messages and returns
+// everything it sends until each 600 URI Acquire has been answered.
+func runTranscript(t *testing.T, client httpClient, input []Message) []*Message {
+	t.Helper()
+	stdinreader, stdinwriter := io.Pipe()
+	stdoutreader, stdoutwriter := io.Pipe()
+	method := NewAptMethod(bufio.NewReader(stdinreader), stdoutwriter)
+	method.client = client
+	method.dl = fakeDownloader{}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go method.Run(ctx)
+	go func() {
+		writer := NewAptMessageWriter(stdinwriter)
+		for _, msg := range input {
+			writer.WriteMessage(msg)
+		}
+	}()
+
+	acquires := 0
+	for _, msg := range input {
+		if msg.code == 600 {
+			acquires++
+		}
+	}
+
+	var transcript []*Message
+	reader := NewAptMessageReader(bufio.NewReader(stdoutreader))
+	for answered := 0; answered < acquires || len(transcript) == 0; {
+		msg, err := reader.ReadMessage(ctx)
+		if err != nil {
+			t.Fatalf("failed reading transcript: %v", err)
+		}
+		transcript = append(transcript, msg)
+		if methodSpec[msg.code].terminal {
+			answered++
+		}
+	}
+
+	for _, p := range []io.Closer{stdinreader, stdinwriter, stdoutreader, stdoutwriter} {
+		p.Close()
+	}
+	return transcript
+}
+
+// checkConformance reports any way in which transcript violates the method
+// interface.
+func checkConformance(t *testing.T, transcript []*Message) {
+	t.Helper()
+	if len(transcript) == 0 || transcript[0].code != 100 {
+		t.Fatalf("first message must be 100 Capabilities, got %v", transcript)
+	}
+	if transcript[0].Get("Send-Config") != "true" {
+		t.Errorf("capabilities must request configuration: %v", transcript[0])
+	}
+
+	started := make(map[string]bool)
+	finished := make(map[string]bool)
+	for i, msg := range transcript {
+		spec, ok := methodSpec[msg.code]
+		if !ok {
+			t.Errorf("message %d has unknown code: %v", i, msg)
+			continue
+		}
+		if msg.description != spec.description {
+			t.Errorf("message %d has description %q, expected %q", i, msg.description, spec.description)
+		}
+		for _, field := range spec.required {
+			if msg.Get(field) == "" {
+				t.Errorf("message %d is missing required field %s: %v", i, field, msg)
+			}
+		}
+		if i > 0 && msg.code == 100 {
+			t.Errorf("capabilities sent more than once")
+		}
+
+		uri := msg.Get("URI")
+		switch {
+		case msg.code == 200:
+			if started[uri] || finished[uri] {
+				t.Errorf("message %d starts %s twice or after it finished", i, uri)
+			}
+			started[uri] = true
+		case spec.terminal:
+			if finished[uri] {
+				t.Errorf("message %d finishes %s twice", i, uri)
+			}
+			if msg.code == 201 && msg.Get("IMS-Hit") != "true" && !started[uri] {
+				t.Errorf("message %d finishes %s without starting it", i, uri)
+			}
+			finished[uri] = true
+		}
+	}
+}
+
+func acquireMessage(uri string) Message {
+	return Message{
+		code:        600,
+		description: "URI Acquire",
+		fields:      map[string][]string{"URI": {uri}, "Filename": {"/path/to/file"}},
+	}
+}
+
+func TestConformance(t *testing.T) {
+	var tests = []struct {
+		name   string
+		client httpClient
+		input  []Message
+	}{
+		{
+			"download",
+			fakeHTTPClient{},
+			[]Message{acquireMessage("ar+https://fake.uri/dists/repo/Release")},
+		},
+		{
+			"not modified",
+			fakeHTTPClient{code: 304},
+			[]Message{acquireMessage("ar+https://fake.uri/dists/repo/Release")},
+		},
+		{
+			"not found",
+			fakeHTTPClient{code: 404},
+			[]Message{acquireMessage("ar+https://fake.uri/pool/repo/p/pkg.deb")},
+		},
+		{
+			"optional not found",
+			fakeHTTPClient{code: 404},
+			[]Message{acquireMessage("ar+https://fake.uri/dists/repo/InRelease")},
+		},
+		{
+			"gone",
+			fakeHTTPClient{code: 410},
+			[]Message{acquireMessage("ar+https://fake.uri/pool/repo/p/pkg_1.0.deb")},
+		},
+		{
+			"redirect passed to apt",
+			fakeHTTPClient{code: 302, header: map[string][]string{"Location": {"/dists/repo/Release.new"}}},
+			[]Message{
+				{
+					code:        601,
+					description: "Configuration",
+					fields:      map[string][]string{"Config-Item": {"Acquire::gar::Follow-Redirects=false"}},
+				},
+				acquireMessage("ar+https://fake.uri/dists/repo/Release"),
+			},
+		},
+		{
+			"server error",
+			fakeHTTPClient{code: 500},
+			[]Message{acquireMessage("ar+https://fake.uri/dists/repo/Release")},
+		},
+		{
+			"several acquires",
+			fakeHTTPClient{},
+			[]Message{
+				{
+					code:        601,
+					description: "Configuration",
+					fields:      map[string][]string{"Config-Item": {"Acquire::gar::Timeout=30"}},
+				},
+				acquireMessage("ar+https://fake.uri/dists/repo/InRelease"),
+				acquireMessage("ar+https://fake.uri/dists/repo/main/binary-amd64/Packages"),
+			},
+		},
+		{
+			"missing filename",
+			fakeHTTPClient{},
+			[]Message{{
+				code:        600,
+				description: "URI Acquire",
+				fields:      map[string][]string{"URI": {"ar+https://fake.uri/dists/repo/Release"}},
+			}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			checkConformance(t, runTranscript(t, tt.client, tt.input))
+		})
+	}
+}
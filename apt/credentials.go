@@ -0,0 +1,340 @@
+//  Copyright 2021 Google LLC
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package apt
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/user"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/compute/metadata"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+)
+
+// credentialTypes are the types of credentials JSON file the method accepts.
+// external_account files configure workload identity federation, which
+// exchanges a token from another identity provider, read from a file or URL
+// named in the configuration, for a Google access token.
+var credentialTypes = []string{"service_account", "authorized_user", "external_account"}
+
+// credentialsType returns the type of a credentials JSON file, failing if
+// it isn't one the method accepts.
+func credentialsType(b []byte) (string, error) {
+	var f struct {
+		Type         string `json:"type"`
+		ClientID     string `json:"client_id"`
+		ClientSecret string `json:"client_secret"`
+		RefreshToken string `json:"refresh_token"`
+	}
+	if err := json.Unmarshal(b, &f); err != nil {
+		return "", fmt.Errorf("malformed credentials file: %v", err)
+	}
+	if f.Type == "authorized_user" && (f.ClientID == "" || f.ClientSecret == "" || f.RefreshToken == "") {
+		return "", errors.New("authorized_user credentials need client_id, client_secret and refresh_token")
+	}
+	for _, t := range credentialTypes {
+		if f.Type == t {
+			return t, nil
+		}
+	}
+	if f.Type == "" {
+		return "", errors.New("credentials file has no type")
+	}
+	return "", fmt.Errorf("unsupported credentials type %q, expected one of %s", f.Type, strings.Join(credentialTypes, ", "))
+}
+
+// accessTokenEnv names the environment variable which may hold a short-lived
+// OAuth access token, for CI systems which already have one.
+const accessTokenEnv = "ARTIFACT_REGISTRY_ACCESS_TOKEN"
+
+// maxCredentialSize bounds the credential read from Credential-FD; service
+// account keys are a few KiB.
+const maxCredentialSize = 64 * 1024
+
+// readCredentialFD reads the credential from the already open file
+// descriptor fd and closes it. The credential is read into a single buffer,
+// so that no partial copies are left behind when the Secret is released.
+func readCredentialFD(fd int) (*Secret, error) {
+	f := os.NewFile(uintptr(fd), fmt.Sprintf("credential-fd-%d", fd))
+	if f == nil {
+		return nil, fmt.Errorf("invalid file descriptor %d", fd)
+	}
+	defer f.Close()
+	buf := make([]byte, maxCredentialSize)
+	n, err := io.ReadFull(f, buf)
+	if err == nil {
+		NewSecret(buf).Release()
+		return nil, fmt.Errorf("credential is larger than %d bytes", maxCredentialSize)
+	}
+	if err != io.EOF && err != io.ErrUnexpectedEOF {
+		NewSecret(buf).Release()
+		return nil, err
+	}
+	if n == 0 {
+		return nil, errors.New("credential is empty")
+	}
+	return NewSecret(buf[:n]), nil
+}
+
+// tokenSourceFromSecret returns a token source for a credential read from
+// Credential-FD: either a credentials JSON file, or a bare access token.
+func tokenSourceFromSecret(ctx context.Context, credential *Secret) (oauth2.TokenSource, error) {
+	b := bytes.TrimSpace(credential.Bytes())
+	if len(b) == 0 {
+		return nil, errors.New("credential is empty")
+	}
+	if b[0] != '{' {
+		return oauth2.StaticTokenSource(&oauth2.Token{AccessToken: string(b)}), nil
+	}
+	return tokenSourceFromJSON(ctx, b)
+}
+
+// tokenSourceFromFile returns a token source for the credentials JSON file
+// at path, such as a service account key.
+func tokenSourceFromFile(ctx context.Context, path string) (oauth2.TokenSource, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read credentials file: %v", err)
+	}
+	key := NewSecret(b)
+	defer key.Release()
+	return tokenSourceFromJSON(ctx, key.Bytes())
+}
+
+// selfSignedJWTAudience is the audience of self-signed JWTs, which Google
+// APIs accept as bearer tokens in place of OAuth access tokens, when they
+// aren't minted for the host of a request; see jwtAudience.
+const selfSignedJWTAudience = "https://artifactregistry.googleapis.com/"
+
+// jwtAudience is the audience of self-signed JWTs sent to host.
+func jwtAudience(host string) string {
+	return "https://" + host + "/"
+}
+
+// jwtTokenSourceFromFile returns a token source which signs JWTs for
+// audience with the service account key at path, rather than exchanging the
+// key for access tokens at the OAuth endpoint.
+func jwtTokenSourceFromFile(path, audience string) (oauth2.TokenSource, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read credentials file: %v", err)
+	}
+	key := NewSecret(b)
+	defer key.Release()
+	typ, err := credentialsType(key.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	if typ != "service_account" {
+		return nil, fmt.Errorf("self-signed JWTs need a service account key, not %s credentials", typ)
+	}
+	return google.JWTAccessTokenSourceFromJSON(key.Bytes(), audience)
+}
+
+// newJWTTokenSource returns a source of JWTs self-signed with the service
+// account key at path, each bound to the host it is sent to, and reloaded
+// as for newReloadingTokenSource. The key is checked now.
+func (m *Method) newJWTTokenSource(ctx context.Context, path string) (oauth2.TokenSource, error) {
+	newSource := func(audience string) (oauth2.TokenSource, error) {
+		load := func(_ context.Context, path string) (oauth2.TokenSource, error) {
+			return jwtTokenSourceFromFile(path, audience)
+		}
+		ts, err := newReloadingTokenSource(ctx, path, load, func(msg string) { m.writer.Log(msg) })
+		if err != nil {
+			return nil, err
+		}
+		return m.manageTokens(ts), nil
+	}
+	first, err := newSource(selfSignedJWTAudience)
+	if err != nil {
+		return nil, err
+	}
+	return &audienceTokenSource{
+		newSource:       newSource,
+		audience:        jwtAudience,
+		defaultAudience: selfSignedJWTAudience,
+		sources:         map[string]oauth2.TokenSource{selfSignedJWTAudience: first},
+	}, nil
+}
+
+// reloadingTokenSource reads a service account key file again whenever its
+// modification time changes, so that a key rotated while the method runs is
+// used from the next token refresh rather than the one parsed at startup.
+type reloadingTokenSource struct {
+	ctx  context.Context
+	path string
+	load func(context.Context, string) (oauth2.TokenSource, error)
+	log  func(string)
+
+	mu      sync.Mutex
+	modTime time.Time
+	base    oauth2.TokenSource
+}
+
+// newReloadingTokenSource returns a reloadingTokenSource for the credentials
+// JSON file at path, loaded with load, failing if it can't be loaded now.
+func newReloadingTokenSource(ctx context.Context, path string, load func(context.Context, string) (oauth2.TokenSource, error), log func(string)) (*reloadingTokenSource, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read credentials file: %v", err)
+	}
+	base, err := load(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	return &reloadingTokenSource{ctx: ctx, path: path, load: load, log: log, modTime: fi.ModTime(), base: base}, nil
+}
+
+// Token implements oauth2.TokenSource. A file which can't be read or parsed
+// after it changes, e.g. because it is caught mid-rotation, leaves the
+// previous key in use and is tried again on the next refresh.
+func (ts *reloadingTokenSource) Token() (*oauth2.Token, error) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if fi, err := os.Stat(ts.path); err == nil && !fi.ModTime().Equal(ts.modTime) {
+		if base, err := ts.load(ts.ctx, ts.path); err == nil {
+			ts.base, ts.modTime = base, fi.ModTime()
+			ts.log("reloaded changed credentials file " + ts.path)
+		} else {
+			ts.log(fmt.Sprintf("keeping previous credentials, failed to reload %s: %v", ts.path, err))
+		}
+	}
+	return ts.base.Token()
+}
+
+// tokenSourceFromJSON returns a token source for a credentials JSON file.
+func tokenSourceFromJSON(ctx context.Context, b []byte) (oauth2.TokenSource, error) {
+	typ, err := credentialsType(b)
+	if err != nil {
+		return nil, err
+	}
+	creds, err := google.CredentialsFromJSON(ctx, b, cloudPlatformScope)
+	if err != nil {
+		return nil, fmt.Errorf("failed to obtain creds from credentials file: %v", err)
+	}
+	if typ == "authorized_user" {
+		return userTokenSource{creds.TokenSource}, nil
+	}
+	return creds.TokenSource, nil
+}
+
+// userTokenSource exchanges the refresh token of gcloud user credentials,
+// as found on developer workstations, for access tokens. When the refresh
+// token is refused it says how to get a new one, rather than leaving users
+// with a bare invalid_grant.
+type userTokenSource struct {
+	base oauth2.TokenSource
+}
+
+func (ts userTokenSource) Token() (*oauth2.Token, error) {
+	token, err := ts.base.Token()
+	var retrieve *oauth2.RetrieveError
+	if errors.As(err, &retrieve) && retrieve.Response != nil && retrieve.Response.StatusCode >= 400 && retrieve.Response.StatusCode < 500 {
+		return nil, fmt.Errorf("user credentials were refused, run `gcloud auth application-default login` to renew them: %w", err)
+	}
+	return token, err
+}
+
+// wellKnownCredentialsFile returns the path of the credentials file written
+// by `gcloud auth application-default login`.
+func wellKnownCredentialsFile() string {
+	const f = "application_default_credentials.json"
+	if runtime.GOOS == "windows" {
+		return filepath.Join(os.Getenv("APPDATA"), "gcloud", f)
+	}
+	home := os.Getenv("HOME")
+	if home == "" {
+		if u, err := user.Current(); err == nil {
+			home = u.HomeDir
+		}
+	}
+	if home == "" {
+		return ""
+	}
+	return filepath.Join(home, ".config", "gcloud", f)
+}
+
+// onGCE reports whether the metadata server is available. It is replaced
+// in tests.
+var onGCE = metadata.OnGCE
+
+// errUnusableCredentials is returned by defaultTokenSource for a credentials
+// file which is named or present but can't be used.
+var errUnusableCredentials = errors.New("unusable credentials")
+
+// defaultTokenSource finds Application Default Credentials in the usual
+// order: the GOOGLE_APPLICATION_CREDENTIALS file, gcloud's well-known file,
+// then the metadata server. A file which is named or present but unusable
+// is an error, so that a broken key file doesn't leave the method running
+// as an unintended identity, unless Credentials-Fallback is set; then it
+// falls back past it, and warns naming what was tried and what was used.
+// In debug mode it logs the source used either way.
+func (m *Method) defaultTokenSource(ctx context.Context) (oauth2.TokenSource, error) {
+	var tried []string
+	unusable := func(source string, err error) error {
+		if m.config.credentialsFallback {
+			tried = append(tried, fmt.Sprintf("%s: %v", source, err))
+			return nil
+		}
+		return fmt.Errorf("%w in %s: %v", errUnusableCredentials, source, err)
+	}
+	use := func(ts oauth2.TokenSource, source string) (oauth2.TokenSource, error) {
+		if len(tried) > 0 {
+			m.writer.Warning(fmt.Sprintf("using credentials from %s after trying: %s", source, strings.Join(tried, "; ")))
+		} else {
+			m.debugLog(ctx, "using credentials from "+source)
+		}
+		return ts, nil
+	}
+
+	if path := os.Getenv("GOOGLE_APPLICATION_CREDENTIALS"); path != "" {
+		ts, err := tokenSourceFromFile(ctx, path)
+		if err == nil {
+			return use(ts, "GOOGLE_APPLICATION_CREDENTIALS file "+path)
+		}
+		if err := unusable("GOOGLE_APPLICATION_CREDENTIALS file "+path, err); err != nil {
+			return nil, err
+		}
+	}
+	if path := wellKnownCredentialsFile(); path != "" {
+		if _, err := os.Stat(path); err == nil {
+			ts, err := tokenSourceFromFile(ctx, path)
+			if err == nil {
+				return use(ts, "gcloud credentials file "+path)
+			}
+			if err := unusable("gcloud credentials file "+path, err); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if onGCE() {
+		return use(google.ComputeTokenSource(""), "the metadata server")
+	}
+	if len(tried) == 0 {
+		return nil, errors.New("no credentials found")
+	}
+	return nil, fmt.Errorf("no usable credentials found, tried: %s", strings.Join(tried, "; "))
+}
@@ -0,0 +1,500 @@
+//  Copyright 2021 Google LLC
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package apt
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+const testAuthorizedUser = `{"type": "authorized_user", "client_id": "id", "client_secret": "secret", "refresh_token": "token"}`
+
+func TestDefaultTokenSourceFallback(t *testing.T) {
+	dir := t.TempDir()
+	valid := filepath.Join(dir, "valid.json")
+	os.WriteFile(valid, []byte(testAuthorizedUser), 0600)
+	invalid := filepath.Join(dir, "invalid.json")
+	os.WriteFile(invalid, []byte("not json"), 0600)
+	home := filepath.Join(dir, "home")
+	wellKnown := filepath.Join(home, ".config", "gcloud", "application_default_credentials.json")
+	os.MkdirAll(filepath.Dir(wellKnown), 0755)
+
+	var tests = []struct {
+		name, env, wellKnown string
+		fallback             bool
+		expectedWarning      []string
+		expectedErr          string
+	}{
+		{"env file", valid, "", false, nil, ""},
+		{"well-known file", "", testAuthorizedUser, false, nil, ""},
+		{"metadata server", "", "", false, nil, ""},
+		{"missing env file", filepath.Join(dir, "missing.json"), testAuthorizedUser, false, nil, "missing.json"},
+		{"invalid env file", invalid, "", false, nil, "invalid.json"},
+		{"invalid well-known file", "", "{}", false, nil, "application_default_credentials.json"},
+		{"missing env file with fallback", filepath.Join(dir, "missing.json"), testAuthorizedUser, true, []string{"using credentials from gcloud credentials file", "missing.json"}, ""},
+		{"invalid env file with fallback", invalid, "", true, []string{"using credentials from the metadata server", "invalid.json"}, ""},
+		{"invalid well-known file with fallback", "", "{}", true, []string{"using credentials from the metadata server", "application_default_credentials.json"}, ""},
+	}
+
+	for _, tt := range tests {
+		os.Remove(wellKnown)
+		if tt.wellKnown != "" {
+			os.WriteFile(wellKnown, []byte(tt.wellKnown), 0600)
+		}
+		setenv(t, "GOOGLE_APPLICATION_CREDENTIALS", tt.env)
+		setenv(t, "HOME", home)
+		// Makes the metadata server appear available without contacting it.
+		setenv(t, "GCE_METADATA_HOST", "127.0.0.1:1")
+
+		var buffer bytes.Buffer
+		method := NewAptMethod(bufio.NewReader(&bytes.Buffer{}), &buffer)
+		method.config.credentialsFallback = tt.fallback
+		ts, err := method.defaultTokenSource(context.Background())
+		if tt.expectedErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.expectedErr) {
+				t.Errorf("%s: expected an error naming %q, got %v", tt.name, tt.expectedErr, err)
+			}
+			continue
+		}
+		if err != nil || ts == nil {
+			t.Errorf("%s: failed, %v", tt.name, err)
+			continue
+		}
+		if tt.expectedWarning == nil && buffer.Len() != 0 {
+			t.Errorf("%s: expected no warning, got %q", tt.name, buffer.String())
+		}
+		for _, expected := range tt.expectedWarning {
+			if !strings.HasPrefix(buffer.String(), "104 Warning") || !strings.Contains(buffer.String(), expected) {
+				t.Errorf("%s: expected a warning containing %q, got %q", tt.name, expected, buffer.String())
+			}
+		}
+	}
+}
+
+func TestCredentialsType(t *testing.T) {
+	var tests = []struct {
+		input, expected string
+		expectErr       bool
+	}{
+		{`{"type": "service_account"}`, "service_account", false},
+		{testAuthorizedUser, "authorized_user", false},
+		{`{"type": "external_account", "audience": "a"}`, "external_account", false},
+		{`{"type": "authorized_user", "client_id": "id"}`, "", true},
+		{`{"type": "impersonated_service_account"}`, "", true},
+		{`{}`, "", true},
+		{`not json`, "", true},
+	}
+
+	for _, tt := range tests {
+		res, err := credentialsType([]byte(tt.input))
+		if res != tt.expected || tt.expectErr != (err != nil) {
+			t.Errorf("failed, credentialsType(%q) = %q, %v", tt.input, res, err)
+		}
+	}
+}
+
+// TestExternalAccountCredentials authenticates with a workload identity
+// federation configuration, exchanging a subject token read from a file.
+func TestExternalAccountCredentials(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/sts":
+			if r.FormValue("subject_token") != "subject-token" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprint(w, `{"access_token": "federated-token", "issued_token_type": "urn:ietf:params:oauth:token-type:access_token", "token_type": "Bearer", "expires_in": 3600}`)
+		default:
+			if r.Header.Get("Authorization") != "Bearer federated-token" {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			fmt.Fprint(w, "package contents")
+		}
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	subject := filepath.Join(dir, "subject")
+	os.WriteFile(subject, []byte("subject-token"), 0600)
+	config := filepath.Join(dir, "config.json")
+	os.WriteFile(config, []byte(fmt.Sprintf(`{
+		"type": "external_account",
+		"audience": "//iam.googleapis.com/projects/1/locations/global/workloadIdentityPools/pool/providers/provider",
+		"subject_token_type": "urn:ietf:params:oauth:token-type:jwt",
+		"token_url": "%s/sts",
+		"credential_source": {"file": %q}
+	}`, server.URL, subject)), 0600)
+
+	var buffer bytes.Buffer
+	method := NewAptMethod(bufio.NewReader(&bytes.Buffer{}), &buffer)
+	method.config.serviceAccountJSON = config
+	method.config.authHosts = []string{"127.0.0.1"}
+	ctx := context.WithValue(context.Background(), oauth2.HTTPClient, server.Client())
+	filename := filepath.Join(dir, "pkg.deb")
+	msg := &Message{
+		code:        600,
+		description: "URI Acquire",
+		fields:      map[string][]string{"URI": {"ar+" + server.URL + "/pool/pkg.deb"}, "Filename": {filename}},
+	}
+	if err := method.handleAcquire(ctx, msg); err != nil {
+		t.Fatalf("failed, %v", err)
+	}
+	if !strings.Contains(buffer.String(), "201 URI Done") {
+		t.Errorf("failed, expected URI Done, got %q", buffer.String())
+	}
+	if contents, _ := os.ReadFile(filename); string(contents) != "package contents" {
+		t.Errorf("failed, unexpected file contents %q", contents)
+	}
+}
+
+func TestDefaultTokenSourceDebug(t *testing.T) {
+	valid := filepath.Join(t.TempDir(), "valid.json")
+	os.WriteFile(valid, []byte(testAuthorizedUser), 0600)
+	setenv(t, "GOOGLE_APPLICATION_CREDENTIALS", valid)
+
+	for _, debug := range []bool{false, true} {
+		var buffer bytes.Buffer
+		method := NewAptMethod(bufio.NewReader(&bytes.Buffer{}), &buffer)
+		method.config.debug = debug
+		if _, err := method.defaultTokenSource(context.Background()); err != nil {
+			t.Fatalf("failed, %v", err)
+		}
+		expected := "using credentials from GOOGLE_APPLICATION_CREDENTIALS file " + valid
+		if logged := strings.Contains(buffer.String(), expected); logged != debug {
+			t.Errorf("failed with debug %v, expected log of %q, got %q", debug, expected, buffer.String())
+		}
+	}
+}
+
+func TestAccessToken(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer ci-token" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		fmt.Fprint(w, "package contents")
+	}))
+	defer server.Close()
+
+	var tests = []struct {
+		name        string
+		configItems []string
+		env         string
+	}{
+		{"config item", []string{"Acquire::gar::Access-Token=stale-token", "Acquire::gar::Access-Token=ci-token"}, ""},
+		{"environment", nil, "ci-token"},
+	}
+
+	for _, tt := range tests {
+		setenv(t, "ARTIFACT_REGISTRY_ACCESS_TOKEN", tt.env)
+		var buffer bytes.Buffer
+		method := NewAptMethod(bufio.NewReader(&bytes.Buffer{}), &buffer)
+		method.handleConfigure(&Message{code: 601, description: "Configuration", fields: map[string][]string{
+			"Config-Item": append([]string{"Debug::Acquire::gar=true", "Acquire::gar::Auth-Hosts::=127.0.0.1"}, tt.configItems...),
+		}})
+		ctx := context.WithValue(context.Background(), oauth2.HTTPClient, server.Client())
+		msg := &Message{
+			code:        600,
+			description: "URI Acquire",
+			fields:      map[string][]string{"URI": {"ar+" + server.URL + "/pool/pkg.deb"}, "Filename": {filepath.Join(t.TempDir(), "pkg.deb")}},
+		}
+		if err := method.handleAcquire(ctx, msg); err != nil || !strings.Contains(buffer.String(), "201 URI Done") {
+			t.Errorf("%s: failed, %v: %q", tt.name, err, buffer.String())
+		}
+		if strings.Contains(buffer.String(), "ci-token") || strings.Contains(buffer.String(), "stale-token") {
+			t.Errorf("%s: failed, token leaked into output %q", tt.name, buffer.String())
+		}
+	}
+}
+
+// redirectTransport sends every request to the host of target, standing in
+// for Google's fixed token endpoints.
+type redirectTransport struct {
+	target string
+	base   http.RoundTripper
+}
+
+func (t redirectTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.URL.Host = strings.TrimPrefix(t.target, "https://")
+	req.Host = ""
+	return t.base.RoundTrip(req)
+}
+
+func TestAuthorizedUserCredentials(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/token" {
+			if r.FormValue("grant_type") != "refresh_token" || r.FormValue("refresh_token") != "token" {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprint(w, `{"error": "invalid_grant", "error_description": "Token has been expired or revoked."}`)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprint(w, `{"access_token": "user-token", "token_type": "Bearer", "expires_in": 3600}`)
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer user-token" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		fmt.Fprint(w, "package contents")
+	}))
+	defer server.Close()
+
+	var tests = []struct {
+		name, credentials, expectedErr string
+	}{
+		{"valid", testAuthorizedUser, ""},
+		{"revoked", strings.Replace(testAuthorizedUser, `"refresh_token": "token"`, `"refresh_token": "revoked"`, 1), "gcloud auth application-default login"},
+	}
+
+	for _, tt := range tests {
+		dir := t.TempDir()
+		path := filepath.Join(dir, "adc.json")
+		os.WriteFile(path, []byte(tt.credentials), 0600)
+
+		var buffer bytes.Buffer
+		method := NewAptMethod(bufio.NewReader(&bytes.Buffer{}), &buffer)
+		method.config.serviceAccountJSON = path
+		client := &http.Client{Transport: redirectTransport{target: server.URL, base: server.Client().Transport}}
+		ctx := context.WithValue(context.Background(), oauth2.HTTPClient, client)
+		msg := &Message{
+			code:        600,
+			description: "URI Acquire",
+			fields:      map[string][]string{"URI": {"ar+https://us-apt.pkg.dev/projects/p/repo/pool/pkg.deb"}, "Filename": {filepath.Join(dir, "pkg.deb")}},
+		}
+		err := method.handleAcquire(ctx, msg)
+		if tt.expectedErr == "" {
+			if err != nil || !strings.Contains(buffer.String(), "201 URI Done") {
+				t.Errorf("%s: failed, %v: %q", tt.name, err, buffer.String())
+			}
+		} else if err == nil || !strings.Contains(err.Error(), tt.expectedErr) {
+			t.Errorf("%s: failed, expected error containing %q, got %v", tt.name, tt.expectedErr, err)
+		}
+	}
+}
+
+func TestReloadingTokenSource(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"access_token": "token%s", "token_type": "Bearer", "expires_in": 3600}`, strings.TrimPrefix(r.URL.Path, "/token"))
+	}))
+	defer server.Close()
+	ctx := context.WithValue(context.Background(), oauth2.HTTPClient, server.Client())
+
+	path := filepath.Join(t.TempDir(), "key.json")
+	writeServiceAccountKey(t, path, server.URL+"/token1")
+	var logs []string
+	ts, err := newReloadingTokenSource(ctx, path, tokenSourceFromFile, func(msg string) { logs = append(logs, msg) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tok, err := ts.Token(); err != nil || tok.AccessToken != "token1" {
+		t.Fatalf("failed, got %v, %v", tok, err)
+	}
+
+	// A key caught mid-rotation keeps the previous one in use.
+	later := time.Now().Add(time.Minute)
+	os.WriteFile(path, []byte("{"), 0600)
+	os.Chtimes(path, later, later)
+	if tok, err := ts.Token(); err != nil || tok.AccessToken != "token1" || len(logs) != 1 {
+		t.Errorf("failed, got %v, %v, logs %q", tok, err, logs)
+	}
+
+	writeServiceAccountKey(t, path, server.URL+"/token2")
+	later = later.Add(time.Minute)
+	os.Chtimes(path, later, later)
+	if tok, err := ts.Token(); err != nil || tok.AccessToken != "token2" {
+		t.Errorf("failed, expected the rotated key to be used, got %v, %v", tok, err)
+	}
+}
+
+func TestSelfSignedJWT(t *testing.T) {
+	var claims struct {
+		Iss, Aud string
+	}
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/token" {
+			t.Error("failed, self-signed JWTs shouldn't be exchanged at the token endpoint")
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		parts := strings.Split(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "), ".")
+		if len(parts) != 3 {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		payload, _ := base64.RawURLEncoding.DecodeString(parts[1])
+		json.Unmarshal(payload, &claims)
+		fmt.Fprint(w, "package contents")
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	key := filepath.Join(dir, "key.json")
+	writeServiceAccountKey(t, key, server.URL+"/token")
+	var buffer bytes.Buffer
+	method := NewAptMethod(bufio.NewReader(&bytes.Buffer{}), &buffer)
+	method.handleConfigure(&Message{code: 601, description: "Configuration", fields: map[string][]string{
+		"Config-Item": {"Acquire::gar::Service-Account-JSON=" + key, "Acquire::gar::Self-Signed-JWT=true", "Acquire::gar::Auth-Hosts::=127.0.0.1"},
+	}})
+	ctx := context.WithValue(context.Background(), oauth2.HTTPClient, server.Client())
+	msg := &Message{
+		code:        600,
+		description: "URI Acquire",
+		fields:      map[string][]string{"URI": {"ar+" + server.URL + "/pool/pkg.deb"}, "Filename": {filepath.Join(dir, "pkg.deb")}},
+	}
+	if err := method.handleAcquire(ctx, msg); err != nil || !strings.Contains(buffer.String(), "201 URI Done") {
+		t.Fatalf("failed, %v: %q", err, buffer.String())
+	}
+	if claims.Iss != "builder@p.iam.gserviceaccount.com" || claims.Aud != jwtAudience(strings.TrimPrefix(server.URL, "https://")) {
+		t.Errorf("failed, unexpected claims %+v", claims)
+	}
+
+	user := filepath.Join(dir, "user.json")
+	os.WriteFile(user, []byte(testAuthorizedUser), 0600)
+	if _, err := jwtTokenSourceFromFile(user, selfSignedJWTAudience); err == nil {
+		t.Error("failed, expected user credentials to be refused")
+	}
+}
+
+func TestAptMethodAnonymous(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/token" {
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprint(w, `{"access_token": "key-token", "token_type": "Bearer", "expires_in": 3600}`)
+			return
+		}
+		auth := r.Header.Get("Authorization")
+		if r.URL.Path == "/private/pkg.deb" && auth != "Bearer key-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprint(w, auth)
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	setenv(t, "GOOGLE_APPLICATION_CREDENTIALS", "")
+	setenv(t, "HOME", dir)
+	defer func(f func() bool) { onGCE = f }(onGCE)
+	onGCE = func() bool { return false }
+
+	var buffer bytes.Buffer
+	method := NewAptMethod(bufio.NewReader(&bytes.Buffer{}), &buffer)
+	method.handleConfigure(&Message{code: 601, description: "Configuration", fields: map[string][]string{
+		"Config-Item": {"Debug::Acquire::gar=true", "Acquire::gar::Auth-Hosts::=127.0.0.1"},
+	}})
+	ctx := context.WithValue(context.Background(), oauth2.HTTPClient, server.Client())
+	acquire := func(path string) (string, error) {
+		filename := filepath.Join(dir, filepath.Base(path))
+		err := method.handleAcquire(ctx, &Message{
+			code:        600,
+			description: "URI Acquire",
+			fields:      map[string][]string{"URI": {"ar+" + server.URL + path}, "Filename": {filename}},
+		})
+		b, _ := os.ReadFile(filename)
+		return string(b), err
+	}
+
+	if auth, err := acquire("/public/pkg.deb"); err != nil || auth != "" {
+		t.Fatalf("failed, expected an anonymous request, got %q, %v: %q", auth, err, buffer.String())
+	}
+	if !strings.Contains(buffer.String(), "sending requests without authentication") {
+		t.Errorf("failed, expected a debug message about anonymous access, got %q", buffer.String())
+	}
+	if _, err := acquire("/private/pkg.deb"); err == nil {
+		t.Errorf("failed, expected a refused anonymous request to fail")
+	}
+
+	// Credentials which turn up later are used once a request is refused.
+	keyFile := filepath.Join(dir, "key.json")
+	writeServiceAccountKey(t, keyFile, server.URL+"/token")
+	setenv(t, "GOOGLE_APPLICATION_CREDENTIALS", keyFile)
+	if _, err := acquire("/private/pkg.deb"); err != nil {
+		t.Fatalf("failed, expected a retry with credentials, got %v: %q", err, buffer.String())
+	}
+	if auth, err := acquire("/public/pkg.deb"); err != nil || auth != "Bearer key-token" {
+		t.Errorf("failed, expected later requests to be authenticated, got %q, %v", auth, err)
+	}
+}
+
+func TestAptMethodRequireAuth(t *testing.T) {
+	var requests int
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		fmt.Fprint(w, "package contents")
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	setenv(t, "GOOGLE_APPLICATION_CREDENTIALS", "")
+	setenv(t, "HOME", dir)
+	defer func(f func() bool) { onGCE = f }(onGCE)
+	onGCE = func() bool { return false }
+
+	var tests = []struct {
+		name     string
+		config   []string
+		expected string
+	}{
+		{"no credentials", nil, "no usable credentials found and Require-Auth is set"},
+		{"host not allowed", []string{"Acquire::gar::Access-Token=token"}, "tokens aren't sent to 127.0.0.1"},
+		{"host allowed", []string{"Acquire::gar::Access-Token=token", "Acquire::gar::Auth-Hosts::=127.0.0.1"}, ""},
+	}
+	for _, tt := range tests {
+		requests = 0
+		var buffer bytes.Buffer
+		method := NewAptMethod(bufio.NewReader(&bytes.Buffer{}), &buffer)
+		method.handleConfigure(&Message{code: 601, description: "Configuration", fields: map[string][]string{
+			"Config-Item": append([]string{"Acquire::gar::Require-Auth=true"}, tt.config...),
+		}})
+		ctx := context.WithValue(context.Background(), oauth2.HTTPClient, server.Client())
+		msg := &Message{
+			code:        600,
+			description: "URI Acquire",
+			fields:      map[string][]string{"URI": {"ar+" + server.URL + "/pool/pkg.deb"}, "Filename": {filepath.Join(dir, "pkg.deb")}},
+		}
+		err := method.handleAcquire(ctx, msg)
+		if tt.expected == "" {
+			if err != nil || requests != 1 {
+				t.Errorf("%s: failed, %v: %q", tt.name, err, buffer.String())
+			}
+			continue
+		}
+		if err == nil || !strings.HasPrefix(buffer.String(), "400 URI Failure") || !strings.Contains(buffer.String(), tt.expected) {
+			t.Errorf("%s: failed, expected a URI Failure containing %q, got %v: %q", tt.name, tt.expected, err, buffer.String())
+		}
+		if requests != 0 {
+			t.Errorf("%s: failed, expected no request to be sent, got %d", tt.name, requests)
+		}
+	}
+}
@@ -0,0 +1,177 @@
+//  Copyright 2021 Google LLC
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+//go:build linux || darwin || freebsd || netbsd || openbsd
+// +build linux darwin freebsd netbsd openbsd
+
+package apt
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"golang.org/x/oauth2"
+)
+
+func TestCredentialFD(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/token" {
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprint(w, `{"access_token": "key-token", "token_type": "Bearer", "expires_in": 3600}`)
+			return
+		}
+		if auth := r.Header.Get("Authorization"); auth != "Bearer fd-token" && auth != "Bearer key-token" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		fmt.Fprint(w, "package contents")
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	keyFile := filepath.Join(dir, "key.json")
+	writeServiceAccountKey(t, keyFile, server.URL+"/token")
+	key, err := os.ReadFile(keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tests = []struct {
+		name, credential string
+	}{
+		{"access token", "fd-token\n"},
+		{"service account key", string(key)},
+	}
+
+	for _, tt := range tests {
+		r, w, err := os.Pipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.WriteString(tt.credential)
+		w.Close()
+		// The method closes the descriptor it is given, so give it a copy.
+		fd, err := syscall.Dup(int(r.Fd()))
+		r.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var buffer bytes.Buffer
+		method := NewAptMethod(bufio.NewReader(&bytes.Buffer{}), &buffer)
+		method.config.serviceAccountJSON = filepath.Join(dir, "missing.json")
+		if err := method.handleConfigure(&Message{code: 601, description: "Configuration", fields: map[string][]string{
+			"Config-Item": {fmt.Sprintf("Acquire::gar::Credential-FD=%d", fd), "Acquire::gar::Auth-Hosts::=127.0.0.1"},
+		}}); err != nil {
+			t.Fatalf("%s: failed, %v", tt.name, err)
+		}
+		ctx := context.WithValue(context.Background(), oauth2.HTTPClient, server.Client())
+		filename := filepath.Join(dir, "pkg.deb")
+		msg := &Message{
+			code:        600,
+			description: "URI Acquire",
+			fields:      map[string][]string{"URI": {"ar+" + server.URL + "/pool/pkg.deb"}, "Filename": {filename}},
+		}
+		if err := method.handleAcquire(ctx, msg); err != nil || !strings.Contains(buffer.String(), "201 URI Done") {
+			t.Errorf("%s: failed, %v: %q", tt.name, err, buffer.String())
+		}
+		if !method.config.credential.Empty() {
+			t.Errorf("%s: failed, expected the credential to be released", tt.name)
+		}
+	}
+}
+
+func TestReadCredentialFD(t *testing.T) {
+	for _, size := range []int{0, maxCredentialSize} {
+		r, w, err := os.Pipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		go func() {
+			w.Write(bytes.Repeat([]byte("x"), size))
+			w.Close()
+		}()
+		fd, err := syscall.Dup(int(r.Fd()))
+		r.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if credential, err := readCredentialFD(fd); err == nil {
+			t.Errorf("failed, expected an error reading %d bytes, got %d bytes", size, len(credential.Bytes()))
+		}
+	}
+}
+
+func TestCredentialFDReconfigured(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer fd-token" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		fmt.Fprint(w, "package contents")
+	}))
+	defer server.Close()
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.WriteString("fd-token\n")
+	w.Close()
+	fd, err := syscall.Dup(int(r.Fd()))
+	r.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	var buffer bytes.Buffer
+	method := NewAptMethod(bufio.NewReader(&bytes.Buffer{}), &buffer)
+	ctx := context.WithValue(context.Background(), oauth2.HTTPClient, server.Client())
+	// The second configuration changes an option the client is made with,
+	// so the client is made again, from the credential read the first time.
+	for i, follow := range []string{"true", "false"} {
+		if err := method.handleConfigure(&Message{code: 601, description: "Configuration", fields: map[string][]string{
+			"Config-Item": {fmt.Sprintf("Acquire::gar::Credential-FD=%d", fd), "Acquire::gar::Auth-Hosts::=127.0.0.1", "Acquire::gar::Follow-Redirects=" + follow},
+		}}); err != nil {
+			t.Fatalf("configuration %d: failed, %v", i+1, err)
+		}
+		if method.client != nil {
+			t.Errorf("configuration %d: failed, expected no client before the first acquire", i+1)
+		}
+		buffer.Reset()
+		// Another file each time, so that it isn't reused.
+		name := fmt.Sprintf("pkg%d.deb", i)
+		msg := &Message{
+			code:        600,
+			description: "URI Acquire",
+			fields:      map[string][]string{"URI": {"ar+" + server.URL + "/pool/" + name}, "Filename": {filepath.Join(dir, name)}},
+		}
+		if err := method.handleAcquire(ctx, msg); err != nil || !strings.Contains(buffer.String(), "201 URI Done") {
+			t.Errorf("configuration %d: failed, %v: %q", i+1, err, buffer.String())
+		}
+	}
+	if !method.credentialFD.Empty() {
+		t.Errorf("failed, expected the credential to be released")
+	}
+}
@@ -0,0 +1,229 @@
+//  Copyright 2021 Google LLC
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package apt
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"sync"
+)
+
+// defaultPipelineDepth is how many URI Acquire messages are handled at once
+// unless Pipeline-Depth says otherwise. It matches the depth apt itself
+// pipelines to methods by default.
+const defaultPipelineDepth = 10
+
+// workers returns how many acquires are handled at once.
+func (c *aptMethodConfig) workers() int {
+	if c.pipelineDepth <= 0 {
+		return defaultPipelineDepth
+	}
+	return c.pipelineDepth
+}
+
+// queuedAcquire is a URI Acquire message waiting for a worker.
+type queuedAcquire struct {
+	msg  *Message
+	host string
+}
+
+// acquireQueue holds the URI Acquire messages handed to dispatchAcquire
+// until they can start, in the order apt sent them, and counts those
+// running, in all and for each host. Its workers handle them with ctx.
+type acquireQueue struct {
+	ctx         context.Context
+	pending     []queuedAcquire
+	running     int
+	hostRunning map[string]int
+	// hostLimit holds how many acquires slow start lets each host run at
+	// once; see rampLimit.
+	hostLimit map[string]int
+}
+
+// mayStart reports whether an acquire for host may start now. With apt's
+// Queue-Mode "host", its default, each host has Pipeline-Depth workers of
+// its own, so that a backlog for one doesn't hold up others, as with
+// apt's own methods, which it runs once for each host. With "access", all
+// hosts share them.
+func (c *aptMethodConfig) mayStart(q *acquireQueue, host string) bool {
+	if c.slowStart && q.hostRunning[host] >= q.rampLimit(host) {
+		return false
+	}
+	if c.sharedQueue {
+		return q.running < c.workers()
+	}
+	return q.hostRunning[host] < c.workers()
+}
+
+// dispatchAcquire queues msg for a worker, which starts on it as soon as
+// its host has one free; see mayStart. It blocks while Pipeline-Depth
+// messages are already waiting, so that apt's pipeline backs up rather than
+// the method queueing without bound, and gives up when ctx is cancelled.
+func (m *Method) dispatchAcquire(ctx context.Context, msg *Message) {
+	m.requestPrewarm(msg)
+	m.queueMu.Lock()
+	defer m.queueMu.Unlock()
+	if m.queue == nil {
+		m.queue = &acquireQueue{ctx: ctx, hostRunning: make(map[string]int), hostLimit: make(map[string]int)}
+		changed := sync.NewCond(&m.queueMu)
+		m.queueChanged = changed
+		go func() {
+			<-ctx.Done()
+			m.queueMu.Lock()
+			changed.Broadcast()
+			m.queueMu.Unlock()
+		}()
+	}
+	for len(m.queue.pending) >= m.config.workers() && ctx.Err() == nil {
+		m.queueChanged.Wait()
+	}
+	if ctx.Err() != nil {
+		return
+	}
+	next := queuedAcquire{msg: msg, host: aptHost(msg.Get("URI"))}
+	m.queue.pending = append(m.queue.pending, next)
+	m.logQueue("queued", next)
+	m.startAcquires()
+}
+
+// logQueue logs a transition of an acquire in the queue with
+// Debug::Acquire::gar::Queue, with how many acquires are queued and
+// running, and how many of its host's workers are busy. m.queueMu must be
+// held.
+func (m *Method) logQueue(event string, next queuedAcquire) {
+	if !m.config.debugQueue {
+		return
+	}
+	q := m.queue
+	busy, scope := q.hostRunning[next.host], "for "+next.host
+	if m.config.sharedQueue {
+		busy, scope = q.running, "in all"
+	}
+	m.writer.Log(fmt.Sprintf("queue: %s %s: %d queued, %d running, %d of %d workers busy %s", event, next.msg.Get("URI"), len(q.pending), q.running, busy, m.config.workers(), scope))
+}
+
+// startAcquires starts a worker on each queued acquire which may start,
+// oldest first. m.queueMu must be held.
+func (m *Method) startAcquires() {
+	q := m.queue
+	for i := 0; i < len(q.pending); {
+		next := q.pending[i]
+		if !m.config.mayStart(q, next.host) {
+			i++
+			continue
+		}
+		q.pending = append(q.pending[:i], q.pending[i+1:]...)
+		q.running++
+		q.hostRunning[next.host]++
+		m.logQueue("dequeued", next)
+		m.workers.Add(1)
+		go m.runAcquire(q.ctx, next)
+	}
+	m.queueChanged.Broadcast()
+}
+
+// runAcquire handles a queued acquire, then starts any it made room for.
+func (m *Method) runAcquire(ctx context.Context, next queuedAcquire) {
+	defer m.workers.Done()
+	defer m.failOnPanic()
+	// Once cancelled, messages not yet begun are left unanswered.
+	if ctx.Err() == nil {
+		m.queueMu.Lock()
+		m.logQueue("started", next)
+		m.queueMu.Unlock()
+		m.acquire(context.WithValue(ctx, queueHostKey{}, next.host), next.msg)
+	}
+	m.queueMu.Lock()
+	defer m.queueMu.Unlock()
+	q := m.queue
+	q.running--
+	if q.hostRunning[next.host]--; q.hostRunning[next.host] == 0 {
+		delete(q.hostRunning, next.host)
+	}
+	m.logQueue("finished", next)
+	m.startAcquires()
+}
+
+// acquire handles a URI Acquire message, reporting it to telemetry. An
+// acquire of a URI another is still fetching waits for it, and is answered
+// from its download; see joinFetch. An acquire into a file another is still
+// writing waits for it too, so that they don't write over each other; the
+// second can then often reuse the first's download.
+func (m *Method) acquire(ctx context.Context, msg *Message) {
+	uri := msg.Get("URI")
+	fetch, leader := m.joinFetch(uri)
+	if leader {
+		defer m.finishFetch(uri, fetch)
+	} else {
+		defer m.leaveFetch(fetch)
+		select {
+		case <-fetch.done:
+		case <-ctx.Done():
+			return
+		}
+		ctx = context.WithValue(ctx, sharedFetchKey{}, fetch)
+	}
+	defer m.lockTarget(msg.Get("Filename"))()
+	start := m.timeSource().Now()
+	result := "done"
+	if err := m.handleAcquire(ctx, msg); err != nil {
+		result = "failed"
+	} else {
+		m.retryDone(uri)
+	}
+	m.metrics().Timer("acquire", m.timeSource().Now().Sub(start), map[string]string{"result": result})
+}
+
+// lockTarget waits until no other acquire is writing filename, and marks
+// it as being written until the returned func is called.
+func (m *Method) lockTarget(filename string) func() {
+	key, err := filepath.Abs(filename)
+	if err != nil {
+		key = filename
+	}
+	for {
+		m.targetsMu.Lock()
+		busy, ok := m.targets[key]
+		if !ok {
+			if m.targets == nil {
+				m.targets = make(map[string]chan struct{})
+			}
+			done := make(chan struct{})
+			m.targets[key] = done
+			m.targetsMu.Unlock()
+			return func() {
+				m.targetsMu.Lock()
+				delete(m.targets, key)
+				m.targetsMu.Unlock()
+				close(done)
+			}
+		}
+		m.targetsMu.Unlock()
+		<-busy
+	}
+}
+
+// stopWorkers waits for the acquires queued and in progress to finish, so
+// that those dispatched later start with the configuration of the time. It
+// is safe to call more than once.
+func (m *Method) stopWorkers() {
+	// Each worker starts any acquires left waiting for it before it stops,
+	// so none are left queued once all have stopped.
+	m.workers.Wait()
+	m.queueMu.Lock()
+	m.queue = nil
+	m.queueMu.Unlock()
+}
@@ -0,0 +1,280 @@
+//  Copyright 2021 Google LLC
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package apt
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+func TestRunPipelined(t *testing.T) {
+	const depth = 3
+	// The server answers once depth requests are outstanding at once, which
+	// only happens if they are handled concurrently.
+	var wg sync.WaitGroup
+	wg.Add(depth)
+	arrived := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(arrived)
+	}()
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead {
+			// Warming up the connections.
+			return
+		}
+		wg.Done()
+		select {
+		case <-arrived:
+			fmt.Fprint(w, r.URL.Path)
+		case <-time.After(5 * time.Second):
+			http.Error(w, "requests weren't pipelined", http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	input := fmt.Sprintf("601 Configuration\nConfig-Item: Acquire::gar::Access-Token=token\nConfig-Item: Acquire::gar::Auth-Hosts::=127.0.0.1\nConfig-Item: Acquire::gar::Pipeline-Depth=%d\n\n", depth)
+	for i := 0; i < depth; i++ {
+		input += fmt.Sprintf("600 URI Acquire\nURI: ar+%s/pool/pkg%d.deb\nFilename: %s\n\n", server.URL, i, filepath.Join(dir, fmt.Sprintf("pkg%d.deb", i)))
+	}
+	var output bytes.Buffer
+	method := NewAptMethod(bufio.NewReader(strings.NewReader(input)), &output)
+	ctx := context.WithValue(context.Background(), oauth2.HTTPClient, server.Client())
+	if err := method.Run(ctx); err != nil {
+		t.Fatalf("failed, %v: %q", err, output.String())
+	}
+
+	if n := strings.Count(output.String(), "201 URI Done"); n != depth {
+		t.Errorf("failed, expected %d acquires to finish, got %d: %q", depth, n, output.String())
+	}
+	for i := 0; i < depth; i++ {
+		expected := fmt.Sprintf("/pool/pkg%d.deb", i)
+		if b, _ := os.ReadFile(filepath.Join(dir, fmt.Sprintf("pkg%d.deb", i))); string(b) != expected {
+			t.Errorf("failed, expected pkg%d.deb to hold %q, got %q", i, expected, b)
+		}
+	}
+}
+
+func TestRunQueueMode(t *testing.T) {
+	for _, mode := range []string{"host", "access"} {
+		// The first host answers once the second has been asked, or gives
+		// up after a while.
+		asked := make(chan struct{})
+		var mu sync.Mutex
+		var order []string
+		record := func(event string) {
+			mu.Lock()
+			order = append(order, event)
+			mu.Unlock()
+		}
+		first := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			select {
+			case <-asked:
+			case <-time.After(500 * time.Millisecond):
+			}
+			record("first")
+			fmt.Fprint(w, "first")
+		}))
+		second := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			record("second")
+			close(asked)
+			fmt.Fprint(w, "second")
+		}))
+
+		dir := t.TempDir()
+		input := fmt.Sprintf("601 Configuration\nConfig-Item: Acquire::gar::Access-Token=token\nConfig-Item: Acquire::gar::Auth-Hosts::=127.0.0.1\nConfig-Item: Acquire::gar::Pipeline-Depth=1\nConfig-Item: Acquire::Queue-Mode=%s\n\n", mode)
+		for i, server := range []*httptest.Server{first, second} {
+			input += fmt.Sprintf("600 URI Acquire\nURI: ar+%s/pool/pkg.deb\nFilename: %s\n\n", server.URL, filepath.Join(dir, fmt.Sprintf("pkg%d.deb", i)))
+		}
+		var output bytes.Buffer
+		method := NewAptMethod(bufio.NewReader(strings.NewReader(input)), &output)
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+		ctx := context.WithValue(context.Background(), oauth2.HTTPClient, client)
+		if err := method.Run(ctx); err != nil {
+			t.Fatalf("failed, %v: %q", err, output.String())
+		}
+		first.Close()
+		second.Close()
+
+		if n := strings.Count(output.String(), "201 URI Done"); n != 2 {
+			t.Errorf("failed, Queue-Mode %s: expected both acquires to finish, got %d: %q", mode, n, output.String())
+		}
+		// Each host has a worker of its own unless they share one.
+		expected := "second first"
+		if mode == "access" {
+			expected = "first second"
+		}
+		if res := strings.Join(order, " "); res != expected {
+			t.Errorf("failed, Queue-Mode %s: expected requests answered in order %q, got %q", mode, expected, res)
+		}
+	}
+}
+
+func TestRunLogsQueue(t *testing.T) {
+	var method *Method
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Answer the first once the second is queued behind it.
+		waitFor(t, func() bool {
+			method.queueMu.Lock()
+			defer method.queueMu.Unlock()
+			return method.queue != nil && (len(method.queue.pending) == 1 || r.URL.Path != "/pool/pkg0.deb")
+		})
+		fmt.Fprint(w, r.URL.Path)
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	input := "601 Configuration\nConfig-Item: Acquire::gar::Access-Token=token\nConfig-Item: Acquire::gar::Auth-Hosts::=127.0.0.1\nConfig-Item: Acquire::gar::Pipeline-Depth=1\nConfig-Item: Debug::Acquire::gar::Queue=true\n\n"
+	for i := 0; i < 2; i++ {
+		input += fmt.Sprintf("600 URI Acquire\nURI: ar+%s/pool/pkg%d.deb\nFilename: %s\n\n", server.URL, i, filepath.Join(dir, fmt.Sprintf("pkg%d.deb", i)))
+	}
+	var output bytes.Buffer
+	method = NewAptMethod(bufio.NewReader(strings.NewReader(input)), &output)
+	ctx := context.WithValue(context.Background(), oauth2.HTTPClient, server.Client())
+	if err := method.Run(ctx); err != nil {
+		t.Fatalf("failed, %v: %q", err, output.String())
+	}
+
+	host := strings.TrimPrefix(server.URL, "https://")
+	for i := 0; i < 2; i++ {
+		uri := fmt.Sprintf("ar+%s/pool/pkg%d.deb", server.URL, i)
+		last := -1
+		for _, event := range []string{"queued", "dequeued", "started", "finished"} {
+			pos := strings.Index(output.String(), "queue: "+event+" "+uri+": ")
+			if pos <= last {
+				t.Errorf("failed, expected %s to be logged as %s after its earlier transitions: %q", uri, event, output.String())
+			}
+			last = pos
+		}
+	}
+	expected := fmt.Sprintf("queue: finished ar+%s/pool/pkg0.deb: 1 queued, 0 running, 0 of 1 workers busy for %s\n", server.URL, host)
+	if !strings.Contains(output.String(), expected) {
+		t.Errorf("failed, expected %q in %q", expected, output.String())
+	}
+}
+
+func TestRunPrewarm(t *testing.T) {
+	for _, conns := range []int{0, 3} {
+		var mu sync.Mutex
+		var methods []string
+		gets := 0
+		server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == http.MethodHead {
+				// Acquires don't wait for the connections to be warmed
+				// up, so all of them are sent before any HEAD is
+				// answered.
+				waitFor(t, func() bool {
+					mu.Lock()
+					defer mu.Unlock()
+					return gets == 6
+				})
+			}
+			mu.Lock()
+			methods = append(methods, r.Method)
+			if r.Method == http.MethodGet {
+				gets++
+			}
+			mu.Unlock()
+			fmt.Fprint(w, r.URL.Path)
+		}))
+		dir := t.TempDir()
+		input := fmt.Sprintf("601 Configuration\nConfig-Item: Acquire::gar::Access-Token=token\nConfig-Item: Acquire::gar::Auth-Hosts::=127.0.0.1\nConfig-Item: Acquire::gar::Prewarm-Connections=%d\n\n", conns)
+		for i := 0; i < 6; i++ {
+			input += fmt.Sprintf("600 URI Acquire\nURI: ar+%s/pool/pkg%d.deb\nFilename: %s\n\n", server.URL, i, filepath.Join(dir, fmt.Sprintf("pkg%d.deb", i)))
+		}
+		var output bytes.Buffer
+		method := NewAptMethod(bufio.NewReader(strings.NewReader(input)), &output)
+		ctx := context.WithValue(context.Background(), oauth2.HTTPClient, server.Client())
+		if err := method.Run(ctx); err != nil {
+			t.Fatalf("failed, %v: %q", err, output.String())
+		}
+		server.Close()
+
+		expected := strings.Repeat("GET ", 6) + strings.Repeat("HEAD ", conns)
+		if res := strings.Join(methods, " ") + " "; res != expected {
+			t.Errorf("failed, Prewarm-Connections %d: expected requests %q, got %q", conns, expected, res)
+		}
+	}
+}
+
+func TestRunCoalescesAcquires(t *testing.T) {
+	var method *Method
+	var mu sync.Mutex
+	gets := 0
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead {
+			return
+		}
+		mu.Lock()
+		gets++
+		mu.Unlock()
+		// Answer once the second acquire of the URI waits for this one.
+		waitFor(t, func() bool {
+			method.fetchesMu.Lock()
+			defer method.fetchesMu.Unlock()
+			fetch, ok := method.fetches["ar+https://"+r.Host+r.URL.Path]
+			return ok && fetch.waiting == 1
+		})
+		fmt.Fprint(w, "package")
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	input := "601 Configuration\nConfig-Item: Acquire::gar::Access-Token=token\nConfig-Item: Acquire::gar::Auth-Hosts::=127.0.0.1\n\n"
+	for _, name := range []string{"first.deb", "second.deb"} {
+		input += fmt.Sprintf("600 URI Acquire\nURI: ar+%s/pool/pkg.deb\nFilename: %s\n\n", server.URL, filepath.Join(dir, name))
+	}
+	var output bytes.Buffer
+	method = NewAptMethod(bufio.NewReader(strings.NewReader(input)), &output)
+	// Move files out of the way once done, as apt does.
+	method.AddWriteHook(func(msg *Message) {
+		if msg.code == 201 {
+			os.Rename(msg.Get("Filename"), msg.Get("Filename")+".done")
+		}
+	})
+	ctx := context.WithValue(context.Background(), oauth2.HTTPClient, server.Client())
+	if err := method.Run(ctx); err != nil {
+		t.Fatalf("failed, %v: %q", err, output.String())
+	}
+
+	if n := strings.Count(output.String(), "201 URI Done"); n != 2 {
+		t.Errorf("failed, expected both acquires to finish, got %d: %q", n, output.String())
+	}
+	if gets != 1 {
+		t.Errorf("failed, expected a single fetch, got %d", gets)
+	}
+	for _, name := range []string{"first.deb", "second.deb"} {
+		if b, _ := os.ReadFile(filepath.Join(dir, name+".done")); string(b) != "package" {
+			t.Errorf("failed, expected %s to hold the package, got %q", name, b)
+		}
+	}
+	if len(method.fetches) != 0 {
+		t.Errorf("failed, expected no fetches left in progress, got %v", method.fetches)
+	}
+}
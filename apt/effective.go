@@ -0,0 +1,110 @@
+//  Copyright 2021 Google LLC
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package apt
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// Sources of the value of a config option, as effectiveConfig shows them.
+const (
+	sourceDefault = "default"
+	sourceApt     = "apt"
+	sourceEnv     = "env"
+)
+
+// configValue is the value a config option was last set to, and where it
+// came from. List options accumulate values.
+type configValue struct {
+	values []string
+	source string
+}
+
+// recordConfig notes that option was set to value from source, for
+// effectiveConfig.
+func (m *Method) recordConfig(option *ConfigOption, value, source string) {
+	if m.configValues == nil {
+		m.configValues = make(map[string]*configValue)
+	}
+	v, ok := m.configValues[option.Key]
+	if !ok || option.Type != "list" || v.source != source {
+		v = &configValue{source: source}
+		m.configValues[option.Key] = v
+	}
+	v.values = append(v.values, strings.TrimSpace(value))
+}
+
+// applyEnvOverrides applies the options set by environment variables, as
+// named by ConfigOption.env, over those apt sent. With strict set, a value
+// of the wrong type is an error; otherwise the option logs it as it would
+// a config item.
+func (m *Method) applyEnvOverrides(strict bool) error {
+	for i := range configOptions {
+		option := &configOptions[i]
+		name := option.env()
+		if name == "" || option.apply == nil {
+			continue
+		}
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+		if strict {
+			if err := option.validate(value); err != nil {
+				return fmt.Errorf("$%s: %v", name, err)
+			}
+		}
+		option.apply(m, option.Key+"="+value, value)
+		m.recordConfig(option, value, sourceEnv)
+	}
+	return nil
+}
+
+// effectiveConfig describes each option that is set or has a default, one
+// per line as Key=value followed by where the value came from. Secrets are
+// redacted, and list values joined with commas.
+func (m *Method) effectiveConfig() []string {
+	var lines []string
+	for _, option := range configOptions {
+		value, source := option.Default, sourceDefault
+		if v, ok := m.configValues[option.Key]; ok {
+			value, source = strings.Join(v.values, ","), v.source
+		} else if value == "" {
+			continue
+		}
+		if option.Secret && value != "" {
+			value = redacted
+		}
+		lines = append(lines, fmt.Sprintf("%s=%s (%s)", option.Key, value, source))
+	}
+	return lines
+}
+
+// EffectiveConfig returns the configuration the method would run with if
+// apt sent it items, given as Key=value like the Config-Item fields of a
+// 601 Configuration message, with the environment's overrides applied. It
+// is described one option per line, as Key=value followed by where the
+// value came from: apt, env, or the default.
+func EffectiveConfig(items []string) ([]string, error) {
+	m := NewAptMethod(nil, io.Discard)
+	msg := &Message{code: 601, description: "Configuration", fields: map[string][]string{"Config-Item": items}}
+	if err := m.handleConfigure(msg); err != nil {
+		return nil, err
+	}
+	return m.effectiveConfig(), nil
+}
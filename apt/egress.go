@@ -0,0 +1,83 @@
+//  Copyright 2021 Google LLC
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package apt
+
+import (
+	"context"
+	"fmt"
+	"net"
+)
+
+// resolver exists to enable mocking of net.Resolver.
+type resolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+// checkEgress resolves host and checks that all of its addresses fall within
+// the configured allowlist, catching DNS hijacking or misrouted private
+// endpoints before a credentialed request is sent. A violation is an error
+// if Egress-Allowlist-Mode is "fail", and otherwise only a warning. Each host
+// is checked once per session.
+func (m *Method) checkEgress(ctx context.Context, host string) error {
+	if len(m.config.egressAllowlist) == 0 {
+		return nil
+	}
+	m.egressMu.Lock()
+	defer m.egressMu.Unlock()
+	if err, ok := m.egressChecked[host]; ok {
+		return err
+	}
+	err := m.resolveAllowed(ctx, host)
+	if err != nil && !m.config.egressFail {
+		m.writer.Warning(err.Error())
+		err = nil
+	}
+	if m.egressChecked == nil {
+		m.egressChecked = make(map[string]error)
+	}
+	m.egressChecked[host] = err
+	return err
+}
+
+func (m *Method) resolveAllowed(ctx context.Context, host string) error {
+	var addrs []net.IPAddr
+	if ip := net.ParseIP(host); ip != nil {
+		addrs = []net.IPAddr{{IP: ip}}
+	} else {
+		var err error
+		r := m.resolver
+		if r == nil {
+			r = net.DefaultResolver
+		}
+		if addrs, err = r.LookupIPAddr(ctx, host); err != nil {
+			return fmt.Errorf("egress preflight failed to resolve %s: %v", host, err)
+		}
+	}
+	for _, addr := range addrs {
+		if !ipAllowed(addr.IP, m.config.egressAllowlist) {
+			return fmt.Errorf("egress preflight: %s resolved to %s, which is outside the allowlist", host, addr.IP)
+		}
+	}
+	return nil
+}
+
+func ipAllowed(ip net.IP, allowlist []*net.IPNet) bool {
+	for _, n := range allowlist {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
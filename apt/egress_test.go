@@ -0,0 +1,91 @@
+//  Copyright 2021 Google LLC
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package apt
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+)
+
+// fakeResolver resolves hosts from a map, counting lookups.
+type fakeResolver struct {
+	addrs   map[string][]string
+	lookups int
+}
+
+func (r *fakeResolver) LookupIPAddr(_ context.Context, host string) ([]net.IPAddr, error) {
+	r.lookups++
+	ips, ok := r.addrs[host]
+	if !ok {
+		return nil, errors.New("no such host")
+	}
+	var addrs []net.IPAddr
+	for _, ip := range ips {
+		addrs = append(addrs, net.IPAddr{IP: net.ParseIP(ip)})
+	}
+	return addrs, nil
+}
+
+func TestCheckEgress(t *testing.T) {
+	r := &fakeResolver{addrs: map[string][]string{
+		"private.pkg.dev":  {"199.36.153.8", "199.36.153.9"},
+		"hijacked.pkg.dev": {"199.36.153.8", "203.0.113.7"},
+	}}
+	var tests = []struct {
+		host, mode    string
+		expectErr     bool
+		expectWarning bool
+	}{
+		{"private.pkg.dev", "fail", false, false},
+		{"hijacked.pkg.dev", "fail", true, false},
+		{"hijacked.pkg.dev", "warn", false, true},
+		{"unknown.pkg.dev", "fail", true, false},
+		{"199.36.153.10", "fail", false, false},
+		{"10.0.0.1", "fail", true, false},
+	}
+
+	for _, tt := range tests {
+		var buffer bytes.Buffer
+		method := NewAptMethod(bufio.NewReader(&bytes.Buffer{}), &buffer)
+		method.resolver = r
+		method.handleConfigure(&Message{
+			code:        601,
+			description: "Configuration",
+			fields: map[string][]string{"Config-Item": {
+				"Acquire::gar::Egress-Allowlist::=199.36.153.8/30",
+				"Acquire::gar::Egress-Allowlist::=2001:db8::/32",
+				"Acquire::gar::Egress-Allowlist-Mode=" + tt.mode,
+			}},
+		})
+
+		err := method.checkEgress(context.Background(), tt.host)
+		if tt.expectErr != (err != nil) {
+			t.Errorf("failed for %s in %s mode, unexpected error result %v", tt.host, tt.mode, err)
+		}
+		if warned := strings.HasPrefix(buffer.String(), "104 Warning"); warned != tt.expectWarning {
+			t.Errorf("failed for %s in %s mode, unexpected output %q", tt.host, tt.mode, buffer.String())
+		}
+		// The result is remembered for the rest of the session.
+		lookups := r.lookups
+		if err2 := method.checkEgress(context.Background(), tt.host); (err == nil) != (err2 == nil) || r.lookups != lookups {
+			t.Errorf("failed for %s, expected the preflight result to be reused", tt.host)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+//  Copyright 2021 Google LLC
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package apt
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// EgressStats counts the files and bytes downloaded from a repository.
+// Bytes are as transferred, so compressed transfers count their compressed
+// size, which is what egress is billed on.
+type EgressStats struct {
+	Files int64 `json:"files"`
+	Bytes int64 `json:"bytes"`
+}
+
+// egressKey returns the repository uri belongs to for egress accounting:
+// its host and project, e.g. us-apt.pkg.dev/projects/my-project, or just
+// its host for URIs of another form.
+func egressKey(uri string) string {
+	u, err := parseAptURI(uri)
+	if err != nil {
+		return uri
+	}
+	parts := strings.Split(strings.TrimPrefix(u.Path, "/"), "/")
+	if len(parts) < 2 || parts[0] != "projects" || parts[1] == "" {
+		return u.Host
+	}
+	return u.Host + "/projects/" + parts[1]
+}
+
+// recordEgress adds a download of n bytes from uri to the session's stats.
+func (m *Method) recordEgress(uri string, n int64) {
+	m.egressStatsMu.Lock()
+	defer m.egressStatsMu.Unlock()
+	if m.egressStats == nil {
+		m.egressStats = make(map[string]EgressStats)
+	}
+	key := egressKey(uri)
+	stats := m.egressStats[key]
+	stats.Files++
+	stats.Bytes += n
+	m.egressStats[key] = stats
+	m.metrics().Counter("egress_bytes", n, map[string]string{"repository": key})
+}
+
+// EgressStats returns the files and bytes downloaded from each repository
+// so far in this session.
+func (m *Method) EgressStats() map[string]EgressStats {
+	m.egressStatsMu.Lock()
+	defer m.egressStatsMu.Unlock()
+	stats := make(map[string]EgressStats, len(m.egressStats))
+	for key, s := range m.egressStats {
+		stats[key] = s
+	}
+	return stats
+}
+
+// saveEgressStats adds the session's stats to today's counters in the
+// Egress-Stats-File, a JSON object keyed by UTC date and then repository.
+// The file is replaced atomically, though concurrent sessions may lose
+// each other's counts.
+func (m *Method) saveEgressStats() error {
+	if m.config.egressStatsFile == "" {
+		return nil
+	}
+	session := m.EgressStats()
+	if len(session) == 0 {
+		return nil
+	}
+	daily := make(map[string]map[string]EgressStats)
+	if b, err := os.ReadFile(m.config.egressStatsFile); err == nil {
+		if err := json.Unmarshal(b, &daily); err != nil {
+			return fmt.Errorf("failed to parse %s: %v", m.config.egressStatsFile, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	today := m.timeSource().Now().UTC().Format("2006-01-02")
+	if daily[today] == nil {
+		daily[today] = make(map[string]EgressStats)
+	}
+	for key, s := range session {
+		total := daily[today][key]
+		total.Files += s.Files
+		total.Bytes += s.Bytes
+		daily[today][key] = total
+	}
+	b, err := json.MarshalIndent(daily, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(m.config.egressStatsFile), ".egress-stats-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(append(b, '\n')); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), m.config.egressStatsFile)
+}
@@ -0,0 +1,86 @@
+//  Copyright 2021 Google LLC
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package apt
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestEgressKey(t *testing.T) {
+	var tests = []struct {
+		uri, expected string
+	}{
+		{"ar+https://us-apt.pkg.dev/projects/p/dists/repo/InRelease", "us-apt.pkg.dev/projects/p"},
+		{"ar+https://us-apt.pkg.dev/projects/p/pool/repo/pkg.deb", "us-apt.pkg.dev/projects/p"},
+		{"ar+https://mirror.example.com:8443/debian/pool/pkg.deb", "mirror.example.com:8443"},
+	}
+
+	for _, tt := range tests {
+		if res := egressKey(tt.uri); res != tt.expected {
+			t.Errorf("failed, egressKey(%q) = %q, expected %q", tt.uri, res, tt.expected)
+		}
+	}
+}
+
+func TestEgressStatsFile(t *testing.T) {
+	dir := t.TempDir()
+	statsFile := filepath.Join(dir, "egress.json")
+	session := func(uris ...string) {
+		var input bytes.Buffer
+		io.WriteString(&input, (&Message{code: 601, description: "Configuration", fields: map[string][]string{
+			"Config-Item": {"Acquire::gar::Egress-Stats-File=" + statsFile},
+		}}).String())
+		for _, uri := range uris {
+			io.WriteString(&input, (&Message{code: 600, description: "URI Acquire", fields: map[string][]string{
+				"URI": {uri}, "Filename": {filepath.Join(dir, "file")},
+			}}).String())
+		}
+		var output bytes.Buffer
+		method := NewAptMethod(bufio.NewReader(&input), &output)
+		method.client = fakeHTTPClient{body: "package contents"}
+		method.SetClock(newFakeClock())
+		if err := method.Run(context.Background()); err != nil {
+			t.Fatalf("failed, %v", err)
+		}
+	}
+
+	session("ar+https://us-apt.pkg.dev/projects/a/pool/pkg.deb", "ar+https://us-apt.pkg.dev/projects/b/pool/pkg.deb")
+	session("ar+https://us-apt.pkg.dev/projects/a/pool/other.deb")
+
+	b, err := os.ReadFile(statsFile)
+	if err != nil {
+		t.Fatalf("failed, %v", err)
+	}
+	var daily map[string]map[string]EgressStats
+	if err := json.Unmarshal(b, &daily); err != nil {
+		t.Fatalf("failed, %v", err)
+	}
+	n := int64(len("package contents"))
+	expected := map[string]map[string]EgressStats{"2021-03-01": {
+		"us-apt.pkg.dev/projects/a": {Files: 2, Bytes: 2 * n},
+		"us-apt.pkg.dev/projects/b": {Files: 1, Bytes: n},
+	}}
+	if !reflect.DeepEqual(daily, expected) {
+		t.Errorf("failed, expected %v, got %v", expected, daily)
+	}
+}
@@ -0,0 +1,78 @@
+//  Copyright 2021 Google LLC
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package apt
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrorKind classifies the errors returned by Run, so that callers can tell
+// why the method stopped without parsing error messages.
+type ErrorKind int
+
+const (
+	// UnknownError is the kind of unclassified errors.
+	UnknownError ErrorKind = iota
+	// ConfigError means the configuration sent by apt was unusable.
+	ConfigError
+	// AuthError means credentials could not be obtained.
+	AuthError
+	// ProtocolError means apt sent a message which could not be parsed.
+	ProtocolError
+	// IOError means reading from or writing to apt failed.
+	IOError
+)
+
+// kindError attaches an ErrorKind to an error.
+type kindError struct {
+	kind ErrorKind
+	err  error
+}
+
+func (e *kindError) Error() string {
+	return e.err.Error()
+}
+
+func (e *kindError) Unwrap() error {
+	return e.err
+}
+
+func withKind(kind ErrorKind, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &kindError{kind: kind, err: err}
+}
+
+// KindOf returns the kind of err, or UnknownError if it is not classified.
+func KindOf(err error) ErrorKind {
+	var ke *kindError
+	if errors.As(err, &ke) {
+		return ke.kind
+	}
+	return UnknownError
+}
+
+// failOnPanic, deferred at the top of the method's goroutines, tells apt of
+// a panic with a 401 General Failure before letting it crash the method, so
+// that apt reports its cause rather than only that the method exited
+// unexpectedly.
+func (m *Method) failOnPanic() {
+	if r := recover(); r != nil {
+		m.writer.Fail(fmt.Sprintf("internal error: %v", r))
+		panic(r)
+	}
+}
@@ -0,0 +1,88 @@
+//  Copyright 2021 Google LLC
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package apt
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"syscall"
+)
+
+// sniBlocked reports whether err looks like a TLS handshake cut short by a
+// firewall filtering on the server name: the connection is reset or closed
+// after the ClientHello, the reply isn't TLS at all (e.g. a block page), or
+// the handshake never completes. Failures to reach a proxy are left to
+// proxyFailure.
+func sniBlocked(err error) bool {
+	var op *net.OpError
+	if errors.As(err, &op) && op.Op == "proxyconnect" {
+		return false
+	}
+	var record tls.RecordHeaderError
+	if errors.As(err, &record) || errors.Is(err, syscall.ECONNRESET) || errors.Is(err, io.EOF) {
+		return true
+	}
+	return strings.Contains(err.Error(), "TLS handshake timeout")
+}
+
+// fallbackHost returns the host name of the fallback endpoint, without any
+// port.
+func (c *aptMethodConfig) fallbackHost() string {
+	if host, _, err := net.SplitHostPort(c.fallbackEndpoint); err == nil {
+		return host
+	}
+	return c.fallbackEndpoint
+}
+
+// fallbackURI rewrites the host of uri to the fallback endpoint, once the
+// method has switched to it.
+func (m *Method) fallbackURI(uri string) string {
+	m.fallbackMu.Lock()
+	active := m.fallbackActive
+	m.fallbackMu.Unlock()
+	if !active {
+		return uri
+	}
+	u, err := url.Parse(uri)
+	if err != nil {
+		return uri
+	}
+	u.Host = m.config.fallbackEndpoint
+	return u.String()
+}
+
+// switchToFallback reports whether a request to host which failed with err
+// should be retried through the fallback endpoint, switching the rest of
+// the session to it if so.
+func (m *Method) switchToFallback(host string, err error) bool {
+	if m.config.fallbackEndpoint == "" || host == m.config.fallbackEndpoint || !sniBlocked(err) {
+		return false
+	}
+	m.fallbackMu.Lock()
+	defer m.fallbackMu.Unlock()
+	if m.fallbackActive {
+		// Another acquire switched first; retry without logging again.
+		return true
+	}
+	m.fallbackActive = true
+	m.metrics().Event("fallback_endpoint", map[string]string{"host": host})
+	m.writer.Log(fmt.Sprintf("TLS handshake with %s failed as if blocked by SNI filtering (%v), switching to fallback endpoint %s", host, err, m.config.fallbackEndpoint))
+	return true
+}
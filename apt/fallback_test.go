@@ -0,0 +1,108 @@
+//  Copyright 2021 Google LLC
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package apt
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"golang.org/x/oauth2"
+)
+
+func TestSNIBlocked(t *testing.T) {
+	var tests = []struct {
+		name     string
+		err      error
+		expected bool
+	}{
+		{"reset", &url.Error{Op: "Get", Err: &net.OpError{Op: "read", Err: os.NewSyscallError("read", syscall.ECONNRESET)}}, true},
+		{"closed", &url.Error{Op: "Get", Err: io.EOF}, true},
+		{"not TLS", &url.Error{Op: "Get", Err: tls.RecordHeaderError{Msg: "first record does not look like a TLS handshake"}}, true},
+		{"timeout", &url.Error{Op: "Get", Err: errors.New("net/http: TLS handshake timeout")}, true},
+		{"proxy", &url.Error{Op: "Get", Err: &net.OpError{Op: "proxyconnect", Err: syscall.ECONNRESET}}, false},
+		{"refused", &url.Error{Op: "Get", Err: &net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}}, false},
+		{"deadline", context.DeadlineExceeded, false},
+	}
+	for _, tt := range tests {
+		if res := sniBlocked(tt.err); res != tt.expected {
+			t.Errorf("%s: failed, got %v, expected %v", tt.name, res, tt.expected)
+		}
+	}
+}
+
+func TestAptMethodFallbackEndpoint(t *testing.T) {
+	// The blocked endpoint resets every connection, as SNI filters do on
+	// seeing the ClientHello.
+	blocked, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer blocked.Close()
+	go func() {
+		for {
+			conn, err := blocked.Accept()
+			if err != nil {
+				return
+			}
+			conn.(*net.TCPConn).SetLinger(0)
+			conn.Read(make([]byte, 1))
+			conn.Close()
+		}
+	}()
+	fallback := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.URL.Path+" "+r.Header.Get("Authorization"))
+	}))
+	defer fallback.Close()
+	fallbackURL, _ := url.Parse(fallback.URL)
+
+	var buffer bytes.Buffer
+	method := NewAptMethod(bufio.NewReader(&bytes.Buffer{}), &buffer)
+	method.handleConfigure(&Message{code: 601, description: "Configuration", fields: map[string][]string{
+		"Config-Item": {"Acquire::gar::Access-Token=token", "Acquire::gar::Fallback-Endpoint=" + fallbackURL.Host},
+	}})
+	ctx := context.WithValue(context.Background(), oauth2.HTTPClient, fallback.Client())
+	dir := t.TempDir()
+	for _, name := range []string{"first.deb", "second.deb"} {
+		filename := filepath.Join(dir, name)
+		msg := &Message{
+			code:        600,
+			description: "URI Acquire",
+			fields:      map[string][]string{"URI": {"ar+https://" + blocked.Addr().String() + "/pool/" + name}, "Filename": {filename}},
+		}
+		if err := method.handleAcquire(ctx, msg); err != nil {
+			t.Fatalf("failed, %v: %q", err, buffer.String())
+		}
+		if b, _ := os.ReadFile(filename); string(b) != "/pool/"+name+" Bearer token" {
+			t.Errorf("failed, expected %s from the fallback endpoint with the token, got %q", name, b)
+		}
+	}
+	if n := strings.Count(buffer.String(), "switching to fallback endpoint "+fallbackURL.Host); n != 1 {
+		t.Errorf("failed, expected the switch to be logged once, got %q", buffer.String())
+	}
+}
@@ -0,0 +1,146 @@
+//  Copyright 2021 Google LLC
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package apt
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// FetchOptions configures Fetch. The zero value uses Application Default
+// Credentials.
+type FetchOptions struct {
+	// ServiceAccountJSON and ServiceAccountEmail select credentials as the
+	// Service-Account-JSON and Service-Account-Email config items do.
+	ServiceAccountJSON, ServiceAccountEmail string
+	// Client, if set, is used to send requests instead of an authenticated
+	// client created from the credentials.
+	Client *http.Client
+	// ConfigItems are further config items, as apt would send them, e.g.
+	// "Acquire::gar::Timeout=30".
+	ConfigItems []string
+	// LastModified, if set, makes the fetch conditional, as apt does with a
+	// file it already has.
+	LastModified string
+	// ExpectedSize, if positive, is checked against the downloaded size.
+	ExpectedSize int64
+	// ExpectedSHA256, if set, is checked against the hex SHA-256 of the
+	// downloaded file.
+	ExpectedSHA256 string
+	// Progress, if set, is called as the download progresses with the
+	// bytes written so far and the total, which is -1 if unknown.
+	Progress func(written, total int64)
+	// Log, if set, is called with the log messages and warnings the method
+	// would send to apt.
+	Log func(msg string)
+}
+
+// FetchResult describes a completed Fetch.
+type FetchResult struct {
+	// NotModified is set if the file is unchanged since
+	// FetchOptions.LastModified, in which case dest is not written.
+	NotModified  bool
+	Size         int64
+	MD5Hash      string
+	SHA256Hash   string
+	LastModified string
+}
+
+// Fetch downloads uri, an ar+https or https URI, to the file dest with all of
+// the transport's authentication, verification and resumption logic, for Go
+// programs which don't speak the apt method protocol. Cancelling ctx aborts
+// the download.
+func Fetch(ctx context.Context, uri, dest string, opts *FetchOptions) (*FetchResult, error) {
+	if opts == nil {
+		opts = &FetchOptions{}
+	}
+	m := NewAptMethod(bufio.NewReader(strings.NewReader("")), io.Discard)
+	m.writer.setTimeout(0)
+	if opts.Client != nil {
+		m.client = opts.Client
+	}
+
+	var items []string
+	if opts.ServiceAccountJSON != "" {
+		items = append(items, "Acquire::gar::Service-Account-JSON="+opts.ServiceAccountJSON)
+	}
+	if opts.ServiceAccountEmail != "" {
+		items = append(items, "Acquire::gar::Service-Account-Email="+opts.ServiceAccountEmail)
+	}
+	items = append(items, opts.ConfigItems...)
+	if len(items) > 0 {
+		if err := m.handleConfigure(&Message{code: 601, description: "Configuration", fields: map[string][]string{"Config-Item": items}}); err != nil {
+			return nil, err
+		}
+	}
+
+	// The method reports the outcome as messages to apt; collect them.
+	total := int64(-1)
+	var result *Message
+	m.writer.AddHook(func(msg *Message) {
+		switch msg.code {
+		case 101, 104:
+			if opts.Log != nil {
+				opts.Log(msg.Get("Message"))
+			}
+		case 200:
+			if size, err := strconv.ParseInt(msg.Get("Size"), 10, 64); err == nil {
+				total = size
+			}
+		case 201, 400, 401:
+			result = msg
+		}
+	})
+	if opts.Progress != nil {
+		m.config.progress = func(written int64) { opts.Progress(written, total) }
+	}
+
+	fields := map[string][]string{"URI": {uri}, "Filename": {dest}}
+	if opts.LastModified != "" {
+		fields["Last-Modified"] = []string{opts.LastModified}
+	}
+	if opts.ExpectedSize > 0 {
+		fields["Expected-Checksum-FileSize"] = []string{strconv.FormatInt(opts.ExpectedSize, 10)}
+	}
+	if opts.ExpectedSHA256 != "" {
+		fields["Expected-SHA256"] = []string{opts.ExpectedSHA256}
+	}
+	err := m.handleAcquire(ctx, &Message{code: 600, description: "URI Acquire", fields: fields})
+	if result == nil || result.code != 201 {
+		if result != nil {
+			return nil, errors.New(result.Get("Message"))
+		}
+		if err == nil {
+			err = errors.New("no result from method")
+		}
+		return nil, err
+	}
+
+	res := &FetchResult{
+		NotModified:  result.Get("IMS-Hit") == "true",
+		MD5Hash:      result.Get("MD5-Hash"),
+		SHA256Hash:   result.Get("SHA256-Hash"),
+		LastModified: result.Get("Last-Modified"),
+	}
+	if !res.NotModified {
+		res.Size, _ = strconv.ParseInt(result.Get("Size"), 10, 64)
+	}
+	return res, nil
+}
@@ -0,0 +1,89 @@
+//  Copyright 2021 Google LLC
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package apt
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFetch(t *testing.T) {
+	content := strings.Repeat("package contents\n", 5000)
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/missing.deb":
+			w.WriteHeader(http.StatusNotFound)
+		case r.Header.Get("If-Modified-Since") != "":
+			w.WriteHeader(http.StatusNotModified)
+		default:
+			w.Header().Set("Content-Length", fmt.Sprint(len(content)))
+			w.Header().Set("Last-Modified", "Mon, 01 Mar 2021 03:05:06 GMT")
+			fmt.Fprint(w, content)
+		}
+	}))
+	defer server.Close()
+	uri := "ar+https://" + strings.TrimPrefix(server.URL, "https://")
+	dest := filepath.Join(t.TempDir(), "pkg.deb")
+
+	var last, total int64
+	sha := fmt.Sprintf("%x", sha256.Sum256([]byte(content)))
+	res, err := Fetch(context.Background(), uri+"/pkg.deb", dest, &FetchOptions{
+		Client:         server.Client(),
+		ExpectedSize:   int64(len(content)),
+		ExpectedSHA256: sha,
+		Progress:       func(written, t int64) { last, total = written, t },
+	})
+	if err != nil {
+		t.Fatalf("failed, %v", err)
+	}
+	if res.Size != int64(len(content)) || res.MD5Hash != fmt.Sprintf("%x", md5.Sum([]byte(content))) || res.SHA256Hash != sha || res.NotModified {
+		t.Errorf("failed, unexpected result %+v", res)
+	}
+	if got, _ := os.ReadFile(dest); string(got) != content {
+		t.Errorf("failed, unexpected file contents")
+	}
+	if last != int64(len(content)) || total != int64(len(content)) {
+		t.Errorf("failed, expected final progress of %d/%d, got %d/%d", len(content), len(content), last, total)
+	}
+
+	res, err = Fetch(context.Background(), uri+"/pkg.deb", dest, &FetchOptions{Client: server.Client(), LastModified: res.LastModified})
+	if err != nil || !res.NotModified {
+		t.Errorf("failed, expected not modified, got %+v, %v", res, err)
+	}
+
+	other := filepath.Join(t.TempDir(), "other.deb")
+	_, err = Fetch(context.Background(), uri+"/pkg.deb", other, &FetchOptions{Client: server.Client(), ExpectedSHA256: strings.Repeat("0", 64)})
+	if err == nil || !strings.Contains(err.Error(), "SHA256 hash mismatch: expected "+strings.Repeat("0", 64)+", got "+sha) {
+		t.Errorf("failed, expected a hash mismatch, got %v", err)
+	}
+
+	if _, err := Fetch(context.Background(), uri+"/missing.deb", dest, &FetchOptions{Client: server.Client()}); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("failed, expected a 404 error, got %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := Fetch(ctx, uri+"/pkg.deb", dest, &FetchOptions{Client: server.Client()}); err == nil {
+		t.Errorf("failed, expected a cancelled fetch to fail")
+	}
+}
@@ -0,0 +1,84 @@
+//  Copyright 2021 Google LLC
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package apt
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"hash"
+	"sync"
+)
+
+// HashBackend constructs the digests computed over downloaded files.
+// Algorithms are named as apt names them: "MD5Sum", "SHA1", "SHA256" and
+// "SHA512".
+type HashBackend interface {
+	// New returns a new hash for algorithm, or nil if it is unsupported.
+	New(algorithm string) hash.Hash
+}
+
+// StandardHashBackend uses the Go standard library implementations, which
+// use SHA-NI on amd64 and the ARMv8 crypto extensions on arm64 when the CPU
+// supports them.
+type StandardHashBackend struct{}
+
+// New implements HashBackend.
+func (StandardHashBackend) New(algorithm string) hash.Hash {
+	switch algorithm {
+	case "MD5Sum":
+		return md5.New()
+	case "SHA1":
+		return sha1.New()
+	case "SHA256":
+		return sha256.New()
+	case "SHA512":
+		return sha512.New()
+	}
+	return nil
+}
+
+var (
+	hashBackendMu sync.Mutex
+	hashBackend   HashBackend = StandardHashBackend{}
+)
+
+// SetHashBackend replaces the backend used to hash downloads, e.g. with a
+// FIPS validated implementation.
+func SetHashBackend(b HashBackend) {
+	hashBackendMu.Lock()
+	defer hashBackendMu.Unlock()
+	hashBackend = b
+}
+
+// downloadHashes returns the algorithms downloads are hashed with: MD5Sum,
+// which apt requires of a method, and the SHA digests the backend supports,
+// which apt's http method also reports.
+func downloadHashes() []string {
+	algorithms := []string{"MD5Sum"}
+	for _, algorithm := range []string{"SHA1", "SHA256", "SHA512"} {
+		if newHash(algorithm) != nil {
+			algorithms = append(algorithms, algorithm)
+		}
+	}
+	return algorithms
+}
+
+func newHash(algorithm string) hash.Hash {
+	hashBackendMu.Lock()
+	defer hashBackendMu.Unlock()
+	return hashBackend.New(algorithm)
+}
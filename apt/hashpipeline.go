@@ -0,0 +1,128 @@
+//  Copyright 2021 Google LLC
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package apt
+
+import (
+	"fmt"
+	"hash"
+	"sync"
+	"sync/atomic"
+)
+
+// hashPipelineDepth is how many chunks each hasher may fall behind the
+// writer before writes block. A few chunks absorb the jitter of network
+// reads without holding much memory.
+const hashPipelineDepth = 8
+
+// hashPipeline computes digests over a stream, each in its own goroutine,
+// so that reading from the network and writing to disk carry on while the
+// CPU hashes, and several digests of a multi-GB package are computed on
+// separate cores rather than one after another.
+type hashPipeline struct {
+	algorithms []string
+	hashes     []hash.Hash
+	chunks     []chan *sharedChunk
+	wg         sync.WaitGroup
+	pool       sync.Pool
+	closed     bool
+}
+
+// sharedChunk is a copy of written data which all hashers read. The last
+// hasher to finish with it returns it to the pool.
+type sharedChunk struct {
+	data []byte
+	refs int32
+}
+
+// newHashPipeline starts a hasher for each of algorithms, failing if the
+// hash backend doesn't support one of them.
+func newHashPipeline(algorithms ...string) (*hashPipeline, error) {
+	p := &hashPipeline{algorithms: algorithms}
+	for _, algorithm := range algorithms {
+		h := newHash(algorithm)
+		if h == nil {
+			return nil, fmt.Errorf("hash backend does not support %s", algorithm)
+		}
+		p.hashes = append(p.hashes, h)
+	}
+	for _, h := range p.hashes {
+		chunks := make(chan *sharedChunk, hashPipelineDepth)
+		p.chunks = append(p.chunks, chunks)
+		p.wg.Add(1)
+		go func(h hash.Hash) {
+			defer p.wg.Done()
+			for chunk := range chunks {
+				h.Write(chunk.data)
+				if atomic.AddInt32(&chunk.refs, -1) == 0 {
+					p.pool.Put(chunk)
+				}
+			}
+		}(h)
+	}
+	return p, nil
+}
+
+// Write implements io.Writer. b is copied, so the caller may reuse it.
+func (p *hashPipeline) Write(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	chunk, _ := p.pool.Get().(*sharedChunk)
+	if chunk == nil || cap(chunk.data) < len(b) {
+		chunk = &sharedChunk{data: make([]byte, len(b))}
+	}
+	chunk.data = chunk.data[:len(b)]
+	copy(chunk.data, b)
+	chunk.refs = int32(len(p.chunks))
+	for _, chunks := range p.chunks {
+		chunks <- chunk
+	}
+	return len(b), nil
+}
+
+// Close waits for the hashers to finish. It may be called more than once.
+func (p *hashPipeline) Close() {
+	if p.closed {
+		return
+	}
+	p.closed = true
+	for _, chunks := range p.chunks {
+		close(chunks)
+	}
+	p.wg.Wait()
+}
+
+// result closes the pipeline and returns the downloadResult for size bytes
+// hashed.
+func (p *hashPipeline) result(size int64) downloadResult {
+	return downloadResult{
+		md5Hash:    p.Sum("MD5Sum"),
+		sha1Hash:   p.Sum("SHA1"),
+		sha256Hash: p.Sum("SHA256"),
+		sha512Hash: p.Sum("SHA512"),
+		size:       size,
+	}
+}
+
+// Sum closes the pipeline and returns the hex digest for algorithm.
+func (p *hashPipeline) Sum(algorithm string) string {
+	p.Close()
+	for i, a := range p.algorithms {
+		if a == algorithm {
+			return fmt.Sprintf("%x", p.hashes[i].Sum(nil))
+		}
+	}
+	return ""
+}
@@ -0,0 +1,94 @@
+//  Copyright 2021 Google LLC
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package apt
+
+import (
+	"fmt"
+	"hash"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+var allAlgorithms = []string{"MD5Sum", "SHA1", "SHA256", "SHA512"}
+
+func TestHashPipeline(t *testing.T) {
+	data := make([]byte, 1<<20)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	p, err := newHashPipeline(allAlgorithms...)
+	if err != nil {
+		t.Fatalf("failed, %v", err)
+	}
+	// Reuse one buffer, as the downloader does, to check that writes are
+	// copied before the hashers see them.
+	buf := make([]byte, 4096)
+	for off := 0; off < len(data); off += len(buf) {
+		copy(buf, data[off:])
+		p.Write(buf)
+	}
+	for _, algorithm := range allAlgorithms {
+		h := newHash(algorithm)
+		h.Write(data)
+		if expected, res := fmt.Sprintf("%x", h.Sum(nil)), p.Sum(algorithm); res != expected {
+			t.Errorf("failed, %s: expected %s, got %s", algorithm, expected, res)
+		}
+	}
+
+	SetHashBackend(nilHashBackend{})
+	defer SetHashBackend(StandardHashBackend{})
+	if _, err := newHashPipeline("SHA256"); err == nil {
+		t.Error("failed, expected an error from a backend without SHA256")
+	}
+}
+
+// BenchmarkHashPipeline compares computing all of apt's digests one after
+// another with computing them in the pipeline. Run it with -cpu 2 to see
+// the gain on a 2-vCPU node.
+func BenchmarkHashPipeline(b *testing.B) {
+	chunk := make([]byte, defaultWriteChunkSize)
+	const size = 64 << 20
+	b.Run("sequential", func(b *testing.B) {
+		b.SetBytes(size)
+		for i := 0; i < b.N; i++ {
+			var writers []io.Writer
+			var hashes []hash.Hash
+			for _, algorithm := range allAlgorithms {
+				h := newHash(algorithm)
+				writers = append(writers, h)
+				hashes = append(hashes, h)
+			}
+			w := io.MultiWriter(writers...)
+			for n := 0; n < size; n += len(chunk) {
+				w.Write(chunk)
+			}
+			for _, h := range hashes {
+				h.Sum(nil)
+			}
+		}
+	})
+	b.Run("pipeline", func(b *testing.B) {
+		b.SetBytes(size)
+		for i := 0; i < b.N; i++ {
+			p, _ := newHashPipeline(allAlgorithms...)
+			for n := 0; n < size; n += len(chunk) {
+				p.Write(chunk)
+			}
+			for _, algorithm := range allAlgorithms {
+				p.Sum(algorithm)
+			}
+		}
+	})
+}
@@ -0,0 +1,73 @@
+//  Copyright 2021 Google LLC
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package apt
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// HealthCheck checks that the method is ready to serve apt: that a token can
+// be obtained and that the hosts in the sources files are reachable. The
+// result is sent as a 101 Log, so that node agents can verify patching
+// readiness without running apt; ar+https runs it on SIGUSR2. It is safe to
+// call while Run is running.
+// Until apt has sent its configuration the check is skipped, so that it
+// doesn't set up credentials from defaults the configuration may override.
+func (m *Method) HealthCheck(ctx context.Context) error {
+	m.configMu.RLock()
+	defer m.configMu.RUnlock()
+	if !m.configured {
+		m.writer.logSequenced(0, "health check skipped, as apt hasn't sent the configuration yet")
+		return nil
+	}
+	err := m.healthCheck(ctx)
+	if err != nil {
+		m.writer.logSequenced(0, fmt.Sprintf("health check failed: %v", err))
+	} else {
+		m.writer.logSequenced(0, "health check passed")
+	}
+	return err
+}
+
+func (m *Method) healthCheck(ctx context.Context) error {
+	if err := m.initClient(ctx); err != nil {
+		return withKind(AuthError, err)
+	}
+	m.clientMu.Lock()
+	tokens := m.tokens
+	m.clientMu.Unlock()
+	if tokens != nil {
+		token, err := tokens.Token()
+		if err != nil {
+			return withKind(AuthError, fmt.Errorf("failed to obtain token: %v", err))
+		}
+		if !token.Valid() {
+			return withKind(AuthError, fmt.Errorf("token is not valid"))
+		}
+	}
+
+	var failed []string
+	for _, host := range sourceHosts(readSources(m.config.dirs.sourceFiles())) {
+		if _, err := m.probeHost(ctx, host); err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v", host, err))
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("unreachable hosts: %s", strings.Join(failed, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+//  Copyright 2021 Google LLC
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package apt
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/oauth2"
+)
+
+type failingTokenSource struct{}
+
+func (failingTokenSource) Token() (*oauth2.Token, error) {
+	return nil, errors.New("no token for you")
+}
+
+type unreachableHTTPClient struct{}
+
+func (unreachableHTTPClient) Do(req *http.Request) (*http.Response, error) {
+	return nil, errors.New("connection refused")
+}
+
+func TestHealthCheck(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "sources.list"), []byte(testSourcesList), 0644)
+
+	var tests = []struct {
+		name     string
+		tokens   oauth2.TokenSource
+		client   httpClient
+		kind     ErrorKind
+		expected string
+	}{
+		{"healthy", oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "token"}), &recordingHTTPClient{}, UnknownError, "health check passed"},
+		{"no token", failingTokenSource{}, &recordingHTTPClient{}, AuthError, "health check failed: failed to obtain token: no token for you"},
+		{"unreachable", oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "token"}), unreachableHTTPClient{}, UnknownError, "health check failed: unreachable hosts: us-apt.pkg.dev"},
+	}
+
+	for _, tt := range tests {
+		var buffer bytes.Buffer
+		method := NewAptMethod(bufio.NewReader(&bytes.Buffer{}), &buffer)
+		method.configured = true
+		method.config.dirs.etc = dir
+		method.client = tt.client
+		method.tokens = tt.tokens
+		err := method.HealthCheck(context.Background())
+		if (err == nil) != (tt.expected == "health check passed") || KindOf(err) != tt.kind {
+			t.Errorf("%s: failed, unexpected error %v", tt.name, err)
+		}
+		if !strings.HasPrefix(buffer.String(), "101 Log\n") || !strings.Contains(buffer.String(), tt.expected) {
+			t.Errorf("%s: failed, expected log containing %q, got %q", tt.name, tt.expected, buffer.String())
+		}
+	}
+}
+
+func TestHealthCheckBeforeConfiguration(t *testing.T) {
+	var buffer bytes.Buffer
+	method := NewAptMethod(bufio.NewReader(&bytes.Buffer{}), &buffer)
+	if err := method.HealthCheck(context.Background()); err != nil {
+		t.Errorf("failed, %v", err)
+	}
+	if !strings.Contains(buffer.String(), "health check skipped") {
+		t.Errorf("failed, expected the check to be skipped, got %q", buffer.String())
+	}
+	method.clientMu.Lock()
+	defer method.clientMu.Unlock()
+	if method.client != nil || method.tokens != nil {
+		t.Error("failed, expected no client to be set up before the configuration")
+	}
+}
@@ -0,0 +1,96 @@
+//  Copyright 2021 Google LLC
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package apt
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// helperTimeout bounds how long a credential helper may run.
+const helperTimeout = 30 * time.Second
+
+// helperTokenSource obtains tokens by running a credential helper, which
+// prints either a bare access token or a JSON object such as
+//
+//	{"access_token": "ya29...", "expires_in": 3599}
+//
+// on stdout. This lets corporate secret brokers and custom token vending
+// services supply tokens. It is run again once the token expires; a token
+// without an expiry is used for the rest of the session.
+type helperTokenSource struct {
+	ctx  context.Context
+	path string
+	now  func() time.Time
+}
+
+func newHelperTokenSource(ctx context.Context, path string, clock Clock) oauth2.TokenSource {
+	return oauth2.ReuseTokenSource(nil, helperTokenSource{ctx: ctx, path: path, now: clock.Now})
+}
+
+func (h helperTokenSource) Token() (*oauth2.Token, error) {
+	ctx, cancel := context.WithTimeout(h.ctx, helperTimeout)
+	defer cancel()
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, h.path)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("credential helper %s failed: %v: %s", h.path, err, msg)
+		}
+		return nil, fmt.Errorf("credential helper %s failed: %v", h.path, err)
+	}
+	secret := NewSecret(stdout.Bytes())
+	defer secret.Release()
+	return parseHelperToken(secret.Bytes(), h.now())
+}
+
+// parseHelperToken parses the output of a credential helper.
+func parseHelperToken(b []byte, now time.Time) (*oauth2.Token, error) {
+	b = bytes.TrimSpace(b)
+	if len(b) == 0 {
+		return nil, errors.New("credential helper printed no token")
+	}
+	if b[0] != '{' {
+		if bytes.ContainsAny(b, " \t\r\n") {
+			return nil, errors.New("credential helper printed more than a token")
+		}
+		return &oauth2.Token{AccessToken: string(b)}, nil
+	}
+	var out struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	if err := json.Unmarshal(b, &out); err != nil {
+		return nil, errors.New("credential helper printed malformed JSON")
+	}
+	if out.AccessToken == "" {
+		return nil, errors.New("credential helper printed no access_token")
+	}
+	token := &oauth2.Token{AccessToken: out.AccessToken}
+	if out.ExpiresIn > 0 {
+		token.Expiry = now.Add(time.Duration(out.ExpiresIn) * time.Second)
+	}
+	return token, nil
+}
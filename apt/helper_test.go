@@ -0,0 +1,86 @@
+//  Copyright 2021 Google LLC
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package apt
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseHelperToken(t *testing.T) {
+	now := time.Date(2021, 3, 1, 0, 0, 0, 0, time.UTC)
+	var tests = []struct {
+		output, token string
+		expiry        time.Time
+		expectErr     bool
+	}{
+		{"ya29.token\n", "ya29.token", time.Time{}, false},
+		{`{"access_token": "ya29.token", "expires_in": 60}`, "ya29.token", now.Add(time.Minute), false},
+		{`{"access_token": "ya29.token"}`, "ya29.token", time.Time{}, false},
+		{`{"expires_in": 60}`, "", time.Time{}, true},
+		{`{"access_token": `, "", time.Time{}, true},
+		{"usage: helper [flags]\n", "", time.Time{}, true},
+		{"", "", time.Time{}, true},
+	}
+
+	for _, tt := range tests {
+		token, err := parseHelperToken([]byte(tt.output), now)
+		if tt.expectErr != (err != nil) {
+			t.Errorf("failed for %q, unexpected error %v", tt.output, err)
+			continue
+		}
+		if err == nil && (token.AccessToken != tt.token || !token.Expiry.Equal(tt.expiry)) {
+			t.Errorf("failed for %q, got %q expiring %v", tt.output, token.AccessToken, token.Expiry)
+		}
+		if err != nil && strings.Contains(err.Error(), "ya29") {
+			t.Errorf("failed for %q, error reveals the output: %v", tt.output, err)
+		}
+	}
+}
+
+func TestHelperTokenSource(t *testing.T) {
+	dir := t.TempDir()
+	helper := func(name, script string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte("#!/bin/sh\n"+script), 0755); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	var tests = []struct {
+		path, token, expectedErr string
+	}{
+		{helper("ok", `echo '{"access_token": "helper-token", "expires_in": 3600}'`), "helper-token", ""},
+		{helper("fail", "echo 'broker unavailable' >&2; exit 1"), "", "broker unavailable"},
+		{filepath.Join(dir, "missing"), "", "no such file"},
+	}
+
+	for _, tt := range tests {
+		token, err := newHelperTokenSource(context.Background(), tt.path, SystemClock{}).Token()
+		if tt.expectedErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.expectedErr) {
+				t.Errorf("failed for %s, expected error containing %q, got %v", tt.path, tt.expectedErr, err)
+			}
+			continue
+		}
+		if err != nil || token.AccessToken != tt.token || !token.Valid() {
+			t.Errorf("failed for %s, got %v, %v", tt.path, token, err)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+//  Copyright 2021 Google LLC
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package apt
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+
+	"golang.org/x/oauth2"
+)
+
+// definitiveFailure classifies an error from a request which will recur for
+// every other request to the same host in this run: the host's certificate
+// failing verification, or our credentials being refused. It returns "" for
+// errors which may be transient.
+func definitiveFailure(err error) string {
+	var unknownAuthority x509.UnknownAuthorityError
+	var invalid x509.CertificateInvalidError
+	var hostname x509.HostnameError
+	var retrieve *oauth2.RetrieveError
+	switch {
+	case errors.As(err, &unknownAuthority), errors.As(err, &invalid), errors.As(err, &hostname):
+		return "TLS"
+	case errors.As(err, &retrieve):
+		if retrieve.Response != nil && retrieve.Response.StatusCode >= 400 && retrieve.Response.StatusCode < 500 {
+			return "auth"
+		}
+	}
+	return ""
+}
+
+// hostFailureKey identifies what a definitive failure recurs for: a host,
+// and for auth failures the identity of the credentials refused, as
+// described by identityFor, since sources entries with other credentials
+// for the same host may still succeed.
+type hostFailureKey struct {
+	host, identity string
+}
+
+// recordHostFailure remembers err for host, when requested with the
+// credentials identity describes, if it is definitive, so that the
+// remaining acquires from the host fail immediately rather than repeating
+// the same slow failure.
+func (m *Method) recordHostFailure(host, identity string, err error) {
+	kind := definitiveFailure(err)
+	if kind == "" {
+		return
+	}
+	err = fmt.Errorf("%s failure for %s earlier in this run: %v", kind, host, err)
+	key := hostFailureKey{host: host}
+	if kind == "auth" {
+		err = withKind(AuthError, err)
+		key.identity = identity
+	}
+	m.hostMu.Lock()
+	defer m.hostMu.Unlock()
+	if m.hostFailures == nil {
+		m.hostFailures = make(map[hostFailureKey]error)
+	}
+	m.hostFailures[key] = err
+}
+
+// hostFailure returns the definitive failure recorded for host, or for the
+// credentials identity describes there, if any.
+func (m *Method) hostFailure(host, identity string) error {
+	m.hostMu.Lock()
+	defer m.hostMu.Unlock()
+	if err, ok := m.hostFailures[hostFailureKey{host: host}]; ok {
+		return err
+	}
+	return m.hostFailures[hostFailureKey{host: host, identity: identity}]
+}
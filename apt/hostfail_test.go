@@ -0,0 +1,108 @@
+//  Copyright 2021 Google LLC
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package apt
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/oauth2"
+)
+
+// countingHTTPClient counts the requests it passes on to client.
+type countingHTTPClient struct {
+	client httpClient
+	count  int
+}
+
+func (c *countingHTTPClient) Do(req *http.Request) (*http.Response, error) {
+	c.count++
+	return c.client.Do(req)
+}
+
+// refusedTokenSource fails as a token endpoint refusing credentials does.
+type refusedTokenSource struct{}
+
+func (refusedTokenSource) Token() (*oauth2.Token, error) {
+	return nil, &oauth2.RetrieveError{Response: &http.Response{StatusCode: http.StatusBadRequest}, Body: []byte(`{"error": "invalid_grant"}`)}
+}
+
+func TestAptMethodHostFailureMemoized(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	var tests = []struct {
+		name           string
+		client         httpClient
+		expectedCalls  int
+		expectedReason string
+		expectedKind   ErrorKind
+	}{
+		// The default client doesn't trust the test server's certificate.
+		{"untrusted certificate", &http.Client{}, 1, "TLS failure for", UnknownError},
+		{"refused credentials", &http.Client{Transport: &oauth2.Transport{Source: refusedTokenSource{}, Base: server.Client().Transport}}, 1, "auth failure for", AuthError},
+		{"transient", unreachableHTTPClient{}, 3, "connection refused", UnknownError},
+	}
+
+	for _, tt := range tests {
+		var buffer bytes.Buffer
+		method := NewAptMethod(bufio.NewReader(&bytes.Buffer{}), &buffer)
+		client := &countingHTTPClient{client: tt.client}
+		method.client = client
+
+		var err error
+		for i := 0; i < 3; i++ {
+			msg := &Message{
+				code:        600,
+				description: "URI Acquire",
+				fields:      map[string][]string{"URI": {"ar+" + server.URL + "/pool/pkg.deb"}, "Filename": {filepath.Join(t.TempDir(), "pkg.deb")}},
+			}
+			err = method.handleAcquire(context.Background(), msg)
+		}
+		if client.count != tt.expectedCalls {
+			t.Errorf("%s: failed, expected %d requests, got %d", tt.name, tt.expectedCalls, client.count)
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.expectedReason) || KindOf(err) != tt.expectedKind {
+			t.Errorf("%s: failed, unexpected error for the last acquire: %v", tt.name, err)
+		}
+		if n := strings.Count(buffer.String(), "400 URI Failure"); n != 3 {
+			t.Errorf("%s: failed, expected 3 URI Failures, got %d", tt.name, n)
+		}
+	}
+}
+
+func TestHostFailureByIdentity(t *testing.T) {
+	method := NewAptMethod(bufio.NewReader(&bytes.Buffer{}), &bytes.Buffer{})
+	_, refused := refusedTokenSource{}.Token()
+	method.recordHostFailure("us-apt.pkg.dev", "Service-Account-JSON /etc/a.json", refused)
+	if err := method.hostFailure("us-apt.pkg.dev", "Service-Account-JSON /etc/a.json"); KindOf(err) != AuthError {
+		t.Errorf("failed, expected the refused credentials to fail fast, got %v", err)
+	}
+	if err := method.hostFailure("us-apt.pkg.dev", "Service-Account-JSON /etc/b.json"); err != nil {
+		t.Errorf("failed, expected other credentials for the host not to fail, got %v", err)
+	}
+
+	method.recordHostFailure("us-apt.pkg.dev", "Service-Account-JSON /etc/a.json", x509.UnknownAuthorityError{})
+	if err := method.hostFailure("us-apt.pkg.dev", "Service-Account-JSON /etc/b.json"); err == nil || !strings.Contains(err.Error(), "TLS failure") {
+		t.Errorf("failed, expected a TLS failure to fail every request to the host, got %v", err)
+	}
+}
@@ -0,0 +1,124 @@
+//  Copyright 2021 Google LLC
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package apt
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/compute/metadata"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+	"golang.org/x/oauth2/jws"
+)
+
+// proxyAudienceHost is replaced in Proxy-ID-Token-Audience by the host a
+// tunnel through the proxy is opened to.
+const proxyAudienceHost = "{host}"
+
+// newProxyTokenSource returns a source of ID tokens for the audience of an
+// IAP-protected egress proxy; see newIDTokenSource. An audience naming
+// {host} is bound to the host each tunnel is opened to, with the tokens of
+// each host cached apart.
+func (m *Method) newProxyTokenSource(ctx context.Context) (oauth2.TokenSource, error) {
+	template := m.config.proxyAudience
+	ts, err := m.newIDTokenSource(ctx, template)
+	if err != nil || !strings.Contains(template, proxyAudienceHost) {
+		return ts, err
+	}
+	return &audienceTokenSource{
+		newSource: func(audience string) (oauth2.TokenSource, error) {
+			return m.newIDTokenSource(ctx, audience)
+		},
+		audience: func(host string) string {
+			return strings.ReplaceAll(template, proxyAudienceHost, host)
+		},
+	}, nil
+}
+
+// newIDTokenSource returns a source of ID tokens for audience, minted with
+// the Service-Account-JSON key if one is configured, or by the metadata
+// server otherwise. Other credentials can't mint ID tokens for an arbitrary
+// audience.
+func (m *Method) newIDTokenSource(ctx context.Context, audience string) (oauth2.TokenSource, error) {
+	if m.config.serviceAccountJSON == "" {
+		return oauth2.ReuseTokenSource(nil, metadataIDTokenSource{audience: audience}), nil
+	}
+	b, err := os.ReadFile(m.config.serviceAccountJSON)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read credentials file: %v", err)
+	}
+	key := NewSecret(b)
+	defer key.Release()
+	typ, err := credentialsType(key.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	if typ != "service_account" {
+		return nil, fmt.Errorf("ID tokens need a service account key, not %s credentials", typ)
+	}
+	conf, err := google.JWTConfigFromJSON(key.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	conf.PrivateClaims = map[string]interface{}{"target_audience": audience}
+	conf.UseIDToken = true
+	return conf.TokenSource(ctx), nil
+}
+
+// metadataIDTokenSource fetches ID tokens for audience from the metadata
+// server, as the VM's default service account.
+type metadataIDTokenSource struct {
+	audience string
+}
+
+func (ts metadataIDTokenSource) Token() (*oauth2.Token, error) {
+	idToken, err := metadata.Get("instance/service-accounts/default/identity?format=full&audience=" + url.QueryEscape(ts.audience))
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch an ID token from the metadata server: %v", err)
+	}
+	claims, err := jws.Decode(idToken)
+	if err != nil {
+		return nil, fmt.Errorf("malformed ID token from the metadata server: %v", err)
+	}
+	return &oauth2.Token{AccessToken: idToken, Expiry: time.Unix(claims.Exp, 0)}, nil
+}
+
+// proxyConnectHeader returns a GetProxyConnectHeader function which adds
+// an ID token from ts to each CONNECT request as Proxy-Authorization, that
+// for the host the tunnel is opened to if ts binds them to hosts.
+func proxyConnectHeader(ts oauth2.TokenSource) func(context.Context, *url.URL, string) (http.Header, error) {
+	return func(_ context.Context, _ *url.URL, target string) (http.Header, error) {
+		source := ts
+		if hts, ok := ts.(hostTokenSource); ok {
+			host, _, err := net.SplitHostPort(target)
+			if err != nil {
+				host = target
+			}
+			source = hts.forHost(host)
+		}
+		tok, err := source.Token()
+		if err != nil {
+			return nil, fmt.Errorf("failed to obtain an ID token for the proxy: %v", err)
+		}
+		return http.Header{"Proxy-Authorization": {"Bearer " + tok.AccessToken}}, nil
+	}
+}
@@ -0,0 +1,124 @@
+//  Copyright 2021 Google LLC
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package apt
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// tunnelProxy is a CONNECT proxy which requires Proxy-Authorization for
+// tunnels to protected.
+func tunnelProxy(t *testing.T, protected, expected string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if r.Host == protected && r.Header.Get("Proxy-Authorization") != expected {
+			w.WriteHeader(http.StatusProxyAuthRequired)
+			return
+		}
+		upstream, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		conn, buffered, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		go func() {
+			io.Copy(upstream, buffered)
+			upstream.Close()
+		}()
+		io.Copy(conn, upstream)
+		conn.Close()
+	}))
+}
+
+func TestProxyIDToken(t *testing.T) {
+	payload := base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf(`{"aud": "proxy-client-id", "exp": %d}`, time.Now().Add(time.Hour).Unix())))
+	idToken := "eyJhbGciOiJSUzI1NiJ9." + payload + ".sig"
+	var audience string
+	tokens := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		parts := strings.Split(r.Form.Get("assertion"), ".")
+		if len(parts) == 3 {
+			claims, _ := base64.RawURLEncoding.DecodeString(parts[1])
+			audience = string(claims)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"id_token": %q}`, idToken)
+	}))
+	defer tokens.Close()
+	repo := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.Header.Get("Authorization"))
+	}))
+	defer repo.Close()
+	repoURL, _ := url.Parse(repo.URL)
+	proxy := tunnelProxy(t, repoURL.Host, "Bearer "+idToken)
+	defer proxy.Close()
+	proxyURL, _ := url.Parse(proxy.URL)
+
+	dir := t.TempDir()
+	key := filepath.Join(dir, "key.json")
+	writeServiceAccountKey(t, key, tokens.URL)
+	var buffer bytes.Buffer
+	method := NewAptMethod(bufio.NewReader(&bytes.Buffer{}), &buffer)
+	method.handleConfigure(&Message{code: 601, description: "Configuration", fields: map[string][]string{
+		"Config-Item": {
+			"Acquire::gar::Access-Token=ar-token",
+			"Acquire::gar::Service-Account-JSON=" + key,
+			"Acquire::gar::Proxy-ID-Token-Audience=proxy-client-id",
+			"Acquire::gar::Auth-Hosts::=127.0.0.1",
+		},
+	}})
+	transport := repo.Client().Transport.(*http.Transport).Clone()
+	transport.Proxy = http.ProxyURL(proxyURL)
+	ctx := context.WithValue(context.Background(), oauth2.HTTPClient, &http.Client{Transport: transport})
+	filename := filepath.Join(dir, "pkg.deb")
+	msg := &Message{
+		code:        600,
+		description: "URI Acquire",
+		fields:      map[string][]string{"URI": {"ar+" + repo.URL + "/pool/pkg.deb"}, "Filename": {filename}},
+	}
+	if err := method.handleAcquire(ctx, msg); err != nil || !strings.Contains(buffer.String(), "201 URI Done") {
+		t.Fatalf("failed, %v: %q", err, buffer.String())
+	}
+	if b, _ := os.ReadFile(filename); string(b) != "Bearer ar-token" {
+		t.Errorf("failed, expected the repository to get the Artifact Registry token, got %q", b)
+	}
+	if !strings.Contains(audience, `"target_audience":"proxy-client-id"`) {
+		t.Errorf("failed, expected an ID token for the proxy's audience, claims were %s", audience)
+	}
+}
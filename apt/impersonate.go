@@ -0,0 +1,100 @@
+//  Copyright 2021 Google LLC
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package apt
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// iamCredentialsEndpoint is the IAM Service Account Credentials API,
+// replaced in tests.
+var iamCredentialsEndpoint = "https://iamcredentials.googleapis.com/v1/"
+
+// impersonateTokenSource mints tokens for a target service account with the
+// IAM generateAccessToken call, authenticated by the base credentials. Each
+// delegate in the chain must be able to impersonate the next, and the last
+// the target.
+type impersonateTokenSource struct {
+	ctx       context.Context
+	base      oauth2.TokenSource
+	target    string
+	delegates []string
+}
+
+func newImpersonateTokenSource(ctx context.Context, base oauth2.TokenSource, target string, delegates []string) oauth2.TokenSource {
+	return oauth2.ReuseTokenSource(nil, impersonateTokenSource{ctx: ctx, base: base, target: target, delegates: delegates})
+}
+
+func (ts impersonateTokenSource) Token() (*oauth2.Token, error) {
+	request := struct {
+		Delegates []string `json:"delegates,omitempty"`
+		Scope     []string `json:"scope"`
+		Lifetime  string   `json:"lifetime"`
+	}{Scope: []string{cloudPlatformScope}, Lifetime: "3600s"}
+	for _, delegate := range ts.delegates {
+		request.Delegates = append(request.Delegates, "projects/-/serviceAccounts/"+delegate)
+	}
+	b, err := json.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("POST", iamCredentialsEndpoint+"projects/-/serviceAccounts/"+ts.target+":generateAccessToken", bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := oauth2.NewClient(ts.ctx, ts.base).Do(req.WithContext(ts.ctx))
+	if err != nil {
+		return nil, fmt.Errorf("failed to impersonate %s: %v", ts.target, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to impersonate %s: code %d", ts.target, resp.StatusCode)
+	}
+	var response struct {
+		AccessToken string `json:"accessToken"`
+		ExpireTime  string `json:"expireTime"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&response); err != nil {
+		return nil, fmt.Errorf("malformed response impersonating %s: %v", ts.target, err)
+	}
+	expiry, err := time.Parse(time.RFC3339, response.ExpireTime)
+	if err != nil || response.AccessToken == "" {
+		return nil, fmt.Errorf("malformed response impersonating %s", ts.target)
+	}
+	return &oauth2.Token{AccessToken: response.AccessToken, TokenType: "Bearer", Expiry: expiry}, nil
+}
+
+// parseDelegates parses a comma-separated chain of service accounts.
+func parseDelegates(value string) ([]string, bool) {
+	var delegates []string
+	for _, delegate := range strings.Split(value, ",") {
+		delegate = strings.TrimSpace(delegate)
+		if delegate == "" || strings.Contains(delegate, "/") {
+			return nil, false
+		}
+		delegates = append(delegates, delegate)
+	}
+	return delegates, true
+}
@@ -0,0 +1,101 @@
+//  Copyright 2021 Google LLC
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package apt
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"golang.org/x/oauth2"
+)
+
+func TestParseDelegates(t *testing.T) {
+	var tests = []struct {
+		value    string
+		expected []string
+		ok       bool
+	}{
+		{"a@p.iam.gserviceaccount.com", []string{"a@p.iam.gserviceaccount.com"}, true},
+		{"a@p.iam.gserviceaccount.com, b@p.iam.gserviceaccount.com", []string{"a@p.iam.gserviceaccount.com", "b@p.iam.gserviceaccount.com"}, true},
+		{"a@p.iam.gserviceaccount.com,,b@p.iam.gserviceaccount.com", nil, false},
+		{"projects/-/serviceAccounts/a@p.iam.gserviceaccount.com", nil, false},
+	}
+
+	for _, tt := range tests {
+		if res, ok := parseDelegates(tt.value); !reflect.DeepEqual(res, tt.expected) || ok != tt.ok {
+			t.Errorf("failed, parseDelegates(%q) = %v, %v", tt.value, res, ok)
+		}
+	}
+}
+
+func TestImpersonation(t *testing.T) {
+	var delegates []string
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v1/projects/-/serviceAccounts/target@p.iam.gserviceaccount.com:generateAccessToken" {
+			var request struct {
+				Delegates []string
+				Scope     []string
+			}
+			if r.Header.Get("Authorization") != "Bearer base-token" || json.NewDecoder(r.Body).Decode(&request) != nil {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			delegates = request.Delegates
+			fmt.Fprint(w, `{"accessToken": "impersonated-token", "expireTime": "2099-01-01T00:00:00Z"}`)
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer impersonated-token" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		fmt.Fprint(w, "package contents")
+	}))
+	defer server.Close()
+	defer func(endpoint string) { iamCredentialsEndpoint = endpoint }(iamCredentialsEndpoint)
+	iamCredentialsEndpoint = server.URL + "/v1/"
+
+	var buffer bytes.Buffer
+	method := NewAptMethod(bufio.NewReader(&bytes.Buffer{}), &buffer)
+	method.handleConfigure(&Message{code: 601, description: "Configuration", fields: map[string][]string{
+		"Config-Item": {
+			"Acquire::gar::Access-Token=base-token",
+			"Acquire::gar::Auth-Hosts::=127.0.0.1",
+			"Acquire::gar::Impersonate-Service-Account=target@p.iam.gserviceaccount.com",
+			"Acquire::gar::Impersonate-Delegates=a@p.iam.gserviceaccount.com,b@p.iam.gserviceaccount.com",
+		},
+	}})
+	ctx := context.WithValue(context.Background(), oauth2.HTTPClient, server.Client())
+	msg := &Message{
+		code:        600,
+		description: "URI Acquire",
+		fields:      map[string][]string{"URI": {"ar+" + server.URL + "/pool/pkg.deb"}, "Filename": {filepath.Join(t.TempDir(), "pkg.deb")}},
+	}
+	if err := method.handleAcquire(ctx, msg); err != nil || !strings.Contains(buffer.String(), "201 URI Done") {
+		t.Fatalf("failed, %v: %q", err, buffer.String())
+	}
+	expected := []string{"projects/-/serviceAccounts/a@p.iam.gserviceaccount.com", "projects/-/serviceAccounts/b@p.iam.gserviceaccount.com"}
+	if !reflect.DeepEqual(delegates, expected) {
+		t.Errorf("failed, expected delegates %v, got %v", expected, delegates)
+	}
+}
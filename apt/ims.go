@@ -0,0 +1,67 @@
+//  Copyright 2021 Google LLC
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package apt
+
+import (
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// dateLayouts are the layouts of dates accepted in Last-Modified besides
+// the HTTP date formats http.ParseTime accepts: with a numeric time zone,
+// as some versions of apt write them, and RFC 3339.
+var dateLayouts = []string{time.RFC1123Z, time.RFC3339}
+
+// httpDate returns the date given by a Last-Modified field of URI Acquire
+// in the format of HTTP dates, which servers compare If-Modified-Since in,
+// or "" if it isn't a date. Seconds since the epoch are accepted too.
+func httpDate(value string) string {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return ""
+	}
+	t, err := http.ParseTime(value)
+	for _, layout := range dateLayouts {
+		if err == nil {
+			break
+		}
+		t, err = time.Parse(layout, value)
+	}
+	if err != nil {
+		secs, parseErr := strconv.ParseInt(value, 10, 64)
+		if parseErr != nil {
+			return ""
+		}
+		t = time.Unix(secs, 0)
+	}
+	return t.UTC().Format(http.TimeFormat)
+}
+
+// setLastModified sets the modification time of filename to lastModified,
+// the Last-Modified of the response it was downloaded from, as apt's http
+// method does. apt sends a file's modification time as Last-Modified when
+// it next acquires it, so that If-Modified-Since is then the server's own
+// date. For a download left incomplete, it is the If-Range validator which
+// partialDownload resumes it with.
+func setLastModified(filename, lastModified string) {
+	t, err := http.ParseTime(lastModified)
+	if err != nil {
+		return
+	}
+	os.Chtimes(filename, time.Now(), t)
+}
@@ -0,0 +1,95 @@
+//  Copyright 2021 Google LLC
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package apt
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestHTTPDate(t *testing.T) {
+	var tests = []struct {
+		value, expected string
+	}{
+		{"Mon, 01 Mar 2021 03:05:06 GMT", "Mon, 01 Mar 2021 03:05:06 GMT"},
+		{"Mon, 01 Mar 2021 04:05:06 +0100", "Mon, 01 Mar 2021 03:05:06 GMT"},
+		{"Monday, 01-Mar-21 03:05:06 GMT", "Mon, 01 Mar 2021 03:05:06 GMT"},
+		{"2021-03-01T03:05:06Z", "Mon, 01 Mar 2021 03:05:06 GMT"},
+		{"1614567906", "Mon, 01 Mar 2021 03:05:06 GMT"},
+		{" Mon, 01 Mar 2021 03:05:06 GMT ", "Mon, 01 Mar 2021 03:05:06 GMT"},
+		{"whenever", ""},
+		{"", ""},
+	}
+
+	for _, tt := range tests {
+		if res := httpDate(tt.value); res != tt.expected {
+			t.Errorf("failed, httpDate(%q) = %q, expected %q", tt.value, res, tt.expected)
+		}
+	}
+}
+
+func TestAptMethodIfModifiedSince(t *testing.T) {
+	content := "Package: hello\n"
+	modtime := time.Date(2021, 3, 1, 3, 5, 6, 0, time.UTC)
+	var tests = []struct {
+		name, lastModified string
+		expectedIMSHit     bool
+	}{
+		{"none", "", false},
+		{"http date", "Mon, 01 Mar 2021 03:05:06 GMT", true},
+		{"numeric zone", "Mon, 01 Mar 2021 04:05:06 +0100", true},
+		{"older", "Sun, 28 Feb 2021 03:05:06 GMT", false},
+		{"not a date", "whenever", false},
+	}
+
+	for _, tt := range tests {
+		filename := filepath.Join(t.TempDir(), "Packages.xz")
+		var buffer bytes.Buffer
+		method := NewAptMethod(bufio.NewReader(&bytes.Buffer{}), &buffer)
+		method.client = &serveContentClient{content: content, modtime: modtime}
+		fields := map[string][]string{"URI": {"ar+https://fake.uri/dists/repo/main/binary-amd64/Packages.xz"}, "Filename": {filename}}
+		if tt.lastModified != "" {
+			fields["Last-Modified"] = []string{tt.lastModified}
+		}
+		if err := method.handleAcquire(context.Background(), &Message{code: 600, description: "URI Acquire", fields: fields}); err != nil {
+			t.Fatalf("%s: failed, %v", tt.name, err)
+		}
+
+		reader := NewAptMessageReader(bufio.NewReader(&buffer))
+		var done *Message
+		for {
+			msg, err := reader.ReadMessage(context.Background())
+			if err != nil {
+				break
+			}
+			done = msg
+		}
+		if done == nil || done.code != 201 || (done.Get("IMS-Hit") == "true") != tt.expectedIMSHit || done.Get("Last-Modified") == "" {
+			t.Errorf("%s: failed, unexpected URI Done %v", tt.name, done)
+			continue
+		}
+		if tt.expectedIMSHit {
+			continue
+		}
+		if info, err := os.Stat(filename); err != nil || !info.ModTime().Equal(modtime) {
+			t.Errorf("%s: failed, expected the file to be stamped with Last-Modified %v, got %v, %v", tt.name, modtime, info, err)
+		}
+	}
+}
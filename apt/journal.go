@@ -0,0 +1,190 @@
+//  Copyright 2021 Google LLC
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package apt
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"time"
+)
+
+// JournalEntry records an artifact delivered to apt, as a line of JSON in
+// the Journal-File.
+type JournalEntry struct {
+	Time   time.Time `json:"time"`
+	URI    string    `json:"uri"`
+	SHA256 string    `json:"sha256"`
+	Size   int64     `json:"size"`
+	// Identity describes the credentials the artifact was fetched with.
+	Identity string `json:"identity"`
+	// Prev is the SHA-256 of the previous line of the journal, or empty
+	// for the first. Chaining the lines makes editing, inserting or
+	// removing lines evident, except at the end of the journal.
+	Prev string `json:"prev"`
+}
+
+// maxJournalLine bounds the length of a line of the journal.
+const maxJournalLine = 64 << 10
+
+// journalDelivery appends an entry for the file delivered for uri to the
+// Journal-File, if there is one. The SHA-256 computed while downloading is
+// used if there is one; otherwise the file is read again. Failing to is a
+// warning: the acquire has already succeeded.
+func (m *Method) journalDelivery(uri, filename, identity string, res downloadResult) {
+	if m.config.journalFile == "" {
+		return
+	}
+	err := func() error {
+		if res.sha256Hash == "" {
+			f, err := os.Open(filename)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			hash := sha256.New()
+			if res.size, err = io.Copy(hash, f); err != nil {
+				return err
+			}
+			res.sha256Hash = fmt.Sprintf("%x", hash.Sum(nil))
+		}
+		return appendJournal(m.config.journalFile, JournalEntry{
+			Time:     m.timeSource().Now().UTC(),
+			URI:      uri,
+			SHA256:   res.sha256Hash,
+			Size:     res.size,
+			Identity: identity,
+		})
+	}()
+	if err != nil {
+		m.writer.Warning(fmt.Sprintf("failed to record %s in the journal %s: %v", uri, m.config.journalFile, err))
+	}
+}
+
+// identityFor describes the credentials a request to u is sent with, given
+// the options of its sources entry, if any.
+func (m *Method) identityFor(sc *sourceConfig, u *url.URL) string {
+	allowed := m.config.authHostAllowed(u.Hostname())
+	switch {
+	case sc != nil && sc.serviceAccountJSON != "":
+		if allowed {
+			return sourceServiceAccountJSON + " " + sc.serviceAccountJSON
+		}
+	case sc != nil && sc.serviceAccountEmail != "":
+		if allowed {
+			return sourceServiceAccountEmail + " " + sc.serviceAccountEmail
+		}
+	default:
+		m.clientMu.Lock()
+		defer m.clientMu.Unlock()
+		if entry := matchAuthConf(m.authConf, u); entry != nil {
+			return "auth.conf login " + entry.login
+		}
+		if allowed && !m.anonymous && m.identity != "" {
+			return m.identity
+		}
+	}
+	return "anonymous"
+}
+
+// appendJournal appends entry to the journal at path, chained to its last
+// line. The file is locked meanwhile, as apt runs several methods at once.
+func appendJournal(path string, entry JournalEntry) error {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := lockFile(f); err != nil {
+		return err
+	}
+	defer unlockFile(f)
+
+	last, err := lastLine(f)
+	if err != nil {
+		return err
+	}
+	if last != nil {
+		entry.Prev = fmt.Sprintf("%x", sha256.Sum256(last))
+	}
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(b, '\n'))
+	return err
+}
+
+// lastLine returns the last line of f, without its newline, or nil if f is
+// empty.
+func lastLine(f *os.File) ([]byte, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := fi.Size()
+	if size == 0 {
+		return nil, nil
+	}
+	n := size
+	if n > maxJournalLine+1 {
+		n = maxJournalLine + 1
+	}
+	b := make([]byte, n)
+	if _, err := f.ReadAt(b, size-n); err != nil {
+		return nil, err
+	}
+	if b[len(b)-1] != '\n' {
+		return nil, fmt.Errorf("journal doesn't end with a complete line")
+	}
+	b = b[:len(b)-1]
+	if i := bytes.LastIndexByte(b, '\n'); i >= 0 {
+		return b[i+1:], nil
+	} else if n < size {
+		return nil, fmt.Errorf("journal has a line longer than %d bytes", maxJournalLine)
+	}
+	return b, nil
+}
+
+// VerifyJournal checks that each line of a journal written with
+// Journal-File is an entry chained to the line before, and returns how many
+// entries it holds. Lines removed from the end, or a changed last line, can't
+// be detected.
+func VerifyJournal(r io.Reader) (int, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 4096), maxJournalLine)
+	prev := ""
+	entries := 0
+	for scanner.Scan() {
+		entries++
+		var entry JournalEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return entries - 1, fmt.Errorf("line %d: %v", entries, err)
+		}
+		if entry.Prev != prev {
+			return entries - 1, fmt.Errorf("line %d: doesn't follow the line before", entries)
+		}
+		prev = fmt.Sprintf("%x", sha256.Sum256(scanner.Bytes()))
+	}
+	if err := scanner.Err(); err != nil {
+		return entries, fmt.Errorf("line %d: %v", entries+1, err)
+	}
+	return entries, nil
+}
@@ -0,0 +1,116 @@
+//  Copyright 2021 Google LLC
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package apt
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/oauth2"
+)
+
+func TestAptMethodJournal(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "contents of %s", r.URL.Path)
+	}))
+	defer server.Close()
+	dir := t.TempDir()
+	journal := filepath.Join(dir, "journal.jsonl")
+
+	var buffer bytes.Buffer
+	method := NewAptMethod(bufio.NewReader(&bytes.Buffer{}), &buffer)
+	method.clock = newFakeClock()
+	method.handleConfigure(&Message{code: 601, description: "Configuration", fields: map[string][]string{
+		"Config-Item": {"Acquire::gar::Access-Token=token", "Acquire::gar::Auth-Hosts::=127.0.0.1", "Acquire::gar::Journal-File=" + journal},
+	}})
+	ctx := context.WithValue(context.Background(), oauth2.HTTPClient, server.Client())
+	paths := []string{"/pool/a.deb", "/pool/b.deb", "/pool/c.deb"}
+	for _, path := range paths {
+		if err := method.handleAcquire(ctx, &Message{
+			code:        600,
+			description: "URI Acquire",
+			fields:      map[string][]string{"URI": {"ar+" + server.URL + path}, "Filename": {filepath.Join(dir, filepath.Base(path))}},
+		}); err != nil {
+			t.Fatalf("failed, %v: %q", err, buffer.String())
+		}
+	}
+
+	b, err := os.ReadFile(journal)
+	if err != nil {
+		t.Fatalf("failed, %v", err)
+	}
+	if n, err := VerifyJournal(bytes.NewReader(b)); n != len(paths) || err != nil {
+		t.Errorf("failed, expected %d intact entries, got %d, %v", len(paths), n, err)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(b), "\n"), "\n")
+	for i, path := range paths {
+		var entry JournalEntry
+		if err := json.Unmarshal([]byte(lines[i]), &entry); err != nil {
+			t.Fatalf("failed, %v", err)
+		}
+		contents := "contents of " + path
+		expected := JournalEntry{
+			Time:     newFakeClock().Now(),
+			URI:      "ar+" + server.URL + path,
+			SHA256:   fmt.Sprintf("%x", sha256.Sum256([]byte(contents))),
+			Size:     int64(len(contents)),
+			Identity: "Access-Token",
+		}
+		if !entry.Time.Equal(expected.Time) || entry.URI != expected.URI || entry.SHA256 != expected.SHA256 || entry.Size != expected.Size || entry.Identity != expected.Identity {
+			t.Errorf("failed, expected %+v, got %+v", expected, entry)
+		}
+	}
+}
+
+func TestVerifyJournal(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal.jsonl")
+	for _, uri := range []string{"ar+https://us-apt.pkg.dev/a", "ar+https://us-apt.pkg.dev/b", "ar+https://us-apt.pkg.dev/c"} {
+		if err := appendJournal(path, JournalEntry{URI: uri, Identity: "anonymous"}); err != nil {
+			t.Fatalf("failed, %v", err)
+		}
+	}
+	b, _ := os.ReadFile(path)
+	lines := strings.SplitAfter(string(b), "\n")
+
+	var tests = []struct {
+		name, journal string
+		entries       int
+		intact        bool
+	}{
+		{"intact", string(b), 3, true},
+		{"empty", "", 0, true},
+		{"edited", strings.Replace(string(b), "/a", "/x", 1), 1, false},
+		{"removed", lines[0] + lines[2], 1, false},
+		{"reordered", lines[1] + lines[0] + lines[2], 0, false},
+		{"truncated", lines[0] + lines[1], 2, true},
+		{"not JSON", lines[0] + "garbage\n", 1, false},
+	}
+	for _, tt := range tests {
+		n, err := VerifyJournal(strings.NewReader(tt.journal))
+		if n != tt.entries || (err == nil) != tt.intact {
+			t.Errorf("%s: failed, expected %d entries and intact %v, got %d, %v", tt.name, tt.entries, tt.intact, n, err)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+//  Copyright 2021 Google LLC
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package apt
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+)
+
+// maximumSizeError is returned when a file is larger than the Maximum-Size
+// apt gave for it.
+type maximumSizeError struct {
+	size, max int64
+}
+
+func (e *maximumSizeError) Error() string {
+	if e.size < 0 {
+		return fmt.Sprintf("file is larger than the maximum of %d bytes", e.max)
+	}
+	return fmt.Sprintf("file is larger than expected (%d > %d bytes)", e.size, e.max)
+}
+
+// checkMaximumSize checks size, the length of the file resp holds or "" if
+// it isn't known, against max, if positive. A length which is that of a
+// content coding, rather than of the file, can't be checked up front.
+func checkMaximumSize(resp *http.Response, size string, max int64) error {
+	if max <= 0 || resp.Header.Get("Content-Encoding") != "" || isGzipVariant(resp) {
+		return nil
+	}
+	if n, err := strconv.ParseInt(size, 10, 64); err == nil && n > max {
+		return &maximumSizeError{size: n, max: max}
+	}
+	return nil
+}
+
+// limitedBody fails reads once the file would be more than max bytes long,
+// n of which have been read, so that a server can't fill the disk with a
+// file apt bounds the size of.
+type limitedBody struct {
+	io.ReadCloser
+	n, max int64
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n += int64(n)
+	if b.n > b.max {
+		return n - int(b.n-b.max), &maximumSizeError{size: -1, max: b.max}
+	}
+	return n, err
+}
@@ -0,0 +1,79 @@
+//  Copyright 2021 Google LLC
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package apt
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestAptMethodMaximumSize(t *testing.T) {
+	body := strings.Repeat("0123456789", 20)
+	var tests = []struct {
+		name          string
+		header        map[string][]string
+		maximumSize   string
+		expectedCodes []int
+	}{
+		{"no maximum", map[string][]string{}, "", []int{200, 201}},
+		{"within", map[string][]string{"Content-Length": {"200"}}, "200", []int{200, 201}},
+		{"content length", map[string][]string{"Content-Length": {"200"}}, "100", []int{400}},
+		{"unknown length", map[string][]string{}, "100", []int{200, 400}},
+		{"coded length", map[string][]string{"Content-Length": {"200"}, "Content-Encoding": {"identity"}}, "100", []int{200, 400}},
+	}
+
+	for _, tt := range tests {
+		filename := filepath.Join(t.TempDir(), "InRelease")
+		var buffer bytes.Buffer
+		method := NewAptMethod(bufio.NewReader(&bytes.Buffer{}), &buffer)
+		method.client = fakeHTTPClient{header: tt.header, body: body}
+		fields := map[string][]string{"URI": {"ar+https://fake.uri/dists/repo/InRelease"}, "Filename": {filename}}
+		if tt.maximumSize != "" {
+			fields["Maximum-Size"] = []string{tt.maximumSize}
+		}
+		method.handleAcquire(context.Background(), &Message{code: 600, description: "URI Acquire", fields: fields})
+
+		var codes []int
+		var last *Message
+		reader := NewAptMessageReader(bufio.NewReader(&buffer))
+		for {
+			msg, err := reader.ReadMessage(context.Background())
+			if err != nil {
+				break
+			}
+			codes = append(codes, msg.code)
+			last = msg
+		}
+		if !reflect.DeepEqual(codes, tt.expectedCodes) {
+			t.Errorf("%s: failed, expected %v, got %v", tt.name, tt.expectedCodes, codes)
+			continue
+		}
+		if last.code != 400 {
+			continue
+		}
+		if last.Get("FailReason") != "MaximumSizeExceeded" || !strings.Contains(last.Get("Message"), "larger than") {
+			t.Errorf("%s: failed, unexpected URI Failure %v", tt.name, last)
+		}
+		if _, err := os.Stat(filename); !os.IsNotExist(err) {
+			t.Errorf("%s: failed, expected no file to be left, got %v", tt.name, err)
+		}
+	}
+}
@@ -16,6 +16,7 @@ package apt
 
 import (
 	"fmt"
+	"net/textproto"
 	"sort"
 	"strings"
 )
@@ -27,14 +28,85 @@ type Message struct {
 	fields      map[string][]string
 }
 
-// Get returns the first AptMessage Field for `key`, or "".
+// aptFieldNames maps the lowercased names of the fields apt sends and
+// receives whose spelling differs from the usual header capitalization to
+// the spelling apt uses.
+var aptFieldNames = func() map[string]string {
+	names := make(map[string]string)
+	for _, name := range []string{
+		"URI", "New-URI", "Alt-URIs", "Target-Base-URI", "Target-Repo-URI",
+		"Send-URI-Encoded", "FailReason", "IMS-Hit",
+		"MD5-Hash", "MD5Sum-Hash", "SHA1-Hash", "SHA256-Hash", "SHA512-Hash",
+		"Expected-MD5Sum", "Expected-SHA1", "Expected-SHA256", "Expected-SHA512",
+	} {
+		names[strings.ToLower(name)] = name
+	}
+	return names
+}()
+
+// canonicalFieldName returns the name a field is stored under in messages
+// read from apt, which treats field names as case-insensitive: apt's own
+// spelling for the fields it knows, and the usual header capitalization for
+// others, so "config-item" becomes "Config-Item".
+func canonicalFieldName(name string) string {
+	if canonical, ok := aptFieldNames[strings.ToLower(name)]; ok {
+		return canonical
+	}
+	return textproto.CanonicalMIMEHeaderKey(name)
+}
+
+// Get returns the first AptMessage Field for `key`, or "". As with GetAll,
+// `key` is matched without regard to case.
 func (m *Message) Get(key string) string {
+	if vals := m.GetAll(key); len(vals) > 0 {
+		return vals[0]
+	}
+	return ""
+}
+
+// GetAll returns all the values of the field `key`, in the order they were
+// sent, or nil. Fields read from apt are matched without regard to case, as
+// the reader stores them under their canonical names.
+func (m *Message) GetAll(key string) []string {
 	if vals, ok := m.fields[key]; ok {
-		if len(vals) > 0 {
-			return vals[0]
+		return vals
+	}
+	return m.fields[canonicalFieldName(key)]
+}
+
+// hasField reports whether m has a field named key, without regard to case.
+func (m *Message) hasField(key string) bool {
+	for name := range m.fields {
+		if strings.EqualFold(name, key) {
+			return true
 		}
 	}
-	return ""
+	return false
+}
+
+// lineBreaks replaces the line breaks in field values; see safe.
+var lineBreaks = strings.NewReplacer("\r\n", " ", "\n", " ", "\r", " ")
+
+// safe returns a copy of m which can be written to apt without corrupting
+// the stream, or an error if m can't be. A line break would end a field
+// early, the rest being read as another field or, after a blank line, as
+// another message, so line breaks in values become spaces, as apt's own
+// methods do for error messages. Colons are fine in values, which end at
+// the line break, but not in keys, which end at the first colon.
+func (m *Message) safe() (Message, error) {
+	if strings.ContainsAny(m.description, "\r\n") {
+		return Message{}, fmt.Errorf("invalid message description %q", m.description)
+	}
+	fields := make(map[string][]string, len(m.fields))
+	for key, values := range m.fields {
+		if key == "" || strings.ContainsAny(key, ": \t\r\n") {
+			return Message{}, fmt.Errorf("invalid field name %q in %d %s message", key, m.code, m.description)
+		}
+		for _, value := range values {
+			fields[key] = append(fields[key], lineBreaks.Replace(value))
+		}
+	}
+	return Message{code: m.code, description: m.description, fields: fields}, nil
 }
 
 func (m *Message) String() string {
@@ -60,7 +132,11 @@ func (m *Message) String() string {
 
 func new100Message() Message {
 	fields := make(map[string][]string)
+	fields["Pipeline"] = []string{"true"}
 	fields["Send-Config"] = []string{"true"}
+	// Have apt percent-encode the URIs it sends, so that file names with
+	// spaces, "+" or "%" in them are unambiguous; see encodeURI.
+	fields["Send-URI-Encoded"] = []string{"true"}
 	fields["Version"] = []string{"1.0"}
 	return Message{code: 100, description: "Capabilities", fields: fields}
 }
@@ -71,10 +147,32 @@ func new101Message(msg string) Message {
 	return Message{code: 101, description: "Log", fields: fields}
 }
 
+func new102Message(msg string) Message {
+	fields := make(map[string][]string)
+	fields["Message"] = []string{msg}
+	return Message{code: 102, description: "Status", fields: fields}
+}
+
+func new103Message(uri, newURI string) Message {
+	fields := make(map[string][]string)
+	fields["URI"] = []string{uri}
+	fields["New-URI"] = []string{newURI}
+	return Message{code: 103, description: "Redirect", fields: fields}
+}
+
+func new104Message(msg string) Message {
+	fields := make(map[string][]string)
+	fields["Message"] = []string{msg}
+	return Message{code: 104, description: "Warning", fields: fields}
+}
+
 func new200Message(uri, size, lastModified string) Message {
 	fields := make(map[string][]string)
 	fields["URI"] = []string{uri}
-	fields["Size"] = []string{size}
+	// The size is unknown for chunked responses.
+	if size != "" {
+		fields["Size"] = []string{size}
+	}
 	if lastModified != "" {
 		fields["Last-Modified"] = []string{lastModified}
 	}
@@ -85,7 +183,9 @@ func new200Message(uri, size, lastModified string) Message {
 func new201Message(uri, size, lastModified, md5Hash, filename string, imsHit bool) Message {
 	fields := make(map[string][]string)
 	fields["URI"] = []string{uri}
-	fields["Last-Modified"] = []string{lastModified}
+	if lastModified != "" {
+		fields["Last-Modified"] = []string{lastModified}
+	}
 	fields["Filename"] = []string{filename}
 	if imsHit {
 		fields["IMS-Hit"] = []string{"true"}
@@ -96,10 +196,28 @@ func new201Message(uri, size, lastModified, md5Hash, filename string, imsHit boo
 	return Message{code: 201, description: "URI Done", fields: fields}
 }
 
-func new400Message(uri, msg string) Message {
+// setHashFields adds the digests of res to a 201 URI Done message, under
+// the names apt's http method uses, so that apt needn't hash the file again.
+func setHashFields(m Message, res downloadResult) {
+	for name, sum := range map[string]string{
+		"MD5Sum-Hash": res.md5Hash,
+		"SHA1-Hash":   res.sha1Hash,
+		"SHA256-Hash": res.sha256Hash,
+		"SHA512-Hash": res.sha512Hash,
+	} {
+		if sum != "" {
+			m.fields[name] = []string{sum}
+		}
+	}
+}
+
+func new400Message(uri, msg, failReason string) Message {
 	fields := make(map[string][]string)
 	fields["URI"] = []string{uri}
 	fields["Message"] = []string{msg}
+	if failReason != "" {
+		fields["FailReason"] = []string{failReason}
+	}
 	return Message{code: 400, description: "URI Failure", fields: fields}
 }
 
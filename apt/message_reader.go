@@ -19,24 +19,103 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
 	"strconv"
 	"strings"
 )
 
 var errEmptyMessage = errors.New("empty message")
 
+// ReaderLimits bounds the messages a MessageReader accepts, so that a
+// misbehaving apt can't make the method buffer without bound. A limit of
+// zero means no limit.
+type ReaderLimits struct {
+	// MaxLineLength is the most bytes in a line, excluding its line break.
+	MaxLineLength int
+	// MaxFields is the most distinct field names in a message.
+	MaxFields int
+	// MaxValues is the most values of any one field in a message.
+	MaxValues int
+	// MaxMessageBytes is the most bytes in a message, including its line
+	// breaks, so that lines within the other limits can't add up without
+	// bound.
+	MaxMessageBytes int
+}
+
+// DefaultReaderLimits are the limits of a new MessageReader. They leave
+// ample room for a 601 Configuration, which carries apt's whole config as
+// Config-Item values, some of them scripts: a typical one has a few thousand
+// items in well under 1MiB.
+var DefaultReaderLimits = ReaderLimits{
+	MaxLineLength:   64 << 10,
+	MaxFields:       256,
+	MaxValues:       8192,
+	MaxMessageBytes: 1 << 20,
+}
+
+// LimitError is returned by ReadMessage for a message exceeding one of the
+// reader's limits. It is a ProtocolError.
+type LimitError struct {
+	// Limit is the limit exceeded: "line length", "message size", "fields"
+	// or "values".
+	Limit string
+	// Max is its value.
+	Max int
+	// Field is the field with too many values, for the "values" limit.
+	Field string
+}
+
+func (e *LimitError) Error() string {
+	switch e.Limit {
+	case "line length":
+		return fmt.Sprintf("message line longer than %d bytes", e.Max)
+	case "message size":
+		return fmt.Sprintf("message longer than %d bytes", e.Max)
+	case "values":
+		return fmt.Sprintf("message field %q has more than %d values", e.Field, e.Max)
+	default:
+		return fmt.Sprintf("message has more than %d %s", e.Max, e.Limit)
+	}
+}
+
+// MessageHook is called with each message read or written, e.g. to record
+// transcripts or collect metrics. It must not modify the message.
+type MessageHook func(msg *Message)
+
 // MessageReader supports reading Apt messages.
 type MessageReader struct {
 	reader  *bufio.Reader
 	message *Message
+	hooks   []MessageHook
+	limits  ReaderLimits
+	// size is the number of bytes read of the current message.
+	size int
 }
 
-// NewAptMessageReader returns an AptMessageReader.
+// NewAptMessageReader returns an AptMessageReader with the
+// DefaultReaderLimits.
 func NewAptMessageReader(r *bufio.Reader) *MessageReader {
-	return &MessageReader{reader: r}
+	return &MessageReader{reader: r, limits: DefaultReaderLimits}
+}
+
+// SetLimits replaces the reader's limits.
+func (r *MessageReader) SetLimits(limits ReaderLimits) {
+	r.limits = limits
+}
+
+// AddHook adds a hook which is called with every complete message read.
+func (r *MessageReader) AddHook(hook MessageHook) {
+	r.hooks = append(r.hooks, hook)
+}
+
+// pending reports whether more input has already arrived.
+func (r *MessageReader) pending() bool {
+	return r.reader.Buffered() > 0
 }
 
 // ReadMessage reads lines from `reader` until a complete message is received.
+// A message exceeding the reader's limits is abandoned with a LimitError, and
+// the rest of its input is left unread.
 func (r *MessageReader) ReadMessage(ctx context.Context) (*Message, error) {
 	for {
 		select {
@@ -44,7 +123,26 @@ func (r *MessageReader) ReadMessage(ctx context.Context) (*Message, error) {
 			return nil, ctx.Err()
 		default:
 		}
-		line, err := r.reader.ReadString('\n')
+		line, err := r.readLine()
+		if err == nil && (r.message != nil || strings.TrimSpace(line) != "") {
+			r.size += len(line)
+			if max := r.limits.MaxMessageBytes; max > 0 && r.size > max {
+				err = &LimitError{Limit: "message size", Max: max}
+			}
+		}
+		var limitErr *LimitError
+		if errors.As(err, &limitErr) {
+			r.message = nil
+			r.size = 0
+			return nil, withKind(ProtocolError, err)
+		}
+		if err == io.EOF && (r.message != nil || strings.TrimSpace(line) != "") {
+			// apt closing its end between messages is how it says it is
+			// done; closing it within one is not.
+			r.message = nil
+			r.size = 0
+			return nil, withKind(ProtocolError, fmt.Errorf("input ended within a message: %w", io.ErrUnexpectedEOF))
+		}
 		if err != nil {
 			return nil, err
 		}
@@ -58,22 +156,46 @@ func (r *MessageReader) ReadMessage(ctx context.Context) (*Message, error) {
 			// Message is done, return and reset.
 			msg := r.message
 			r.message = nil
+			r.size = 0
+			for _, hook := range r.hooks {
+				hook(msg)
+			}
 			return msg, nil
 		}
 
 		if r.message == nil {
 			r.message = &Message{}
 			if err := r.parseHeader(line); err != nil {
-				return nil, err
+				return nil, withKind(ProtocolError, err)
 			}
 		} else {
 			if err := r.parseField(line); err != nil {
-				return nil, err
+				return nil, withKind(ProtocolError, err)
 			}
 		}
 	}
 }
 
+// readLine reads up to and including the next line break, failing with a
+// LimitError rather than buffering a line longer than the limit.
+func (r *MessageReader) readLine() (string, error) {
+	var line []byte
+	for {
+		chunk, err := r.reader.ReadSlice('\n')
+		length := len(line) + len(chunk)
+		if err == nil {
+			length--
+		}
+		if max := r.limits.MaxLineLength; max > 0 && length > max {
+			return "", &LimitError{Limit: "line length", Max: max}
+		}
+		line = append(line, chunk...)
+		if err != bufio.ErrBufferFull {
+			return string(line), err
+		}
+	}
+}
+
 func (r *MessageReader) parseHeader(line string) error {
 	if line == "" {
 		return errors.New("empty message header")
@@ -108,13 +230,19 @@ func (r *MessageReader) parseField(line string) error {
 	if r.message.fields == nil {
 		r.message.fields = make(map[string][]string)
 	}
-	key := strings.TrimSpace(parts[0])
+	key := canonicalFieldName(strings.TrimSpace(parts[0]))
 	value := strings.TrimSpace(parts[1])
 	if key == "" || value == "" {
 		return fmt.Errorf("malformed field %q, empty key or value", line)
 	}
 
-	fieldlist := r.message.fields[key]
+	fieldlist, ok := r.message.fields[key]
+	if max := r.limits.MaxFields; max > 0 && !ok && len(r.message.fields) >= max {
+		return &LimitError{Limit: "fields", Max: max}
+	}
+	if max := r.limits.MaxValues; max > 0 && len(fieldlist) >= max {
+		return &LimitError{Limit: "values", Max: max, Field: key}
+	}
 	fieldlist = append(fieldlist, value)
 	r.message.fields[key] = fieldlist
 	return nil
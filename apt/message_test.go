@@ -18,7 +18,13 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"errors"
+	"io"
+	"reflect"
+	"runtime"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestAptMessageGet(t *testing.T) {
@@ -50,6 +56,39 @@ func TestAptMessageGet(t *testing.T) {
 	}
 }
 
+func TestAptMessageGetCaseInsensitive(t *testing.T) {
+	input := "601 Configuration\nconfig-item: a=1\nCONFIG-ITEM: b=2\nConfig-Item: c=3\nuri: ar+https://fake.uri/file\nsha256-hash: abc\n\n"
+	reader := NewAptMessageReader(bufio.NewReader(strings.NewReader(input)))
+	msg, err := reader.ReadMessage(context.Background())
+	if err != nil {
+		t.Fatalf("failed: %v", err)
+	}
+	expected := map[string][]string{
+		"Config-Item": {"a=1", "b=2", "c=3"},
+		"URI":         {"ar+https://fake.uri/file"},
+		"SHA256-Hash": {"abc"},
+	}
+	if !reflect.DeepEqual(msg.fields, expected) {
+		t.Errorf("failed, expected fields: %q got: %q", expected, msg.fields)
+	}
+	for _, key := range []string{"Config-Item", "config-item", "CONFIG-ITEM", "cOnFiG-iTeM"} {
+		if res := msg.Get(key); res != "a=1" {
+			t.Errorf("Get(%q), expected: %q got: %q", key, "a=1", res)
+		}
+		if res := msg.GetAll(key); !reflect.DeepEqual(res, expected["Config-Item"]) {
+			t.Errorf("GetAll(%q), expected: %q got: %q", key, expected["Config-Item"], res)
+		}
+	}
+	for _, key := range []string{"URI", "Uri", "uri"} {
+		if res := msg.Get(key); res != "ar+https://fake.uri/file" {
+			t.Errorf("Get(%q), expected: %q got: %q", key, "ar+https://fake.uri/file", res)
+		}
+	}
+	if res := msg.GetAll("Missing"); res != nil {
+		t.Errorf("GetAll(%q), expected nil got: %q", "Missing", res)
+	}
+}
+
 func TestAptWriterWriteMessage(t *testing.T) {
 	var tests = []struct {
 		message  Message
@@ -119,10 +158,77 @@ func TestAptWriterWriteMessage(t *testing.T) {
 	}
 }
 
+func TestAptWriterRoundTrip(t *testing.T) {
+	var tests = []struct {
+		fields, expected map[string][]string
+	}{
+		{
+			map[string][]string{"Message": {"line one\nline two"}},
+			map[string][]string{"Message": {"line one line two"}},
+		},
+		{
+			map[string][]string{"Message": {"crlf\r\n\r\n200 URI Done\r\nFilename: /etc/passwd"}},
+			map[string][]string{"Message": {"crlf  200 URI Done Filename: /etc/passwd"}},
+		},
+		{
+			map[string][]string{"Message": {"carriage\rreturn"}},
+			map[string][]string{"Message": {"carriage return"}},
+		},
+		{
+			map[string][]string{"URI": {"ar+https://us-apt.pkg.dev/projects/p:x/Release"}},
+			map[string][]string{"URI": {"ar+https://us-apt.pkg.dev/projects/p:x/Release"}},
+		},
+		{
+			map[string][]string{"Message": {"key: value: more"}, "Other": {"\nleading"}},
+			map[string][]string{"Message": {"key: value: more"}, "Other": {"leading"}},
+		},
+	}
+
+	for _, tt := range tests {
+		var buffer bytes.Buffer
+		writer := NewAptMessageWriter(&buffer)
+		if err := writer.WriteMessage(Message{code: 400, description: "URI Failure", fields: tt.fields}); err != nil {
+			t.Fatalf("WriteMessage(%q) failed: %v", tt.fields, err)
+		}
+		reader := NewAptMessageReader(bufio.NewReader(&buffer))
+		res, err := reader.ReadMessage(context.Background())
+		if err != nil {
+			t.Fatalf("ReadMessage(%q) failed: %v", tt.fields, err)
+		}
+		if res.code != 400 || res.description != "URI Failure" || !reflect.DeepEqual(res.fields, tt.expected) {
+			t.Errorf("round trip of %q, expected: %q got: %d %s %q", tt.fields, tt.expected, res.code, res.description, res.fields)
+		}
+		if buffer.Len() != 0 {
+			t.Errorf("round trip of %q left %q unread", tt.fields, buffer.String())
+		}
+	}
+}
+
+func TestAptWriterWriteMessageInvalid(t *testing.T) {
+	var tests = []Message{
+		{code: 101, description: "Log\n\n201 URI Done"},
+		{code: 101, description: "Log", fields: map[string][]string{"": {"val"}}},
+		{code: 101, description: "Log", fields: map[string][]string{"Key: x": {"val"}}},
+		{code: 101, description: "Log", fields: map[string][]string{"Two Words": {"val"}}},
+		{code: 101, description: "Log", fields: map[string][]string{"Key\nOther": {"val"}}},
+	}
+
+	for _, tt := range tests {
+		var buffer bytes.Buffer
+		writer := NewAptMessageWriter(&buffer)
+		if err := writer.WriteMessage(tt); err == nil {
+			t.Errorf("WriteMessage(%v) succeeded, expected error", tt)
+		}
+		if buffer.Len() != 0 {
+			t.Errorf("WriteMessage(%v) wrote %q, expected nothing", tt, buffer.String())
+		}
+	}
+}
+
 func TestAptWriterSendCapabilities(t *testing.T) {
 	var buffer bytes.Buffer
 	writer := NewAptMessageWriter(&buffer)
-	expected := "100 Capabilities\nSend-Config: true\nVersion: 1.0\n\n"
+	expected := "100 Capabilities\nPipeline: true\nSend-Config: true\nSend-URI-Encoded: true\nVersion: 1.0\n\n"
 	if err := writer.SendCapabilities(); err != nil || buffer.String() != expected {
 		t.Errorf("failed, expected:\n%q\ngot:\n%q", expected, buffer.String())
 	}
@@ -136,6 +242,14 @@ func TestAptWriterLog(t *testing.T) {
 			"some log message",
 			"101 Log\nMessage: some log message\n\n",
 		},
+		{
+			"GET /dists/repo/Release HTTP/1.1\r\nHost: fake.uri\r\n\r\n",
+			"101 Log\nMessage: GET /dists/repo/Release HTTP/1.1\n\n101 Log\nMessage: Host: fake.uri\n\n",
+		},
+		{
+			"first\n\nthird",
+			"101 Log\nMessage: first\n\n101 Log\nMessage: third\n\n",
+		},
 	}
 
 	for _, tt := range tests {
@@ -146,6 +260,88 @@ func TestAptWriterLog(t *testing.T) {
 		}
 	}
 }
+
+func TestAptWriterLogRoundTrip(t *testing.T) {
+	pipeReader, pipeWriter := io.Pipe()
+	writer := NewAptMessageWriter(pipeWriter)
+	msg := "GET /dists/repo/Release HTTP/1.1\r\nHost: fake.uri\r\n\r\n  \n\nbody"
+	go func() {
+		writer.Log(msg)
+		writer.logSequenced(3, "\nsequenced\n")
+		pipeWriter.Close()
+	}()
+
+	reader := NewAptMessageReader(bufio.NewReader(pipeReader))
+	var got []string
+	for {
+		res, err := reader.ReadMessage(context.Background())
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("ReadMessage failed after %q: %v", got, err)
+		}
+		got = append(got, res.Get("Message"))
+	}
+	expected := []string{"GET /dists/repo/Release HTTP/1.1", "Host: fake.uri", "body", "[acquire 3 #1] sequenced"}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("failed, expected %q got %q", expected, got)
+	}
+}
+
+func TestAptWriterTimeoutGoroutine(t *testing.T) {
+	var buffer bytes.Buffer
+	writer := NewAptMessageWriter(&buffer)
+	before := runtime.NumGoroutine()
+	for i := 0; i < 100; i++ {
+		if err := writer.Log("some log message"); err != nil {
+			t.Fatalf("failed: %v", err)
+		}
+	}
+	// One goroutine makes every timed write.
+	if after := runtime.NumGoroutine(); after > before+1 {
+		t.Errorf("failed, expected at most one more goroutine, went from %d to %d", before, after)
+	}
+	writer.stop()
+	if err := writer.Log("after stop"); err != nil || !strings.HasSuffix(buffer.String(), "Message: after stop\n\n") {
+		t.Errorf("failed to write after stop: %v", err)
+	}
+	writer.stop()
+}
+
+func TestAptWriterStatus(t *testing.T) {
+	var buffer bytes.Buffer
+	writer := NewAptMessageWriter(&buffer)
+	expected := "102 Status\nMessage: retrying (2/5) in 4s: connection reset\n\n"
+	if err := writer.Status("retrying (2/5) in 4s: connection reset"); err != nil || buffer.String() != expected {
+		t.Errorf("failed, expected:\n%q\ngot:\n%q", expected, buffer.String())
+	}
+}
+
+func TestAptWriterWarning(t *testing.T) {
+	var buffer bytes.Buffer
+	writer := NewAptMessageWriter(&buffer)
+	expected := "104 Warning\nMessage: some warning\n\n"
+	if err := writer.Warning("some warning"); err != nil || buffer.String() != expected {
+		t.Errorf("failed, expected:\n%q\ngot:\n%q", expected, buffer.String())
+	}
+}
+
+func TestAptWriterLogSequenced(t *testing.T) {
+	var buffer bytes.Buffer
+	writer := NewAptMessageWriter(&buffer)
+	writer.logSequenced(3, "first")
+	writer.logSequenced(0, "second")
+	writer.logSequenced(4, "third\nfourth")
+	expected := "101 Log\nMessage: [acquire 3 #1] first\n\n" +
+		"101 Log\nMessage: [#2] second\n\n" +
+		"101 Log\nMessage: [acquire 4 #3] third\n\n" +
+		"101 Log\nMessage: [acquire 4 #3] fourth\n\n"
+	if buffer.String() != expected {
+		t.Errorf("failed, expected:\n%q\ngot:\n%q", expected, buffer.String())
+	}
+}
+
 func TestAptWriterURIStart(t *testing.T) {
 	var tests = []struct {
 		uri, size, lastModified, expected string
@@ -222,6 +418,33 @@ func TestAptWriterFailURI(t *testing.T) {
 	}
 }
 
+func TestAptWriterFailURIReason(t *testing.T) {
+	var tests = []struct {
+		uri, msg, reason, expected string
+	}{
+		{
+			"http://fake.uri/debian/InRelease",
+			"404 Not Found",
+			"HttpError404",
+			"400 URI Failure\nFailReason: HttpError404\nMessage: 404 Not Found\nURI: http://fake.uri/debian/InRelease\n\n",
+		},
+		{
+			"http://fake.uri/debian/",
+			"uri failure message",
+			"",
+			"400 URI Failure\nMessage: uri failure message\nURI: http://fake.uri/debian/\n\n",
+		},
+	}
+
+	for _, tt := range tests {
+		var buffer bytes.Buffer
+		writer := NewAptMessageWriter(&buffer)
+		if err := writer.FailURIReason(tt.uri, tt.msg, tt.reason); err != nil || buffer.String() != tt.expected {
+			t.Errorf("failed, expected:\n%q\ngot:\n%q", tt.expected, buffer.String())
+		}
+	}
+}
+
 func TestAptWriterFail(t *testing.T) {
 	var tests = []struct {
 		msg, expected string
@@ -241,6 +464,27 @@ func TestAptWriterFail(t *testing.T) {
 	}
 }
 
+func TestAptWriterTimeout(t *testing.T) {
+	// Nobody reads from the pipe, so writes block.
+	_, pipeWriter := io.Pipe()
+	defer pipeWriter.Close()
+	writer := NewAptMessageWriter(pipeWriter)
+	writer.timeout = 10 * time.Millisecond
+
+	if err := writer.Log("some log message"); err != errWriteTimeout {
+		t.Errorf("failed, expected %v got %v", errWriteTimeout, err)
+	}
+	if writer.Err() != errWriteTimeout {
+		t.Errorf("failed, expected Err() to return %v got %v", errWriteTimeout, writer.Err())
+	}
+
+	// Later writes fail without blocking.
+	writer.timeout = time.Hour
+	if err := writer.Log("another log message"); err != errWriteTimeout {
+		t.Errorf("failed, expected %v got %v", errWriteTimeout, err)
+	}
+}
+
 func compareFields(first, second map[string][]string) bool {
 	if len(first) != len(second) {
 		return false
@@ -259,6 +503,34 @@ func compareFields(first, second map[string][]string) bool {
 	return true
 }
 
+func TestAptWriterHooks(t *testing.T) {
+	var buffer bytes.Buffer
+	writer := NewAptMessageWriter(&buffer)
+	var codes []int
+	writer.AddHook(func(msg *Message) { codes = append(codes, msg.code) })
+	writer.AddHook(func(msg *Message) { codes = append(codes, -msg.code) })
+	writer.SendCapabilities()
+	writer.Log("some log message")
+	if expected := []int{100, -100, 101, -101}; !reflect.DeepEqual(codes, expected) {
+		t.Errorf("failed, expected hooks to see %v got %v", expected, codes)
+	}
+}
+
+func TestAptReaderHooks(t *testing.T) {
+	input := "600 URI Acquire\nURI: ar+https://fake.uri/debian/\n\n\n601 Configuration\nConfig-Item: a=b\n\n"
+	reader := NewAptMessageReader(bufio.NewReader(strings.NewReader(input)))
+	var codes []int
+	reader.AddHook(func(msg *Message) { codes = append(codes, msg.code) })
+	for {
+		if _, err := reader.ReadMessage(context.Background()); err == io.EOF {
+			break
+		}
+	}
+	if expected := []int{600, 601}; !reflect.DeepEqual(codes, expected) {
+		t.Errorf("failed, expected hooks to see %v got %v", expected, codes)
+	}
+}
+
 func TestAptReaderReadMessage(t *testing.T) {
 	var tests = []struct {
 		msg      string
@@ -293,6 +565,66 @@ func TestAptReaderReadMessage(t *testing.T) {
 	}
 }
 
+func TestAptReaderLimits(t *testing.T) {
+	limits := ReaderLimits{MaxLineLength: 8192, MaxFields: 2, MaxValues: 3, MaxMessageBytes: 20000}
+	long := strings.Repeat("x", 8000)
+	var tests = []struct {
+		msg      string
+		expected *LimitError
+	}{
+		// Within the limits, with a line longer than the bufio buffer.
+		{"601 Configuration\nConfig-Item: " + long + "\nConfig-Item: b\nConfig-Item: c\nOther: d\n\n", nil},
+		{"601 Configuration\nConfig-Item: " + long + long + "\n\n", &LimitError{Limit: "line length", Max: 8192}},
+		{"601 " + long + long + "\n\n", &LimitError{Limit: "line length", Max: 8192}},
+		{"601 Configuration\nA: 1\nB: 2\nC: 3\n\n", &LimitError{Limit: "fields", Max: 2}},
+		{"601 Configuration\nA: 1\nA: 2\nA: 3\nA: 4\n\n", &LimitError{Limit: "values", Max: 3, Field: "A"}},
+		{"601 Configuration\nA: " + long + "\nB: " + long + "\nA: " + long + "\n\n", &LimitError{Limit: "message size", Max: 20000}},
+	}
+
+	for _, tt := range tests {
+		reader := NewAptMessageReader(bufio.NewReader(strings.NewReader(tt.msg)))
+		reader.SetLimits(limits)
+		_, err := reader.ReadMessage(context.Background())
+		if tt.expected == nil {
+			if err != nil {
+				t.Errorf("failed for %.40q: %v", tt.msg, err)
+			}
+			continue
+		}
+		var limitErr *LimitError
+		if !errors.As(err, &limitErr) || *limitErr != *tt.expected || KindOf(err) != ProtocolError {
+			t.Errorf("failed for %.40q, expected %v got %v", tt.msg, tt.expected, err)
+		}
+	}
+
+	// Without limits, anything goes.
+	msg := "601 Configuration\nA: " + long + long + "\nA: 2\nA: 3\nA: 4\nB: 1\nC: 1\n\n"
+	reader := NewAptMessageReader(bufio.NewReader(strings.NewReader(msg)))
+	reader.SetLimits(ReaderLimits{})
+	if _, err := reader.ReadMessage(context.Background()); err != nil {
+		t.Errorf("failed without limits: %v", err)
+	}
+}
+
+func TestAptReaderDefaultMessageSize(t *testing.T) {
+	// Lines of the longest length allowed, few enough for MaxValues, still
+	// add up to more than MaxMessageBytes.
+	limits := DefaultReaderLimits
+	item := "Config-Item: " + strings.Repeat("x", limits.MaxLineLength-len("Config-Item: ")) + "\n"
+	count := limits.MaxMessageBytes/len(item) + 1
+	if count > limits.MaxValues {
+		t.Fatalf("%d lines exceed MaxValues %d", count, limits.MaxValues)
+	}
+	msg := "601 Configuration\n" + strings.Repeat(item, count) + "\n"
+
+	reader := NewAptMessageReader(bufio.NewReader(strings.NewReader(msg)))
+	_, err := reader.ReadMessage(context.Background())
+	var limitErr *LimitError
+	if !errors.As(err, &limitErr) || limitErr.Limit != "message size" || KindOf(err) != ProtocolError {
+		t.Errorf("expected a message size ProtocolError, got %v", err)
+	}
+}
+
 func TestAptReaderParseHeader(t *testing.T) {
 	var tests = []struct {
 		message  Message
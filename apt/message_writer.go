@@ -15,40 +15,237 @@
 package apt
 
 import (
+	"errors"
+	"fmt"
 	"io"
+	"strings"
+	"sync"
+	"time"
 )
 
-// MessageWriter supports writing Apt messages.
+const defaultWriteTimeout = 5 * time.Minute
+
+var errWriteTimeout = errors.New("timed out writing message to apt, is it still reading?")
+
+// MessageWriter supports writing Apt messages. It is safe for concurrent use.
 type MessageWriter struct {
+	// mu serializes writes so that messages are never interleaved.
+	mu     sync.Mutex
 	writer io.Writer
+	// timeout bounds how long a single write may block, if positive.
+	timeout time.Duration
+	clock   Clock
+	// writes carries the writes bounded by timeout to the goroutine which
+	// makes them, which answers on written; see writeString. writes is nil
+	// while no such goroutine is running.
+	writes  chan []byte
+	written chan error
+	// err is the first write error. Once a write has failed the stream may
+	// hold a partial message, so all later writes fail too.
+	err   error
+	hooks []MessageHook
+	// logSeq numbers sequenced log messages in the order they are written.
+	logSeq uint64
+	// noWarnings is set when apt is too old to handle 104 Warning messages.
+	noWarnings bool
 }
 
 // NewAptMessageWriter returns an AptMessageWriter.
 func NewAptMessageWriter(w io.Writer) *MessageWriter {
-	return &MessageWriter{writer: w}
+	return &MessageWriter{writer: w, timeout: defaultWriteTimeout, clock: SystemClock{}}
+}
+
+func (w *MessageWriter) setTimeout(timeout time.Duration) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.timeout = timeout
+}
+
+// Err returns the error which caused writing to fail, if any.
+func (w *MessageWriter) Err() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.err
+}
+
+// AddHook adds a hook which is called with every message written, in the
+// order they are written. Hooks are called while writing is serialized, so
+// they must not write messages themselves.
+func (w *MessageWriter) AddHook(hook MessageHook) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.hooks = append(w.hooks, hook)
 }
 
 // WriteMessage writes an AptMessage.
 func (w *MessageWriter) WriteMessage(m Message) error {
-	return w.writeString(m.String())
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.writeMessage(m)
 }
 
-// WriteString writes a raw string.
-func (w *MessageWriter) writeString(s string) error {
-	if _, err := w.writer.Write([]byte(s)); err != nil {
+// logSequenced writes a 101 Log message prefixed with a sequence number and,
+// if non-zero, the ID of the acquire it relates to, so that output from
+// concurrent work stays attributable and ordered.
+func (w *MessageWriter) logSequenced(acquireID uint64, msg string) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.logSeq++
+	prefix := fmt.Sprintf("[#%d] ", w.logSeq)
+	if acquireID != 0 {
+		prefix = fmt.Sprintf("[acquire %d #%d] ", acquireID, w.logSeq)
+	}
+	return w.writeLog(prefix, msg)
+}
+
+// writeLog writes msg in 101 Log messages, one per line, each starting with
+// prefix. A field can't hold more than one line: apt would read the rest,
+// such as the headers of a dumped request, as fields of the message, and a
+// blank line would end it early. Blank lines of msg are left out, as apt
+// rejects a message with an empty field. w.mu must be held.
+func (w *MessageWriter) writeLog(prefix, msg string) error {
+	lines := strings.Split(strings.ReplaceAll(msg, "\r\n", "\n"), "\n")
+	for _, line := range lines {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		if err := w.writeMessage(new101Message(prefix + line)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeMessage writes an AptMessage and calls the hooks, with line breaks
+// in its values replaced; see safe. A message which can't be written safely
+// is not written at all. w.mu must be held.
+func (w *MessageWriter) writeMessage(m Message) error {
+	m, err := m.safe()
+	if err != nil {
 		return err
 	}
+	if err := w.writeString(m.String()); err != nil {
+		return err
+	}
+	for _, hook := range w.hooks {
+		hook(&m)
+	}
 	return nil
 }
 
+// writeString writes a raw string. w.mu must be held.
+func (w *MessageWriter) writeString(s string) error {
+	if w.err != nil {
+		return w.err
+	}
+	if w.timeout <= 0 {
+		if _, err := w.writer.Write([]byte(s)); err != nil {
+			w.err = err
+			return err
+		}
+		return nil
+	}
+
+	// If apt stops reading, the write blocks forever. It can't be
+	// interrupted, so it is made by a goroutine which is left behind on a
+	// timeout, to exit once the write returns, e.g. when apt exits. As
+	// writes are serialized, one goroutine makes them all.
+	if w.writes == nil {
+		w.writes = make(chan []byte)
+		w.written = make(chan error, 1)
+		go writeLoop(w.writer, w.writes, w.written)
+	}
+	w.writes <- []byte(s)
+	clock := w.clock
+	if clock == nil {
+		clock = SystemClock{}
+	}
+	timer := clock.NewTimer(w.timeout)
+	defer timer.Stop()
+	select {
+	case err := <-w.written:
+		if err != nil {
+			w.err = err
+			return err
+		}
+		return nil
+	case <-timer.C():
+		w.err = errWriteTimeout
+		w.stopLocked()
+		return w.err
+	}
+}
+
+// writeLoop writes each string received on writes to writer, sending the
+// result on written, until writes is closed.
+func writeLoop(writer io.Writer, writes <-chan []byte, written chan<- error) {
+	for b := range writes {
+		_, err := writer.Write(b)
+		written <- err
+	}
+}
+
+// stop ends the goroutine making timed writes, if any, once it has finished
+// its write; a later write starts another.
+func (w *MessageWriter) stop() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.stopLocked()
+}
+
+// stopLocked is stop with w.mu held.
+func (w *MessageWriter) stopLocked() {
+	if w.writes != nil {
+		close(w.writes)
+		w.writes = nil
+	}
+}
+
 // SendCapabilities writes a 100 Capabilities message.
 func (w *MessageWriter) SendCapabilities() error {
 	return w.WriteMessage(new100Message())
 }
 
-// Log writes a 101 Log message.
+// Log writes a 101 Log message, or one per line of msg.
 func (w *MessageWriter) Log(msg string) error {
-	return w.WriteMessage(new101Message(msg))
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.writeLog("", msg)
+}
+
+// Status sends a 102 Status message, which apt shows in its progress line.
+func (w *MessageWriter) Status(msg string) error {
+	return w.WriteMessage(new102Message(msg))
+}
+
+// URIStatus sends a 102 Status message about the progress of a URI.
+func (w *MessageWriter) URIStatus(uri, msg string) error {
+	m := new102Message(msg)
+	m.fields["URI"] = []string{uri}
+	return w.WriteMessage(m)
+}
+
+// Redirect writes a 103 Redirect message, telling apt to fetch uri from
+// newURI instead.
+func (w *MessageWriter) Redirect(uri, newURI string) error {
+	return w.WriteMessage(new103Message(uri, newURI))
+}
+
+// Warning writes a 104 Warning message, which apt shows to the user, or a
+// 101 Log message if apt is too old to handle warnings.
+func (w *MessageWriter) Warning(msg string) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.noWarnings {
+		return w.writeLog("Warning: ", msg)
+	}
+	return w.writeMessage(new104Message(msg))
+}
+
+func (w *MessageWriter) setWarnings(enabled bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.noWarnings = !enabled
 }
 
 // URIStart writes a 200 URI Start message.
@@ -63,7 +260,13 @@ func (w *MessageWriter) URIDone(uri, size, lastModified, md5Hash, filename strin
 
 // FailURI writes a 400 URI Failure message.
 func (w *MessageWriter) FailURI(uri, msg string) error {
-	return w.WriteMessage(new400Message(uri, msg))
+	return w.WriteMessage(new400Message(uri, msg, ""))
+}
+
+// FailURIReason writes a 400 URI Failure message with a FailReason field,
+// which apt uses to decide how to handle the failure.
+func (w *MessageWriter) FailURIReason(uri, msg, reason string) error {
+	return w.WriteMessage(new400Message(uri, msg, reason))
 }
 
 // Fail writes a 401 General Failure message.
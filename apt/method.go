@@ -16,16 +16,23 @@ package apt
 
 import (
 	"bufio"
+	"compress/gzip"
 	"context"
-	"crypto/md5"
 	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"net/http/httputil"
+	"net/url"
 	"os"
+	"path"
+	"regexp"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
@@ -33,16 +40,65 @@ import (
 
 const (
 	cloudPlatformScope = "https://www.googleapis.com/auth/cloud-platform"
+
+	defaultReadBufferSize = 32 * 1024
+	defaultWriteChunkSize = 32 * 1024
 )
 
+// defaultConfig returns the configuration of a method before apt sends any.
+func defaultConfig() *aptMethodConfig {
+	return &aptMethodConfig{
+		readBufferSize:     defaultReadBufferSize,
+		writeChunkSize:     defaultWriteChunkSize,
+		dirs:               defaultAptDirs(),
+		sandboxUser:        defaultSandboxUser,
+		statusInterval:     defaultStatusInterval,
+		prewarmConnections: defaultPrewarmConnections,
+	}
+}
+
 // NewAptMethod returns an AptMethod.
 func NewAptMethod(input *bufio.Reader, output io.Writer) *Method {
-	return &Method{
-		config: &aptMethodConfig{},
+	config := defaultConfig()
+	m := &Method{
+		config: config,
 		writer: NewAptMessageWriter(output),
 		reader: NewAptMessageReader(input),
-		dl:     downloaderImpl{},
+		clock:  SystemClock{},
 	}
+	m.dl = downloaderImpl{config: config, metrics: m.metrics}
+	return m
+}
+
+// SetReaderLimits replaces the limits on the messages read from apt; see
+// ReaderLimits. It must be called before Run.
+func (m *Method) SetReaderLimits(limits ReaderLimits) {
+	m.reader.SetLimits(limits)
+}
+
+// AddReadHook adds a hook which is called with every message read from apt.
+// It must be called before Run.
+func (m *Method) AddReadHook(hook MessageHook) {
+	m.reader.AddHook(hook)
+}
+
+// AddWriteHook adds a hook which is called with every message written to
+// apt.
+func (m *Method) AddWriteHook(hook MessageHook) {
+	m.writer.AddHook(hook)
+}
+
+// acquireIDKey is the context key for the ID of the acquire being handled.
+type acquireIDKey struct{}
+
+// debugLog logs msg in debug mode, attributed to the acquire being handled
+// in ctx, if any.
+func (m *Method) debugLog(ctx context.Context, msg string) {
+	if !m.config.debug {
+		return
+	}
+	id, _ := ctx.Value(acquireIDKey{}).(uint64)
+	m.writer.logSequenced(id, msg)
 }
 
 // httpClient exists to enable mocking of http.Client.
@@ -52,10 +108,34 @@ type httpClient interface {
 
 // downloader exists to enable mocking of AptMethod.download.
 type downloader interface {
-	download(io.ReadCloser, string) (string, error)
+	// download writes the body to the named file after the first offset
+	// bytes already in it, which are kept. length is the expected length
+	// of the body, or -1 if it isn't known. progress, if set, is called
+	// with the bytes of the file written so far.
+	download(body io.ReadCloser, filename string, offset, length int64, progress func(written int64)) (downloadResult, error)
 }
 
-type downloaderImpl struct{}
+// downloadResult describes a completed download.
+type downloadResult struct {
+	// The hex digests of the file. Only md5Hash is certain to be set; the
+	// others are empty if the hash backend doesn't support them.
+	md5Hash, sha1Hash, sha256Hash, sha512Hash string
+	// size is the number of bytes written to the target file.
+	size int64
+}
+
+type downloaderImpl struct {
+	config *aptMethodConfig
+	// metrics, if set, returns the Telemetry downloads are reported to.
+	metrics func() Telemetry
+}
+
+func (r downloaderImpl) telemetry() Telemetry {
+	if r.metrics == nil {
+		return NopTelemetry{}
+	}
+	return r.metrics()
+}
 
 // Method represents the method handler.
 type Method struct {
@@ -64,91 +144,720 @@ type Method struct {
 	config *aptMethodConfig
 	client httpClient
 	dl     downloader
+	clock  Clock
+	// telemetry receives measurements; see metrics.
+	telemetry Telemetry
+	// aptVersion is the version of the apt driving the method, as far as
+	// it is known; see detectAptVersion.
+	aptVersion aptVersion
+	// configValues holds the values config options were set to, keyed by
+	// option; see effectiveConfig. configured is set once a configuration
+	// has been applied, which another replaces; see resetConfig.
+	configValues map[string]*configValue
+	configured   bool
+	// configMu is held by handleConfigure while it replaces the
+	// configuration, and by what reads it beside Run from other
+	// goroutines, such as HealthCheck. Acquires needn't hold it, as
+	// handleConfigure only runs once they have finished.
+	configMu sync.RWMutex
+	// credentialFD holds what was read from Credential-FD, which can only
+	// be read once, for configurations sent later. It is released once
+	// credentialTokens is made from it, which the clients made for those
+	// configurations share. credentialTokens is guarded by clientMu.
+	credentialFD     *Secret
+	credentialTokens oauth2.TokenSource
+
+	// background tracks work Run started in the background, which it
+	// waits for before returning.
+	background sync.WaitGroup
+	// queue holds the URI Acquire messages from Run until a worker starts
+	// on them; see dispatchAcquire. It is guarded by queueMu, and
+	// queueChanged is broadcast when it changes. workers tracks the
+	// workers.
+	queueMu      sync.Mutex
+	queueChanged *sync.Cond
+	queue        *acquireQueue
+	workers      sync.WaitGroup
+	// prewarmGates holds a gate per host a burst of acquires has asked to
+	// warm up. It is guarded by prewarmMu.
+	prewarmMu    sync.Mutex
+	prewarmGates map[string]*prewarmGate
+	// targets holds, for each file being written by an acquire, a channel
+	// closed when it is done. It is guarded by targetsMu.
+	targetsMu sync.Mutex
+	targets   map[string]chan struct{}
+
+	// clientMu guards initialization of client, which may happen in the
+	// background during warmup.
+	clientMu          sync.Mutex
+	warmupStarted     bool
+	validationStarted bool
+	// tokens is the token source behind client, kept for health checks.
+	tokens oauth2.TokenSource
+	// proxyTokens, if set, is the source of ID tokens for the proxy.
+	proxyTokens oauth2.TokenSource
+	// authConf holds the entries of apt's auth.conf, used when no
+	// credentials are configured.
+	authConf []authConfEntry
+	// anonymous is set when no credentials were found, so that requests
+	// are sent without authentication until authenticate finds some.
+	anonymous bool
+	// identity describes the credentials the client was made with, for
+	// the journal; see identityFor.
+	identity string
+
+	resolver resolver
+	// egressChecked holds the result of the egress preflight per host. It is
+	// guarded by egressMu, as hosts are also probed in the background.
+	egressMu      sync.Mutex
+	egressChecked map[string]error
+	// hostFailures holds definitive failures per host, and for auth
+	// failures per credentials used with it, guarded by hostMu.
+	hostMu       sync.Mutex
+	hostFailures map[hostFailureKey]error
+
+	// acquireSeq numbers acquires, to attribute debug logs to them.
+	acquireSeq uint64
+
+	// completed records the URIs downloaded this session, guarded by
+	// completedMu as acquires are handled concurrently.
+	completedMu sync.Mutex
+	completed   map[string]completedDownload
+
+	// secrets caches secrets fetched from Secret Manager until used.
+	secrets map[string]*Secret
+
+	// fallbackActive is set once requests have switched to the fallback
+	// endpoint. It is guarded by fallbackMu.
+	fallbackMu     sync.Mutex
+	fallbackActive bool
+
+	// region is the candidate host selected by selectRegion, if any. It is
+	// guarded by regionMu, which is held while probing so that concurrent
+	// acquires wait for the selection.
+	regionMu       sync.Mutex
+	region         string
+	regionSelected bool
+
+	// sources holds the options given in sources entries, read once.
+	sourcesOnce sync.Once
+	sources     []*sourceConfig
+
+	// egressStats counts downloads per repository, guarded by egressStatsMu.
+	egressStatsMu sync.Mutex
+	egressStats   map[string]EgressStats
+
+	// retryFailed and retryDelivered are the URIs which failed transiently
+	// and which were delivered in this session, for the Retry-Queue-File,
+	// guarded by retryMu.
+	retryMu        sync.Mutex
+	retryFailed    map[string]DeferredRetry
+	retryDelivered map[string]bool
+	// warned holds the warnings sent to apt, each of which is only sent
+	// once; see warn. It is guarded by warnMu.
+	warnMu sync.Mutex
+	warned map[string]bool
+	// fetches holds the acquire fetching each URI, which other acquires of
+	// it wait for; see joinFetch. It is guarded by fetchesMu.
+	fetchesMu sync.Mutex
+	fetches   map[string]*uriFetch
 }
 
 type aptMethodConfig struct {
 	serviceAccountJSON, serviceAccountEmail string
 	debug                                   bool
+	readBufferSize, writeChunkSize          int
+	regionCandidates                        []string
+	// recordHeaders lists response headers to copy into URI Done.
+	recordHeaders []string
+	// scopedOptions maps host patterns to the host-scoped options set for
+	// them. Unscoped options are stored under the empty pattern.
+	scopedOptions   map[string]map[string][]string
+	warmup          bool
+	validateSources bool
+	// egressAllowlist holds the networks that hosts must resolve into, if
+	// any. egressFail makes a violation fatal rather than a warning.
+	egressAllowlist []*net.IPNet
+	egressFail      bool
+	// expectedProject and expectedLocation, if set, pin the repositories
+	// which may be accessed.
+	expectedProject, expectedLocation string
+	// progress, if set, is called with the number of bytes written so far
+	// as a download progresses. It is set before any acquire and not
+	// changed after; see downloadProgress.
+	progress func(written int64)
+	// warnSizeMismatch makes a mismatch with apt's expected size a warning
+	// rather than a failure.
+	warnSizeMismatch bool
+	dirs             aptDirs
+	chaos            *chaosConfig
+	// credential is the key or token read from Credential-FD, if any. It
+	// is released once the client is built.
+	credential *Secret
+	// maxWriteChunkSize, if larger than writeChunkSize, lets the write
+	// chunk size adapt to throughput between the two.
+	maxWriteChunkSize int
+	// accessToken is a short-lived OAuth token supplied by Access-Token.
+	accessToken *Secret
+	// credentialHelper is a program which prints access tokens.
+	credentialHelper string
+	// serviceAccountSecret is the Secret Manager secret version holding a
+	// service account key.
+	serviceAccountSecret string
+	// verifyChecksums checks packages against the checksums recorded by
+	// the Artifact Registry API.
+	verifyChecksums bool
+	// impersonate is a service account to impersonate with the configured
+	// credentials, through the chain of delegates.
+	impersonate string
+	delegates   []string
+	// selfSignedJWT authenticates with JWTs signed by the Service-Account-JSON
+	// key instead of access tokens from the OAuth endpoint.
+	selfSignedJWT bool
+	// credentialsFallback lets default credentials fall back past a
+	// credentials file which is named or present but unusable.
+	credentialsFallback bool
+	// mmapThreshold, if set, is the size from which bodies of a known
+	// length are written through a memory mapping.
+	mmapThreshold int
+	// authHosts are host patterns, besides defaultAuthHosts, which bearer
+	// tokens may be sent to.
+	authHosts []string
+	// egressStatsFile, if set, accumulates the session's egress per
+	// repository into daily counters.
+	egressStatsFile string
+	// proxyAudience, if set, is the audience of ID tokens sent to an
+	// IAP-protected proxy as Proxy-Authorization.
+	proxyAudience string
+	// authConfWrite writes tokens to auth.conf.d for other tooling.
+	authConfWrite bool
+	// fallbackEndpoint, if set, is the host requests switch to when TLS
+	// handshakes fail as if blocked by SNI filtering.
+	fallbackEndpoint string
+	// requireAuth refuses to send requests without credentials.
+	requireAuth bool
+	// dropPrivileges switches to sandboxUser after configuration when
+	// started as root.
+	dropPrivileges bool
+	sandboxUser    string
+	// telemetry names the built-in Telemetry to use, none, log or
+	// textfile, the last writing to telemetryFile.
+	telemetry     string
+	telemetryFile string
+	// pipelineDepth is how many acquires are handled at once, for each
+	// host unless sharedQueue is set.
+	pipelineDepth int
+	// sharedQueue is set when apt's Queue-Mode is access, so that all
+	// hosts share pipelineDepth.
+	sharedQueue bool
+	// debugQueue is set to log the transitions of the acquire queue.
+	debugQueue bool
+	// slowStart is set to ramp up how many acquires each host runs at
+	// once; see observeResponse.
+	slowStart bool
+	// statusInterval is how often the progress of a download is reported,
+	// or 0 not to report it.
+	statusInterval time.Duration
+	// aptVersion is the version of apt given by Apt-Version, if any.
+	aptVersion aptVersion
+	// passRedirects is set to pass redirects to apt in 103 Redirect
+	// messages rather than following them.
+	passRedirects bool
+	// journalFile, if set, is where delivered artifacts are recorded.
+	journalFile string
+	// prewarmConnections is how many connections are opened to a host for
+	// a burst of acquires before it is sent, or 0 for none.
+	prewarmConnections int
+	// ignoreIntermediaries is set to treat every 401 and 403 as Artifact
+	// Registry's own; see intermediaryChallenge.
+	ignoreIntermediaries bool
+	// retryQueueFile, if set, is where URIs which failed transiently are
+	// kept for a later run.
+	retryQueueFile string
 }
 
-// Run runs the method.
+// Run runs the method until apt closes its input or ctx is cancelled.
+// Errors which stop it can be classified with KindOf. URI Acquire messages
+// are handled concurrently, up to Pipeline-Depth at a time; when apt closes
+// its input, those in progress are finished first.
+//
+// Cancelling ctx stops Run promptly at any stage, with these guarantees:
+//   - Run returns nil and handles no further message. Messages apt has sent
+//     which Run hasn't begun to handle are left unanswered, as if the method
+//     had exited; a read in progress is abandoned, so Run must not be called
+//     again with the same input.
+//   - An acquire in progress is aborted, whether waiting for the response or
+//     transferring the body, and answered with a 400 URI Failure, so that
+//     apt doesn't wait on it. Its Filename holds exactly the bytes received
+//     before the abort.
+//   - Every message is written whole, and background work started by Run has
+//     stopped, and written whatever it had to, when Run returns.
+//   - Egress stats and telemetry are saved as on any other return, and no
+//     temporary files are left behind.
 func (m *Method) Run(ctx context.Context) error {
-	m.writer.SendCapabilities()
+	defer m.writer.stop()
+	if err := m.writer.SendCapabilities(); err != nil {
+		return withKind(IOError, err)
+	}
+	defer m.failOnPanic()
+	defer func() {
+		if m.config.debug {
+			m.DumpState()
+		}
+		if err := m.saveEgressStats(); err != nil {
+			m.writer.Log(fmt.Sprintf("failed to save egress stats: %v", err))
+		}
+		if err := m.saveRetryQueue(); err != nil {
+			m.writer.Log(fmt.Sprintf("failed to save the retry queue: %v", err))
+		}
+		if err := m.flushTelemetry(); err != nil {
+			m.writer.Log(fmt.Sprintf("failed to flush telemetry: %v", err))
+		}
+	}()
+	ctx, cancel := context.WithCancel(ctx)
+	defer m.background.Wait()
+	defer m.stopWorkers()
+	defer cancel()
 	for {
 		select {
 		case <-ctx.Done():
 			return nil
 		default:
 		}
-		msg, err := m.reader.ReadMessage(ctx)
+		msg, err := m.readMessage(ctx)
+		if ctx.Err() != nil {
+			return nil
+		}
 		if errors.Is(err, errEmptyMessage) {
 			continue
 		} else if errors.Is(err, io.EOF) {
+			// apt has no more work: finish what it sent and exit
+			// cleanly.
+			m.stopWorkers()
 			return nil
 		} else if err != nil {
+			if KindOf(err) == UnknownError && ctx.Err() == nil {
+				err = withKind(IOError, err)
+			}
+			if KindOf(err) == ProtocolError {
+				// Say why rather than leave apt to report that the
+				// method exited unexpectedly.
+				m.writer.Fail(fmt.Sprintf("invalid message from apt: %v", err))
+			}
 			return err
 		}
 		switch msg.code {
 		case 600:
-			m.handleAcquire(ctx, msg)
+			m.dispatchAcquire(ctx, msg)
 		case 601:
-			m.handleConfigure(msg)
+			// apt may send configuration again at any point. Acquires in
+			// progress keep the configuration they began with, and the
+			// workers start again with the new one, e.g. its
+			// Pipeline-Depth.
+			m.stopWorkers()
+			if err := m.handleConfigure(msg); err != nil {
+				m.writer.Fail(err.Error())
+				return withKind(ConfigError, err)
+			}
+			if m.config.debug {
+				for _, line := range m.effectiveConfig() {
+					m.writer.Log("effective config: " + line)
+				}
+			}
+			if err := m.initTelemetry(); err != nil {
+				m.writer.Fail(err.Error())
+				return withKind(ConfigError, err)
+			}
+			if err := m.dropPrivileges(ctx); err != nil {
+				m.writer.Fail(err.Error())
+				if KindOf(err) == UnknownError {
+					err = withKind(ConfigError, err)
+				}
+				return err
+			}
+			m.startWarmup(ctx)
+			m.startValidation(ctx)
 		default:
 			// TODO(hopkiw): now write a test for this.
 			m.writer.Fail(fmt.Sprintf("Unsupported message code %d received from apt", msg.code))
 		}
+		// Stop rather than linger if apt is no longer reading our output.
+		if err := m.writer.Err(); err != nil {
+			return withKind(IOError, err)
+		}
+	}
+}
+
+// readMessage reads the next message from apt, giving up when ctx is
+// cancelled. The read then carries on in the background, and its message
+// is discarded.
+func (m *Method) readMessage(ctx context.Context) (*Message, error) {
+	type result struct {
+		msg *Message
+		err error
+	}
+	read := make(chan result, 1)
+	go func() {
+		msg, err := m.reader.ReadMessage(ctx)
+		read <- result{msg, err}
+	}()
+	select {
+	case r := <-read:
+		return r.msg, r.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
 	}
 }
 
 func (m *Method) initClient(ctx context.Context) error {
+	m.clientMu.Lock()
+	defer m.clientMu.Unlock()
 	if m.client != nil {
 		return nil
 	}
 
 	var ts oauth2.TokenSource
 	switch {
-	case m.config.serviceAccountJSON != "":
-		json, err := os.ReadFile(m.config.serviceAccountJSON)
+	case m.config.credential != nil:
+		if m.credentialTokens == nil {
+			secretTS, err := tokenSourceFromSecret(ctx, m.config.credential)
+			m.config.credential.Release()
+			if err != nil {
+				return fmt.Errorf("failed to obtain creds from Credential-FD: %v", err)
+			}
+			m.credentialTokens = secretTS
+		}
+		ts = m.credentialTokens
+		m.identity = "Credential-FD"
+		m.debugLog(ctx, "using credentials from Credential-FD")
+	case !m.config.accessToken.Empty():
+		ts = oauth2.StaticTokenSource(&oauth2.Token{AccessToken: string(m.config.accessToken.Bytes())})
+		m.identity = "Access-Token"
+		m.debugLog(ctx, "using the token from Access-Token")
+	case m.config.credentialHelper != "":
+		ts = newHelperTokenSource(ctx, m.config.credentialHelper, m.timeSource())
+		m.identity = "Credential-Helper " + m.config.credentialHelper
+		m.debugLog(ctx, "using tokens from Credential-Helper "+m.config.credentialHelper)
+	case m.config.serviceAccountSecret != "":
+		secret, err := m.accessSecret(ctx, m.config.serviceAccountSecret)
+		if err != nil {
+			return fmt.Errorf("failed to obtain creds from Service-Account-Secret: %v", err)
+		}
+		secretTS, err := tokenSourceFromSecret(ctx, secret)
+		if err != nil {
+			return fmt.Errorf("failed to obtain creds from Service-Account-Secret: %v", err)
+		}
+		secret.Release()
+		ts = secretTS
+		m.identity = "Service-Account-Secret " + m.config.serviceAccountSecret
+		m.debugLog(ctx, "using credentials from Service-Account-Secret "+m.config.serviceAccountSecret)
+	case m.config.serviceAccountJSON != "" && m.config.selfSignedJWT:
+		jwtTS, err := m.newJWTTokenSource(ctx, m.config.serviceAccountJSON)
 		if err != nil {
-			return fmt.Errorf("failed to read service account JSON file: %v", err)
+			return fmt.Errorf("failed to obtain creds from service account JSON: %v", err)
 		}
-		creds, err := google.CredentialsFromJSON(ctx, json, cloudPlatformScope)
+		ts = jwtTS
+		m.identity = "Service-Account-JSON " + m.config.serviceAccountJSON
+		m.debugLog(ctx, "using self-signed JWTs for each host from Service-Account-JSON file "+m.config.serviceAccountJSON)
+	case m.config.serviceAccountJSON != "":
+		jsonTS, err := newReloadingTokenSource(ctx, m.config.serviceAccountJSON, tokenSourceFromFile, func(msg string) { m.writer.Log(msg) })
 		if err != nil {
 			return fmt.Errorf("failed to obtain creds from service account JSON: %v", err)
 		}
-		ts = creds.TokenSource
+		ts = jsonTS
+		m.identity = "Service-Account-JSON " + m.config.serviceAccountJSON
+		m.debugLog(ctx, "using credentials from Service-Account-JSON file "+m.config.serviceAccountJSON)
 	case m.config.serviceAccountEmail != "":
 		ts = google.ComputeTokenSource(m.config.serviceAccountEmail)
+		m.identity = "Service-Account-Email " + m.config.serviceAccountEmail
+		m.debugLog(ctx, "using credentials of "+m.config.serviceAccountEmail+" from the metadata server")
+		ts = m.retryTokens(ctx, ts)
+	case os.Getenv(accessTokenEnv) != "":
+		ts = oauth2.StaticTokenSource(&oauth2.Token{AccessToken: os.Getenv(accessTokenEnv)})
+		m.identity = "$" + accessTokenEnv
+		m.debugLog(ctx, "using the token from $"+accessTokenEnv)
 	default:
-		creds, err := google.FindDefaultCredentials(ctx)
+		// Without configured credentials, hosts with an entry in apt's
+		// auth.conf use it, as they would with apt's https method.
+		m.authConf = readAuthConf(m.config.dirs.authConfFiles())
+		if len(m.authConf) > 0 {
+			m.debugLog(ctx, fmt.Sprintf("using %d entries from auth.conf", len(m.authConf)))
+		}
+		defaultTS, err := m.defaultTokenSource(ctx)
 		if err != nil {
-			return fmt.Errorf("failed to obtain default creds: %v", err)
+			if m.config.impersonate != "" || errors.Is(err, errUnusableCredentials) {
+				return fmt.Errorf("failed to obtain default creds: %v", err)
+			}
+			if m.config.requireAuth && len(m.authConf) == 0 {
+				return fmt.Errorf("no usable credentials found and Require-Auth is set: %v", err)
+			}
+			// Public repositories can be read without credentials.
+			m.anonymous = true
+			m.debugLog(ctx, fmt.Sprintf("sending requests without authentication: %v", err))
+			m.metrics().Event("anonymous_access", nil)
+			break
 		}
-		ts = creds.TokenSource
+		ts = m.retryTokens(ctx, defaultTS)
+		m.identity = "application default credentials"
 	}
-	if ts == nil {
+	if ts == nil && !m.anonymous {
 		return errors.New("failed to obtain creds")
 	}
-	m.client = oauth2.NewClient(ctx, ts)
+	if m.config.impersonate != "" {
+		ts = newImpersonateTokenSource(ctx, ts, m.config.impersonate, m.config.delegates)
+		m.identity += " impersonating " + m.config.impersonate
+		m.debugLog(ctx, fmt.Sprintf("impersonating %s through %v", m.config.impersonate, m.config.delegates))
+	}
+	if _, bound := ts.(hostTokenSource); ts != nil && !bound {
+		// Those bound to hosts manage the tokens of each audience.
+		ts = m.manageTokens(ts)
+	}
+	m.tokens = ts
+	if m.config.proxyAudience != "" {
+		proxyTS, err := m.newProxyTokenSource(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to obtain ID tokens for the proxy: %v", err)
+		}
+		m.proxyTokens = proxyTS
+		m.debugLog(ctx, "sending ID tokens for "+m.config.proxyAudience+" to the proxy")
+	}
+	if _, bound := ts.(hostTokenSource); bound && m.config.authConfWrite {
+		m.writer.Log("ignoring Auth-Conf-Write, as self-signed JWTs are bound to the host of each request")
+	} else if m.config.authConfWrite && ts != nil {
+		ts = m.newAuthConfWriter(ts)
+	}
+	m.client = m.config.newAuthClient(ctx, ts, m.proxyTokens, m.authConf)
+	return nil
+}
+
+// authenticate looks for default credentials again if the method fell back
+// to anonymous access, e.g. after a repository refused an anonymous
+// request, and switches the client to them if they are found now. It
+// reports whether the client changed.
+func (m *Method) authenticate(ctx context.Context) bool {
+	m.clientMu.Lock()
+	defer m.clientMu.Unlock()
+	if !m.anonymous {
+		return false
+	}
+	defaultTS, err := m.defaultTokenSource(ctx)
+	if err != nil {
+		m.debugLog(ctx, fmt.Sprintf("still sending requests without authentication: %v", err))
+		return false
+	}
+	var ts oauth2.TokenSource = m.manageTokens(m.retryTokens(ctx, defaultTS))
+	m.tokens = ts
+	m.identity = "application default credentials"
+	if m.config.authConfWrite {
+		ts = m.newAuthConfWriter(ts)
+	}
+	m.client = m.config.newAuthClient(ctx, ts, m.proxyTokens, m.authConf)
+	m.anonymous = false
+	return true
+}
+
+// checkRequireAuth fails a request to u which would be sent without
+// credentials, if Require-Auth is set: one to a host tokens aren't sent to
+// and without an auth.conf entry, or any such request while the method has
+// no credentials.
+func (m *Method) checkRequireAuth(u *url.URL) error {
+	if !m.config.requireAuth || matchAuthConf(m.authConf, u) != nil {
+		return nil
+	}
+	m.clientMu.Lock()
+	anonymous := m.anonymous
+	m.clientMu.Unlock()
+	if anonymous {
+		return fmt.Errorf("refusing to fetch %s without authentication as Require-Auth is set, and no usable credentials were found", u.Redacted())
+	}
+	if !m.config.authHostAllowed(u.Hostname()) {
+		return fmt.Errorf("refusing to fetch %s without authentication as Require-Auth is set, and tokens aren't sent to %s; add it to Auth-Hosts", u.Redacted(), u.Hostname())
+	}
 	return nil
 }
 
 // download performs the actual downloading to target file and returns
-// an MD5 hash of the downloaded file.
-func (r downloaderImpl) download(body io.ReadCloser, filename string) (string, error) {
+// the MD5 hash and size of the downloaded file, reporting completed
+// downloads to telemetry.
+func (r downloaderImpl) download(body io.ReadCloser, filename string, offset, length int64, progress func(written int64)) (downloadResult, error) {
+	start := time.Now()
+	res, err := r.downloadFile(body, filename, offset, length, progress)
+	if err == nil {
+		metrics := r.telemetry()
+		metrics.Timer("download", time.Since(start), nil)
+		metrics.Counter("downloaded_bytes", res.size-offset, nil)
+	}
+	return res, err
+}
+
+// downloadFile writes body to filename. The response is read through a buffer
+// of readBufferSize bytes and written out in chunks of writeChunkSize bytes,
+// so that writes to slow media can be tuned. If maxWriteChunkSize is set the
+// chunk size adapts to throughput between the two. Bodies of a known length
+// of at least mmapThreshold bytes are written through a memory mapping. A
+// positive offset appends body to the first offset bytes of the file, which
+// are hashed first.
+func (r downloaderImpl) downloadFile(body io.ReadCloser, filename string, offset, length int64, progress func(written int64)) (downloadResult, error) {
 	defer body.Close()
-	data, err := io.ReadAll(body)
+	hashes, err := newHashPipeline(downloadHashes()...)
 	if err != nil {
-		return "", err
+		return downloadResult{}, err
 	}
-	file, err := os.Create(filename)
+	defer hashes.Close()
+	file, err := openTarget(filename, offset, hashes, progress)
 	if err != nil {
-		return "", err
+		return downloadResult{}, err
 	}
 	defer file.Close()
 
-	_, err = file.Write(data)
-	return fmt.Sprintf("%x", md5.Sum(data)), err
+	readBufferSize, writeChunkSize := defaultReadBufferSize, defaultWriteChunkSize
+	maxWriteChunkSize := 0
+	if r.config != nil {
+		if r.config.readBufferSize > 0 {
+			readBufferSize = r.config.readBufferSize
+		}
+		if r.config.writeChunkSize > 0 {
+			writeChunkSize = r.config.writeChunkSize
+		}
+		maxWriteChunkSize = r.config.maxWriteChunkSize
+	}
+	minWriteChunkSize := writeChunkSize
+	if maxWriteChunkSize < writeChunkSize {
+		maxWriteChunkSize = writeChunkSize
+	}
+	if r.config != nil && r.config.mmapThreshold > 0 && offset == 0 && length >= int64(r.config.mmapThreshold) {
+		res, err := r.downloadMapped(bufio.NewReaderSize(body, readBufferSize), file, length, hashes, maxWriteChunkSize, progress)
+		if err != errMmapUnavailable {
+			return res, err
+		}
+		r.telemetry().Event("mmap_unavailable", nil)
+	}
+
+	size := offset
+	reader := bufio.NewReaderSize(body, readBufferSize)
+	chunk := make([]byte, writeChunkSize)
+	for {
+		start := time.Now()
+		n, err := io.ReadFull(reader, chunk)
+		elapsed := time.Since(start)
+		if n > 0 {
+			if _, err := file.Write(chunk[:n]); err != nil {
+				return downloadResult{}, err
+			}
+			hashes.Write(chunk[:n])
+			size += int64(n)
+			if progress != nil {
+				progress(size)
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		} else if err != nil {
+			return downloadResult{}, err
+		}
+		if next := adaptChunkSize(len(chunk), minWriteChunkSize, maxWriteChunkSize, elapsed); next != len(chunk) {
+			chunk = make([]byte, next)
+		}
+	}
+	return hashes.result(size), nil
+}
+
+// Chunks filled faster than fastChunk grow the write chunk size, and chunks
+// slower than slowChunk shrink it, so that trickling index files don't hold
+// large buffers while bulk .debs on fast links are written in large chunks.
+const (
+	fastChunk = 10 * time.Millisecond
+	slowChunk = 100 * time.Millisecond
+)
+
+// adaptChunkSize returns the size of the next write chunk, given how long it
+// took to fill one of size bytes, bounded by min and max.
+func adaptChunkSize(size, min, max int, elapsed time.Duration) int {
+	switch {
+	case elapsed < fastChunk && size < max:
+		size *= 2
+		if size > max {
+			size = max
+		}
+	case elapsed > slowChunk && size > min:
+		size /= 2
+		if size < min {
+			size = min
+		}
+	}
+	return size
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// decodedBody wraps a decompressing reader while closing the underlying
+// response body.
+type decodedBody struct {
+	io.Reader
+	body io.Closer
+}
+
+func (d decodedBody) Close() error {
+	return d.body.Close()
+}
+
+// gzipEncoded reports whether the body of resp is gzip encoded or is the
+// gzip variant of the requested file, and so must be decompressed.
+func gzipEncoded(resp *http.Response) bool {
+	return strings.EqualFold(resp.Header.Get("Content-Encoding"), "gzip") || isGzipVariant(resp)
+}
+
+// decodeBody returns the decompressed body of resp, along with a counter of
+// the compressed bytes read from the wire when the body is gzip encoded or is
+// the gzip variant of the requested file.
+func decodeBody(resp *http.Response) (io.ReadCloser, *countingReader, error) {
+	if !gzipEncoded(resp) {
+		return resp.Body, nil, nil
+	}
+	wire := &countingReader{r: resp.Body}
+	buffered := bufio.NewReader(wire)
+	if _, err := buffered.Peek(1); err == io.EOF {
+		// Zero-length files are legal, and an empty body has nothing to
+		// decode even if it is labeled as gzip.
+		return decodedBody{Reader: buffered, body: resp.Body}, nil, nil
+	}
+	gz, err := gzip.NewReader(buffered)
+	if err != nil {
+		resp.Body.Close()
+		return nil, nil, err
+	}
+	return decodedBody{Reader: gz, body: resp.Body}, wire, nil
+}
+
+// downloadResponse downloads the body of resp, which was received for req to
+// acquire uri, to filename, after the first offset bytes already there. If
+// maxSize is positive, the download fails once the file would exceed it.
+// progress, if set, is called with the bytes of the file written so far.
+func (m *Method) downloadResponse(req *http.Request, resp *http.Response, filename string, offset, maxSize int64, progress func(written int64)) (downloadResult, *countingReader, error) {
+	resp.Body = m.newResumingBody(req, resp, offset)
+	body, wire, err := decodeBody(resp)
+	if err != nil {
+		return downloadResult{}, nil, err
+	}
+	length := int64(-1)
+	if wire == nil {
+		length = resp.ContentLength
+	}
+	if maxSize > 0 {
+		body = &limitedBody{ReadCloser: body, n: offset, max: maxSize}
+	}
+	res, err := m.dl.download(body, filename, offset, length, progress)
+	return res, wire, err
 }
 
 func (m *Method) handleAcquire(ctx context.Context, msg *Message) error {
@@ -164,62 +873,331 @@ func (m *Method) handleAcquire(ctx context.Context, msg *Message) error {
 		m.writer.FailURI(uri, err.Error())
 		return err
 	}
-	ifModifiedSince := msg.Get("Last-Modified")
+	if err := m.checkExpectedRepository(uri); err != nil {
+		m.writer.FailURI(uri, err.Error())
+		return err
+	}
+	ifModifiedSince := httpDate(msg.Get("Last-Modified"))
+
+	expectedSize := msg.Get("Expected-Size")
+	if expectedSize == "" {
+		expectedSize = msg.Get("Expected-Checksum-FileSize")
+	}
+	// apt limits files whose size it can't know in advance, such as
+	// InRelease, to Maximum-Size.
+	maxSize, _ := strconv.ParseInt(msg.Get("Maximum-Size"), 10, 64)
+
+	ctx = context.WithValue(ctx, acquireIDKey{}, atomic.AddUint64(&m.acquireSeq, 1))
+	if prev, ok := m.reuseCompleted(ctx, uri, filename); ok && sizeMatches(expectedSize, prev.result.size) && hashMismatch(msg, prev.result) == nil &&
+		(maxSize <= 0 || prev.result.size <= maxSize) {
+		size := strconv.FormatInt(prev.result.size, 10)
+		m.writer.URIStart(uri, size, prev.lastModified)
+		m.journalDelivery(uri, filename, prev.identity, prev.result)
+		setLastModified(filename, prev.lastModified)
+		done := new201Message(uri, size, prev.lastModified, prev.result.md5Hash, filename, false)
+		setHashFields(done, prev.result)
+		m.writer.WriteMessage(done)
+		return nil
+	}
 
 	if err := m.initClient(ctx); err != nil {
 		m.writer.FailURI(uri, err.Error())
 		return err
 	}
 
-	realuri := strings.Replace(uri, "ar+https", "https", 1)
+	sc := m.sourceConfigFor(uri)
+	if sc != nil {
+		if err := m.initSourceClient(ctx, sc); err != nil {
+			m.writer.FailURI(uri, err.Error())
+			return err
+		}
+		ctx = context.WithValue(ctx, sourceConfigKey{}, sc)
+	}
+
+	m.selectRegion(ctx)
+
+	realuri := m.fallbackURI(m.regionURI(strings.Replace(encodeURI(uri), "ar+https", "https", 1)))
 	req, err := http.NewRequest("GET", realuri, nil)
 	if err != nil {
+		m.writer.FailURI(uri, err.Error())
+		return err
+	}
+	if err := m.checkEgress(ctx, req.URL.Hostname()); err != nil {
+		m.writer.FailURI(uri, err.Error())
+		return err
+	}
+	if err := m.hostFailure(req.URL.Host, m.identityFor(sc, req.URL)); err != nil {
+		m.writer.FailURI(uri, err.Error())
 		return err
 	}
+	if err := m.checkRequireAuth(req.URL); err != nil {
+		m.writer.FailURI(uri, err.Error())
+		return err
+	}
+	m.startPrewarm(ctx, uri, req.URL.Host)
+	reqCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	req = req.WithContext(reqCtx)
+	// Timeout bounds the wait for a response, not the whole transfer.
+	var timer Timer
+	timeout := m.config.timeout(req.URL.Host)
+	if timeout > 0 {
+		timer = m.timeSource().NewTimer(timeout)
+		go func() {
+			select {
+			case <-timer.C():
+				cancel()
+			case <-reqCtx.Done():
+			}
+		}()
+	}
+	var offset int64
 	if ifModifiedSince != "" {
-		// TODO(hopkiw): validate this string is in RFC1123Z format.
-		req.Header.Add("If-Modified-Since", ifModifiedSince)
+		req.Header.Set("If-Modified-Since", ifModifiedSince)
+	} else if msg.Get("Last-Modified") != "" {
+		m.debugLog(ctx, fmt.Sprintf("ignoring Last-Modified %q of %s, which isn't a date", msg.Get("Last-Modified"), uri))
+	} else if n, validator := partialDownload(filename, uri); n > 0 {
+		// Ask for the rest of what an earlier attempt left behind.
+		offset = n
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		req.Header.Set("If-Range", validator)
 	}
+	for name, values := range m.config.extraHeaders(req.URL.Host) {
+		for _, value := range values {
+			req.Header.Add(name, value)
+		}
+	}
+	if sc != nil && sc.quotaProject != "" {
+		req.Header.Set(quotaProjectHeader, sc.quotaProject)
+	}
+	setAcceptHeaders(req.Header, uri)
 
 	if m.config.debug {
 		if reqDump, dumpErr := httputil.DumpRequest(req, true); dumpErr == nil {
-			m.writer.Log(string(reqDump))
+			m.debugLog(ctx, string(reqDump))
 		}
 	}
 
-	resp, err := m.client.Do(req)
+	resp, err := m.do(req)
+	if timer != nil && !timer.Stop() && err != nil {
+		err = fmt.Errorf("timed out after %v waiting for %s", timeout, req.URL.Host)
+	}
 
 	if m.config.debug && resp != nil {
 		if respDump, dumpErr := httputil.DumpResponse(resp, false); dumpErr == nil {
-			m.writer.Log(string(respDump))
+			m.debugLog(ctx, string(respDump))
+		}
+		if upstream := describeUpstream(resp); upstream != "" {
+			m.debugLog(ctx, upstream)
 		}
 	}
 
+	if err != nil && m.switchToFallback(req.URL.Host, err) {
+		req = req.Clone(reqCtx)
+		req.URL.Host, req.Host = m.config.fallbackEndpoint, ""
+		resp, err = m.do(req)
+	}
 	if err != nil {
+		if proxy, _ := proxyForRequest(req); proxy != nil {
+			if proxyErr := proxyFailure(err, proxy, req.URL.Host); proxyErr != nil {
+				err = proxyErr
+			}
+		}
+		m.recordHostFailure(req.URL.Host, m.identityFor(sc, req.URL), err)
+		m.deferRetry(ctx, uri, err)
 		m.writer.FailURI(uri, err.Error())
 		return err
 	}
 
+	if realm, ok := m.config.intermediaryChallenge(req, resp); ok {
+		// Credentials for Artifact Registry won't satisfy it, so don't
+		// retry with them, and don't let the user blame IAM.
+		drainBody(resp.Body)
+		err := intermediaryRejection(resp.Status, realm)
+		m.writer.FailURIReason(uri, err.Error(), fmt.Sprintf("HttpError%d", resp.StatusCode))
+		return err
+	}
+
+	if (resp.StatusCode == 401 || resp.StatusCode == 403) && m.authenticate(ctx) {
+		// The repository isn't public, but credentials have turned up
+		// since the method started, so ask again with them.
+		drainBody(resp.Body)
+		m.debugLog(ctx, fmt.Sprintf("retrying %s with credentials after %s", uri, resp.Status))
+		m.warn(fmt.Sprintf("%s refused a request without credentials, which was retried with application default credentials", req.URL.Host))
+		if resp, err = m.do(req); err != nil {
+			m.recordHostFailure(req.URL.Host, m.identityFor(sc, req.URL), err)
+			m.deferRetry(ctx, uri, err)
+			m.writer.FailURI(uri, err.Error())
+			return err
+		}
+	}
+
+	if resp.StatusCode >= 400 {
+		// A common misconfiguration is pointing apt at a repository of
+		// another format, which otherwise surfaces as a confusing 4xx.
+		if err := repositoryFormatError(resp); err != nil {
+			m.writer.FailURI(uri, err.Error())
+			return err
+		}
+	}
+
+	if resp.StatusCode != 200 {
+		defer drainBody(resp.Body)
+	}
+	if arch := indexArch(uri); arch != "" {
+		m.metrics().Counter("arch_index_responses", 1, map[string]string{"arch": arch, "status": strconv.Itoa(resp.StatusCode)})
+	}
+
 	size := resp.Header.Get("Content-Length")
 	lastModified := resp.Header.Get("Last-Modified")
+	var resumed int64
+	if resp.StatusCode == http.StatusPartialContent {
+		start, total, err := resumedRange(resp, offset)
+		if err != nil {
+			m.writer.FailURI(uri, err.Error())
+			return err
+		}
+		resumed = start
+		size = ""
+		if total >= 0 {
+			size = strconv.FormatInt(total, 10)
+		}
+	}
 	switch resp.StatusCode {
-	case 200:
+	case 200, 206:
+		if err := checkMaximumSize(resp, size, maxSize); err != nil {
+			if resumed > 0 {
+				os.Remove(filename)
+			}
+			m.writer.FailURIReason(uri, err.Error(), "MaximumSizeExceeded")
+			return err
+		}
 		// It's weird to send URI Start after we've already contacted
 		// the server, but we need to know the size.
-		m.writer.URIStart(uri, size, lastModified)
-		md5Hash, err := m.dl.download(resp.Body, filename)
+		start := new200Message(uri, size, lastModified)
+		start.fields["Resume-Point"] = []string{strconv.FormatInt(resumed, 10)}
+		m.writer.WriteMessage(start)
+		progress := m.downloadProgress(uri, expectedLength(resp, size))
+		res, wire, err := m.downloadResponse(req, resp, filename, resumed, maxSize, progress)
+		if rb, ok := resp.Body.(*resumingBody); ok && errors.Is(err, errRestartDownload) {
+			// Start over rather than report hashes of a file spliced
+			// together from two versions. Creating the file again
+			// truncates it and resets the hashes.
+			m.writer.Log(fmt.Sprintf("%s changed during transfer, downloading it again", uri))
+			resp = rb.restarted
+			lastModified = resp.Header.Get("Last-Modified")
+			resumed = 0
+			res, wire, err = m.downloadResponse(req, resp, filename, 0, maxSize, progress)
+		}
+		var tooLarge *maximumSizeError
+		if errors.As(err, &tooLarge) {
+			// Leave nothing to resume, nor for apt to mistake for the
+			// file.
+			os.Remove(filename)
+			m.writer.FailURIReason(uri, err.Error(), "MaximumSizeExceeded")
+			return err
+		}
 		if err != nil {
+			setLastModified(filename, lastModified)
+			m.deferRetry(ctx, uri, err)
+			m.writer.FailURI(uri, err.Error())
+			return err
+		}
+		if !sizeMatches(expectedSize, res.size) {
+			// Indexes regenerated during a long transaction can
+			// legitimately change size, so this may be relaxed.
+			err := fmt.Errorf("size mismatch: expected %s bytes, got %d", expectedSize, res.size)
+			if !m.config.warnSizeMismatch {
+				m.writer.FailURI(uri, err.Error())
+				return err
+			}
+			m.writer.Warning(fmt.Sprintf("%s: %v", uri, err))
+		}
+		if err := hashMismatch(msg, res); err != nil {
+			// Hand apt a failure rather than a file it would only reject.
+			m.writer.FailURIReason(uri, err.Error(), "HashSumMismatch")
+			return err
+		}
+		if m.config.verifyChecksums && strings.HasSuffix(uriPath(uri), ".deb") {
+			if err := m.verifyChecksum(ctx, uri, filename); err != nil {
+				m.writer.FailURI(uri, err.Error())
+				return err
+			}
+		}
+		identity := m.identityFor(sc, req.URL)
+		m.recordCompleted(uri, filename, lastModified, identity, res)
+		m.journalDelivery(uri, filename, identity, res)
+		transferred := res.size - resumed
+		if wire != nil {
+			transferred = wire.n
+		}
+		m.recordEgress(uri, transferred)
+		setLastModified(filename, lastModified)
+		done := new201Message(uri, strconv.FormatInt(res.size, 10), lastModified, res.md5Hash, filename, false)
+		setHashFields(done, res)
+		if wire != nil {
+			// Size is what ended up on disk; also report what was
+			// transferred so apt's accounting stays accurate.
+			done.fields["Compressed-Size"] = []string{strconv.FormatInt(wire.n, 10)}
+		}
+		m.recordResponseHeaders(done, resp.Header)
+		m.writer.WriteMessage(done)
+	case 416:
+		if err := m.completedPartial(msg, filename, offset, resp, m.identityFor(sc, req.URL)); err != nil {
 			m.writer.FailURI(uri, err.Error())
 			return err
 		}
-		m.writer.URIDone(uri, size, lastModified, md5Hash, filename, false)
 	case 304:
 		// Unchanged since Last-Modified. Respond with "IMS-Hit: true" to
 		// indicate the existing file is valid.
+		if lastModified == "" {
+			lastModified = msg.Get("Last-Modified")
+		}
 		m.writer.URIDone(uri, size, lastModified, "", filename, true)
+	case 404:
+		reason := fmt.Sprintf("HttpError%d", resp.StatusCode)
+		if isOptionalIndex(uri) {
+			// apt probes for these files and falls back quietly when they
+			// are missing, so keep the message short and unalarming. apt
+			// falls back on HttpError404, so the reason stays, and
+			// Transient-Failure tells it the file is missing for good
+			// rather than worth retrying.
+			failure := new400Message(uri, "404 Not Found", reason)
+			failure.fields["Transient-Failure"] = []string{"false"}
+			m.writer.WriteMessage(failure)
+			return fmt.Errorf("optional file not found: %s", uri)
+		}
+		err := fmt.Errorf("error downloading: code %v", resp.StatusCode)
+		m.writer.FailURIReason(uri, err.Error(), reason)
+		return err
+	case 301, 302, 303, 307, 308:
+		// Only seen when Follow-Redirects is off; otherwise the client
+		// follows them.
+		newURI, err := m.config.redirectURI(req, resp.Header.Get("Location"))
+		if err != nil {
+			m.writer.FailURI(uri, err.Error())
+			return err
+		}
+		m.debugLog(ctx, fmt.Sprintf("passing redirect of %s to %s to apt", uri, newURI))
+		m.writer.Redirect(uri, newURI)
+	case 410:
+		// Cleanup policies delete old versions, which the local indexes
+		// may still list. Retrying won't help, refreshing them will.
+		err := errors.New("410 Gone: this file was deleted from the repository, e.g. by a cleanup policy; run apt update to refresh the package indexes")
+		m.writer.FailURIReason(uri, err.Error(), fmt.Sprintf("HttpError%d", resp.StatusCode))
+		return err
+	case 401, 403:
+		// Artifact Registry's own refusal, as intermediaries' were
+		// reported above.
+		err := fmt.Errorf("error downloading: code %v, refused by %s for %s: check that these credentials may read the repository", resp.StatusCode, req.URL.Host, m.identityFor(sc, req.URL))
+		m.writer.FailURIReason(uri, err.Error(), fmt.Sprintf("HttpError%d", resp.StatusCode))
+		return err
 	default:
-		// All other codes including 404, 403, etc.
+		// All other codes.
 		err := fmt.Errorf("error downloading: code %v", resp.StatusCode)
+		if transientStatus(resp.StatusCode) {
+			m.deferRetry(ctx, uri, err)
+		}
 		m.writer.FailURI(uri, err.Error())
 		return err
 	}
@@ -227,6 +1205,94 @@ func (m *Method) handleAcquire(ctx context.Context, msg *Message) error {
 	return nil
 }
 
+// recordResponseHeaders copies the configured response headers into a URI
+// Done message, e.g. X-Goog-Generation to trace exactly which object was
+// installed. Headers named like a field apt knows or one of the message's
+// fields are skipped, without regard to case as apt reads them, so that a
+// response can't replace e.g. the hashes apt verifies.
+func (m *Method) recordResponseHeaders(done Message, header http.Header) {
+	for _, name := range m.config.recordHeaders {
+		if _, known := aptFieldNames[strings.ToLower(name)]; known || done.hasField(name) {
+			continue
+		}
+		if values := header.Values(name); len(values) > 0 {
+			done.fields[canonicalFieldName(name)] = values
+		}
+	}
+}
+
+// nonAptFormat matches Artifact Registry errors which give the format of a
+// repository other than apt, e.g. "has format DOCKER" or "The format of
+// repository projects/p/locations/l/repositories/r is MAVEN". Formats are
+// only matched as Artifact Registry spells them, in upper case right after
+// the words naming them, so that ordinary words such as "go" aren't taken
+// for one.
+var nonAptFormat = regexp.MustCompile(`\b[Ff]ormat:? (DOCKER|MAVEN|NPM|PYTHON|YUM|GO|KFP|GENERIC)\b|\b[Ff]ormat of repository \S+ is (DOCKER|MAVEN|NPM|PYTHON|YUM|GO|KFP|GENERIC)\b`)
+
+// repositoryFormatError inspects the body of an error response and returns
+// an explanatory error if it indicates the repository is not an apt
+// repository.
+func repositoryFormatError(resp *http.Response) error {
+	if resp.Body == nil {
+		return nil
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	if err != nil {
+		return nil
+	}
+	match := nonAptFormat.FindSubmatch(body)
+	if match == nil {
+		return nil
+	}
+	format := match[1]
+	if len(format) == 0 {
+		format = match[2]
+	}
+	return fmt.Errorf("repository has format %s, not apt; check the sources.list entry (code %d)", format, resp.StatusCode)
+}
+
+// do sends an HTTP request for an acquire.
+func (m *Method) do(req *http.Request) (*http.Response, error) {
+	if err := m.injectChaos(); err != nil {
+		return nil, err
+	}
+	clock := m.timeSource()
+	start := clock.Now()
+	resp, err := m.clientFor(req).Do(req)
+	latency := clock.Now().Sub(start)
+	status, code := "error", 0
+	if err == nil {
+		status, code = strconv.Itoa(resp.StatusCode), resp.StatusCode
+	}
+	m.metrics().Timer("http_request", latency, map[string]string{"host": req.URL.Host, "status": status})
+	m.observeResponse(req.Context(), code, err, latency)
+	return resp, err
+}
+
+// isOptionalIndex reports whether uri refers to an index file which apt
+// requests speculatively and for which a 404 is an expected outcome, e.g.
+// InRelease (apt falls back to Release and Release.gpg), translations and
+// contents indices.
+func isOptionalIndex(uri string) bool {
+	base := path.Base(uri)
+	for _, ext := range []string{".gz", ".xz", ".bz2", ".lzma", ".lz4", ".zst"} {
+		base = strings.TrimSuffix(base, ext)
+	}
+	switch {
+	case base == "InRelease":
+		return true
+	case strings.HasPrefix(base, "Translation-"):
+		return true
+	case strings.HasPrefix(base, "Contents-"):
+		return true
+	case base == "Index" && strings.Contains(uri, "/i18n/"):
+		return true
+	case strings.Contains(uri, "/dep11/"):
+		return true
+	}
+	return false
+}
+
 // Ported from apt's `StringToBool` function
 // https://salsa.debian.org/apt-team/apt/-/blob/a0a76c2e20c1ddefd76a4a539a9350b96d66006e/apt-pkg/contrib/strutl.cc#L824
 func stringToBool(s string) bool {
@@ -248,29 +1314,126 @@ func stringToBool(s string) bool {
 	return false
 }
 
-func (m *Method) handleConfigure(msg *Message) {
-	configs, ok := msg.fields["Config-Item"]
-	if !ok {
-		// Nothing to set.
-		return
+// sizeMatches reports whether size matches the size apt expects, if any.
+func sizeMatches(expected string, size int64) bool {
+	if expected == "" {
+		return true
+	}
+	return expected == strconv.FormatInt(size, 10)
+}
+
+// hashMismatch compares the digests of res with those apt expects, given by
+// Expected-MD5Sum, Expected-SHA1, Expected-SHA256 and Expected-SHA512, and
+// describes the first which differs. Digests the hash backend didn't
+// compute are left to apt to check.
+func hashMismatch(msg *Message, res downloadResult) error {
+	for _, h := range []struct{ algorithm, sum string }{
+		{"MD5Sum", res.md5Hash},
+		{"SHA1", res.sha1Hash},
+		{"SHA256", res.sha256Hash},
+		{"SHA512", res.sha512Hash},
+	} {
+		expected := strings.TrimSpace(msg.Get("Expected-" + h.algorithm))
+		if expected == "" || h.sum == "" {
+			continue
+		}
+		if !strings.EqualFold(expected, h.sum) {
+			return fmt.Errorf("%s hash mismatch: expected %s, got %s", h.algorithm, expected, h.sum)
+		}
+	}
+	return nil
+}
+
+// handleConfigure applies the Config-Item fields of a 601 Configuration
+// message. As with apt.conf, when the same key is given more than once the
+// last value wins; list items (keys ending in "::") accumulate instead.
+// Environment variables then override options; see applyEnvOverrides. A
+// later message replaces the configuration of an earlier one; see
+// resetConfig. An error is returned if an item is malformed, as apt never
+// sends those, or with Strict-Config set, if an Acquire::gar item is
+// unknown or has a value of the wrong type.
+func (m *Method) handleConfigure(msg *Message) error {
+	m.configMu.Lock()
+	defer m.configMu.Unlock()
+	reconfiguring := m.configured
+	var previous map[string]*configValue
+	if reconfiguring {
+		previous = m.resetConfig()
 	}
+	m.configured = true
+	configs := msg.GetAll("Config-Item")
+	strict := false
+	for _, configItem := range configs {
+		if value := strings.TrimPrefix(configItem, strictConfigItem+"="); value != configItem {
+			strict = stringToBool(strings.TrimSpace(value))
+		}
+	}
+	seen := make(map[string]string)
+	var overridden []string
 	for _, configItem := range configs {
 		parts := strings.SplitN(configItem, "=", 2)
 		if len(parts) != 2 {
-			m.writer.Log(fmt.Sprintf("malformed config item: %v", configItem))
-			return
+			return fmt.Errorf("malformed config item: %v", configItem)
+		}
+		if !strings.HasSuffix(parts[0], "::") {
+			if prev, ok := seen[parts[0]]; ok && prev != parts[1] {
+				value := parts[1]
+				if isSecretConfigItem(parts[0]) {
+					value, prev = redacted, redacted
+				}
+				overridden = append(overridden, fmt.Sprintf("config item %s=%q overrides earlier value %q", parts[0], value, prev))
+			}
+			seen[parts[0]] = parts[1]
 		}
-		switch parts[0] {
-		case "Acquire::gar::Service-Account-JSON":
-			m.config.serviceAccountJSON = strings.TrimSpace(parts[1])
-		case "Acquire::gar::Service-Account-Email":
-			m.config.serviceAccountEmail = strings.TrimSpace(parts[1])
-		case "Debug::Acquire::gar":
-			m.config.debug = stringToBool(strings.TrimSpace(parts[1]))
+		if option, ok := configOptionsByItem[parts[0]]; ok {
+			if strict {
+				if err := option.validate(parts[1]); err != nil {
+					return err
+				}
+			}
+			option.apply(m, configItem, parts[1])
+			m.recordConfig(option, parts[1], sourceApt)
+		} else if err := m.handleScopedConfig(parts[0], parts[1]); err != nil {
+			if strict {
+				return err
+			}
+			if !errors.Is(err, errUnknownConfigItem) {
+				m.writer.Log(err.Error())
+			}
 		}
 	}
-	// Enforce the precedence of these two options.
+	if err := m.applyEnvOverrides(strict); err != nil {
+		return err
+	}
+	// Enforce the precedence of the credential options.
+	if m.config.credential != nil {
+		m.config.serviceAccountJSON = ""
+	}
 	if m.config.serviceAccountJSON != "" {
 		m.config.serviceAccountEmail = ""
 	}
+	if len(m.config.delegates) > 0 && m.config.impersonate == "" {
+		m.writer.Log("Impersonate-Delegates is ignored without Impersonate-Service-Account")
+	}
+	if m.config.debug {
+		for _, o := range overridden {
+			m.writer.Log(o)
+		}
+	}
+	m.detectAptVersion(seen)
+	if reconfiguring {
+		m.reconfigured(previous)
+	}
+	return nil
+}
+
+// parseSize parses a positive integer, such as a size in bytes, from a config
+// item value, logging and returning false if it is invalid.
+func (m *Method) parseSize(configItem, value string) (int, bool) {
+	size, err := strconv.Atoi(strings.TrimSpace(value))
+	if err != nil || size <= 0 {
+		m.writer.Log(fmt.Sprintf("invalid value in config item: %v", configItem))
+		return 0, false
+	}
+	return size, true
 }
@@ -16,11 +16,23 @@ package apt
 
 import (
 	"bufio"
+	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash"
 	"io"
 	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestHandleConfigure(t *testing.T) {
@@ -77,6 +89,14 @@ func TestHandleConfigure(t *testing.T) {
 			},
 			aptMethodConfig{debug: false},
 		},
+		{
+			// Last value wins.
+			[]string{
+				"Acquire::gar::Service-Account-Email=first@domain",
+				"Acquire::gar::Service-Account-Email=second@domain",
+			},
+			aptMethodConfig{serviceAccountEmail: "second@domain"},
+		},
 	}
 
 	for _, tt := range tests {
@@ -99,25 +119,648 @@ func TestHandleConfigure(t *testing.T) {
 
 }
 
+func TestHandleConfigureOverrideLogging(t *testing.T) {
+	var tests = []struct {
+		configItems []string
+		expectLog   bool
+	}{
+		{
+			[]string{
+				"Debug::Acquire::gar=true",
+				"Acquire::gar::Service-Account-Email=first@domain",
+				"Acquire::gar::Service-Account-Email=second@domain",
+			},
+			true,
+		},
+		{
+			// Only logged in debug mode.
+			[]string{
+				"Acquire::gar::Service-Account-Email=first@domain",
+				"Acquire::gar::Service-Account-Email=second@domain",
+			},
+			false,
+		},
+		{
+			// Repeating the same value is not an override.
+			[]string{
+				"Debug::Acquire::gar=true",
+				"Acquire::gar::Service-Account-Email=first@domain",
+				"Acquire::gar::Service-Account-Email=first@domain",
+			},
+			false,
+		},
+		{
+			// List items accumulate.
+			[]string{
+				"Debug::Acquire::gar=true",
+				"Acquire::gar::Region-Candidates::=us-apt.pkg.dev",
+				"Acquire::gar::Region-Candidates::=europe-apt.pkg.dev",
+			},
+			false,
+		},
+	}
+
+	for _, tt := range tests {
+		var buffer bytes.Buffer
+		method := NewAptMethod(bufio.NewReader(&bytes.Buffer{}), &buffer)
+		msg := &Message{
+			code:        601,
+			description: "Configuration",
+			fields:      map[string][]string{"Config-Item": tt.configItems},
+		}
+
+		method.handleConfigure(msg)
+		if logged := strings.Contains(buffer.String(), "overrides earlier value"); logged != tt.expectLog {
+			t.Errorf("override logged = %v, expected %v; output %q", logged, tt.expectLog, buffer.String())
+		}
+	}
+}
+
+func TestHandleConfigureSizes(t *testing.T) {
+	var tests = []struct {
+		configItems                                       []string
+		readBufferSize, writeChunkSize, maxWriteChunkSize int
+	}{
+		{
+			[]string{
+				"Acquire::gar::Read-Buffer-Size=1048576",
+				"Acquire::gar::Write-Chunk-Size=4096",
+				"Acquire::gar::Max-Write-Chunk-Size=65536",
+			},
+			1048576, 4096, 65536,
+		},
+		{
+			[]string{
+				"Acquire::gar::Read-Buffer-Size=big",
+				"Acquire::gar::Write-Chunk-Size=-1",
+				"Acquire::gar::Max-Write-Chunk-Size=0",
+			},
+			defaultReadBufferSize, defaultWriteChunkSize, 0,
+		},
+	}
+
+	for _, tt := range tests {
+		var buffer bytes.Buffer
+		method := NewAptMethod(bufio.NewReader(&bytes.Buffer{}), &buffer)
+		msg := &Message{
+			code:        601,
+			description: "Configuration",
+			fields:      map[string][]string{"Config-Item": tt.configItems},
+		}
+
+		method.handleConfigure(msg)
+		if method.config.readBufferSize != tt.readBufferSize {
+			t.Errorf("read buffer size doesn't match, got %d expected %d", method.config.readBufferSize, tt.readBufferSize)
+		}
+		if method.config.writeChunkSize != tt.writeChunkSize {
+			t.Errorf("write chunk size doesn't match, got %d expected %d", method.config.writeChunkSize, tt.writeChunkSize)
+		}
+		if method.config.maxWriteChunkSize != tt.maxWriteChunkSize {
+			t.Errorf("max write chunk size doesn't match, got %d expected %d", method.config.maxWriteChunkSize, tt.maxWriteChunkSize)
+		}
+	}
+}
+
+func TestAdaptChunkSize(t *testing.T) {
+	var tests = []struct {
+		size, min, max int
+		elapsed        time.Duration
+		expected       int
+	}{
+		{4096, 4096, 65536, time.Millisecond, 8192},
+		{49152, 4096, 65536, time.Millisecond, 65536},
+		{65536, 4096, 65536, time.Millisecond, 65536},
+		{65536, 4096, 65536, time.Second, 32768},
+		{6144, 4096, 65536, time.Second, 4096},
+		{4096, 4096, 65536, time.Second, 4096},
+		{8192, 4096, 65536, 50 * time.Millisecond, 8192},
+		{4096, 4096, 4096, time.Millisecond, 4096},
+	}
+
+	for _, tt := range tests {
+		if res := adaptChunkSize(tt.size, tt.min, tt.max, tt.elapsed); res != tt.expected {
+			t.Errorf("failed, adaptChunkSize(%d, %d, %d, %v) = %d, expected %d", tt.size, tt.min, tt.max, tt.elapsed, res, tt.expected)
+		}
+	}
+}
+
+func TestDownload(t *testing.T) {
+	var tests = []struct {
+		data                                              string
+		readBufferSize, writeChunkSize, maxWriteChunkSize int
+	}{
+		{"", 16, 16, 0},
+		{"hello world", 16, 16, 0},
+		{strings.Repeat("0123456789", 100), 16, 7, 0},
+		{strings.Repeat("0123456789", 100), 0, 0, 0},
+		{strings.Repeat("0123456789", 1000), 16, 7, 4096},
+	}
+
+	for _, tt := range tests {
+		filename := filepath.Join(t.TempDir(), "file")
+		dl := downloaderImpl{config: &aptMethodConfig{readBufferSize: tt.readBufferSize, writeChunkSize: tt.writeChunkSize, maxWriteChunkSize: tt.maxWriteChunkSize}}
+		res, err := dl.download(io.NopCloser(strings.NewReader(tt.data)), filename, 0, -1, nil)
+		if err != nil {
+			t.Fatalf("failed, %v", err)
+		}
+		if expected := fmt.Sprintf("%x", md5.Sum([]byte(tt.data))); res.md5Hash != expected {
+			t.Errorf("hash doesn't match, got %q expected %q", res.md5Hash, expected)
+		}
+		if res.size != int64(len(tt.data)) {
+			t.Errorf("size doesn't match, got %d expected %d", res.size, len(tt.data))
+		}
+		contents, err := os.ReadFile(filename)
+		if err != nil {
+			t.Fatalf("failed, %v", err)
+		}
+		if string(contents) != tt.data {
+			t.Errorf("contents don't match, got %d bytes expected %d bytes", len(contents), len(tt.data))
+		}
+	}
+}
+
+func TestDownloadMapped(t *testing.T) {
+	data := strings.Repeat("0123456789", 1000)
+	var tests = []struct {
+		name          string
+		length        int64
+		mmapThreshold int
+		expected      string
+		expectErr     bool
+	}{
+		{"mapped", int64(len(data)), 1, data, false},
+		{"below threshold", int64(len(data)), len(data) + 1, data, false},
+		{"unknown length", -1, 1, data, false},
+		{"short body", int64(len(data)) + 10, 1, data, false},
+		{"long body", int64(len(data)) - 10, 1, "", true},
+	}
+
+	for _, tt := range tests {
+		filename := filepath.Join(t.TempDir(), "file")
+		var progress int64
+		dl := downloaderImpl{config: &aptMethodConfig{writeChunkSize: 4096, mmapThreshold: tt.mmapThreshold}}
+		res, err := dl.download(io.NopCloser(strings.NewReader(data)), filename, 0, tt.length, func(n int64) { progress = n })
+		if tt.expectErr {
+			if err == nil {
+				t.Errorf("%s: failed, expected an error", tt.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: failed, %v", tt.name, err)
+		}
+		contents, _ := os.ReadFile(filename)
+		if string(contents) != tt.expected || res.size != int64(len(tt.expected)) || progress != res.size {
+			t.Errorf("%s: failed, got %d bytes, size %d, progress %d, expected %d", tt.name, len(contents), res.size, progress, len(tt.expected))
+		}
+		if expected := fmt.Sprintf("%x", md5.Sum([]byte(tt.expected))); res.md5Hash != expected {
+			t.Errorf("%s: hash doesn't match, got %q expected %q", tt.name, res.md5Hash, expected)
+		}
+	}
+}
+
+// BenchmarkDownload compares buffered and memory-mapped writes of a large
+// package, to justify leaving Mmap-Threshold unset by default.
+func BenchmarkDownload(b *testing.B) {
+	data := bytes.Repeat([]byte("0123456789abcdef"), 4<<20)
+	for _, bm := range []struct {
+		name          string
+		mmapThreshold int
+	}{
+		{"buffered", 0},
+		{"mmap", 1},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			filename := filepath.Join(b.TempDir(), "file")
+			dl := downloaderImpl{config: &aptMethodConfig{mmapThreshold: bm.mmapThreshold}}
+			b.SetBytes(int64(len(data)))
+			for i := 0; i < b.N; i++ {
+				if _, err := dl.download(io.NopCloser(bytes.NewReader(data)), filename, 0, int64(len(data)), nil); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// countingHashBackend records which algorithms were requested.
+type countingHashBackend struct {
+	requested []string
+}
+
+func (b *countingHashBackend) New(algorithm string) hash.Hash {
+	b.requested = append(b.requested, algorithm)
+	return StandardHashBackend{}.New(algorithm)
+}
+
+func TestDownloadHashBackend(t *testing.T) {
+	backend := &countingHashBackend{}
+	SetHashBackend(backend)
+	defer SetHashBackend(StandardHashBackend{})
+
+	filename := filepath.Join(t.TempDir(), "file")
+	dl := downloaderImpl{config: &aptMethodConfig{}}
+	if _, err := dl.download(io.NopCloser(strings.NewReader("data")), filename, 0, -1, nil); err != nil {
+		t.Fatalf("failed, %v", err)
+	}
+	for _, algorithm := range []string{"MD5Sum", "SHA1", "SHA256", "SHA512"} {
+		found := false
+		for _, requested := range backend.requested {
+			found = found || requested == algorithm
+		}
+		if !found {
+			t.Errorf("expected the backend to provide %s, got %v", algorithm, backend.requested)
+		}
+	}
+
+	SetHashBackend(nilHashBackend{})
+	if _, err := dl.download(io.NopCloser(strings.NewReader("data")), filename, 0, -1, nil); err == nil {
+		t.Errorf("expected an error from a backend without MD5Sum")
+	}
+}
+
+type nilHashBackend struct{}
+
+func (nilHashBackend) New(string) hash.Hash { return nil }
+
+func TestDecodeBody(t *testing.T) {
+	data := strings.Repeat("Package: hello\n", 100)
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	gz.Write([]byte(data))
+	gz.Close()
+	wireSize := int64(compressed.Len())
+
+	resp := &http.Response{
+		Header: http.Header{"Content-Encoding": {"gzip"}},
+		Body:   io.NopCloser(&compressed),
+	}
+	body, wire, err := decodeBody(resp)
+	if err != nil {
+		t.Fatalf("failed, %v", err)
+	}
+	decoded, err := io.ReadAll(body)
+	if err != nil {
+		t.Fatalf("failed, %v", err)
+	}
+	if string(decoded) != data {
+		t.Errorf("decoded body doesn't match")
+	}
+	if wire == nil || wire.n != wireSize {
+		t.Errorf("compressed size doesn't match, got %v expected %d", wire, wireSize)
+	}
+
+	resp = &http.Response{Body: io.NopCloser(strings.NewReader(data))}
+	if _, wire, err := decodeBody(resp); err != nil || wire != nil {
+		t.Errorf("expected unencoded body to pass through, got %v, %v", wire, err)
+	}
+}
+
+func TestRepositoryFormatError(t *testing.T) {
+	var tests = []struct {
+		body     string
+		expected string
+	}{
+		{`{"error": {"code": 400, "message": "Repository \"my-repo\" has format DOCKER, which does not support this request."}}`, "DOCKER"},
+		{`The format of repository projects/p/locations/us/repositories/r is MAVEN`, "MAVEN"},
+		{`{"error": {"message": "unsupported request for repository format: GO"}}`, "GO"},
+		{`Please go to the console and check the request format.`, ""},
+		{`generic error: malformed request, format not supported`, ""},
+		{`Python packages have a different format. Use pip.`, ""},
+		{`Repository "r" has format docker`, ""},
+		{`Repository "r" has format APT, and the package was not found.`, ""},
+		{`The format of repository r is GOOGLE`, ""},
+		{`{"error": {"code": 404, "message": "Not found"}}`, ""},
+		{`Requested entity was not found.`, ""},
+		{``, ""},
+	}
+
+	for _, tt := range tests {
+		resp := &http.Response{StatusCode: 400, Body: io.NopCloser(strings.NewReader(tt.body))}
+		err := repositoryFormatError(resp)
+		if tt.expected == "" {
+			if err != nil {
+				t.Errorf("expected no error for %q, got %v", tt.body, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.expected) {
+			t.Errorf("expected error mentioning %s for %q, got %v", tt.expected, tt.body, err)
+		}
+	}
+}
+
+func TestIsOptionalIndex(t *testing.T) {
+	var tests = []struct {
+		uri      string
+		expected bool
+	}{
+		{"ar+https://us-apt.pkg.dev/projects/p/dists/r/InRelease", true},
+		{"ar+https://us-apt.pkg.dev/projects/p/dists/r/Release", false},
+		{"ar+https://us-apt.pkg.dev/projects/p/dists/r/main/i18n/Translation-en.xz", true},
+		{"ar+https://us-apt.pkg.dev/projects/p/dists/r/main/i18n/Index", true},
+		{"ar+https://us-apt.pkg.dev/projects/p/dists/r/main/Contents-amd64.gz", true},
+		{"ar+https://us-apt.pkg.dev/projects/p/dists/r/main/dep11/Components-amd64.yml.gz", true},
+		{"ar+https://us-apt.pkg.dev/projects/p/dists/r/main/binary-amd64/Packages.xz", false},
+		{"ar+https://us-apt.pkg.dev/projects/p/pool/r/h/hello/hello_1.0_amd64.deb", false},
+	}
+
+	for _, tt := range tests {
+		if res := isOptionalIndex(tt.uri); res != tt.expected {
+			t.Errorf("isOptionalIndex(%q) = %v, expected %v", tt.uri, res, tt.expected)
+		}
+	}
+}
+
 type fakeHTTPClient struct {
 	code   int
 	header map[string][]string
+	// body, if set, is returned as the response body.
+	body  string
+	calls *int
 }
 
 func (m fakeHTTPClient) Do(req *http.Request) (*http.Response, error) {
+	if m.calls != nil {
+		*m.calls++
+	}
 	if m.code == 0 {
 		m.code = 200
 	}
 	if m.header == nil {
 		m.header = map[string][]string{"Content-Length": {"200"}, "Last-Modified": {"whenever"}}
 	}
-	return &http.Response{StatusCode: m.code, Header: m.header}, nil
+	resp := &http.Response{StatusCode: m.code, Header: m.header}
+	if m.body != "" {
+		resp.Body = io.NopCloser(strings.NewReader(m.body))
+	}
+	return resp, nil
 }
 
 type fakeDownloader struct{}
 
-func (d fakeDownloader) download(_ io.ReadCloser, _ string) (string, error) {
-	return "ABCDEFGHI", nil
+func (d fakeDownloader) download(_ io.ReadCloser, _ string, _, _ int64, _ func(int64)) (downloadResult, error) {
+	return downloadResult{md5Hash: "ABCDEFGHI", size: 200}, nil
+}
+
+func TestAptMethodExpectedSize(t *testing.T) {
+	var tests = []struct {
+		configItem, expectedSize string
+		expectedCodes            []int
+	}{
+		{"", "", []int{200, 201}},
+		{"", "200", []int{200, 201}},
+		{"", "100", []int{200, 400}},
+		{"Acquire::gar::Expected-Size-Mismatch=fail", "100", []int{200, 400}},
+		{"Acquire::gar::Expected-Size-Mismatch=warn", "100", []int{200, 104, 201}},
+	}
+
+	for _, tt := range tests {
+		var buffer bytes.Buffer
+		method := NewAptMethod(bufio.NewReader(&bytes.Buffer{}), &buffer)
+		method.client = fakeHTTPClient{}
+		method.dl = fakeDownloader{}
+		if tt.configItem != "" {
+			method.handleConfigure(&Message{
+				code:        601,
+				description: "Configuration",
+				fields:      map[string][]string{"Config-Item": {tt.configItem}},
+			})
+		}
+		fields := map[string][]string{"URI": {"ar+https://fake.uri/dists/repo/Packages"}, "Filename": {"/path/to/file"}}
+		if tt.expectedSize != "" {
+			fields["Expected-Checksum-FileSize"] = []string{tt.expectedSize}
+		}
+		method.handleAcquire(context.Background(), &Message{code: 600, description: "URI Acquire", fields: fields})
+
+		var codes []int
+		reader := NewAptMessageReader(bufio.NewReader(&buffer))
+		for {
+			msg, err := reader.ReadMessage(context.Background())
+			if err != nil {
+				break
+			}
+			codes = append(codes, msg.code)
+		}
+		if !reflect.DeepEqual(codes, tt.expectedCodes) {
+			t.Errorf("failed with %q and expected size %q, expected %v got %v", tt.configItem, tt.expectedSize, tt.expectedCodes, codes)
+		}
+	}
+}
+
+func TestAptMethodExpectedHashes(t *testing.T) {
+	var tests = []struct {
+		name           string
+		fields         map[string][]string
+		expectedReason string
+	}{
+		{"none", map[string][]string{}, ""},
+		{"match", map[string][]string{"Expected-MD5Sum": {"abcdefghi"}}, ""},
+		{"mismatch", map[string][]string{"Expected-MD5Sum": {"0123456789"}}, "HashSumMismatch"},
+		{"not computed", map[string][]string{"Expected-SHA256": {"0123456789"}}, ""},
+	}
+
+	for _, tt := range tests {
+		var buffer bytes.Buffer
+		method := NewAptMethod(bufio.NewReader(&bytes.Buffer{}), &buffer)
+		method.client = fakeHTTPClient{}
+		method.dl = fakeDownloader{}
+		fields := map[string][]string{"URI": {"ar+https://fake.uri/pool/p.deb"}, "Filename": {"/path/to/file"}}
+		for k, v := range tt.fields {
+			fields[k] = v
+		}
+		err := method.handleAcquire(context.Background(), &Message{code: 600, description: "URI Acquire", fields: fields})
+
+		reader := NewAptMessageReader(bufio.NewReader(&buffer))
+		reader.ReadMessage(context.Background())
+		last, _ := reader.ReadMessage(context.Background())
+		if tt.expectedReason == "" {
+			if err != nil || last == nil || last.code != 201 {
+				t.Errorf("%s: failed, expected URI Done, got %v, %v", tt.name, last, err)
+			}
+			continue
+		}
+		if err == nil || last == nil || last.code != 400 || last.Get("FailReason") != tt.expectedReason ||
+			!strings.Contains(last.Get("Message"), "MD5Sum hash mismatch: expected 0123456789, got ABCDEFGHI") {
+			t.Errorf("%s: failed, expected URI Failure, got %v, %v", tt.name, last, err)
+		}
+	}
+}
+
+// TestAptMethodEmptyBody checks that a zero-length file, which is a legal
+// index, is written out and reported with the size and hash of empty input.
+func TestAptMethodEmptyBody(t *testing.T) {
+	var tests = []struct {
+		name        string
+		header      http.Header
+		chunked     bool
+		expectedLen string
+	}{
+		{"plain", nil, false, "0"},
+		{"gzip encoded", http.Header{"Content-Encoding": {"gzip"}}, false, "0"},
+		{"chunked", nil, true, ""},
+	}
+
+	for _, tt := range tests {
+		server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			for name, values := range tt.header {
+				w.Header()[name] = values
+			}
+			if tt.chunked {
+				w.(http.Flusher).Flush()
+			}
+		}))
+		filename := filepath.Join(t.TempDir(), "Packages")
+		os.WriteFile(filename, []byte("stale contents"), 0644)
+
+		var buffer bytes.Buffer
+		method := NewAptMethod(bufio.NewReader(&bytes.Buffer{}), &buffer)
+		method.client = server.Client()
+		msg := &Message{
+			code:        600,
+			description: "URI Acquire",
+			fields:      map[string][]string{"URI": {"ar+" + server.URL + "/dists/repo/main/binary-amd64/Packages"}, "Filename": {filename}},
+		}
+		if err := method.handleAcquire(context.Background(), msg); err != nil {
+			t.Errorf("%s: failed, %v", tt.name, err)
+		}
+		server.Close()
+
+		reader := NewAptMessageReader(bufio.NewReader(&buffer))
+		start, err := reader.ReadMessage(context.Background())
+		if err != nil || start.code != 200 || start.Get("Size") != tt.expectedLen {
+			t.Errorf("%s: failed, unexpected URI Start %v, %v", tt.name, start, err)
+		}
+		done, err := reader.ReadMessage(context.Background())
+		if err != nil || done.code != 201 || done.Get("Size") != "0" || done.Get("MD5-Hash") != fmt.Sprintf("%x", md5.Sum(nil)) ||
+			done.Get("SHA256-Hash") != fmt.Sprintf("%x", sha256.Sum256(nil)) {
+			t.Errorf("%s: failed, unexpected URI Done %v, %v", tt.name, done, err)
+		}
+		if contents, err := os.ReadFile(filename); err != nil || len(contents) != 0 {
+			t.Errorf("%s: failed, expected an empty file, got %q, %v", tt.name, contents, err)
+		}
+	}
+}
+
+func TestAptMethodDebugLogAttribution(t *testing.T) {
+	var buffer bytes.Buffer
+	method := NewAptMethod(bufio.NewReader(&bytes.Buffer{}), &buffer)
+	method.client = fakeHTTPClient{}
+	method.dl = fakeDownloader{}
+	method.config.debug = true
+	for _, uri := range []string{"ar+https://fake.uri/dists/repo/Release", "ar+https://fake.uri/dists/repo/InRelease"} {
+		method.handleAcquire(context.Background(), &Message{
+			code:        600,
+			description: "URI Acquire",
+			fields:      map[string][]string{"URI": {uri}, "Filename": {"/path/to/file"}},
+		})
+	}
+
+	for _, expected := range []string{"[acquire 1 #1] GET /dists/repo/Release", "[acquire 1 #2] HTTP/", "[acquire 2 #3] GET /dists/repo/InRelease", "[acquire 2 #4] HTTP/"} {
+		if !strings.Contains(buffer.String(), expected) {
+			t.Errorf("failed, expected debug log %q in %q", expected, buffer.String())
+		}
+	}
+}
+
+func TestAptMethodRecordHeaders(t *testing.T) {
+	var buffer bytes.Buffer
+	method := NewAptMethod(bufio.NewReader(&bytes.Buffer{}), &buffer)
+	method.client = fakeHTTPClient{header: map[string][]string{
+		"Last-Modified":     {"whenever"},
+		"Md5-Hash":          {"forged"},
+		"Sha512-Hash":       {"forged"},
+		"X-Goog-Generation": {"1614567906000000"},
+		"X-Goog-Hash":       {"crc32c=n03x6A==", "md5=Ojk9c3dhfxgoKVVHYwFbHQ=="},
+	}}
+	method.dl = fakeDownloader{}
+	method.handleConfigure(&Message{
+		code:        601,
+		description: "Configuration",
+		fields: map[string][]string{"Config-Item": {
+			"Acquire::gar::Record-Headers::=x-goog-generation",
+			"Acquire::gar::Record-Headers::=X-Goog-Hash",
+			"Acquire::gar::Record-Headers::=X-Missing",
+			"Acquire::gar::Record-Headers::=Last-Modified",
+			"Acquire::gar::Record-Headers::=MD5-Hash",
+			"Acquire::gar::Record-Headers::=sha512-hash",
+		}},
+	})
+	method.handleAcquire(context.Background(), &Message{
+		code:        600,
+		description: "URI Acquire",
+		fields:      map[string][]string{"URI": {"ar+https://fake.uri/pool/p.deb"}, "Filename": {"/path/to/file"}},
+	})
+
+	expected := "201 URI Done\nFilename: /path/to/file\nLast-Modified: whenever\nMD5-Hash: ABCDEFGHI\nMD5Sum-Hash: ABCDEFGHI\nSize: 200\nURI: ar+https://fake.uri/pool/p.deb\n" +
+		"X-Goog-Generation: 1614567906000000\nX-Goog-Hash: crc32c=n03x6A==\nX-Goog-Hash: md5=Ojk9c3dhfxgoKVVHYwFbHQ==\n\n"
+	if !strings.HasSuffix(buffer.String(), expected) {
+		t.Errorf("failed, expected:\n%q\ngot:\n%q", expected, buffer.String())
+	}
+}
+
+func TestAptMethodReuseCompleted(t *testing.T) {
+	dir := t.TempDir()
+	var calls int
+	var buffer bytes.Buffer
+	method := NewAptMethod(bufio.NewReader(&bytes.Buffer{}), &buffer)
+	method.client = fakeHTTPClient{body: "package contents", calls: &calls}
+
+	acquire := func(filename string) *Message {
+		buffer.Reset()
+		method.handleAcquire(context.Background(), &Message{
+			code:        600,
+			description: "URI Acquire",
+			fields:      map[string][]string{"URI": {"ar+https://fake.uri/pool/pkg.deb"}, "Filename": {filename}},
+		})
+		reader := NewAptMessageReader(bufio.NewReader(&buffer))
+		var last *Message
+		for {
+			msg, err := reader.ReadMessage(context.Background())
+			if err != nil {
+				return last
+			}
+			last = msg
+		}
+	}
+
+	first := filepath.Join(dir, "first")
+	second := filepath.Join(dir, "second")
+	var tests = []struct {
+		filename      string
+		expectedCalls int
+	}{
+		{first, 1},
+		// Same file, still intact.
+		{first, 1},
+		// Copied to a new file.
+		{second, 1},
+	}
+	for _, tt := range tests {
+		done := acquire(tt.filename)
+		if done == nil || done.code != 201 || done.Get("Size") != "16" {
+			t.Errorf("failed, expected URI Done, got %v", done)
+		}
+		if calls != tt.expectedCalls {
+			t.Errorf("got %d fetches, expected %d", calls, tt.expectedCalls)
+		}
+	}
+	if contents, err := os.ReadFile(second); err != nil || string(contents) != "package contents" {
+		t.Errorf("failed copying earlier download: %q, %v", contents, err)
+	}
+
+	// apt moved the file away, so it must be fetched again.
+	os.Remove(first)
+	os.Remove(second)
+	if done := acquire(first); done == nil || done.code != 201 || calls != 2 {
+		t.Errorf("failed, expected a new fetch, got %d fetches and %v", calls, done)
+	}
+
+	// The file changed on disk, so it must be fetched again.
+	os.WriteFile(first, []byte("tampered"), 0644)
+	if done := acquire(first); done == nil || done.code != 201 || calls != 3 {
+		t.Errorf("failed, expected a new fetch, got %d fetches and %v", calls, done)
+	}
 }
 
 func TestAptMethodRun(t *testing.T) {
@@ -232,6 +875,68 @@ func TestAptMethodRun404(t *testing.T) {
 	}
 }
 
+func TestAptMethodGone(t *testing.T) {
+	var buffer bytes.Buffer
+	method := NewAptMethod(bufio.NewReader(&bytes.Buffer{}), &buffer)
+	method.client = fakeHTTPClient{code: 410}
+	err := method.handleAcquire(context.Background(), &Message{
+		code:        600,
+		description: "URI Acquire",
+		fields:      map[string][]string{"URI": {"ar+https://fake.uri/pool/pkg_1.0.deb"}, "Filename": {"/path/to/file"}},
+	})
+	msg, _ := NewAptMessageReader(bufio.NewReader(&buffer)).ReadMessage(context.Background())
+	if err == nil || msg == nil || msg.code != 400 || msg.Get("FailReason") != "HttpError410" || !strings.Contains(msg.Get("Message"), "apt update") {
+		t.Errorf("failed, expected a failure explaining the deletion, got %v: %v", err, msg)
+	}
+}
+
+func TestAptMethodMalformedURI(t *testing.T) {
+	var buffer bytes.Buffer
+	var calls int
+	method := NewAptMethod(bufio.NewReader(&bytes.Buffer{}), &buffer)
+	method.client = fakeHTTPClient{calls: &calls}
+	uri := "ar+https://[fake.uri/pool/pkg_1.0.deb"
+	err := method.handleAcquire(context.Background(), &Message{
+		code:        600,
+		description: "URI Acquire",
+		fields:      map[string][]string{"URI": {uri}, "Filename": {"/path/to/file"}},
+	})
+	msg, _ := NewAptMessageReader(bufio.NewReader(&buffer)).ReadMessage(context.Background())
+	if err == nil || msg == nil || msg.code != 400 || msg.Get("URI") != uri || msg.Get("Message") != err.Error() {
+		t.Errorf("failed, expected a URI failure, got %v: %v", err, msg)
+	}
+	if calls != 0 {
+		t.Errorf("failed, expected no request, got %d", calls)
+	}
+}
+
+func TestAptMethodNotFoundFields(t *testing.T) {
+	var tests = []struct {
+		uri                        string
+		expectedMsg, expectedTrans string
+	}{
+		{"ar+https://fake.uri/pool/pkg_1.0.deb", "error downloading: code 404", ""},
+		{"ar+https://fake.uri/dists/repo/InRelease", "404 Not Found", "false"},
+		{"ar+https://fake.uri/dists/repo/main/i18n/Translation-en.xz", "404 Not Found", "false"},
+	}
+
+	for _, tt := range tests {
+		var buffer bytes.Buffer
+		method := NewAptMethod(bufio.NewReader(&bytes.Buffer{}), &buffer)
+		method.client = fakeHTTPClient{code: 404}
+		err := method.handleAcquire(context.Background(), &Message{
+			code:        600,
+			description: "URI Acquire",
+			fields:      map[string][]string{"URI": {tt.uri}, "Filename": {"/path/to/file"}},
+		})
+		msg, _ := NewAptMessageReader(bufio.NewReader(&buffer)).ReadMessage(context.Background())
+		if err == nil || msg == nil || msg.code != 400 || msg.Get("FailReason") != "HttpError404" ||
+			msg.Get("Message") != tt.expectedMsg || msg.Get("Transient-Failure") != tt.expectedTrans {
+			t.Errorf("%s: failed, expected Message %q and Transient-Failure %q, got %v: %v", tt.uri, tt.expectedMsg, tt.expectedTrans, err, msg)
+		}
+	}
+}
+
 func TestAptMethodRun304(t *testing.T) {
 
 	stdinreader, stdinwriter := io.Pipe()
@@ -303,17 +1008,15 @@ func TestAptMethodRunFail(t *testing.T) {
 		t.Errorf("failed, didn't receive capabilities message")
 	}
 
-	writer := MessageWriter{writer: stdinwriter}
-	writer.WriteMessage(Message{
-		code:        700,
-		description: "Malformed message",
-		fields:      map[string][]string{"": {"foo"}},
-	})
+	// MessageWriter won't write a field without a name, so write it raw.
+	io.WriteString(stdinwriter, "700 Malformed message\n: foo\n\n")
 
-	// If we receive a malformed message from `apt`, we immediately bail
-	// without sending an error response. Unlike the other tests, there is no
-	// protocol message to read here, but we can assert on the return value of
-	// `Run`.
+	// If we receive a malformed message from `apt`, we bail after telling
+	// it why with a General Failure, and Run returns the error.
+	msg, err = reader.ReadMessage(ctx)
+	if err != nil || msg.code != 401 || !strings.Contains(msg.Get("Message"), "invalid message from apt: malformed") {
+		t.Errorf("failed, expected a General Failure, got %v, %v", msg, err)
+	}
 	runErr := <-errChan
 	if runErr == nil {
 		t.Fatalf("failed, expected non-nil runErr (empty key)")
@@ -321,6 +1024,9 @@ func TestAptMethodRunFail(t *testing.T) {
 	if !strings.Contains(runErr.Error(), "malformed") {
 		t.Fatalf("failed, expected runErr to contain 'malformed'")
 	}
+	if KindOf(runErr) != ProtocolError {
+		t.Errorf("failed, expected a protocol error, got kind %v", KindOf(runErr))
+	}
 
 	for _, p := range []io.Closer{stdinreader, stdinwriter, stdoutreader, stdoutwriter} {
 		if err := p.Close(); err != nil {
@@ -328,3 +1034,128 @@ func TestAptMethodRunFail(t *testing.T) {
 		}
 	}
 }
+
+// failingWriter fails every write, as when apt has exited.
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) {
+	return 0, errors.New("broken pipe")
+}
+
+// TestAptMethodRunEOF checks that apt closing stdin between messages, as it
+// does once it is done, stops the method cleanly after the acquires it sent.
+func TestAptMethodRunEOF(t *testing.T) {
+	for _, input := range []string{
+		"",
+		"601 Configuration\nConfig-Item: Acquire::gar::Pipeline-Depth=2\n\n",
+		"600 URI Acquire\nURI: ar+https://fake.uri/a\nFilename: /path/to/a\n\n600 URI Acquire\nURI: ar+https://fake.uri/b\nFilename: /path/to/b\n\n\n",
+	} {
+		var buffer bytes.Buffer
+		method := NewAptMethod(bufio.NewReader(strings.NewReader(input)), &buffer)
+		method.client = fakeHTTPClient{body: "content"}
+		method.dl = fakeDownloader{}
+		if err := method.Run(context.Background()); err != nil {
+			t.Errorf("failed for %q, expected a clean exit, got %v", input, err)
+		}
+		if expected := strings.Count(input, "600 URI Acquire"); strings.Count(buffer.String(), "201 URI Done") != expected {
+			t.Errorf("failed for %q, expected %d URI Done before exiting, got:\n%s", input, expected, buffer.String())
+		}
+	}
+}
+
+func TestAptMethodRunErrorKinds(t *testing.T) {
+	var tests = []struct {
+		input    string
+		output   io.Writer
+		expected ErrorKind
+	}{
+		{"601 Configuration\nConfig-Item: Acquire::gar::Debug\n\n", &bytes.Buffer{}, ConfigError},
+		{"600\n\n", &bytes.Buffer{}, ProtocolError},
+		{"600 URI Acquire\nURI: ar+https://fake.uri/file\n", &bytes.Buffer{}, ProtocolError},
+		{"600 URI Acquire\nURI: ar+https://fake.uri/" + strings.Repeat("x", 1<<20) + "\n\n", &bytes.Buffer{}, ProtocolError},
+		{"", failingWriter{}, IOError},
+	}
+
+	for _, tt := range tests {
+		method := NewAptMethod(bufio.NewReader(strings.NewReader(tt.input)), tt.output)
+		err := method.Run(context.Background())
+		if err == nil || KindOf(err) != tt.expected {
+			t.Errorf("failed for %.60q, expected kind %v got %v (%v)", tt.input, tt.expected, KindOf(err), err)
+		}
+	}
+	if KindOf(errors.New("other")) != UnknownError {
+		t.Errorf("failed, expected unclassified errors to be unknown")
+	}
+}
+
+func TestFailOnPanic(t *testing.T) {
+	var buffer bytes.Buffer
+	method := NewAptMethod(bufio.NewReader(&bytes.Buffer{}), &buffer)
+	func() {
+		defer func() {
+			if r := recover(); r != "boom" {
+				t.Errorf("failed, expected the panic to continue, got %v", r)
+			}
+		}()
+		defer method.failOnPanic()
+		panic("boom")
+	}()
+	if expected := "401 General Failure\nMessage: internal error: boom\n\n"; buffer.String() != expected {
+		t.Errorf("failed, expected %q, got %q", expected, buffer.String())
+	}
+}
+
+func TestParseChaos(t *testing.T) {
+	var tests = []struct {
+		spec      string
+		expected  *chaosConfig
+		expectErr bool
+	}{
+		{"latency:200ms,errorrate:0.05", &chaosConfig{latency: 200 * time.Millisecond, errorRate: 0.05}, false},
+		{"errorrate:1", &chaosConfig{errorRate: 1}, false},
+		{"latency:soon", nil, true},
+		{"errorrate:2", nil, true},
+		{"jitter:5ms", nil, true},
+		{"latency", nil, true},
+	}
+
+	for _, tt := range tests {
+		res, err := parseChaos(tt.spec)
+		if tt.expectErr != (err != nil) {
+			t.Errorf("parseChaos(%q) returned unexpected error result %v", tt.spec, err)
+			continue
+		}
+		if !tt.expectErr && *res != *tt.expected {
+			t.Errorf("parseChaos(%q) = %v, expected %v", tt.spec, res, tt.expected)
+		}
+	}
+}
+
+func TestAptMethodChaosNotBuilt(t *testing.T) {
+	if chaosBuilt {
+		t.Skip("chaos injection is built in")
+	}
+	var buffer bytes.Buffer
+	var calls int
+	method := NewAptMethod(bufio.NewReader(&bytes.Buffer{}), &buffer)
+	method.client = fakeHTTPClient{calls: &calls}
+	method.handleConfigure(&Message{
+		code:        601,
+		description: "Configuration",
+		fields:      map[string][]string{"Config-Item": {"Acquire::gar::Chaos=errorrate:1"}},
+	})
+
+	req, _ := http.NewRequest("GET", "https://fake.uri/", nil)
+	if _, err := method.do(req); err != nil {
+		t.Errorf("expected the request to be sent, got %v", err)
+	}
+	if calls != 1 {
+		t.Errorf("expected 1 call, got %d", calls)
+	}
+	if method.config.chaos != nil {
+		t.Errorf("expected chaos to stay disabled, got %v", method.config.chaos)
+	}
+	if !strings.Contains(buffer.String(), "wasn't built with the chaos tag") {
+		t.Errorf("expected the config item to be reported as ignored, got %q", buffer.String())
+	}
+}
@@ -0,0 +1,32 @@
+//  Copyright 2021 Google LLC
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd
+// +build !linux,!darwin,!freebsd,!netbsd,!openbsd
+
+package apt
+
+import (
+	"errors"
+	"os"
+)
+
+// mmap isn't supported on this platform, so downloads use buffered writes.
+func mmap(*os.File, int64) ([]byte, error) {
+	return nil, errors.New("memory mapping is not supported on this platform")
+}
+
+func munmap([]byte) error {
+	return nil
+}
@@ -0,0 +1,55 @@
+//  Copyright 2021 Google LLC
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package apt
+
+import (
+	"io"
+	"regexp"
+)
+
+// archIndexPattern matches the paths of the indexes apt fetches once per
+// architecture, dists/<suite>/<component>/binary-<arch>/Packages and
+// dists/<suite>/[<component>/]Contents-[udeb-]<arch>, capturing the
+// architecture.
+var archIndexPattern = regexp.MustCompile(`/dists/.+/(?:binary-([^/]+)/.+|Contents-(?:udeb-)?([^/.]+)(?:\.[^/]+)?)$`)
+
+// indexArch returns the architecture of the per-architecture index at uri,
+// or "" if it isn't one.
+func indexArch(uri string) string {
+	match := archIndexPattern.FindStringSubmatch(uriPath(uri))
+	if match == nil {
+		return ""
+	}
+	if match[1] != "" {
+		return match[1]
+	}
+	return match[2]
+}
+
+// maxDrain bounds how much of a response body is read only so that its
+// connection can be reused; a longer one is cheaper to abandon.
+const maxDrain = 64 << 10
+
+// drainBody reads what is left of a response body, such as that of a 404,
+// and closes it. An unread body keeps its connection from carrying the next
+// request, so without this each missing or unchanged index of a multi-arch
+// update would cost a new TLS handshake.
+func drainBody(body io.ReadCloser) {
+	if body == nil {
+		return
+	}
+	io.Copy(io.Discard, io.LimitReader(body, maxDrain))
+	body.Close()
+}
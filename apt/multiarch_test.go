@@ -0,0 +1,112 @@
+//  Copyright 2021 Google LLC
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package apt
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"golang.org/x/oauth2"
+)
+
+func TestIndexArch(t *testing.T) {
+	var tests = []struct {
+		uri, expected string
+	}{
+		{"ar+https://us-apt.pkg.dev/projects/p/dists/r/main/binary-amd64/Packages.xz", "amd64"},
+		{"ar+https://us-apt.pkg.dev/projects/p/dists/r/main/binary-arm64/by-hash/SHA256/abc", "arm64"},
+		{"ar+https://us-apt.pkg.dev/projects/p/dists/r/main/Contents-i386.gz", "i386"},
+		{"ar+https://us-apt.pkg.dev/projects/p/dists/r/Contents-udeb-riscv64", "riscv64"},
+		{"ar+https://us-apt.pkg.dev/projects/p/dists/r/main/i18n/Translation-en", ""},
+		{"ar+https://us-apt.pkg.dev/projects/p/dists/r/InRelease", ""},
+		{"ar+https://us-apt.pkg.dev/projects/p/pool/h/hello/hello_1.0_amd64.deb", ""},
+	}
+	for _, tt := range tests {
+		if res := indexArch(tt.uri); res != tt.expected {
+			t.Errorf("failed, %s: expected %q, got %q", tt.uri, tt.expected, res)
+		}
+	}
+}
+
+// newMultiArchRepo serves the indexes of a repository built for several
+// architectures. Packages for amd64 are unchanged since apt last fetched them,
+// Contents are only published for amd64, with an error page too long to be
+// read for its message, and everything else is served.
+func newMultiArchRepo(t *testing.T) (*httptest.Server, *int64) {
+	var conns int64
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.Contains(r.URL.Path, "/binary-amd64/") && r.Header.Get("If-Modified-Since") != "":
+			w.WriteHeader(http.StatusNotModified)
+		case strings.Contains(r.URL.Path, "/Contents-") && !strings.Contains(r.URL.Path, "-amd64"):
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprintf(w, "<html><body>Not Found<!-- %s --></body></html>", strings.Repeat(" ", 8192))
+		default:
+			fmt.Fprintf(w, "Package: hello\nFilename: %s\n", r.URL.Path)
+		}
+	}))
+	server.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt64(&conns, 1)
+		}
+	}
+	server.StartTLS()
+	t.Cleanup(server.Close)
+	return server, &conns
+}
+
+func TestMultiArchIndexFetches(t *testing.T) {
+	const depth = 4
+	server, conns := newMultiArchRepo(t)
+	dir := t.TempDir()
+	input := fmt.Sprintf("601 Configuration\nConfig-Item: Acquire::gar::Access-Token=token\nConfig-Item: Acquire::gar::Auth-Hosts::=127.0.0.1\nConfig-Item: Acquire::gar::Pipeline-Depth=%d\nConfig-Item: APT::Architectures::=amd64\nConfig-Item: APT::Architectures::=arm64\nConfig-Item: APT::Architectures::=i386\n\n", depth)
+	var acquires int
+	for _, component := range []string{"main", "contrib", "non-free", "universe", "multiverse"} {
+		for _, arch := range []string{"amd64", "arm64", "i386"} {
+			for _, index := range []string{"binary-" + arch + "/Packages", "Contents-" + arch} {
+				acquires++
+				uri := fmt.Sprintf("ar+%s/dists/stable/%s/%s", server.URL, component, index)
+				input += fmt.Sprintf("600 URI Acquire\nURI: %s\nFilename: %s\nLast-Modified: Mon, 01 Mar 2021 00:00:00 GMT\n\n", uri, filepath.Join(dir, fmt.Sprintf("%d", acquires)))
+			}
+		}
+	}
+	var output bytes.Buffer
+	method := NewAptMethod(bufio.NewReader(strings.NewReader(input)), &output)
+	ctx := context.WithValue(context.Background(), oauth2.HTTPClient, server.Client())
+	if err := method.Run(ctx); err != nil {
+		t.Fatalf("failed, %v: %q", err, output.String())
+	}
+
+	res := output.String()
+	if done, hits, failed := strings.Count(res, "201 URI Done"), strings.Count(res, "IMS-Hit: true"), strings.Count(res, "400 URI Failure"); done != 20 || hits != 5 || failed != 10 {
+		t.Errorf("failed, expected 20 URIs done of which 5 unchanged, and 10 failed, got %d, %d, %d: %q", done, hits, failed, res)
+	}
+	// Each worker keeps its connection from one index to the next,
+	// whatever the response. A connection is returned to the pool just
+	// after a 304 is, so a worker may occasionally open another. Warming
+	// up the host opens up to depth more, alongside the first acquires.
+	if n := atomic.LoadInt64(conns); n > 3*depth {
+		t.Errorf("failed, expected at most %d connections for %d indexes, got %d", 3*depth, acquires, n)
+	}
+}
@@ -0,0 +1,80 @@
+//  Copyright 2021 Google LLC
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package apt
+
+import (
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// compressedTypes maps the extensions of files which are already compressed
+// to their media types. Compressing them again in transit only costs CPU.
+var compressedTypes = map[string]string{
+	".gz":   "application/gzip",
+	".xz":   "application/x-xz",
+	".bz2":  "application/x-bzip2",
+	".lzma": "application/x-lzma",
+	".lz4":  "application/x-lz4",
+	".zst":  "application/zstd",
+	".deb":  "application/vnd.debian.binary-package",
+	".udeb": "application/vnd.debian.binary-package",
+	".ddeb": "application/vnd.debian.binary-package",
+}
+
+// gzipTypes are the media types a server may use to offer the .gz variant
+// of an uncompressed index.
+var gzipTypes = map[string]bool{
+	"application/gzip":   true,
+	"application/x-gzip": true,
+}
+
+// setAcceptHeaders sets Accept and Accept-Encoding for the file at uri.
+// Compression is requested explicitly rather than letting the transport
+// decompress transparently, so that both the compressed and the
+// decompressed sizes are known. Uncompressed indexes also accept their .gz
+// variant, the smallest representation this method can decode; files which
+// are already compressed are requested as they are.
+func setAcceptHeaders(h http.Header, uri string) {
+	if mediaType, ok := compressedTypes[path.Ext(uriPath(uri))]; ok {
+		h.Set("Accept", mediaType+", */*;q=0.5")
+		h.Set("Accept-Encoding", "identity")
+		return
+	}
+	h.Set("Accept", "text/plain, application/gzip;q=0.9, */*;q=0.5")
+	h.Set("Accept-Encoding", "gzip")
+}
+
+// uriPath returns the path of uri without any query string.
+func uriPath(uri string) string {
+	if i := strings.IndexAny(uri, "?#"); i >= 0 {
+		return uri[:i]
+	}
+	return uri
+}
+
+// isGzipVariant reports whether resp is the .gz variant of an uncompressed
+// file, served in its place in response to the Accept header.
+func isGzipVariant(resp *http.Response) bool {
+	if resp.Request == nil {
+		return false
+	}
+	if _, ok := compressedTypes[path.Ext(resp.Request.URL.Path)]; ok {
+		return false
+	}
+	mediaType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	return err == nil && gzipTypes[mediaType]
+}
@@ -0,0 +1,60 @@
+//  Copyright 2021 Google LLC
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package apt
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestSetAcceptHeaders(t *testing.T) {
+	var tests = []struct {
+		uri, accept, acceptEncoding string
+	}{
+		{"ar+https://fake.uri/dists/repo/main/binary-amd64/Packages", "text/plain, application/gzip;q=0.9, */*;q=0.5", "gzip"},
+		{"ar+https://fake.uri/dists/repo/InRelease", "text/plain, application/gzip;q=0.9, */*;q=0.5", "gzip"},
+		{"ar+https://fake.uri/dists/repo/main/binary-amd64/Packages.gz", "application/gzip, */*;q=0.5", "identity"},
+		{"ar+https://fake.uri/dists/repo/main/binary-amd64/Packages.xz", "application/x-xz, */*;q=0.5", "identity"},
+		{"ar+https://fake.uri/pool/repo/p/pkg.deb?generation=1", "application/vnd.debian.binary-package, */*;q=0.5", "identity"},
+	}
+
+	for _, tt := range tests {
+		h := http.Header{}
+		setAcceptHeaders(h, tt.uri)
+		if h.Get("Accept") != tt.accept || h.Get("Accept-Encoding") != tt.acceptEncoding {
+			t.Errorf("failed for %s, expected %q and %q, got %q and %q", tt.uri, tt.accept, tt.acceptEncoding, h.Get("Accept"), h.Get("Accept-Encoding"))
+		}
+	}
+}
+
+func TestIsGzipVariant(t *testing.T) {
+	var tests = []struct {
+		path, contentType string
+		expected          bool
+	}{
+		{"/dists/repo/main/binary-amd64/Packages", "application/gzip", true},
+		{"/dists/repo/main/binary-amd64/Packages", "application/x-gzip; charset=binary", true},
+		{"/dists/repo/main/binary-amd64/Packages", "text/plain", false},
+		{"/dists/repo/main/binary-amd64/Packages.gz", "application/gzip", false},
+	}
+
+	for _, tt := range tests {
+		req, _ := http.NewRequest("GET", "https://fake.uri"+tt.path, nil)
+		resp := &http.Response{Request: req, Header: http.Header{"Content-Type": {tt.contentType}}}
+		if res := isGzipVariant(resp); res != tt.expected {
+			t.Errorf("failed for %s with %s, expected %v got %v", tt.path, tt.contentType, tt.expected, res)
+		}
+	}
+}
@@ -0,0 +1,639 @@
+//  Copyright 2021 Google LLC
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package apt
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Scopes of config options.
+const (
+	// GlobalScope options apply to every host.
+	GlobalScope = "global"
+	// HostScope options may also be set for hosts matching a pattern, as
+	// Acquire::gar::<pattern>::<Option>.
+	HostScope = "host"
+)
+
+// ConfigOption describes a config item the method understands. The list
+// returned by ConfigOptions is what handleConfigure applies, so it can be
+// published for config management tools to validate settings against.
+type ConfigOption struct {
+	// Key is the config item name. List options are sent by apt with a
+	// trailing "::", which is not included.
+	Key string `json:"key"`
+	// Type is one of string, bool, integer, enum or list.
+	Type string `json:"type"`
+	// Values lists the values an enum accepts.
+	Values  []string `json:"values,omitempty"`
+	Default string   `json:"default,omitempty"`
+	Scope   string   `json:"scope"`
+	// Secret options are never logged.
+	Secret      bool   `json:"secret,omitempty"`
+	Description string `json:"description"`
+	// Env is the environment variable which overrides the option, if any;
+	// see env.
+	Env string `json:"env,omitempty"`
+
+	// apply sets the option from a config item. Host-scoped options have
+	// none, and are handled by handleScopedConfig.
+	apply func(m *Method, configItem, value string)
+	// client is set for options the client is made with, so that changing
+	// them makes a new one; see reconfigured.
+	client bool
+	// envOverride opts the option in to being overridden from the
+	// environment; see env. It is left off for credentials, programs run,
+	// privileges, where tokens are sent and fault injection, which only
+	// apt's configuration may set.
+	envOverride bool
+}
+
+// configOptions is the registry of config options.
+var configOptions = []ConfigOption{
+	{
+		Key: "Acquire::gar::Service-Account-JSON", Type: "string", Scope: GlobalScope, client: true,
+		Description: "Path of a service account key or workload identity federation configuration.",
+		apply: func(m *Method, _, value string) {
+			m.config.serviceAccountJSON = strings.TrimSpace(value)
+		},
+	},
+	{
+		Key: "Acquire::gar::Self-Signed-JWT", Type: "bool", Default: "false", Scope: GlobalScope, client: true,
+		Description: "Sign JWTs with the Service-Account-JSON key instead of exchanging it for access tokens.",
+		apply: func(m *Method, _, value string) {
+			m.config.selfSignedJWT = stringToBool(strings.TrimSpace(value))
+		},
+	},
+	{
+		Key: "Acquire::gar::Credentials-Fallback", Type: "bool", Default: "false", Scope: GlobalScope, client: true,
+		Description: "Fall back past an unusable default credentials file to the next source, with a warning.",
+		apply: func(m *Method, _, value string) {
+			m.config.credentialsFallback = stringToBool(strings.TrimSpace(value))
+		},
+	},
+	{
+		Key: "Acquire::gar::Service-Account-Email", Type: "string", Scope: GlobalScope, client: true,
+		Description: "Service account to obtain tokens for from the metadata server.",
+		apply: func(m *Method, _, value string) {
+			m.config.serviceAccountEmail = strings.TrimSpace(value)
+		},
+	},
+	{
+		Key: "Acquire::gar::Access-Token", Type: "string", Scope: GlobalScope, Secret: true, client: true,
+		Description: "Short-lived OAuth access token.",
+		apply: func(m *Method, _, value string) {
+			m.config.accessToken.Release()
+			m.config.accessToken = NewSecret([]byte(strings.TrimSpace(value)))
+		},
+	},
+	{
+		Key: "Acquire::gar::Credential-Helper", Type: "string", Scope: GlobalScope, client: true,
+		Description: "Program which prints an access token.",
+		apply: func(m *Method, _, value string) {
+			m.config.credentialHelper = strings.TrimSpace(value)
+		},
+	},
+	{
+		Key: "Acquire::gar::Service-Account-Secret", Type: "string", Scope: GlobalScope, client: true,
+		Description: "Secret Manager secret version holding a service account key, fetched with the default credentials.",
+		apply: func(m *Method, _, value string) {
+			m.config.serviceAccountSecret = strings.TrimSpace(value)
+		},
+	},
+	{
+		Key: "Acquire::gar::Impersonate-Service-Account", Type: "string", Scope: GlobalScope, client: true,
+		Description: "Service account to impersonate with the configured credentials.",
+		apply: func(m *Method, _, value string) {
+			m.config.impersonate = strings.TrimSpace(value)
+		},
+	},
+	{
+		Key: "Acquire::gar::Impersonate-Delegates", Type: "string", Scope: GlobalScope, client: true,
+		Description: "Comma-separated chain of service accounts to impersonate through.",
+		apply: func(m *Method, configItem, value string) {
+			if strings.TrimSpace(value) == "" {
+				m.config.delegates = nil
+				return
+			}
+			delegates, ok := parseDelegates(value)
+			if !ok {
+				m.writer.Log(fmt.Sprintf("invalid value in config item: %v", configItem))
+				return
+			}
+			m.config.delegates = delegates
+		},
+	},
+	{
+		Key: "Acquire::gar::Credential-FD", Type: "integer", Scope: GlobalScope, client: true,
+		Description: "Inherited file descriptor to read a service account key or access token from.",
+		apply: func(m *Method, configItem, value string) {
+			// The descriptor can only be read once.
+			if m.credentialFD != nil {
+				m.config.credential = m.credentialFD
+				return
+			}
+			fd, err := strconv.Atoi(strings.TrimSpace(value))
+			if err != nil || fd < 0 {
+				m.writer.Log(fmt.Sprintf("invalid value in config item: %v", configItem))
+				return
+			}
+			credential, err := readCredentialFD(fd)
+			if err != nil {
+				m.writer.Log(fmt.Sprintf("failed to read Credential-FD %d: %v", fd, err))
+				return
+			}
+			m.config.credential, m.credentialFD = credential, credential
+		},
+	},
+	{
+		Key: "Debug::Acquire::gar", Type: "bool", Default: "false", Scope: GlobalScope,
+		Description: "Log requests, responses and other debugging information.",
+		apply: func(m *Method, _, value string) {
+			m.config.debug = stringToBool(strings.TrimSpace(value))
+		},
+	},
+	{
+		Key: "Debug::Acquire::gar::Queue", Type: "bool", Default: "false", Scope: GlobalScope,
+		Description: "Log each acquire as it is queued, handed to a worker, started and finished, with the queue's depth and how many workers are busy.",
+		apply: func(m *Method, _, value string) {
+			m.config.debugQueue = stringToBool(strings.TrimSpace(value))
+		},
+	},
+	{
+		Key: "Acquire::gar::Read-Buffer-Size", Type: "integer", Default: strconv.Itoa(defaultReadBufferSize), Scope: GlobalScope, envOverride: true,
+		Description: "Bytes of the response to buffer.",
+		apply: func(m *Method, configItem, value string) {
+			if size, ok := m.parseSize(configItem, value); ok {
+				m.config.readBufferSize = size
+			}
+		},
+	},
+	{
+		Key: "Acquire::gar::Write-Chunk-Size", Type: "integer", Default: strconv.Itoa(defaultWriteChunkSize), Scope: GlobalScope, envOverride: true,
+		Description: "Bytes to write to disk at a time.",
+		apply: func(m *Method, configItem, value string) {
+			if size, ok := m.parseSize(configItem, value); ok {
+				m.config.writeChunkSize = size
+			}
+		},
+	},
+	{
+		Key: "Acquire::gar::Max-Write-Chunk-Size", Type: "integer", Scope: GlobalScope, envOverride: true,
+		Description: "Bytes the write chunk size may grow to as throughput allows.",
+		apply: func(m *Method, configItem, value string) {
+			if size, ok := m.parseSize(configItem, value); ok {
+				m.config.maxWriteChunkSize = size
+			}
+		},
+	},
+	{
+		Key: "Acquire::gar::Mmap-Threshold", Type: "integer", Scope: GlobalScope, envOverride: true,
+		Description: "Bytes from which files of a known size are written through a memory mapping.",
+		apply: func(m *Method, configItem, value string) {
+			if size, ok := m.parseSize(configItem, value); ok {
+				m.config.mmapThreshold = size
+			}
+		},
+	},
+	{
+		Key: "Acquire::gar::Write-Timeout", Type: "integer", Scope: GlobalScope, envOverride: true,
+		Description: "Seconds to wait for apt to read a message before giving up.",
+		apply: func(m *Method, configItem, value string) {
+			if seconds, ok := m.parseSize(configItem, value); ok {
+				m.writer.setTimeout(time.Duration(seconds) * time.Second)
+			}
+		},
+	},
+	{
+		Key: "Acquire::gar::Chaos", Type: "string", Scope: GlobalScope,
+		Description: "Latency and error rate to inject for testing, such as \"latency:200ms,errorrate:0.05\".",
+		apply: func(m *Method, configItem, value string) {
+			if !chaosBuilt {
+				m.writer.Log(fmt.Sprintf("ignoring config item %v, as this method wasn't built with the chaos tag", configItem))
+				return
+			}
+			chaos, err := parseChaos(value)
+			if err != nil {
+				m.writer.Log(fmt.Sprintf("invalid value in config item: %v: %v", configItem, err))
+				m.config.chaos = nil
+				return
+			}
+			m.config.chaos = chaos
+			m.writer.Log(fmt.Sprintf("WARNING: chaos testing enabled, injecting %v latency and %v error rate", chaos.latency, chaos.errorRate))
+		},
+	},
+	{
+		Key: "Acquire::gar::Expected-Size-Mismatch", Type: "enum", Values: []string{"fail", "warn"}, Default: "fail", Scope: GlobalScope, envOverride: true,
+		Description: "Whether a download of a size other than apt expects fails or warns.",
+		apply: func(m *Method, configItem, value string) {
+			switch strings.ToLower(strings.TrimSpace(value)) {
+			case "fail":
+				m.config.warnSizeMismatch = false
+			case "warn":
+				m.config.warnSizeMismatch = true
+			default:
+				m.writer.Log(fmt.Sprintf("invalid value in config item: %v", configItem))
+			}
+		},
+	},
+	{
+		Key: "Acquire::gar::Warmup", Type: "bool", Default: "false", Scope: GlobalScope, envOverride: true,
+		Description: "Connect to the hosts in the sources files on startup.",
+		apply: func(m *Method, _, value string) {
+			m.config.warmup = stringToBool(strings.TrimSpace(value))
+		},
+	},
+	{
+		Key: "Acquire::gar::Validate-Sources", Type: "bool", Default: "false", Scope: GlobalScope, envOverride: true,
+		Description: "Warn about sources whose options don't match their repositories.",
+		apply: func(m *Method, _, value string) {
+			m.config.validateSources = stringToBool(strings.TrimSpace(value))
+		},
+	},
+	{
+		Key: "Acquire::gar::Verify-Checksums", Type: "bool", Default: "false", Scope: GlobalScope,
+		Description: "Check packages against the checksums recorded by the Artifact Registry API.",
+		apply: func(m *Method, _, value string) {
+			m.config.verifyChecksums = stringToBool(strings.TrimSpace(value))
+		},
+	},
+	{
+		Key: "Dir", Type: "string", Default: "/", Scope: GlobalScope, client: true,
+		Description: "apt's root directory, used to find the sources files.",
+		apply: func(m *Method, _, value string) {
+			m.config.dirs.root = strings.TrimSpace(value)
+		},
+	},
+	{
+		Key: "Dir::Etc", Type: "string", Default: "etc/apt/", Scope: GlobalScope, client: true,
+		Description: "apt's configuration directory, used to find the sources files.",
+		apply: func(m *Method, _, value string) {
+			m.config.dirs.etc = strings.TrimSpace(value)
+		},
+	},
+	{
+		Key: "Dir::Etc::sourcelist", Type: "string", Default: "sources.list", Scope: GlobalScope,
+		Description: "apt's sources.list file.",
+		apply: func(m *Method, _, value string) {
+			m.config.dirs.sourceList = strings.TrimSpace(value)
+		},
+	},
+	{
+		Key: "Dir::Etc::sourceparts", Type: "string", Default: "sources.list.d", Scope: GlobalScope,
+		Description: "apt's sources.list.d directory.",
+		apply: func(m *Method, _, value string) {
+			m.config.dirs.sourceParts = strings.TrimSpace(value)
+		},
+	},
+	{
+		Key: "Dir::Etc::netrc", Type: "string", Default: "auth.conf", Scope: GlobalScope, client: true,
+		Description: "apt's auth.conf file.",
+		apply: func(m *Method, _, value string) {
+			m.config.dirs.netrc = strings.TrimSpace(value)
+		},
+	},
+	{
+		Key: "Dir::Etc::netrcparts", Type: "string", Default: "auth.conf.d", Scope: GlobalScope, client: true,
+		Description: "apt's auth.conf.d directory.",
+		apply: func(m *Method, _, value string) {
+			m.config.dirs.netrcParts = strings.TrimSpace(value)
+		},
+	},
+	{
+		Key: "Acquire::gar::Auth-Conf-Write", Type: "bool", Default: "false", Scope: GlobalScope, client: true,
+		Description: "Write tokens to auth.conf.d for the hosts in the sources files, for other tooling.",
+		apply: func(m *Method, _, value string) {
+			m.config.authConfWrite = stringToBool(strings.TrimSpace(value))
+		},
+	},
+	{
+		Key: "Acquire::gar::Fallback-Endpoint", Type: "string", Scope: GlobalScope, client: true,
+		Description: "Host to switch to when TLS handshakes fail as if blocked by SNI filtering.",
+		apply: func(m *Method, _, value string) {
+			m.config.fallbackEndpoint = strings.TrimSpace(value)
+		},
+	},
+	{
+		Key: "Acquire::gar::Require-Auth", Type: "bool", Default: "false", Scope: GlobalScope, client: true,
+		Description: "Fail rather than send requests without credentials.",
+		apply: func(m *Method, _, value string) {
+			m.config.requireAuth = stringToBool(strings.TrimSpace(value))
+		},
+	},
+	{
+		Key: "Acquire::gar::Drop-Privileges", Type: "bool", Default: "false", Scope: GlobalScope,
+		Description: "When started as root, switch to APT::Sandbox::User once credentials are read.",
+		apply: func(m *Method, _, value string) {
+			m.config.dropPrivileges = stringToBool(strings.TrimSpace(value))
+		},
+	},
+	{
+		Key: "APT::Sandbox::User", Type: "string", Default: defaultSandboxUser, Scope: GlobalScope,
+		Description: "The user apt's methods run as.",
+		apply: func(m *Method, _, value string) {
+			m.config.sandboxUser = strings.TrimSpace(value)
+		},
+	},
+	{
+		Key: "Acquire::gar::Telemetry", Type: "string", Default: "none", Scope: GlobalScope,
+		Description: "Where to report measurements: none, log (as Log messages) or textfile.",
+		apply: func(m *Method, _, value string) {
+			m.config.telemetry = strings.TrimSpace(value)
+		},
+	},
+	{
+		Key: "Acquire::gar::Telemetry-File", Type: "string", Scope: GlobalScope,
+		Description: "File the textfile Telemetry writes, in the Prometheus text format.",
+		apply: func(m *Method, _, value string) {
+			m.config.telemetryFile = strings.TrimSpace(value)
+		},
+	},
+	{
+		Key: "Acquire::gar::Pipeline-Depth", Type: "integer", Default: strconv.Itoa(defaultPipelineDepth), Scope: GlobalScope, envOverride: true, client: true,
+		Description: "How many of the URIs apt pipelines to the method are fetched at once.",
+		apply: func(m *Method, configItem, value string) {
+			if depth, ok := m.parseSize(configItem, value); ok {
+				m.config.pipelineDepth = depth
+			}
+		},
+	},
+	{
+		Key: "Acquire::gar::Slow-Start", Type: "bool", Default: "false", Scope: GlobalScope, envOverride: true,
+		Description: "Whether each host starts with 2 acquires at once, ramping up to Pipeline-Depth as it responds promptly and backing off as it fails or throttles.",
+		apply: func(m *Method, _, value string) {
+			m.config.slowStart = stringToBool(strings.TrimSpace(value))
+		},
+	},
+	{
+		Key: "Acquire::Queue-Mode", Type: "enum", Values: []string{"host", "access"}, Default: "host", Scope: GlobalScope,
+		Description: "apt's own queue mode: with \"host\", Pipeline-Depth applies to each host, and with \"access\", to all of them together.",
+		apply: func(m *Method, configItem, value string) {
+			switch strings.ToLower(strings.TrimSpace(value)) {
+			case "host":
+				m.config.sharedQueue = false
+			case "access":
+				m.config.sharedQueue = true
+			default:
+				m.writer.Log(fmt.Sprintf("invalid value in config item: %v", configItem))
+			}
+		},
+	},
+	{
+		Key: "Acquire::gar::Status-Interval", Type: "integer", Default: "5", Scope: GlobalScope, envOverride: true,
+		Description: "Seconds between reports of the progress of a download, or 0 not to report it.",
+		apply: func(m *Method, configItem, value string) {
+			if strings.TrimSpace(value) == "0" {
+				m.config.statusInterval = 0
+			} else if seconds, ok := m.parseSize(configItem, value); ok {
+				m.config.statusInterval = time.Duration(seconds) * time.Second
+			}
+		},
+	},
+	{
+		Key: "Acquire::gar::Apt-Version", Type: "string", Scope: GlobalScope,
+		Description: "The version of the apt driving the method, such as \"1.6\", when it is told wrongly from its configuration.",
+		apply: func(m *Method, configItem, value string) {
+			if version, ok := parseAptVersion(value); ok {
+				m.config.aptVersion = version
+			} else {
+				m.writer.Log(fmt.Sprintf("invalid value in config item: %v", configItem))
+			}
+		},
+	},
+	{
+		Key: "Acquire::gar::Follow-Redirects", Type: "bool", Default: "true", Scope: GlobalScope, client: true,
+		Description: "Whether redirects are followed, rather than passed to apt to fetch the new URI itself.",
+		apply: func(m *Method, _, value string) {
+			m.config.passRedirects = !stringToBool(strings.TrimSpace(value))
+		},
+	},
+	{
+		Key: "Acquire::gar::Journal-File", Type: "string", Scope: GlobalScope,
+		Description: "File to append a hash-chained record of each artifact delivered to apt to.",
+		apply: func(m *Method, _, value string) {
+			m.config.journalFile = strings.TrimSpace(value)
+		},
+	},
+	{
+		Key: "Acquire::gar::Prewarm-Connections", Type: "integer", Default: strconv.Itoa(defaultPrewarmConnections), Scope: GlobalScope, envOverride: true,
+		Description: "Connections opened to a host before a burst of acquires for it is sent, or 0 for none.",
+		apply: func(m *Method, configItem, value string) {
+			if strings.TrimSpace(value) == "0" {
+				m.config.prewarmConnections = 0
+			} else if n, ok := m.parseSize(configItem, value); ok {
+				m.config.prewarmConnections = n
+			}
+		},
+	},
+	{
+		Key: "Acquire::gar::Intermediary-Challenges", Type: "enum", Values: []string{"detect", "ignore"}, Default: "detect", Scope: GlobalScope,
+		Description: "Whether a 401 or 403 challenging for a proxy's credentials is reported as the proxy's, or taken as Artifact Registry's.",
+		apply: func(m *Method, configItem, value string) {
+			switch strings.ToLower(strings.TrimSpace(value)) {
+			case "detect":
+				m.config.ignoreIntermediaries = false
+			case "ignore":
+				m.config.ignoreIntermediaries = true
+			default:
+				m.writer.Log(fmt.Sprintf("invalid value in config item: %v", configItem))
+			}
+		},
+	},
+	{
+		Key: strictConfigItem, Type: "bool", Default: "false", Scope: GlobalScope,
+		Description: "Fail on unknown Acquire::gar items and values of the wrong type, rather than logging and ignoring them.",
+		apply:       func(*Method, string, string) {},
+	},
+	{
+		Key: "Acquire::gar::Expected-Project", Type: "string", Scope: GlobalScope,
+		Description: "The only project whose repositories may be accessed.",
+		apply: func(m *Method, _, value string) {
+			m.config.expectedProject = strings.TrimSpace(value)
+		},
+	},
+	{
+		Key: "Acquire::gar::Expected-Location", Type: "string", Scope: GlobalScope,
+		Description: "The only location whose repositories may be accessed.",
+		apply: func(m *Method, _, value string) {
+			m.config.expectedLocation = strings.TrimSpace(value)
+		},
+	},
+	{
+		Key: "Acquire::gar::Auth-Hosts", Type: "list", Scope: GlobalScope,
+		Description: "Hosts, or *.domain patterns, besides *.pkg.dev which tokens may be sent to.",
+		apply: func(m *Method, _, value string) {
+			m.config.authHosts = append(m.config.authHosts, strings.TrimSpace(value))
+		},
+	},
+	{
+		Key: "Acquire::gar::Proxy-ID-Token-Audience", Type: "string", Scope: GlobalScope, client: true,
+		Description: "Audience of ID tokens sent as Proxy-Authorization to an IAP-protected proxy.",
+		apply: func(m *Method, _, value string) {
+			m.config.proxyAudience = strings.TrimSpace(value)
+		},
+	},
+	{
+		Key: "Acquire::gar::Egress-Stats-File", Type: "string", Scope: GlobalScope,
+		Description: "File accumulating daily bytes downloaded per repository, as JSON.",
+		apply: func(m *Method, _, value string) {
+			m.config.egressStatsFile = strings.TrimSpace(value)
+		},
+	},
+	{
+		Key: "Acquire::gar::Retry-Queue-File", Type: "string", Scope: GlobalScope,
+		Description: "File keeping the URIs which failed in ways which may succeed on a later run, as JSON.",
+		apply: func(m *Method, _, value string) {
+			m.config.retryQueueFile = strings.TrimSpace(value)
+		},
+	},
+	{
+		Key: "Acquire::gar::Egress-Allowlist", Type: "list", Scope: GlobalScope,
+		Description: "Networks, in CIDR notation, which hosts must resolve into.",
+		apply: func(m *Method, configItem, value string) {
+			_, network, err := net.ParseCIDR(strings.TrimSpace(value))
+			if err != nil {
+				m.writer.Log(fmt.Sprintf("invalid value in config item: %v", configItem))
+				return
+			}
+			m.config.egressAllowlist = append(m.config.egressAllowlist, network)
+		},
+	},
+	{
+		Key: "Acquire::gar::Egress-Allowlist-Mode", Type: "enum", Values: []string{"warn", "fail"}, Default: "warn", Scope: GlobalScope,
+		Description: "Whether a host outside the egress allowlist warns or fails.",
+		apply: func(m *Method, configItem, value string) {
+			switch strings.ToLower(strings.TrimSpace(value)) {
+			case "warn":
+				m.config.egressFail = false
+			case "fail":
+				m.config.egressFail = true
+			default:
+				m.writer.Log(fmt.Sprintf("invalid value in config item: %v", configItem))
+			}
+		},
+	},
+	{
+		Key: "Acquire::gar::Record-Headers", Type: "list", Scope: GlobalScope,
+		Description: "Response headers to copy into URI Done.",
+		apply: func(m *Method, _, value string) {
+			m.config.recordHeaders = append(m.config.recordHeaders, strings.TrimSpace(value))
+		},
+	},
+	{
+		Key: "Acquire::gar::Region-Candidates", Type: "list", Scope: GlobalScope,
+		Description: "Regional hosts serving the same repositories, of which the fastest is used.",
+		apply: func(m *Method, _, value string) {
+			m.config.regionCandidates = append(m.config.regionCandidates, strings.TrimSpace(value))
+		},
+	},
+	{
+		Key: configPrefix + scopedTimeout, Type: "integer", Scope: HostScope,
+		Description: "Seconds to wait for a response.",
+	},
+	{
+		Key: configPrefix + scopedExtraHeader, Type: "list", Scope: HostScope,
+		Description: "Headers, as \"Name: value\", to add to requests.",
+	},
+}
+
+// ConfigOptions returns the config options the method understands.
+func ConfigOptions() []ConfigOption {
+	options := make([]ConfigOption, len(configOptions))
+	copy(options, configOptions)
+	for i := range options {
+		options[i].Env = options[i].env()
+	}
+	return options
+}
+
+// envPrefix begins the names of the environment variables which override
+// options, e.g. GAR_APT_PIPELINE_DEPTH for Acquire::gar::Pipeline-Depth.
+const envPrefix = "GAR_APT_"
+
+// env returns the name of the environment variable which overrides the
+// option, if it opts in with envOverride. Host-scoped and list options have
+// none, nor do secrets, which have their own variables where it is safe to,
+// such as $ARTIFACT_REGISTRY_ACCESS_TOKEN.
+func (o *ConfigOption) env() string {
+	if !o.envOverride || o.Scope != GlobalScope || o.Type == "list" || o.Secret || !strings.HasPrefix(o.Key, configPrefix) {
+		return ""
+	}
+	name := strings.TrimPrefix(o.Key, configPrefix)
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// validate checks value against the type of the option, as Strict-Config
+// has handleConfigure do before applying it. Options may still reject
+// values of the right type, as apply then logs.
+func (o *ConfigOption) validate(value string) error {
+	value = strings.TrimSpace(value)
+	switch o.Type {
+	case "bool":
+		if _, err := strconv.Atoi(value); err == nil {
+			return nil
+		}
+		switch strings.ToLower(value) {
+		case "yes", "true", "with", "on", "enable", "no", "false", "without", "off", "disable":
+			return nil
+		}
+		return fmt.Errorf("%s must be a boolean", o.Key)
+	case "integer":
+		if n, err := strconv.Atoi(value); err != nil || n < 0 {
+			return fmt.Errorf("%s must be a whole number", o.Key)
+		}
+	case "enum":
+		for _, v := range o.Values {
+			if strings.EqualFold(v, value) {
+				return nil
+			}
+		}
+		return fmt.Errorf("%s must be one of %s", o.Key, strings.Join(o.Values, ", "))
+	}
+	return nil
+}
+
+// strictConfigItem is the Strict-Config option, which handleConfigure
+// looks for before applying any item.
+const strictConfigItem = "Acquire::gar::Strict-Config"
+
+// configOptionsByItem maps config item names, as apt sends them, to the
+// global options they set.
+var configOptionsByItem = func() map[string]*ConfigOption {
+	byItem := make(map[string]*ConfigOption)
+	for i := range configOptions {
+		option := &configOptions[i]
+		if option.apply == nil {
+			continue
+		}
+		key := option.Key
+		if option.Type == "list" {
+			// apt sends list items with an empty trailing key.
+			key += "::"
+		}
+		byItem[key] = option
+	}
+	return byItem
+}()
+
+// isSecretConfigItem reports whether the value of the config item named key
+// must not be logged.
+func isSecretConfigItem(key string) bool {
+	option, ok := configOptionsByItem[key]
+	return ok && option.Secret
+}
@@ -0,0 +1,211 @@
+//  Copyright 2021 Google LLC
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package apt
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestConfigOptions(t *testing.T) {
+	seen := make(map[string]bool)
+	for _, option := range ConfigOptions() {
+		if seen[option.Key] {
+			t.Errorf("failed, duplicate option %s", option.Key)
+		}
+		seen[option.Key] = true
+		if strings.HasSuffix(option.Key, "::") {
+			t.Errorf("failed, option %s has a trailing ::", option.Key)
+		}
+		switch option.Scope {
+		case GlobalScope:
+			if option.apply == nil {
+				t.Errorf("failed, global option %s can't be applied", option.Key)
+			}
+		case HostScope:
+			if !scopedOptions[strings.TrimPrefix(option.Key, configPrefix)] {
+				t.Errorf("failed, host option %s isn't handled by handleScopedConfig", option.Key)
+			}
+		default:
+			t.Errorf("failed, option %s has unknown scope %q", option.Key, option.Scope)
+		}
+		if option.Type == "enum" && len(option.Values) == 0 {
+			t.Errorf("failed, enum option %s has no values", option.Key)
+		}
+		if option.Default != "" {
+			if err := option.validate(option.Default); err != nil {
+				t.Errorf("failed, option %s has an invalid default: %v", option.Key, err)
+			}
+		}
+		if option.Env != "" && (option.Secret || option.Scope != GlobalScope) {
+			t.Errorf("failed, option %s may not be set from the environment", option.Key)
+		}
+	}
+	for option := range scopedOptions {
+		if !seen[configPrefix+option] {
+			t.Errorf("failed, host option %s is missing from the registry", option)
+		}
+	}
+}
+
+func TestConfigOptionsByItem(t *testing.T) {
+	var tests = []struct {
+		item     string
+		expected bool
+	}{
+		{"Acquire::gar::Service-Account-JSON", true},
+		{"Acquire::gar::Record-Headers::", true},
+		{"Acquire::gar::Record-Headers", false},
+		{"Acquire::gar::Timeout", false},
+		{"Acquire::http::Proxy", false},
+	}
+
+	for _, tt := range tests {
+		if _, ok := configOptionsByItem[tt.item]; ok != tt.expected {
+			t.Errorf("failed, expected %s to be a global option: %v", tt.item, tt.expected)
+		}
+	}
+	if !isSecretConfigItem("Acquire::gar::Access-Token") || isSecretConfigItem("Acquire::gar::Service-Account-JSON") {
+		t.Errorf("failed, unexpected secret config items")
+	}
+}
+
+func TestConfigOptionValidate(t *testing.T) {
+	var tests = []struct {
+		key   string
+		value string
+		valid bool
+	}{
+		{"Debug::Acquire::gar", "true", true},
+		{"Debug::Acquire::gar", "1", true},
+		{"Debug::Acquire::gar", "maybe", false},
+		{"Acquire::gar::Pipeline-Depth", "4", true},
+		{"Acquire::gar::Pipeline-Depth", "-1", false},
+		{"Acquire::gar::Pipeline-Depth", "many", false},
+		{"Acquire::gar::Expected-Size-Mismatch", "Warn", true},
+		{"Acquire::gar::Expected-Size-Mismatch", "ignore", false},
+		{"Acquire::gar::Service-Account-Email", "anything", true},
+	}
+
+	for _, tt := range tests {
+		option := configOptionsByItem[tt.key]
+		if err := option.validate(tt.value); (err == nil) != tt.valid {
+			t.Errorf("failed, %s=%s: expected valid %v, got %v", tt.key, tt.value, tt.valid, err)
+		}
+	}
+}
+
+func TestHandleConfigureStrict(t *testing.T) {
+	var tests = []struct {
+		configItems []string
+		expectErr   bool
+	}{
+		{[]string{"Acquire::gar::Pipeline-Depth=many"}, false},
+		{[]string{"Acquire::gar::Strict-Config=true", "Acquire::gar::Pipeline-Depth=4"}, false},
+		{[]string{"Acquire::gar::Pipeline-Depth=many", "Acquire::gar::Strict-Config=true"}, true},
+		{[]string{"Acquire::gar::Strict-Config=true", "Acquire::gar::Pipline-Depth=4"}, true},
+		{[]string{"Acquire::gar::Strict-Config=true", "Acquire::gar::Timeout=soon"}, true},
+		{[]string{"Acquire::gar::Strict-Config=true", "Acquire::http::Pipeline-Depth=many"}, false},
+		{[]string{"Acquire::gar::Pipline-Depth=4"}, false},
+	}
+
+	for _, tt := range tests {
+		var out bytes.Buffer
+		method := NewAptMethod(nil, &out)
+		msg := &Message{code: 601, description: "Configuration", fields: map[string][]string{"Config-Item": tt.configItems}}
+		if err := method.handleConfigure(msg); (err != nil) != tt.expectErr {
+			t.Errorf("failed, %v: expected error %v, got %v", tt.configItems, tt.expectErr, err)
+		}
+	}
+}
+
+func TestHandleConfigureEnvOverrides(t *testing.T) {
+	setenv(t, "GAR_APT_PIPELINE_DEPTH", "3")
+	setenv(t, "GAR_APT_EXPECTED_SIZE_MISMATCH", "warn")
+	var out bytes.Buffer
+	method := NewAptMethod(nil, &out)
+	msg := &Message{code: 601, description: "Configuration", fields: map[string][]string{"Config-Item": {
+		"Acquire::gar::Pipeline-Depth=6",
+		"Acquire::gar::Access-Token=ya29.secret",
+	}}}
+	if err := method.handleConfigure(msg); err != nil {
+		t.Fatalf("failed, unexpected error: %v", err)
+	}
+	if method.config.pipelineDepth != 3 {
+		t.Errorf("failed, expected the environment to override Pipeline-Depth, got %d", method.config.pipelineDepth)
+	}
+	config := strings.Join(method.effectiveConfig(), "\n")
+	for _, expected := range []string{
+		"Acquire::gar::Pipeline-Depth=3 (env)",
+		"Acquire::gar::Expected-Size-Mismatch=warn (env)",
+		"Acquire::gar::Access-Token=[REDACTED] (apt)",
+		"Acquire::gar::Status-Interval=5 (default)",
+	} {
+		if !strings.Contains(config, expected) {
+			t.Errorf("failed, expected %q in:\n%s", expected, config)
+		}
+	}
+
+	setenv(t, "GAR_APT_PIPELINE_DEPTH", "many")
+	msg.fields["Config-Item"] = append(msg.fields["Config-Item"], "Acquire::gar::Strict-Config=yes")
+	if err := NewAptMethod(nil, &out).handleConfigure(msg); err == nil || !strings.Contains(err.Error(), "GAR_APT_PIPELINE_DEPTH") {
+		t.Errorf("failed, expected an error naming the variable, got %v", err)
+	}
+}
+
+func TestEnvOverridesOptIn(t *testing.T) {
+	setenv(t, "GAR_APT_CREDENTIAL_HELPER", "/tmp/evil")
+	setenv(t, "GAR_APT_SERVICE_ACCOUNT_JSON", "/tmp/key.json")
+	setenv(t, "GAR_APT_CHAOS", "errorrate:1")
+	method := NewAptMethod(nil, &bytes.Buffer{})
+	msg := &Message{code: 601, description: "Configuration", fields: map[string][]string{"Config-Item": {
+		"Acquire::gar::Credential-Helper=/usr/bin/helper",
+	}}}
+	if err := method.handleConfigure(msg); err != nil {
+		t.Fatalf("failed, unexpected error: %v", err)
+	}
+	if method.config.credentialHelper != "/usr/bin/helper" || method.config.serviceAccountJSON != "" || method.config.chaos != nil {
+		t.Errorf("failed, expected the environment to be ignored, got helper %q, key %q and chaos %v", method.config.credentialHelper, method.config.serviceAccountJSON, method.config.chaos)
+	}
+	sensitive := map[string]bool{
+		"Acquire::gar::Service-Account-JSON": true, "Acquire::gar::Service-Account-Email": true,
+		"Acquire::gar::Credential-Helper": true, "Acquire::gar::Credential-FD": true,
+		"Acquire::gar::Service-Account-Secret": true, "Acquire::gar::Impersonate-Service-Account": true,
+		"Acquire::gar::Auth-Conf-Write": true, "Acquire::gar::Require-Auth": true,
+		"Acquire::gar::Drop-Privileges": true, "Acquire::gar::Chaos": true,
+	}
+	for _, option := range ConfigOptions() {
+		if option.Env != "" && sensitive[option.Key] {
+			t.Errorf("failed, expected %s not to be overridden from the environment", option.Key)
+		}
+	}
+}
+
+func TestConfigOptionsDocumented(t *testing.T) {
+	doc, err := os.ReadFile("../90artifact-registry")
+	if err != nil {
+		t.Fatalf("failed to read the example config: %v", err)
+	}
+	for _, option := range ConfigOptions() {
+		if !strings.HasPrefix(option.Key, configPrefix) {
+			continue
+		}
+		if name := strings.TrimPrefix(option.Key, configPrefix); !bytes.Contains(doc, []byte(name)) {
+			t.Errorf("failed, option %s isn't documented in 90artifact-registry", option.Key)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+//  Copyright 2021 Google LLC
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package apt
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// defaultPrewarmConnections is how many connections are opened to a host
+// before a burst of acquires for it is sent, unless Prewarm-Connections says
+// otherwise.
+const defaultPrewarmConnections = 4
+
+// prewarmTimeout bounds how long warming up a host may take.
+const prewarmTimeout = 10 * time.Second
+
+// prewarmGate marks a host a burst of acquires asked to warm up, which the
+// first of them starts once.
+type prewarmGate struct {
+	once sync.Once
+}
+
+// aptHost returns the host of uri as apt gave it, before any rewriting.
+func aptHost(uri string) string {
+	u, err := parseAptURI(uri)
+	if err != nil {
+		return ""
+	}
+	return u.Host
+}
+
+// requestPrewarm marks the host of msg to be warmed up if msg is the first
+// acquire for it and more are already waiting to be read: apt sends its
+// whole queue at once at the start of a big upgrade, and without this every
+// worker would resolve the host, connect and fetch a token at once.
+func (m *Method) requestPrewarm(msg *Message) {
+	if m.config.prewarmConnections < 2 || m.config.workers() < 2 || !m.reader.pending() {
+		return
+	}
+	host := aptHost(msg.Get("URI"))
+	m.prewarmMu.Lock()
+	defer m.prewarmMu.Unlock()
+	if _, ok := m.prewarmGates[host]; ok {
+		return
+	}
+	if m.prewarmGates == nil {
+		m.prewarmGates = make(map[string]*prewarmGate)
+	}
+	m.prewarmGates[host] = &prewarmGate{}
+}
+
+// startPrewarm starts warming up host, to which an acquire of uri is sent,
+// in the background if a burst of acquires for it asked for that and no
+// other acquire has yet. No acquire waits for it: they go ahead, and those
+// sent once it is done share the connections it opened.
+func (m *Method) startPrewarm(ctx context.Context, uri, host string) {
+	m.prewarmMu.Lock()
+	gate := m.prewarmGates[aptHost(uri)]
+	m.prewarmMu.Unlock()
+	if gate == nil {
+		return
+	}
+	gate.once.Do(func() {
+		n := m.config.prewarmConnections
+		if n > m.config.workers() {
+			n = m.config.workers()
+		}
+		m.background.Add(1)
+		go func() {
+			defer m.background.Done()
+			defer m.failOnPanic()
+			m.prewarm(ctx, host, n)
+		}()
+	})
+}
+
+// prewarm resolves host and opens n connections to it in parallel,
+// fetching a token on the way, for the acquires of a burst to share.
+func (m *Method) prewarm(ctx context.Context, host string, n int) {
+	ctx, cancel := context.WithTimeout(ctx, prewarmTimeout)
+	defer cancel()
+	start := m.timeSource().Now()
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var failed []error
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer m.failOnPanic()
+			if _, err := m.probeHost(ctx, host); err != nil {
+				mu.Lock()
+				failed = append(failed, err)
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if len(failed) > 0 {
+		m.debugLog(ctx, fmt.Sprintf("warming up %d connections to %s: %d failed, e.g. %v", n, host, len(failed), failed[0]))
+	} else {
+		m.debugLog(ctx, fmt.Sprintf("warmed up %d connections to %s in %v", n, host, m.timeSource().Now().Sub(start)))
+	}
+}
@@ -0,0 +1,64 @@
+//  Copyright 2021 Google LLC
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package apt
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/user"
+)
+
+// defaultSandboxUser is the user apt's own methods switch to when started
+// as root, unless APT::Sandbox::User names another.
+const defaultSandboxUser = "_apt"
+
+// getuid and setUser are replaced in tests, which can't give up root.
+var (
+	getuid  = os.Getuid
+	setUser = switchUser
+)
+
+// dropPrivileges switches the method to the sandbox user if it was started
+// as root, as apt's own methods do. Credentials are read and a first token
+// fetched beforehand, so that key files only root can read are no longer
+// needed; the method carries on with what it holds in memory. Failures to
+// obtain credentials are AuthErrors.
+func (m *Method) dropPrivileges(ctx context.Context) error {
+	name := m.config.sandboxUser
+	if !m.config.dropPrivileges || getuid() != 0 || name == "" || name == "root" {
+		return nil
+	}
+	u, err := user.Lookup(name)
+	if err != nil {
+		return fmt.Errorf("failed to look up sandbox user: %v", err)
+	}
+	if err := m.initClient(ctx); err != nil {
+		return withKind(AuthError, err)
+	}
+	m.clientMu.Lock()
+	tokens := m.tokens
+	m.clientMu.Unlock()
+	if tokens != nil {
+		if _, err := tokens.Token(); err != nil {
+			return withKind(AuthError, fmt.Errorf("failed to obtain token before dropping privileges: %v", err))
+		}
+	}
+	if err := setUser(u); err != nil {
+		return fmt.Errorf("failed to switch to sandbox user %s: %v", name, err)
+	}
+	m.debugLog(ctx, "switched to sandbox user "+name)
+	return nil
+}
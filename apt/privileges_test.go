@@ -0,0 +1,76 @@
+//  Copyright 2021 Google LLC
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package apt
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"os/user"
+	"testing"
+)
+
+func TestDropPrivileges(t *testing.T) {
+	// Any user other than root will do, as the switch itself is faked.
+	current, err := user.Current()
+	if err == nil && current.Uid == "0" {
+		current, err = user.Lookup("nobody")
+	}
+	if err != nil {
+		t.Skip(err)
+	}
+	defer func(f func() int, g func(*user.User) error) { getuid, setUser = f, g }(getuid, setUser)
+
+	var tests = []struct {
+		name        string
+		uid         int
+		config      []string
+		expected    string
+		expectedErr ErrorKind
+	}{
+		{"disabled", 0, []string{"Acquire::gar::Access-Token=token", "APT::Sandbox::User=" + current.Username}, "", UnknownError},
+		{"not root", 1000, []string{"Acquire::gar::Access-Token=token", "Acquire::gar::Drop-Privileges=true", "APT::Sandbox::User=" + current.Username}, "", UnknownError},
+		{"sandbox user root", 0, []string{"Acquire::gar::Access-Token=token", "Acquire::gar::Drop-Privileges=true", "APT::Sandbox::User=root"}, "", UnknownError},
+		{"enabled", 0, []string{"Acquire::gar::Access-Token=token", "Acquire::gar::Drop-Privileges=true", "APT::Sandbox::User=" + current.Username}, current.Username, UnknownError},
+		{"no credentials", 0, []string{"Acquire::gar::Drop-Privileges=true", "APT::Sandbox::User=" + current.Username, "Acquire::gar::Service-Account-JSON=/nonexistent.json"}, "", AuthError},
+	}
+	for _, tt := range tests {
+		var switched string
+		getuid = func() int { return tt.uid }
+		setUser = func(u *user.User) error {
+			switched = u.Username
+			return nil
+		}
+		var buffer bytes.Buffer
+		method := NewAptMethod(bufio.NewReader(&bytes.Buffer{}), &buffer)
+		method.handleConfigure(&Message{code: 601, description: "Configuration", fields: map[string][]string{
+			"Config-Item": tt.config,
+		}})
+		err := method.dropPrivileges(context.Background())
+		if tt.expectedErr != UnknownError {
+			if err == nil || KindOf(err) != tt.expectedErr {
+				t.Errorf("%s: failed, expected an error of kind %v, got %v", tt.name, tt.expectedErr, err)
+			}
+		} else if err != nil {
+			t.Errorf("%s: failed, %v", tt.name, err)
+		}
+		if switched != tt.expected {
+			t.Errorf("%s: failed, switched to %q, expected %q", tt.name, switched, tt.expected)
+		}
+		if tt.expected != "" && method.client == nil {
+			t.Errorf("%s: failed, expected credentials to be read before switching", tt.name)
+		}
+	}
+}
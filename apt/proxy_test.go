@@ -0,0 +1,152 @@
+//  Copyright 2021 Google LLC
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package apt
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/oauth2"
+)
+
+func TestProxyFailure(t *testing.T) {
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Host == "blocked.example.com:443" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.WriteHeader(http.StatusProxyAuthRequired)
+	}))
+	defer proxy.Close()
+	closed, _ := net.Listen("tcp", "127.0.0.1:0")
+	closed.Close()
+
+	var tests = []struct {
+		name, proxy, url, expected string
+	}{
+		{"auth required", proxy.URL, "https://pkg.example.com/", "requires authentication (407)"},
+		{"blocked", proxy.URL, "https://blocked.example.com/", "refused to connect to blocked.example.com (403)"},
+		{"refused", "http://" + closed.Addr().String(), "https://pkg.example.com/", "could not connect to proxy"},
+		{"tls", strings.Replace(proxy.URL, "http:", "https:", 1), "https://pkg.example.com/", "TLS connection to proxy"},
+	}
+
+	for _, tt := range tests {
+		proxyURL, _ := url.Parse(tt.proxy)
+		client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+		_, err := client.Get(tt.url)
+		if err == nil {
+			t.Fatalf("%s: failed, expected an error", tt.name)
+		}
+		if res := proxyFailure(err, proxyURL, "blocked.example.com"); res == nil || !strings.Contains(res.Error(), tt.expected) {
+			t.Errorf("%s: failed, expected %q, got %v", tt.name, tt.expected, res)
+		}
+	}
+
+	if res := proxyFailure(context.DeadlineExceeded, &url.URL{Host: "proxy:3128"}, "pkg.example.com"); res != nil {
+		t.Errorf("failed, expected an unrelated error to be left alone, got %v", res)
+	}
+}
+
+func TestAptMethodProxyFailure(t *testing.T) {
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusProxyAuthRequired)
+	}))
+	defer proxy.Close()
+	proxyURL, _ := url.Parse(proxy.URL)
+	defer func(f func(*http.Request) (*url.URL, error)) { proxyForRequest = f }(proxyForRequest)
+	proxyForRequest = http.ProxyURL(proxyURL)
+
+	var buffer bytes.Buffer
+	method := NewAptMethod(bufio.NewReader(&bytes.Buffer{}), &buffer)
+	method.handleConfigure(&Message{code: 601, description: "Configuration", fields: map[string][]string{
+		"Config-Item": {"Acquire::gar::Access-Token=token"},
+	}})
+	client := &http.Client{Transport: &http.Transport{Proxy: proxyForRequest}}
+	ctx := context.WithValue(context.Background(), oauth2.HTTPClient, client)
+	msg := &Message{
+		code:        600,
+		description: "URI Acquire",
+		fields:      map[string][]string{"URI": {"ar+https://pkg.example.com/pool/pkg.deb"}, "Filename": {filepath.Join(t.TempDir(), "pkg.deb")}},
+	}
+	if err := method.handleAcquire(ctx, msg); err == nil || !strings.Contains(buffer.String(), "proxy "+proxyURL.Host+" requires authentication") {
+		t.Errorf("failed, %v: %q", err, buffer.String())
+	}
+}
+
+func TestIntermediaryChallenge(t *testing.T) {
+	var tests = []struct {
+		name          string
+		code          int
+		header        http.Header
+		config        aptMethodConfig
+		expectedRealm string
+		expected      bool
+	}{
+		{"no challenge", 403, http.Header{}, aptMethodConfig{}, "", false},
+		{"registry realm", 401, http.Header{"Www-Authenticate": {`Bearer realm="https://us-apt.pkg.dev/token"`}}, aptMethodConfig{}, "", false},
+		{"requested host", 401, http.Header{"Www-Authenticate": {`Basic realm="https://mirror.example.com/"`}}, aptMethodConfig{}, "", false},
+		{"proxy realm", 401, http.Header{"Www-Authenticate": {`Basic realm="Corporate Gateway"`}}, aptMethodConfig{}, "Corporate Gateway", true},
+		{"unquoted realm", 403, http.Header{"Www-Authenticate": {`Basic realm=gateway, charset="UTF-8"`}}, aptMethodConfig{}, "gateway", true},
+		{"proxy authenticate", 403, http.Header{"Proxy-Authenticate": {`Negotiate`}}, aptMethodConfig{}, "", true},
+		{"407", 407, http.Header{"Proxy-Authenticate": {`Basic realm="squid"`}}, aptMethodConfig{}, "squid", true},
+		{"not a refusal", 404, http.Header{"Proxy-Authenticate": {`Basic realm="squid"`}}, aptMethodConfig{}, "", false},
+		{"ignored", 401, http.Header{"Www-Authenticate": {`Basic realm="Corporate Gateway"`}}, aptMethodConfig{ignoreIntermediaries: true}, "", false},
+	}
+
+	req := httptest.NewRequest("GET", "https://mirror.example.com/pool/pkg.deb", nil)
+	for _, tt := range tests {
+		realm, ok := tt.config.intermediaryChallenge(req, &http.Response{StatusCode: tt.code, Header: tt.header})
+		if realm != tt.expectedRealm || ok != tt.expected {
+			t.Errorf("%s: failed, expected %q, %v, got %q, %v", tt.name, tt.expectedRealm, tt.expected, realm, ok)
+		}
+	}
+}
+
+func TestAptMethodIntermediaryRejection(t *testing.T) {
+	var tests = []struct {
+		name, configItem string
+		header           map[string][]string
+		expected         string
+	}{
+		{"proxy", "", map[string][]string{"Www-Authenticate": {`Basic realm="Corporate Gateway"`}}, `from an intermediary proxy (realm "Corporate Gateway"), not Artifact Registry`},
+		{"registry", "", map[string][]string{}, "refused by fake.uri for anonymous"},
+		{"ignored", "Acquire::gar::Intermediary-Challenges=ignore", map[string][]string{"Www-Authenticate": {`Basic realm="Corporate Gateway"`}}, "refused by fake.uri for anonymous"},
+	}
+
+	for _, tt := range tests {
+		var buffer bytes.Buffer
+		method := NewAptMethod(bufio.NewReader(&bytes.Buffer{}), &buffer)
+		method.client = fakeHTTPClient{code: 401, header: tt.header}
+		if tt.configItem != "" {
+			method.handleConfigure(&Message{code: 601, description: "Configuration", fields: map[string][]string{"Config-Item": {tt.configItem}}})
+		}
+		msg := &Message{
+			code:        600,
+			description: "URI Acquire",
+			fields:      map[string][]string{"URI": {"ar+https://fake.uri/pool/pkg.deb"}, "Filename": {"/path/to/file"}},
+		}
+		if err := method.handleAcquire(context.Background(), msg); err == nil || !strings.Contains(buffer.String(), tt.expected) {
+			t.Errorf("%s: failed, expected %q, got %v: %q", tt.name, tt.expected, err, buffer.String())
+		}
+	}
+}
@@ -0,0 +1,99 @@
+//  Copyright 2021 Google LLC
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package apt
+
+import (
+	"reflect"
+	"sync"
+)
+
+// resetConfig discards the configuration applied so far, which that of a
+// later 601 Configuration message replaces rather than adds to, and
+// returns the values it set. Background work reading the configuration,
+// such as warmup, is waited for first. The secrets it held are released,
+// but for that read from Credential-FD, which can't be read again.
+func (m *Method) resetConfig() map[string]*configValue {
+	m.background.Wait()
+	previous := m.configValues
+	m.config.accessToken.Release()
+	if m.config.credential != m.credentialFD {
+		m.config.credential.Release()
+	}
+	*m.config = *defaultConfig()
+	m.configValues = nil
+	m.writer.setTimeout(defaultWriteTimeout)
+	return previous
+}
+
+// reconfigured drops the client after a configuration which set the
+// options it is made with to other values than the previous one, which set
+// previous, so that the next acquire makes a new client with them,
+// fetching new tokens. What was worked out with the old client goes with
+// it: the hosts failing fast, the clients and options of sources entries,
+// the selected region, the switch to the fallback endpoint and the secrets
+// fetched for it. The region and egress checks are also made again if
+// their own options changed. Other options take effect as they are.
+func (m *Method) reconfigured(previous map[string]*configValue) {
+	changed := func(keys ...string) bool {
+		for _, key := range keys {
+			if !reflect.DeepEqual(previous[key], m.configValues[key]) {
+				return true
+			}
+		}
+		return false
+	}
+	clientChanged := false
+	for _, option := range configOptions {
+		if option.client && changed(option.Key) {
+			clientChanged = true
+		}
+	}
+	if clientChanged || changed("Acquire::gar::Region-Candidates") {
+		m.regionMu.Lock()
+		m.region, m.regionSelected = "", false
+		m.regionMu.Unlock()
+	}
+	if changed("Acquire::gar::Egress-Allowlist", "Acquire::gar::Egress-Allowlist-Mode") {
+		m.egressMu.Lock()
+		m.egressChecked = nil
+		m.egressMu.Unlock()
+	}
+	if !clientChanged {
+		return
+	}
+	if m.config.debug {
+		m.writer.Log("configuration changed, credentials will be set up again")
+	}
+	m.clientMu.Lock()
+	defer m.clientMu.Unlock()
+	m.client = nil
+	m.tokens, m.proxyTokens = nil, nil
+	m.authConf = nil
+	m.anonymous = false
+	m.identity = ""
+	m.sourcesOnce = sync.Once{}
+	m.sources = nil
+	for _, secret := range m.secrets {
+		secret.Release()
+	}
+	m.secrets = nil
+
+	m.hostMu.Lock()
+	m.hostFailures = nil
+	m.hostMu.Unlock()
+	m.fallbackMu.Lock()
+	m.fallbackActive = false
+	m.fallbackMu.Unlock()
+}
@@ -0,0 +1,168 @@
+//  Copyright 2021 Google LLC
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package apt
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestHandleConfigureReplaces(t *testing.T) {
+	var buffer bytes.Buffer
+	method := NewAptMethod(bufio.NewReader(&bytes.Buffer{}), &buffer)
+	configure := func(items ...string) {
+		t.Helper()
+		if err := method.handleConfigure(&Message{code: 601, description: "Configuration", fields: map[string][]string{"Config-Item": items}}); err != nil {
+			t.Fatalf("failed, %v", err)
+		}
+	}
+
+	configure("Acquire::gar::Auth-Hosts::=mirror.example.com", "Acquire::gar::Pipeline-Depth=2")
+	method.client = fakeHTTPClient{}
+
+	// The same configuration again doesn't add to lists, nor drop the
+	// client.
+	configure("Acquire::gar::Auth-Hosts::=mirror.example.com", "Acquire::gar::Pipeline-Depth=2")
+	if len(method.config.authHosts) != 1 || method.config.pipelineDepth != 2 {
+		t.Errorf("failed, expected the configuration to be replaced, got %v and depth %d", method.config.authHosts, method.config.pipelineDepth)
+	}
+	if method.client == nil {
+		t.Errorf("failed, expected the client to be kept for the same configuration")
+	}
+
+	// Another replaces it, items it leaves out returning to their
+	// defaults. Options the client isn't made with take effect as they are.
+	configure("Debug::Acquire::gar=true", "Acquire::gar::Pipeline-Depth=2")
+	if len(method.config.authHosts) != 0 || method.config.pipelineDepth != 2 || !method.config.debug {
+		t.Errorf("failed, expected the new configuration alone, got %v, depth %d and debug %v", method.config.authHosts, method.config.pipelineDepth, method.config.debug)
+	}
+	if method.client == nil {
+		t.Errorf("failed, expected the client to be kept when only debugging changes")
+	}
+
+	// The client is made again for options it is made with.
+	configure("Debug::Acquire::gar=true")
+	if len(method.config.authHosts) != 0 || method.config.pipelineDepth != 0 || !method.config.debug {
+		t.Errorf("failed, expected the new configuration alone, got %v, depth %d and debug %v", method.config.authHosts, method.config.pipelineDepth, method.config.debug)
+	}
+	if method.client != nil {
+		t.Errorf("failed, expected the client to be dropped for a new configuration")
+	}
+}
+
+func TestResetConfigReleasesSecrets(t *testing.T) {
+	var buffer bytes.Buffer
+	method := NewAptMethod(bufio.NewReader(&bytes.Buffer{}), &buffer)
+	if err := method.handleConfigure(&Message{code: 601, description: "Configuration", fields: map[string][]string{"Config-Item": {"Acquire::gar::Access-Token=token"}}}); err != nil {
+		t.Fatalf("failed, %v", err)
+	}
+	token := method.config.accessToken
+	if string(token.Bytes()) != "token" {
+		t.Fatalf("failed, expected the Access-Token to be kept, got %q", token.Bytes())
+	}
+	if err := method.handleConfigure(&Message{code: 601, description: "Configuration", fields: map[string][]string{"Config-Item": {"Acquire::gar::Access-Token=other"}}}); err != nil {
+		t.Fatalf("failed, %v", err)
+	}
+	if !token.Empty() {
+		t.Errorf("failed, expected the replaced Access-Token to be released")
+	}
+	if string(method.config.accessToken.Bytes()) != "other" {
+		t.Errorf("failed, expected the new Access-Token, got %q", method.config.accessToken.Bytes())
+	}
+}
+
+func TestReconfiguredResetsCaches(t *testing.T) {
+	var buffer bytes.Buffer
+	method := NewAptMethod(bufio.NewReader(&bytes.Buffer{}), &buffer)
+	configure := func(items ...string) {
+		t.Helper()
+		if err := method.handleConfigure(&Message{code: 601, description: "Configuration", fields: map[string][]string{"Config-Item": items}}); err != nil {
+			t.Fatalf("failed, %v", err)
+		}
+	}
+	fill := func() {
+		method.client = fakeHTTPClient{}
+		method.hostFailures = map[hostFailureKey]error{{host: "us-apt.pkg.dev"}: errors.New("TLS failure")}
+		method.sourceConfigFor("ar+https://us-apt.pkg.dev/projects/p/repositories/r")
+		method.sources = []*sourceConfig{{uri: "ar+https://us-apt.pkg.dev/projects/p/repositories/r", client: fakeHTTPClient{}}}
+		method.region, method.regionSelected = "europe-apt.pkg.dev", true
+		method.egressChecked = map[string]error{"us-apt.pkg.dev": nil}
+		method.fallbackActive = true
+	}
+
+	configure("Acquire::gar::Follow-Redirects=true", "Acquire::gar::Region-Candidates::=europe-apt.pkg.dev")
+	fill()
+	// The same configuration again keeps what was worked out with it.
+	configure("Acquire::gar::Follow-Redirects=true", "Acquire::gar::Region-Candidates::=europe-apt.pkg.dev")
+	if method.client == nil || method.hostFailures == nil || method.sources == nil || !method.regionSelected || method.egressChecked == nil || !method.fallbackActive {
+		t.Errorf("failed, expected the caches to be kept for the same configuration")
+	}
+
+	// A new client starts over.
+	configure("Acquire::gar::Follow-Redirects=false", "Acquire::gar::Region-Candidates::=europe-apt.pkg.dev")
+	if method.client != nil || method.hostFailures != nil || method.sources != nil || method.regionSelected || method.region != "" || method.fallbackActive {
+		t.Errorf("failed, expected the caches to be reset with the client")
+	}
+	reread := false
+	method.sourcesOnce.Do(func() { reread = true })
+	if !reread {
+		t.Errorf("failed, expected the sources files to be read again")
+	}
+
+	// As do the region and egress checks when their options change.
+	fill()
+	configure("Acquire::gar::Follow-Redirects=false", "Acquire::gar::Egress-Allowlist::=199.36.153.8/30")
+	if method.regionSelected || method.egressChecked != nil {
+		t.Errorf("failed, expected the region and egress checks to be made again")
+	}
+	if method.client == nil {
+		t.Errorf("failed, expected the client to be kept")
+	}
+}
+
+func TestRunReconfigure(t *testing.T) {
+	input := strings.Join([]string{
+		"601 Configuration\nConfig-Item: Acquire::gar::Pipeline-Depth=1\n",
+		"600 URI Acquire\nURI: ar+https://fake.uri/a\nFilename: /path/to/a\n",
+		"601 Configuration\nConfig-Item: Acquire::gar::Pipeline-Depth=1\nConfig-Item: Debug::Acquire::gar=true\n",
+		"600 URI Acquire\nURI: ar+https://fake.uri/b\nFilename: /path/to/b\n",
+	}, "\n") + "\n"
+	var buffer bytes.Buffer
+	method := NewAptMethod(bufio.NewReader(strings.NewReader(input)), &buffer)
+	method.client = fakeHTTPClient{body: "content"}
+	method.dl = fakeDownloader{}
+	if err := method.Run(context.Background()); err != nil {
+		t.Fatalf("failed, %v", err)
+	}
+
+	// Debug logging starts with the acquire after the second
+	// configuration.
+	output := buffer.String()
+	first := strings.Index(output, "URI: ar+https://fake.uri/a")
+	second := strings.Index(output, "effective config: Debug::Acquire::gar=true (apt)")
+	if first < 0 || second < first || strings.Contains(output[:second], "GET /a") {
+		t.Errorf("failed, expected debug logging only after the second configuration, got:\n%s", output)
+	}
+	if !strings.Contains(output[second:], "GET /b") {
+		t.Errorf("failed, expected the second acquire to be logged, got:\n%s", output)
+	}
+	if strings.Count(output, "201 URI Done") != 2 {
+		t.Errorf("failed, expected both acquires done, got:\n%s", output)
+	}
+}
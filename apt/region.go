@@ -0,0 +1,109 @@
+//  Copyright 2021 Google LLC
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package apt
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// selectRegion probes each of the configured candidate hosts and records the
+// one which responded fastest. It only runs once per session.
+func (m *Method) selectRegion(ctx context.Context) {
+	m.regionMu.Lock()
+	defer m.regionMu.Unlock()
+	if m.regionSelected || len(m.config.regionCandidates) == 0 {
+		return
+	}
+	m.regionSelected = true
+
+	type result struct {
+		host    string
+		latency time.Duration
+		err     error
+	}
+	results := make(chan result, len(m.config.regionCandidates))
+	for _, host := range m.config.regionCandidates {
+		go func(host string) {
+			latency, err := m.probeHost(ctx, host)
+			results <- result{host, latency, err}
+		}(host)
+	}
+
+	var best result
+	for range m.config.regionCandidates {
+		res := <-results
+		if res.err != nil {
+			m.writer.Log(fmt.Sprintf("region probe of %s failed: %v", res.host, res.err))
+			continue
+		}
+		m.debugLog(ctx, fmt.Sprintf("region probe of %s took %v", res.host, res.latency))
+		if best.host == "" || res.latency < best.latency {
+			best = res
+		}
+	}
+	if best.host == "" {
+		m.writer.Log("no candidate region responded, using hosts from sources.list")
+		return
+	}
+	m.region = best.host
+	m.writer.Log(fmt.Sprintf("selected region %s (%v)", best.host, best.latency))
+}
+
+// probeHost measures the time taken for host to respond to a HEAD request.
+// Any HTTP response counts as success, as only reachability is of interest.
+func (m *Method) probeHost(ctx context.Context, host string) (time.Duration, error) {
+	if err := m.checkEgress(ctx, host); err != nil {
+		return 0, err
+	}
+	req, err := http.NewRequest("HEAD", "https://"+host+"/", nil)
+	if err != nil {
+		return 0, err
+	}
+	req = req.WithContext(ctx)
+	clock := m.timeSource()
+	start := clock.Now()
+	resp, err := m.clientFor(req).Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	return clock.Now().Sub(start), nil
+}
+
+// regionURI rewrites the host of uri to the selected region, if uri points
+// at one of the candidate hosts.
+func (m *Method) regionURI(uri string) string {
+	m.regionMu.Lock()
+	region := m.region
+	m.regionMu.Unlock()
+	if region == "" {
+		return uri
+	}
+	u, err := url.Parse(uri)
+	if err != nil {
+		return uri
+	}
+	for _, host := range m.config.regionCandidates {
+		if u.Host == host {
+			u.Host = region
+			return u.String()
+		}
+	}
+	return uri
+}
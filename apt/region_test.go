@@ -0,0 +1,105 @@
+//  Copyright 2021 Google LLC
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package apt
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+type fakeLatencyClient map[string]time.Duration
+
+func (c fakeLatencyClient) Do(req *http.Request) (*http.Response, error) {
+	latency, ok := c[req.URL.Host]
+	if !ok {
+		return nil, errors.New("unreachable")
+	}
+	time.Sleep(latency)
+	return &http.Response{StatusCode: 404, Body: io.NopCloser(strings.NewReader(""))}, nil
+}
+
+func TestSelectRegion(t *testing.T) {
+	var tests = []struct {
+		client     fakeLatencyClient
+		candidates []string
+		expected   string
+	}{
+		{
+			fakeLatencyClient{"us-apt.pkg.dev": 50 * time.Millisecond, "europe-apt.pkg.dev": time.Millisecond},
+			[]string{"us-apt.pkg.dev", "europe-apt.pkg.dev"},
+			"europe-apt.pkg.dev",
+		},
+		{
+			// Unreachable candidates are skipped.
+			fakeLatencyClient{"us-apt.pkg.dev": 10 * time.Millisecond},
+			[]string{"us-apt.pkg.dev", "asia-apt.pkg.dev"},
+			"us-apt.pkg.dev",
+		},
+		{
+			fakeLatencyClient{},
+			[]string{"asia-apt.pkg.dev"},
+			"",
+		},
+		{
+			fakeLatencyClient{"us-apt.pkg.dev": time.Millisecond},
+			nil,
+			"",
+		},
+	}
+
+	for _, tt := range tests {
+		var buffer bytes.Buffer
+		method := &Method{
+			config: &aptMethodConfig{regionCandidates: tt.candidates},
+			writer: NewAptMessageWriter(&buffer),
+			client: tt.client,
+		}
+		method.selectRegion(context.Background())
+		if method.region != tt.expected {
+			t.Errorf("selected region %q, expected %q", method.region, tt.expected)
+		}
+	}
+}
+
+func TestRegionURI(t *testing.T) {
+	method := &Method{
+		config: &aptMethodConfig{regionCandidates: []string{"us-apt.pkg.dev", "europe-apt.pkg.dev"}},
+		region: "europe-apt.pkg.dev",
+	}
+	var tests = []struct {
+		uri, expected string
+	}{
+		{
+			"https://us-apt.pkg.dev/projects/p/dists/r/InRelease",
+			"https://europe-apt.pkg.dev/projects/p/dists/r/InRelease",
+		},
+		{
+			"https://asia-apt.pkg.dev/projects/p/dists/r/InRelease",
+			"https://asia-apt.pkg.dev/projects/p/dists/r/InRelease",
+		},
+	}
+
+	for _, tt := range tests {
+		if res := method.regionURI(tt.uri); res != tt.expected {
+			t.Errorf("regionURI(%q) = %q, expected %q", tt.uri, res, tt.expected)
+		}
+	}
+}
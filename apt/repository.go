@@ -0,0 +1,58 @@
+//  Copyright 2021 Google LLC
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package apt
+
+import (
+	"fmt"
+	"strings"
+)
+
+// parseRepositoryURI returns the project and location of an Artifact
+// Registry URI of the form ar+https://LOCATION-apt.pkg.dev/projects/PROJECT/...
+func parseRepositoryURI(uri string) (project, location string, ok bool) {
+	u, err := parseAptURI(uri)
+	if err != nil {
+		return "", "", false
+	}
+	location = strings.TrimSuffix(u.Hostname(), "-apt.pkg.dev")
+	if location == u.Hostname() || location == "" {
+		return "", "", false
+	}
+	parts := strings.Split(strings.TrimPrefix(u.Path, "/"), "/")
+	if len(parts) < 2 || parts[0] != "projects" || parts[1] == "" {
+		return "", "", false
+	}
+	return parts[1], location, true
+}
+
+// checkExpectedRepository fails closed if uri is not in the project and
+// location operators pinned with Expected-Project and Expected-Location,
+// guarding against sources.list entries which point elsewhere.
+func (m *Method) checkExpectedRepository(uri string) error {
+	if m.config.expectedProject == "" && m.config.expectedLocation == "" {
+		return nil
+	}
+	project, location, ok := parseRepositoryURI(uri)
+	if !ok {
+		return fmt.Errorf("cannot determine the project and location of %s, which must match Expected-Project and Expected-Location", uri)
+	}
+	if m.config.expectedProject != "" && project != m.config.expectedProject {
+		return fmt.Errorf("%s is in project %q, expected %q", uri, project, m.config.expectedProject)
+	}
+	if m.config.expectedLocation != "" && location != m.config.expectedLocation {
+		return fmt.Errorf("%s is in location %q, expected %q", uri, location, m.config.expectedLocation)
+	}
+	return nil
+}
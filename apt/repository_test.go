@@ -0,0 +1,78 @@
+//  Copyright 2021 Google LLC
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package apt
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestParseRepositoryURI(t *testing.T) {
+	var tests = []struct {
+		uri, project, location string
+		ok                     bool
+	}{
+		{"ar+https://us-central1-apt.pkg.dev/projects/my-project/repo/dists/repo/Release", "my-project", "us-central1", true},
+		{"ar+https://europe-apt.pkg.dev/projects/p/repo/pool/p.deb", "p", "europe", true},
+		{"ar+https://us-apt.pkg.dev/repo/dists/repo/Release", "", "", false},
+		{"ar+https://proxy.example.com/projects/p/repo/dists/repo/Release", "", "", false},
+		{"ar+https://apt.pkg.dev/projects/p/repo", "", "", false},
+	}
+
+	for _, tt := range tests {
+		project, location, ok := parseRepositoryURI(tt.uri)
+		if project != tt.project || location != tt.location || ok != tt.ok {
+			t.Errorf("failed for %s, expected %q %q %v got %q %q %v", tt.uri, tt.project, tt.location, tt.ok, project, location, ok)
+		}
+	}
+}
+
+func TestAptMethodExpectedRepository(t *testing.T) {
+	var tests = []struct {
+		uri          string
+		expectedCode string
+	}{
+		{"ar+https://us-central1-apt.pkg.dev/projects/my-project/repo/dists/repo/Release", "201"},
+		{"ar+https://us-central1-apt.pkg.dev/projects/other-project/repo/dists/repo/Release", "400"},
+		{"ar+https://europe-west1-apt.pkg.dev/projects/my-project/repo/dists/repo/Release", "400"},
+		{"ar+https://proxy.example.com/projects/my-project/repo/dists/repo/Release", "400"},
+	}
+
+	for _, tt := range tests {
+		var buffer bytes.Buffer
+		method := NewAptMethod(bufio.NewReader(&bytes.Buffer{}), &buffer)
+		method.client = fakeHTTPClient{}
+		method.dl = fakeDownloader{}
+		method.handleConfigure(&Message{
+			code:        601,
+			description: "Configuration",
+			fields: map[string][]string{"Config-Item": {
+				"Acquire::gar::Expected-Project=my-project",
+				"Acquire::gar::Expected-Location=us-central1",
+			}},
+		})
+		method.handleAcquire(context.Background(), &Message{
+			code:        600,
+			description: "URI Acquire",
+			fields:      map[string][]string{"URI": {tt.uri}, "Filename": {"/path/to/file"}},
+		})
+		if !strings.Contains(buffer.String(), tt.expectedCode+" URI") {
+			t.Errorf("failed for %s, expected %s, got %q", tt.uri, tt.expectedCode, buffer.String())
+		}
+	}
+}
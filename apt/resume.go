@@ -0,0 +1,275 @@
+//  Copyright 2021 Google LLC
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package apt
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// errRestartDownload is returned when a server replies to a range request
+// with the whole file, e.g. because it changed since the transfer began. The
+// part already received can't be used, so the download must start over with
+// the new response to avoid reporting hashes of a spliced file.
+var errRestartDownload = errors.New("server sent the whole file in reply to a range request")
+
+// maxResumeRetries bounds how many times a single transfer is resumed after
+// the connection is reset.
+const maxResumeRetries = 3
+
+// isConnectionReset reports whether err means the peer dropped the
+// connection, as some NAT gateways do to long-lived transfers.
+func isConnectionReset(err error) bool {
+	return errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE)
+}
+
+// monotonicProgress wraps progress so that it never reports fewer bytes than
+// it already has. A restarted download writes the file again from the start,
+// and progress shown to the user shouldn't jump backwards when it does.
+func monotonicProgress(progress func(int64)) func(int64) {
+	var reported int64
+	return func(written int64) {
+		if written > reported {
+			reported = written
+			progress(written)
+		}
+	}
+}
+
+// resumingBody reads a response body, and if the connection is reset part
+// way through, requests the remainder on a fresh connection with a Range
+// request starting at the offset already received.
+type resumingBody struct {
+	body io.ReadCloser
+	req  *http.Request
+	do   func(*http.Request) (*http.Response, error)
+	log  func(string)
+	// status tells the user a resume is under way, so that apt doesn't
+	// appear stalled while the new connection is made.
+	status func(string)
+	// validator is the ETag or Last-Modified of the original response, so
+	// that the server only sends a range of the same version.
+	validator, encoding string
+	offset              int64
+	retries             int
+	// restarted is the full response sent in reply to a range request,
+	// which is read from the start after errRestartDownload.
+	restarted *http.Response
+}
+
+// newResumingBody returns the body of resp, which was received for req, as
+// a resumingBody if the response allows resuming it. offset is where in the
+// file the body starts.
+func (m *Method) newResumingBody(req *http.Request, resp *http.Response, offset int64) io.ReadCloser {
+	validator := resp.Header.Get("ETag")
+	if validator == "" {
+		validator = resp.Header.Get("Last-Modified")
+	}
+	if validator == "" {
+		return resp.Body
+	}
+	return &resumingBody{
+		body:      resp.Body,
+		req:       req,
+		do:        m.do,
+		log:       func(msg string) { m.writer.Log(msg) },
+		status:    func(msg string) { m.writer.Status(msg) },
+		validator: validator,
+		encoding:  resp.Header.Get("Content-Encoding"),
+		offset:    offset,
+	}
+}
+
+func (b *resumingBody) Read(p []byte) (int, error) {
+	n, err := b.body.Read(p)
+	b.offset += int64(n)
+	if err == nil || err == io.EOF || !isConnectionReset(err) || b.retries >= maxResumeRetries {
+		return n, err
+	}
+	b.retries++
+	b.status(fmt.Sprintf("retrying (%d/%d) %s after %d bytes: %v", b.retries, maxResumeRetries, b.req.URL, b.offset, err))
+	if resumeErr := b.resume(); resumeErr == errRestartDownload {
+		return n, resumeErr
+	} else if resumeErr != nil {
+		b.log(fmt.Sprintf("failed to resume %s: %v", b.req.URL, resumeErr))
+		return n, err
+	}
+	if n > 0 {
+		return n, nil
+	}
+	return b.Read(p)
+}
+
+// resume replaces the body with the remainder of the response, fetched on a
+// new connection. Closing the broken body keeps its connection out of the
+// transport's pool.
+func (b *resumingBody) resume() error {
+	b.body.Close()
+	b.body = io.NopCloser(strings.NewReader(""))
+
+	req := b.req.Clone(b.req.Context())
+	req.Header.Del("If-Modified-Since")
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-", b.offset))
+	req.Header.Set("If-Range", b.validator)
+	resp, err := b.do(req)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode == http.StatusOK {
+		b.restarted = resp
+		return errRestartDownload
+	}
+	if resp.StatusCode != http.StatusPartialContent {
+		resp.Body.Close()
+		return fmt.Errorf("unexpected code %d", resp.StatusCode)
+	}
+	if !strings.HasPrefix(resp.Header.Get("Content-Range"), fmt.Sprintf("bytes %d-", b.offset)) {
+		resp.Body.Close()
+		return fmt.Errorf("unexpected Content-Range %q", resp.Header.Get("Content-Range"))
+	}
+	if !strings.EqualFold(resp.Header.Get("Content-Encoding"), b.encoding) {
+		resp.Body.Close()
+		return fmt.Errorf("content encoding changed to %q", resp.Header.Get("Content-Encoding"))
+	}
+	b.body = resp.Body
+	return nil
+}
+
+func (b *resumingBody) Close() error {
+	return b.body.Close()
+}
+
+// partialDownload returns the length of a partial download left at filename
+// by an earlier attempt, and the If-Range validator to resume it with: its
+// modification time, which setLastModified set to the Last-Modified of the
+// response it came from. A server only sends the rest of a file whose
+// Last-Modified matches, so a file left some other way is downloaded again
+// from the start. Only files requested without content coding, such as
+// packages, are resumed, as a range of a coded response can't be decoded
+// on its own.
+func partialDownload(filename, uri string) (int64, string) {
+	if _, ok := compressedTypes[path.Ext(uriPath(uri))]; !ok {
+		return 0, ""
+	}
+	info, err := os.Stat(filename)
+	if err != nil || !info.Mode().IsRegular() || info.Size() == 0 {
+		return 0, ""
+	}
+	return info.Size(), info.ModTime().UTC().Format(http.TimeFormat)
+}
+
+// rehashChunkSize is how many bytes of a partial download are hashed
+// between reports of progress.
+const rehashChunkSize = 1 << 20
+
+// openTarget opens filename to write a download to. A positive offset keeps
+// that many bytes of it, which are written to hashes first, and positions
+// the file after them; otherwise the file is truncated. Hashing a large
+// partial download takes a while, so progress, if not nil, is called with
+// the bytes hashed as it goes, and apt doesn't appear stalled.
+func openTarget(filename string, offset int64, hashes io.Writer, progress func(written int64)) (*os.File, error) {
+	if offset <= 0 {
+		return os.Create(filename)
+	}
+	file, err := os.OpenFile(filename, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	for hashed := int64(0); hashed < offset; {
+		chunk := offset - hashed
+		if chunk > rehashChunkSize {
+			chunk = rehashChunkSize
+		}
+		n, err := io.CopyN(hashes, file, chunk)
+		hashed += n
+		if err != nil {
+			file.Close()
+			return nil, fmt.Errorf("reading partial download: %v", err)
+		}
+		if progress != nil {
+			progress(hashed)
+		}
+	}
+	if err := file.Truncate(offset); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return file, nil
+}
+
+// resumedRange checks that resp, a 206 in reply to a request for the bytes
+// of a file from offset, holds just those, and returns where it starts and
+// the length of the whole file, or -1 if the server didn't say.
+func resumedRange(resp *http.Response, offset int64) (int64, int64, error) {
+	contentRange := resp.Header.Get("Content-Range")
+	var start, end int64
+	var total string
+	if _, err := fmt.Sscanf(contentRange, "bytes %d-%d/%s", &start, &end, &total); err != nil || offset == 0 || start != offset {
+		return 0, 0, fmt.Errorf("unexpected Content-Range %q in reply to a request from byte %d", contentRange, offset)
+	}
+	if total == "*" {
+		return start, -1, nil
+	}
+	length, err := strconv.ParseInt(total, 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("unexpected Content-Range %q in reply to a request from byte %d", contentRange, offset)
+	}
+	return start, length, nil
+}
+
+// completedPartial handles a 416 in reply to a request for the rest of a
+// partial download. If the server gives the length of the file as offset,
+// the download was complete after all and is reported as done, as apt's
+// http method does. Otherwise the file is removed, so that apt's retry
+// starts over.
+func (m *Method) completedPartial(msg *Message, filename string, offset int64, resp *http.Response, identity string) error {
+	uri := msg.Get("URI")
+	if offset == 0 || resp.Header.Get("Content-Range") != fmt.Sprintf("bytes */%d", offset) {
+		if offset > 0 {
+			os.Remove(filename)
+		}
+		return fmt.Errorf("error downloading: code %v", resp.StatusCode)
+	}
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	res, err := hashFile(f)
+	if err != nil {
+		return err
+	}
+	if err := hashMismatch(msg, res); err != nil {
+		os.Remove(filename)
+		return err
+	}
+	lastModified := resp.Header.Get("Last-Modified")
+	size := strconv.FormatInt(res.size, 10)
+	start := new200Message(uri, size, lastModified)
+	start.fields["Resume-Point"] = []string{size}
+	m.writer.WriteMessage(start)
+	m.recordCompleted(uri, filename, lastModified, identity, res)
+	m.journalDelivery(uri, filename, identity, res)
+	done := new201Message(uri, size, lastModified, res.md5Hash, filename, false)
+	setHashFields(done, res)
+	m.writer.WriteMessage(done)
+	return nil
+}
@@ -0,0 +1,299 @@
+//  Copyright 2021 Google LLC
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package apt
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// resetReader returns its data and then fails as if the connection was
+// reset.
+type resetReader struct {
+	data string
+	err  error
+}
+
+func (r *resetReader) Read(p []byte) (int, error) {
+	if r.data == "" {
+		return 0, r.err
+	}
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+// rangeHTTPClient serves ranges of content, resetting the connection after
+// chunk bytes of the first `resets` responses. If rangeCode is 200, ranges
+// are ignored and the whole content is sent instead.
+type rangeHTTPClient struct {
+	content   string
+	chunk     int
+	resets    int
+	rangeCode int
+	ranges    []string
+}
+
+func (c *rangeHTTPClient) Do(req *http.Request) (*http.Response, error) {
+	c.ranges = append(c.ranges, req.Header.Get("Range"))
+	header := http.Header{}
+	header.Set("Last-Modified", "Mon, 01 Mar 2021 03:05:06 GMT")
+	code := http.StatusOK
+	var offset int
+	if req.Header.Get("Range") != "" && c.rangeCode != http.StatusOK {
+		code = http.StatusPartialContent
+		fmt.Sscanf(req.Header.Get("Range"), "bytes=%d-", &offset)
+		header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, len(c.content)-1, len(c.content)))
+	}
+	rest := c.content[offset:]
+	body := io.NopCloser(strings.NewReader(rest))
+	if c.resets > 0 && len(rest) > c.chunk {
+		c.resets--
+		body = io.NopCloser(&resetReader{data: rest[:c.chunk], err: syscall.ECONNRESET})
+	}
+	return &http.Response{StatusCode: code, Header: header, Body: body}, nil
+}
+
+func TestResumingBody(t *testing.T) {
+	content := strings.Repeat("0123456789", 10)
+	var tests = []struct {
+		name                string
+		chunk, resets, code int
+		expected            string
+		expectedErr         error
+		expectedRetries     int
+		expectedRange       string
+	}{
+		{"resumed", 30, 10, 0, content, nil, 3, "bytes=30-"},
+		{"too many resets", 20, 10, 0, content[:80], syscall.ECONNRESET, 3, "bytes=20-"},
+		{"range not honored", 30, 1, 200, content[:30], errRestartDownload, 1, "bytes=30-"},
+	}
+
+	for _, tt := range tests {
+		client := &rangeHTTPClient{content: content, chunk: tt.chunk, resets: tt.resets, rangeCode: tt.code}
+		req, _ := http.NewRequest("GET", "https://fake.uri/pool/p.deb", nil)
+		resp, _ := client.Do(req)
+		var logs, statuses []string
+		body := &resumingBody{
+			body:      resp.Body,
+			req:       req,
+			do:        client.Do,
+			log:       func(msg string) { logs = append(logs, msg) },
+			status:    func(msg string) { statuses = append(statuses, msg) },
+			validator: `"etag"`,
+		}
+
+		got, err := io.ReadAll(body)
+		if !errors.Is(err, tt.expectedErr) {
+			t.Errorf("%s: unexpected error result: %v", tt.name, err)
+		}
+		if string(got) != tt.expected {
+			t.Errorf("%s: expected %q, got %q", tt.name, tt.expected, got)
+		}
+		if body.retries != tt.expectedRetries {
+			t.Errorf("%s: expected %d retries, got %d", tt.name, tt.expectedRetries, body.retries)
+		}
+		if len(statuses) != tt.expectedRetries || !strings.HasPrefix(statuses[0], fmt.Sprintf("retrying (1/%d) ", maxResumeRetries)) {
+			t.Errorf("%s: expected a status for each retry, got %q", tt.name, statuses)
+		}
+		if len(client.ranges) < 2 || client.ranges[1] != tt.expectedRange {
+			t.Errorf("%s: expected a range request from the received offset, got %q", tt.name, client.ranges)
+		}
+	}
+}
+
+func TestNewResumingBodyRequiresValidator(t *testing.T) {
+	method := &Method{}
+	req, _ := http.NewRequest("GET", "https://fake.uri/pool/p.deb", nil)
+	resp := &http.Response{StatusCode: 200, Header: http.Header{}, Body: io.NopCloser(strings.NewReader(""))}
+	if _, ok := method.newResumingBody(req, resp, 0).(*resumingBody); ok {
+		t.Errorf("failed, expected a response without a validator not to be resumed")
+	}
+	resp.Header.Set("Last-Modified", "Mon, 01 Mar 2021 03:05:06 GMT")
+	if _, ok := method.newResumingBody(req, resp, 0).(*resumingBody); !ok {
+		t.Errorf("failed, expected a response with Last-Modified to be resumable")
+	}
+}
+
+func TestAptMethodRestartsDownload(t *testing.T) {
+	content := strings.Repeat("0123456789", 10)
+	filename := filepath.Join(t.TempDir(), "pkg.deb")
+	var buffer bytes.Buffer
+	method := NewAptMethod(bufio.NewReader(&bytes.Buffer{}), &buffer)
+	client := &rangeHTTPClient{content: content, chunk: 30, resets: 1, rangeCode: 200}
+	method.client = client
+	var progress []int64
+	method.config.writeChunkSize = 10
+	method.config.progress = func(written int64) { progress = append(progress, written) }
+
+	msg := &Message{
+		code:        600,
+		description: "URI Acquire",
+		fields:      map[string][]string{"URI": {"ar+https://fake.uri/pool/p.deb"}, "Filename": {filename}},
+	}
+	if err := method.handleAcquire(context.Background(), msg); err != nil {
+		t.Fatalf("failed, %v", err)
+	}
+	if got, _ := os.ReadFile(filename); string(got) != content {
+		t.Errorf("failed, expected the file to be downloaded again, got %q", got)
+	}
+	expected := fmt.Sprintf("MD5-Hash: %x\n", md5.Sum([]byte(content)))
+	if !strings.Contains(buffer.String(), expected) || !strings.Contains(buffer.String(), "Size: 100\n") {
+		t.Errorf("failed, expected URI Done for the whole file, got %q", buffer.String())
+	}
+	for i := 1; i < len(progress); i++ {
+		if progress[i] <= progress[i-1] {
+			t.Errorf("failed, progress went from %d to %d", progress[i-1], progress[i])
+		}
+	}
+	if len(progress) == 0 || progress[len(progress)-1] != 100 {
+		t.Errorf("failed, expected progress to reach 100, got %v", progress)
+	}
+}
+
+// serveContentClient serves content as http.ServeContent does, honoring
+// Range and If-Range, and records the Range of each request.
+type serveContentClient struct {
+	content string
+	modtime time.Time
+	ranges  []string
+}
+
+func (c *serveContentClient) Do(req *http.Request) (*http.Response, error) {
+	c.ranges = append(c.ranges, req.Header.Get("Range"))
+	rec := httptest.NewRecorder()
+	http.ServeContent(rec, req, "p.deb", c.modtime, strings.NewReader(c.content))
+	return rec.Result(), nil
+}
+
+func TestAptMethodResumesPartialFile(t *testing.T) {
+	content := strings.Repeat("0123456789", 10)
+	modtime := time.Date(2021, 3, 1, 3, 5, 6, 0, time.UTC)
+	var tests = []struct {
+		name, partial       string
+		mtime               time.Time
+		expectedRange       string
+		expectedResumePoint string
+	}{
+		{"resumed", content[:40], modtime, "bytes=40-", "40"},
+		{"changed", "9876543210", modtime.Add(time.Hour), "bytes=10-", "0"},
+		{"complete", content, modtime, "bytes=100-", "100"},
+		{"none", "", time.Time{}, "", "0"},
+	}
+
+	for _, tt := range tests {
+		filename := filepath.Join(t.TempDir(), "p.deb")
+		if tt.partial != "" {
+			os.WriteFile(filename, []byte(tt.partial), 0644)
+			setLastModified(filename, tt.mtime.Format(http.TimeFormat))
+		}
+		var buffer bytes.Buffer
+		method := NewAptMethod(bufio.NewReader(&bytes.Buffer{}), &buffer)
+		client := &serveContentClient{content: content, modtime: modtime}
+		method.client = client
+		msg := &Message{
+			code:        600,
+			description: "URI Acquire",
+			fields: map[string][]string{
+				"URI":             {"ar+https://fake.uri/pool/p.deb"},
+				"Filename":        {filename},
+				"Expected-SHA256": {fmt.Sprintf("%x", sha256.Sum256([]byte(content)))},
+			},
+		}
+		if err := method.handleAcquire(context.Background(), msg); err != nil {
+			t.Fatalf("%s: failed, %v", tt.name, err)
+		}
+		if len(client.ranges) != 1 || client.ranges[0] != tt.expectedRange {
+			t.Errorf("%s: failed, expected a request for %q, got %q", tt.name, tt.expectedRange, client.ranges)
+		}
+		if got, _ := os.ReadFile(filename); string(got) != content {
+			t.Errorf("%s: failed, unexpected file contents %q", tt.name, got)
+		}
+
+		reader := NewAptMessageReader(bufio.NewReader(&buffer))
+		start, _ := reader.ReadMessage(context.Background())
+		done, _ := reader.ReadMessage(context.Background())
+		if start == nil || start.Get("Resume-Point") != tt.expectedResumePoint || start.Get("Size") != "100" {
+			t.Errorf("%s: failed, expected URI Start resuming at %s, got %v", tt.name, tt.expectedResumePoint, start)
+		}
+		if done == nil || done.code != 201 || done.Get("Size") != "100" || done.Get("MD5-Hash") != fmt.Sprintf("%x", md5.Sum([]byte(content))) {
+			t.Errorf("%s: failed, unexpected URI Done %v", tt.name, done)
+		}
+	}
+}
+
+func TestOpenTargetProgress(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "partial.deb")
+	content := bytes.Repeat([]byte("x"), 2*rehashChunkSize+rehashChunkSize/2)
+	if err := os.WriteFile(filename, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var reported []int64
+	hashes := sha256.New()
+	file, err := openTarget(filename, int64(len(content)), hashes, func(written int64) {
+		reported = append(reported, written)
+	})
+	if err != nil {
+		t.Fatalf("openTarget failed: %v", err)
+	}
+	file.Close()
+	expected := []int64{rehashChunkSize, 2 * rehashChunkSize, int64(len(content))}
+	if fmt.Sprint(reported) != fmt.Sprint(expected) {
+		t.Errorf("failed, expected progress %v got %v", expected, reported)
+	}
+	if sum := sha256.Sum256(content); !bytes.Equal(hashes.Sum(nil), sum[:]) {
+		t.Errorf("failed, the partial download was not hashed")
+	}
+}
+
+func TestAptMethodMarksPartialFile(t *testing.T) {
+	content := strings.Repeat("0123456789", 10)
+	filename := filepath.Join(t.TempDir(), "pkg.deb")
+	var buffer bytes.Buffer
+	method := NewAptMethod(bufio.NewReader(&bytes.Buffer{}), &buffer)
+	method.client = &rangeHTTPClient{content: content, chunk: 20, resets: 10}
+	method.config.writeChunkSize = 10
+
+	msg := &Message{
+		code:        600,
+		description: "URI Acquire",
+		fields:      map[string][]string{"URI": {"ar+https://fake.uri/pool/p.deb"}, "Filename": {filename}},
+	}
+	if err := method.handleAcquire(context.Background(), msg); err == nil {
+		t.Fatalf("failed, expected the download to fail")
+	}
+	offset, validator := partialDownload(filename, "ar+https://fake.uri/pool/p.deb")
+	if offset == 0 || validator == "" {
+		t.Fatalf("failed, expected a partial file to resume, got %d, %q", offset, validator)
+	}
+	if offset, _ := partialDownload(filename, "ar+https://fake.uri/dists/repo/Release"); offset != 0 {
+		t.Errorf("failed, expected an index which may be coded not to be resumed, got %d", offset)
+	}
+}
@@ -0,0 +1,172 @@
+//  Copyright 2021 Google LLC
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package apt
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// DeferredRetry is an entry of the Retry-Queue-File: a URI whose acquires
+// have failed, most recently in a way which may succeed on a later run,
+// such as a dropped connection or a 503.
+type DeferredRetry struct {
+	URI         string    `json:"uri,omitempty"`
+	Failures    int       `json:"failures"`
+	FirstFailed time.Time `json:"first_failed"`
+	LastFailed  time.Time `json:"last_failed"`
+	LastError   string    `json:"last_error"`
+}
+
+// transientStatus reports whether a response with the HTTP status code may
+// succeed if requested again later.
+func transientStatus(code int) bool {
+	return code == 408 || code == 429 || code >= 500
+}
+
+// deferRetry records that the acquire of uri failed with err, if it may
+// succeed on a later run: that is, unless the failure is definitive, as
+// recordHostFailure has it, or ctx was cancelled.
+func (m *Method) deferRetry(ctx context.Context, uri string, err error) {
+	if m.config.retryQueueFile == "" || ctx.Err() != nil || definitiveFailure(err) != "" {
+		return
+	}
+	m.retryMu.Lock()
+	defer m.retryMu.Unlock()
+	if m.retryFailed == nil {
+		m.retryFailed = make(map[string]DeferredRetry)
+	}
+	now := m.timeSource().Now().UTC()
+	entry := m.retryFailed[uri]
+	if entry.Failures == 0 {
+		entry = DeferredRetry{URI: uri, FirstFailed: now}
+	}
+	entry.Failures++
+	entry.LastFailed = now
+	entry.LastError = err.Error()
+	m.retryFailed[uri] = entry
+	delete(m.retryDelivered, uri)
+}
+
+// retryDone records that uri was acquired, so that it leaves the queue.
+func (m *Method) retryDone(uri string) {
+	if m.config.retryQueueFile == "" {
+		return
+	}
+	m.retryMu.Lock()
+	defer m.retryMu.Unlock()
+	if m.retryDelivered == nil {
+		m.retryDelivered = make(map[string]bool)
+	}
+	m.retryDelivered[uri] = true
+	delete(m.retryFailed, uri)
+}
+
+// LoadRetryQueue reads the Retry-Queue-File at path, returning its entries
+// in the order they are best retried in: most failures first, then those
+// failing longest. A missing file is an empty queue.
+func LoadRetryQueue(path string) ([]DeferredRetry, error) {
+	queue, err := readRetryQueue(path)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]DeferredRetry, 0, len(queue))
+	for uri, entry := range queue {
+		entry.URI = uri
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		a, b := entries[i], entries[j]
+		if a.Failures != b.Failures {
+			return a.Failures > b.Failures
+		}
+		if !a.FirstFailed.Equal(b.FirstFailed) {
+			return a.FirstFailed.Before(b.FirstFailed)
+		}
+		return a.URI < b.URI
+	})
+	return entries, nil
+}
+
+// readRetryQueue reads the queue at path, a JSON object keyed by URI.
+func readRetryQueue(path string) (map[string]DeferredRetry, error) {
+	queue := make(map[string]DeferredRetry)
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return queue, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &queue); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", path, err)
+	}
+	return queue, nil
+}
+
+// saveRetryQueue merges the session into the Retry-Queue-File: URIs which
+// failed transiently are added, counting their failures across runs, and
+// those delivered are removed. The file is replaced atomically, though
+// concurrent sessions may lose each other's changes.
+func (m *Method) saveRetryQueue() error {
+	if m.config.retryQueueFile == "" {
+		return nil
+	}
+	m.retryMu.Lock()
+	defer m.retryMu.Unlock()
+	if len(m.retryFailed) == 0 && len(m.retryDelivered) == 0 {
+		return nil
+	}
+	queue, err := readRetryQueue(m.config.retryQueueFile)
+	if err != nil {
+		return err
+	}
+	for uri := range m.retryDelivered {
+		delete(queue, uri)
+	}
+	for uri, failed := range m.retryFailed {
+		if prev, ok := queue[uri]; ok {
+			failed.Failures += prev.Failures
+			failed.FirstFailed = prev.FirstFailed
+		}
+		failed.URI = ""
+		queue[uri] = failed
+	}
+	b, err := json.MarshalIndent(queue, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(m.config.retryQueueFile), ".retry-queue-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(append(b, '\n')); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), m.config.retryQueueFile)
+}
@@ -0,0 +1,66 @@
+//  Copyright 2021 Google LLC
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package apt
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"path/filepath"
+	"testing"
+)
+
+func TestRetryQueueFile(t *testing.T) {
+	dir := t.TempDir()
+	queueFile := filepath.Join(dir, "queue.json")
+	session := func(code int, uris ...string) {
+		var input bytes.Buffer
+		io.WriteString(&input, (&Message{code: 601, description: "Configuration", fields: map[string][]string{
+			"Config-Item": {"Acquire::gar::Retry-Queue-File=" + queueFile},
+		}}).String())
+		for _, uri := range uris {
+			io.WriteString(&input, (&Message{code: 600, description: "URI Acquire", fields: map[string][]string{
+				"URI": {uri}, "Filename": {filepath.Join(dir, "file")},
+			}}).String())
+		}
+		var output bytes.Buffer
+		method := NewAptMethod(bufio.NewReader(&input), &output)
+		method.client = fakeHTTPClient{code: code, body: "package contents"}
+		method.dl = fakeDownloader{}
+		method.SetClock(newFakeClock())
+		method.config.pipelineDepth = 1
+		if err := method.Run(context.Background()); err != nil {
+			t.Fatalf("failed, %v", err)
+		}
+	}
+	a, b := "ar+https://us-apt.pkg.dev/projects/p/pool/a.deb", "ar+https://us-apt.pkg.dev/projects/p/pool/b.deb"
+
+	session(503, a, b)
+	session(503, b)
+	entries, err := LoadRetryQueue(queueFile)
+	if err != nil || len(entries) != 2 || entries[0].URI != b || entries[0].Failures != 2 || entries[1].URI != a || entries[1].Failures != 1 {
+		t.Fatalf("failed, expected both URIs queued with b first, got %+v, %v", entries, err)
+	}
+	if entries[0].LastError != "error downloading: code 503" {
+		t.Errorf("failed, unexpected last error %q", entries[0].LastError)
+	}
+
+	session(404, a)
+	session(200, b)
+	if entries, err := LoadRetryQueue(queueFile); err != nil || len(entries) != 1 || entries[0].URI != a || entries[0].Failures != 1 {
+		t.Errorf("failed, expected b to leave the queue and a to stay after a 404, got %+v, %v", entries, err)
+	}
+}
@@ -0,0 +1,122 @@
+//  Copyright 2021 Google LLC
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package apt
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+)
+
+// completedDownload records a URI downloaded earlier in the session, so that
+// apt re-requesting it (e.g. after an unrelated transient failure) can be
+// answered without fetching it again.
+type completedDownload struct {
+	filename     string
+	lastModified string
+	// identity describes the credentials it was fetched with.
+	identity string
+	result   downloadResult
+}
+
+func (m *Method) recordCompleted(uri, filename, lastModified, identity string, res downloadResult) {
+	completed := completedDownload{filename: filename, lastModified: lastModified, identity: identity, result: res}
+	m.shareFetch(uri, filename, completed)
+	m.completedMu.Lock()
+	defer m.completedMu.Unlock()
+	if m.completed == nil {
+		m.completed = make(map[string]completedDownload)
+	}
+	m.completed[uri] = completed
+}
+
+func (m *Method) forgetCompleted(uri string) {
+	m.completedMu.Lock()
+	defer m.completedMu.Unlock()
+	delete(m.completed, uri)
+}
+
+// reuseCompleted tries to satisfy an acquire of uri into filename from an
+// earlier download of the same URI. The earlier file must still exist with
+// the same content; apt usually moves files out of its partial directory, in
+// which case the URI is simply fetched again. Files are compared by identity
+// rather than by name, as bootstrap tools may name the same file by relative
+// and absolute paths. An acquire which waited for another of the same URI
+// reads the file that one kept open for it; see joinFetch.
+func (m *Method) reuseCompleted(ctx context.Context, uri, filename string) (completedDownload, bool) {
+	var prev completedDownload
+	var src *os.File
+	var r io.ReadCloser
+	if fetch, ok := sharedFetch(ctx); ok {
+		// The file is shared with the other acquires waiting, so read
+		// it by offset, and leave it to leaveFetch to close.
+		prev, src = fetch.result, fetch.file
+		r = io.NopCloser(io.NewSectionReader(src, 0, prev.result.size))
+	} else {
+		m.completedMu.Lock()
+		completed, ok := m.completed[uri]
+		m.completedMu.Unlock()
+		if !ok {
+			return completedDownload{}, false
+		}
+		f, err := os.Open(completed.filename)
+		if err != nil {
+			m.forgetCompleted(uri)
+			return completedDownload{}, false
+		}
+		prev, src, r = completed, f, f
+	}
+
+	var res downloadResult
+	var err error
+	if sameFile(src, filename) {
+		res, err = hashFile(r)
+	} else {
+		// download closes r.
+		res, err = m.dl.download(r, filename, 0, prev.result.size, nil)
+	}
+	if err != nil || res != prev.result {
+		m.forgetCompleted(uri)
+		return completedDownload{}, false
+	}
+	m.debugLog(ctx, fmt.Sprintf("reusing earlier download of %s from %s", uri, prev.filename))
+	return prev, true
+}
+
+// sameFile reports whether filename names the open file f.
+func sameFile(f *os.File, filename string) bool {
+	fi, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	info, err := os.Stat(filename)
+	return err == nil && os.SameFile(fi, info)
+}
+
+// hashFile computes the downloadResult for an existing file.
+func hashFile(f io.ReadCloser) (downloadResult, error) {
+	defer f.Close()
+	hashes, err := newHashPipeline(downloadHashes()...)
+	if err != nil {
+		return downloadResult{}, err
+	}
+	defer hashes.Close()
+	size, err := io.Copy(hashes, f)
+	if err != nil {
+		return downloadResult{}, err
+	}
+	return hashes.result(size), nil
+}
@@ -0,0 +1,90 @@
+//  Copyright 2021 Google LLC
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package apt
+
+import (
+	"fmt"
+	"io"
+	"sync"
+)
+
+const redacted = "[REDACTED]"
+
+// Secret holds secret material such as service account key JSON or access
+// tokens. It formats as [REDACTED] with every fmt verb, and its memory is
+// zeroed by Release, so that secrets don't leak through logs or core dumps.
+// Secrets should be passed around as *Secret rather than as strings, which
+// can't be zeroed.
+type Secret struct {
+	mu sync.Mutex
+	b  []byte
+}
+
+// NewSecret returns a Secret holding b. The Secret takes ownership of b,
+// which is zeroed on Release.
+func NewSecret(b []byte) *Secret {
+	return &Secret{b: b}
+}
+
+// Bytes returns the secret material, which is only valid until Release is
+// called. Callers must not retain it.
+func (s *Secret) Bytes() []byte {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.b
+}
+
+// Empty reports whether the secret holds no material.
+func (s *Secret) Empty() bool {
+	return len(s.Bytes()) == 0
+}
+
+// Release zeroes the secret material. It is safe to call more than once.
+func (s *Secret) Release() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range s.b {
+		s.b[i] = 0
+	}
+	s.b = nil
+}
+
+// String implements fmt.Stringer without revealing the secret.
+func (s *Secret) String() string {
+	return redacted
+}
+
+// GoString implements fmt.GoStringer without revealing the secret.
+func (s *Secret) GoString() string {
+	return redacted
+}
+
+// Format implements fmt.Formatter so that no verb, including %x and %v with
+// flags, reveals the secret.
+func (s *Secret) Format(f fmt.State, verb rune) {
+	io.WriteString(f, redacted)
+}
+
+// MarshalText implements encoding.TextMarshaler without revealing the
+// secret, so that it is also redacted when encoded as JSON.
+func (s *Secret) MarshalText() ([]byte, error) {
+	return []byte(redacted), nil
+}
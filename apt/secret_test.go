@@ -0,0 +1,56 @@
+//  Copyright 2021 Google LLC
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package apt
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestSecretRedacted(t *testing.T) {
+	secret := NewSecret([]byte("hunter2"))
+	holder := struct {
+		Token *Secret
+	}{secret}
+
+	for _, format := range []string{"%v", "%+v", "%#v", "%s", "%q", "%x", "%X", "%d"} {
+		if res := fmt.Sprintf(format, holder); strings.Contains(res, "hunter2") || strings.Contains(res, "68756e74657232") {
+			t.Errorf("failed, %s revealed the secret: %s", format, res)
+		}
+	}
+	if res, err := json.Marshal(holder); err != nil || strings.Contains(string(res), "hunter2") {
+		t.Errorf("failed, JSON revealed the secret: %s, %v", res, err)
+	}
+}
+
+func TestSecretRelease(t *testing.T) {
+	b := []byte("hunter2")
+	secret := NewSecret(b)
+	if string(secret.Bytes()) != "hunter2" {
+		t.Errorf("failed, unexpected secret %q", secret.Bytes())
+	}
+	secret.Release()
+	secret.Release()
+	if !secret.Empty() {
+		t.Errorf("failed, expected secret to be empty after release")
+	}
+	for _, c := range b {
+		if c != 0 {
+			t.Fatalf("failed, expected memory to be zeroed, got %q", b)
+		}
+	}
+}
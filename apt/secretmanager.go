@@ -0,0 +1,93 @@
+//  Copyright 2021 Google LLC
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package apt
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+
+	"golang.org/x/oauth2"
+)
+
+// secretManagerEndpoint is the Secret Manager API, replaced in tests.
+var secretManagerEndpoint = "https://secretmanager.googleapis.com/v1/"
+
+// secretVersionRE matches a Secret Manager secret version resource name.
+var secretVersionRE = regexp.MustCompile(`^projects/[^/]+/secrets/[^/]+/versions/[^/]+$`)
+
+// maxSecretResponseSize bounds the response to accessing a secret version;
+// secrets are at most 64KiB, which base64 encoding grows by a third.
+const maxSecretResponseSize = 128 * 1024
+
+// accessSecret fetches the payload of a Secret Manager secret version using
+// the default credentials, such as the instance's service account. The
+// payload is cached for the session, so that the key is fetched at most
+// once even if building the client has to be retried.
+func (m *Method) accessSecret(ctx context.Context, name string) (*Secret, error) {
+	if secret, ok := m.secrets[name]; ok && !secret.Empty() {
+		return secret, nil
+	}
+	if !secretVersionRE.MatchString(name) {
+		return nil, fmt.Errorf("malformed secret version %q, expected projects/*/secrets/*/versions/*", name)
+	}
+	ts, err := m.defaultTokenSource(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to obtain default creds to access secret: %v", err)
+	}
+	req, err := http.NewRequest("GET", secretManagerEndpoint+name+":access", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := oauth2.NewClient(ctx, ts).Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to access secret %s: code %d", name, resp.StatusCode)
+	}
+
+	var body struct {
+		Payload struct {
+			Data       []byte `json:"data"`
+			DataCrc32c string `json:"dataCrc32c"`
+		} `json:"payload"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxSecretResponseSize)).Decode(&body); err != nil {
+		return nil, fmt.Errorf("malformed response accessing secret %s: %v", name, err)
+	}
+	secret := NewSecret(body.Payload.Data)
+	if body.Payload.DataCrc32c != "" {
+		want, err := strconv.ParseUint(body.Payload.DataCrc32c, 10, 32)
+		if err != nil || uint32(want) != crc32.Checksum(secret.Bytes(), crc32.MakeTable(crc32.Castagnoli)) {
+			secret.Release()
+			return nil, fmt.Errorf("checksum mismatch accessing secret %s", name)
+		}
+	}
+	if secret.Empty() {
+		return nil, fmt.Errorf("secret %s is empty", name)
+	}
+	if m.secrets == nil {
+		m.secrets = make(map[string]*Secret)
+	}
+	m.secrets[name] = secret
+	return secret, nil
+}
@@ -0,0 +1,114 @@
+//  Copyright 2021 Google LLC
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package apt
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"hash/crc32"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/oauth2"
+)
+
+func TestServiceAccountSecret(t *testing.T) {
+	var key []byte
+	var accesses int
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/token":
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprint(w, `{"access_token": "default-token", "token_type": "Bearer", "expires_in": 3600}`)
+		case "/secret-token":
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprint(w, `{"access_token": "secret-token", "token_type": "Bearer", "expires_in": 3600}`)
+		case "/v1/projects/p/secrets/s/versions/latest:access", "/v1/projects/p/secrets/corrupt/versions/1:access":
+			if r.Header.Get("Authorization") != "Bearer default-token" {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			accesses++
+			checksum := crc32.Checksum(key, crc32.MakeTable(crc32.Castagnoli))
+			if strings.Contains(r.URL.Path, "corrupt") {
+				checksum++
+			}
+			fmt.Fprintf(w, `{"name": "projects/p/secrets/s/versions/1", "payload": {"data": %q, "dataCrc32c": "%d"}}`, base64.StdEncoding.EncodeToString(key), checksum)
+		default:
+			if r.Header.Get("Authorization") != "Bearer secret-token" {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			fmt.Fprint(w, "package contents")
+		}
+	}))
+	defer server.Close()
+	defer func(endpoint string) { secretManagerEndpoint = endpoint }(secretManagerEndpoint)
+	secretManagerEndpoint = server.URL + "/v1/"
+
+	dir := t.TempDir()
+	defaultKey := filepath.Join(dir, "default.json")
+	writeServiceAccountKey(t, defaultKey, server.URL+"/token")
+	secretKey := filepath.Join(dir, "secret.json")
+	writeServiceAccountKey(t, secretKey, server.URL+"/secret-token")
+	var err error
+	if key, err = os.ReadFile(secretKey); err != nil {
+		t.Fatal(err)
+	}
+	setenv(t, "GOOGLE_APPLICATION_CREDENTIALS", defaultKey)
+	ctx := context.WithValue(context.Background(), oauth2.HTTPClient, server.Client())
+
+	var tests = []struct {
+		name, secret, expectedErr string
+	}{
+		{"valid", "projects/p/secrets/s/versions/latest", ""},
+		{"corrupt", "projects/p/secrets/corrupt/versions/1", "checksum mismatch"},
+		{"malformed", "projects/p/secrets/s", "malformed secret version"},
+	}
+
+	for _, tt := range tests {
+		var buffer bytes.Buffer
+		method := NewAptMethod(bufio.NewReader(&bytes.Buffer{}), &buffer)
+		method.handleConfigure(&Message{code: 601, description: "Configuration", fields: map[string][]string{
+			"Config-Item": {"Acquire::gar::Service-Account-Secret=" + tt.secret, "Acquire::gar::Auth-Hosts::=127.0.0.1"},
+		}})
+		msg := &Message{
+			code:        600,
+			description: "URI Acquire",
+			fields:      map[string][]string{"URI": {"ar+" + server.URL + "/pool/pkg.deb"}, "Filename": {filepath.Join(dir, "pkg.deb")}},
+		}
+		err := method.handleAcquire(ctx, msg)
+		if tt.expectedErr == "" {
+			if err != nil || !strings.Contains(buffer.String(), "201 URI Done") {
+				t.Errorf("%s: failed, %v: %q", tt.name, err, buffer.String())
+			}
+			if secret := method.secrets[tt.secret]; !secret.Empty() {
+				t.Errorf("%s: failed, expected the key to be released once used", tt.name)
+			}
+		} else if err == nil || !strings.Contains(err.Error(), tt.expectedErr) {
+			t.Errorf("%s: failed, expected error containing %q, got %v", tt.name, tt.expectedErr, err)
+		}
+	}
+	if accesses != 2 {
+		t.Errorf("failed, expected 2 secret accesses, got %d", accesses)
+	}
+}
@@ -0,0 +1,80 @@
+//  Copyright 2021 Google LLC
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package apt
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+const (
+	// slowStartInitial is how many acquires slow start lets a host run at
+	// once before any of its responses have been seen.
+	slowStartInitial = 2
+	// slowStartLatency is how long a host may take to respond before slow
+	// start stops letting it run more acquires at once.
+	slowStartLatency = 2 * time.Second
+)
+
+// queueHostKey is the context key of the host an acquire was queued for,
+// against which its responses are counted; see observeResponse.
+type queueHostKey struct{}
+
+// rampLimit returns how many acquires slow start lets host run at once.
+func (q *acquireQueue) rampLimit(host string) int {
+	if limit, ok := q.hostLimit[host]; ok {
+		return limit
+	}
+	return slowStartInitial
+}
+
+// observeResponse adjusts, with Slow-Start, how many acquires the host an
+// acquire was queued for may run at once, once a request for it has been
+// answered after latency, or failed with err. A host which responds
+// promptly may run one more, up to Pipeline-Depth, while one which fails or
+// throttles may only run half as many, so that a fleet patching at once
+// backs off rather than opening every connection at the first sign of
+// trouble. A host which responds slowly is left as it is.
+func (m *Method) observeResponse(ctx context.Context, status int, err error, latency time.Duration) {
+	host, ok := ctx.Value(queueHostKey{}).(string)
+	if !ok || !m.config.slowStart {
+		return
+	}
+	m.queueMu.Lock()
+	defer m.queueMu.Unlock()
+	q := m.queue
+	if q == nil || q.ctx.Err() != nil {
+		return
+	}
+	limit := q.rampLimit(host)
+	switch {
+	case err != nil || transientStatus(status):
+		limit /= 2
+		if limit < 1 {
+			limit = 1
+		}
+	case latency < slowStartLatency && limit < m.config.workers():
+		limit++
+	}
+	if limit == q.rampLimit(host) {
+		return
+	}
+	q.hostLimit[host] = limit
+	if m.config.debugQueue {
+		m.writer.Log(fmt.Sprintf("queue: slow start lets %s run %d acquires at once", host, limit))
+	}
+	m.startAcquires()
+}
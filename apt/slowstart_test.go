@@ -0,0 +1,77 @@
+//  Copyright 2021 Google LLC
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package apt
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestObserveResponse(t *testing.T) {
+	var buffer bytes.Buffer
+	method := NewAptMethod(bufio.NewReader(&bytes.Buffer{}), &buffer)
+	method.config.slowStart = true
+	method.config.pipelineDepth = 4
+	method.queue = &acquireQueue{ctx: context.Background(), hostRunning: map[string]int{"host": 2}, hostLimit: make(map[string]int)}
+	method.queueChanged = sync.NewCond(&method.queueMu)
+	ctx := context.WithValue(context.Background(), queueHostKey{}, "host")
+
+	if method.config.mayStart(method.queue, "host") {
+		t.Errorf("failed, expected a host to start with %d acquires at once", slowStartInitial)
+	}
+	var tests = []struct {
+		status   int
+		err      error
+		latency  time.Duration
+		expected int
+	}{
+		{200, nil, time.Millisecond, 3},
+		{404, nil, time.Millisecond, 4},
+		// No more than Pipeline-Depth.
+		{200, nil, time.Millisecond, 4},
+		{503, nil, time.Millisecond, 2},
+		{0, errors.New("connection reset"), time.Millisecond, 1},
+		{429, nil, time.Millisecond, 1},
+		// Slow responses hold the host where it is.
+		{200, nil, 3 * time.Second, 1},
+		{200, nil, time.Millisecond, 2},
+	}
+	for i, tt := range tests {
+		method.observeResponse(ctx, tt.status, tt.err, tt.latency)
+		if limit := method.queue.rampLimit("host"); limit != tt.expected {
+			t.Errorf("failed, response %d: expected %d acquires at once, got %d", i, tt.expected, limit)
+		}
+	}
+	if limit := method.queue.rampLimit("other"); limit != slowStartInitial {
+		t.Errorf("failed, expected other hosts to be unaffected, got %d", limit)
+	}
+
+	// Responses to requests made outside an acquire, or without Slow-Start,
+	// change nothing.
+	method.observeResponse(context.Background(), 503, nil, time.Millisecond)
+	method.config.slowStart = false
+	method.observeResponse(ctx, 503, nil, time.Millisecond)
+	if limit := method.queue.rampLimit("host"); limit != 2 {
+		t.Errorf("failed, expected 2 acquires at once, got %d", limit)
+	}
+	if !method.config.mayStart(method.queue, "host") {
+		t.Errorf("failed, expected no slow start limit without Slow-Start")
+	}
+}
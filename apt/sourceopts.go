@@ -0,0 +1,139 @@
+//  Copyright 2021 Google LLC
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package apt
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+)
+
+// Options which may be given inline in a sources entry, so that each
+// repository can carry its own configuration, e.g.
+// `deb [gar-service-account-json=/etc/apt/a.json] ar+https://...` or
+// `Gar-Service-Account-JSON: /etc/apt/a.json` in a deb822 .sources file.
+const (
+	sourceOptionPrefix        = "gar-"
+	sourceServiceAccountJSON  = "gar-service-account-json"
+	sourceServiceAccountEmail = "gar-service-account-email"
+	sourceQuotaProject        = "gar-quota-project"
+)
+
+// quotaProjectHeader names the project billed for a request.
+const quotaProjectHeader = "X-Goog-User-Project"
+
+// sourceConfig holds the options of a sources entry.
+type sourceConfig struct {
+	uri                                     string
+	serviceAccountJSON, serviceAccountEmail string
+	quotaProject                            string
+	// client authenticates with the entry's credentials, once initialized
+	// by initSourceClient. It is guarded by the method's clientMu.
+	client httpClient
+}
+
+// sourceConfigs returns the options of the sources entries which have any,
+// logging options it doesn't know.
+func sourceConfigs(sources []aptSource, log func(string)) []*sourceConfig {
+	var configs []*sourceConfig
+	for _, source := range sources {
+		sc := &sourceConfig{uri: strings.TrimSuffix(source.uri, "/")}
+		var keys []string
+		for key := range source.options {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			value := strings.TrimSpace(source.options[key])
+			switch key {
+			case sourceServiceAccountJSON:
+				sc.serviceAccountJSON = value
+			case sourceServiceAccountEmail:
+				sc.serviceAccountEmail = value
+			case sourceQuotaProject:
+				sc.quotaProject = value
+			default:
+				if strings.HasPrefix(key, sourceOptionPrefix) {
+					log(fmt.Sprintf("unknown option %s in sources entry for %s", key, source.uri))
+				}
+			}
+		}
+		if sc.serviceAccountJSON != "" || sc.serviceAccountEmail != "" || sc.quotaProject != "" {
+			configs = append(configs, sc)
+		}
+	}
+	return configs
+}
+
+// sourceConfigFor returns the options of the sources entry uri belongs to,
+// the one with the longest matching URI, or nil if it has none. The sources
+// files are read on first use.
+func (m *Method) sourceConfigFor(uri string) *sourceConfig {
+	m.sourcesOnce.Do(func() {
+		m.sources = sourceConfigs(readSources(m.config.dirs.sourceFiles()), func(msg string) { m.writer.Log(msg) })
+	})
+	var best *sourceConfig
+	for _, sc := range m.sources {
+		if (uri == sc.uri || strings.HasPrefix(uri, sc.uri+"/")) && (best == nil || len(sc.uri) > len(best.uri)) {
+			best = sc
+		}
+	}
+	return best
+}
+
+// initSourceClient creates the client for a sources entry with its own
+// credentials. Entries without any use the method's client.
+func (m *Method) initSourceClient(ctx context.Context, sc *sourceConfig) error {
+	m.clientMu.Lock()
+	defer m.clientMu.Unlock()
+	if sc.client != nil {
+		return nil
+	}
+	var ts oauth2.TokenSource
+	switch {
+	case sc.serviceAccountJSON != "":
+		jsonTS, err := newReloadingTokenSource(ctx, sc.serviceAccountJSON, tokenSourceFromFile, func(msg string) { m.writer.Log(msg) })
+		if err != nil {
+			return fmt.Errorf("failed to obtain creds for %s from service account JSON: %v", sc.uri, err)
+		}
+		ts = jsonTS
+		m.debugLog(ctx, "using credentials from "+sourceServiceAccountJSON+" file "+sc.serviceAccountJSON+" for "+sc.uri)
+	case sc.serviceAccountEmail != "":
+		ts = m.retryTokens(ctx, google.ComputeTokenSource(sc.serviceAccountEmail))
+		m.debugLog(ctx, "using credentials of "+sc.serviceAccountEmail+" from the metadata server for "+sc.uri)
+	default:
+		return nil
+	}
+	sc.client = m.config.newAuthClient(ctx, newTokenManager(ts, m.timeSource()), m.proxyTokens, nil)
+	return nil
+}
+
+type sourceConfigKey struct{}
+
+// clientFor returns the client for req: that of its sources entry if the
+// entry has its own credentials, otherwise the method's.
+func (m *Method) clientFor(req *http.Request) httpClient {
+	m.clientMu.Lock()
+	defer m.clientMu.Unlock()
+	if sc, ok := req.Context().Value(sourceConfigKey{}).(*sourceConfig); ok && sc.client != nil {
+		return sc.client
+	}
+	return m.client
+}
@@ -0,0 +1,115 @@
+//  Copyright 2021 Google LLC
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package apt
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/oauth2"
+)
+
+func TestSourceConfigs(t *testing.T) {
+	sources := parseOneLineSources(strings.NewReader(`
+deb ar+https://us-apt.pkg.dev/projects/a a main
+deb [gar-quota-project=billing gar-colour=blue] ar+https://us-apt.pkg.dev/projects/b b main
+`))
+	sources = append(sources, parseDeb822Sources(strings.NewReader(`Types: deb
+URIs: ar+https://us-apt.pkg.dev/projects/b/sub/
+Suites: c
+Components: main
+Gar-Service-Account-JSON: /etc/apt/c.json
+`))...)
+	var logs []string
+	configs := sourceConfigs(sources, func(msg string) { logs = append(logs, msg) })
+	if len(configs) != 2 || configs[0].quotaProject != "billing" || configs[1].serviceAccountJSON != "/etc/apt/c.json" {
+		t.Fatalf("failed, got %+v", configs)
+	}
+	if len(logs) != 1 || !strings.Contains(logs[0], "gar-colour") {
+		t.Errorf("failed, expected the unknown option to be logged, got %q", logs)
+	}
+
+	method := &Method{config: &aptMethodConfig{}}
+	method.sourcesOnce.Do(func() {})
+	method.sources = configs
+	var tests = []struct {
+		uri      string
+		expected *sourceConfig
+	}{
+		{"ar+https://us-apt.pkg.dev/projects/a/dists/a/InRelease", nil},
+		{"ar+https://us-apt.pkg.dev/projects/b/dists/b/InRelease", configs[0]},
+		{"ar+https://us-apt.pkg.dev/projects/b/sub/dists/c/InRelease", configs[1]},
+		{"ar+https://us-apt.pkg.dev/projects/bb/dists/b/InRelease", nil},
+	}
+	for _, tt := range tests {
+		if res := method.sourceConfigFor(tt.uri); res != tt.expected {
+			t.Errorf("failed, sourceConfigFor(%q) = %+v, expected %+v", tt.uri, res, tt.expected)
+		}
+	}
+}
+
+func TestAptMethodSourceOptions(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/token" {
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprint(w, `{"access_token": "source-token", "token_type": "Bearer", "expires_in": 3600}`)
+			return
+		}
+		fmt.Fprintf(w, "%s %s", r.Header.Get("Authorization"), r.Header.Get(quotaProjectHeader))
+	}))
+	defer server.Close()
+
+	root := t.TempDir()
+	key := filepath.Join(root, "key.json")
+	writeServiceAccountKey(t, key, server.URL+"/token")
+	os.MkdirAll(filepath.Join(root, "etc/apt/sources.list.d"), 0755)
+	sources := fmt.Sprintf("Types: deb\nURIs: ar+%s/projects/p\nSuites: s\nComponents: main\nGar-Service-Account-JSON: %s\nGar-Quota-Project: billing\n", server.URL, key)
+	os.WriteFile(filepath.Join(root, "etc/apt/sources.list.d/gar.sources"), []byte(sources), 0644)
+
+	var buffer bytes.Buffer
+	method := NewAptMethod(bufio.NewReader(&bytes.Buffer{}), &buffer)
+	method.handleConfigure(&Message{code: 601, description: "Configuration", fields: map[string][]string{
+		"Config-Item": {"Dir=" + root + "/", "Acquire::gar::Access-Token=global-token", "Acquire::gar::Auth-Hosts::=127.0.0.1"},
+	}})
+	ctx := context.WithValue(context.Background(), oauth2.HTTPClient, server.Client())
+	var tests = []struct {
+		path, expected string
+	}{
+		{"/projects/p/pool/pkg.deb", "Bearer source-token billing"},
+		{"/projects/other/pool/pkg.deb", "Bearer global-token "},
+	}
+	for _, tt := range tests {
+		filename := filepath.Join(root, "pkg.deb")
+		msg := &Message{
+			code:        600,
+			description: "URI Acquire",
+			fields:      map[string][]string{"URI": {"ar+" + server.URL + tt.path}, "Filename": {filename}},
+		}
+		if err := method.handleAcquire(ctx, msg); err != nil {
+			t.Fatalf("failed, %v: %q", err, buffer.String())
+		}
+		if b, _ := os.ReadFile(filename); string(b) != tt.expected {
+			t.Errorf("failed, %s: expected %q, got %q", tt.path, tt.expected, b)
+		}
+	}
+}
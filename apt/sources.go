@@ -0,0 +1,221 @@
+//  Copyright 2021 Google LLC
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package apt
+
+import (
+	"bufio"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// aptSource is a single repository from sources.list or a deb822 .sources
+// file.
+type aptSource struct {
+	uri        string
+	suites     []string
+	components []string
+	// options holds the remaining fields, keyed by lowercase deb822 name,
+	// e.g. "architectures" and "signed-by".
+	options map[string]string
+}
+
+// aptDirs holds the apt configuration which locates the sources files.
+type aptDirs struct {
+	root, etc, sourceList, sourceParts string
+	netrc, netrcParts                  string
+}
+
+func defaultAptDirs() aptDirs {
+	return aptDirs{root: "/", etc: "etc/apt/", sourceList: "sources.list", sourceParts: "sources.list.d", netrc: "auth.conf", netrcParts: "auth.conf.d"}
+}
+
+// resolve mirrors apt's FindFile and FindDir: relative paths are relative to
+// their parent directory setting.
+func resolve(parent, p string) string {
+	if filepath.IsAbs(p) {
+		return p
+	}
+	return filepath.Join(parent, p)
+}
+
+// sourceFiles returns the sources.list and sources.list.d files apt reads.
+func (d aptDirs) sourceFiles() []string {
+	etc := resolve(d.root, d.etc)
+	files := []string{resolve(etc, d.sourceList)}
+	parts := resolve(etc, d.sourceParts)
+	entries, err := os.ReadDir(parts)
+	if err != nil {
+		return files
+	}
+	var names []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.IsDir() && (strings.HasSuffix(name, ".list") || strings.HasSuffix(name, ".sources")) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		files = append(files, filepath.Join(parts, name))
+	}
+	return files
+}
+
+// readSources parses all the given files, skipping any which can't be read.
+func readSources(files []string) []aptSource {
+	var sources []aptSource
+	for _, file := range files {
+		f, err := os.Open(file)
+		if err != nil {
+			continue
+		}
+		if strings.HasSuffix(file, ".sources") {
+			sources = append(sources, parseDeb822Sources(f)...)
+		} else {
+			sources = append(sources, parseOneLineSources(f)...)
+		}
+		f.Close()
+	}
+	return sources
+}
+
+// oneLineOptions maps one-line style option names to their deb822 names.
+var oneLineOptions = map[string]string{
+	"arch": "architectures",
+	"lang": "languages",
+}
+
+// parseOneLineSources parses the traditional sources.list format, e.g.
+// `deb [arch=amd64 signed-by=/path/key.gpg] ar+https://host/projects/p repo main`.
+func parseOneLineSources(r io.Reader) []aptSource {
+	var sources []aptSource
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		options := make(map[string]string)
+		if start := strings.Index(line, "["); start >= 0 {
+			end := strings.Index(line, "]")
+			if end < start {
+				continue
+			}
+			for _, opt := range strings.Fields(line[start+1 : end]) {
+				parts := strings.SplitN(opt, "=", 2)
+				if len(parts) != 2 {
+					continue
+				}
+				key := strings.ToLower(parts[0])
+				if name, ok := oneLineOptions[key]; ok {
+					key = name
+				}
+				options[key] = strings.ReplaceAll(parts[1], ",", " ")
+			}
+			line = line[:start] + line[end+1:]
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 3 || (fields[0] != "deb" && fields[0] != "deb-src") {
+			continue
+		}
+		sources = append(sources, aptSource{
+			uri:        fields[1],
+			suites:     []string{fields[2]},
+			components: fields[3:],
+			options:    options,
+		})
+	}
+	return sources
+}
+
+// parseDeb822Sources parses the deb822 .sources format.
+func parseDeb822Sources(r io.Reader) []aptSource {
+	var sources []aptSource
+	stanza := make(map[string]string)
+	var lastKey string
+	flush := func() {
+		defer func() { stanza, lastKey = make(map[string]string), "" }()
+		if strings.EqualFold(stanza["enabled"], "no") {
+			return
+		}
+		types := strings.Fields(stanza["types"])
+		hasDeb := false
+		for _, t := range types {
+			hasDeb = hasDeb || t == "deb" || t == "deb-src"
+		}
+		if !hasDeb {
+			return
+		}
+		options := make(map[string]string)
+		for key, value := range stanza {
+			switch key {
+			case "types", "uris", "suites", "components", "enabled":
+			default:
+				options[key] = value
+			}
+		}
+		for _, uri := range strings.Fields(stanza["uris"]) {
+			sources = append(sources, aptSource{
+				uri:        uri,
+				suites:     strings.Fields(stanza["suites"]),
+				components: strings.Fields(stanza["components"]),
+				options:    options,
+			})
+		}
+	}
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "#"):
+		case strings.TrimSpace(line) == "":
+			flush()
+		case line[0] == ' ' || line[0] == '\t':
+			// Continuation of the previous field.
+			if lastKey != "" {
+				stanza[lastKey] += "\n" + strings.TrimSpace(line)
+			}
+		default:
+			parts := strings.SplitN(line, ":", 2)
+			if len(parts) != 2 {
+				continue
+			}
+			lastKey = strings.ToLower(strings.TrimSpace(parts[0]))
+			stanza[lastKey] = strings.TrimSpace(parts[1])
+		}
+	}
+	flush()
+	return sources
+}
+
+// sourceHosts returns the distinct hosts of the sources using this method.
+func sourceHosts(sources []aptSource) []string {
+	seen := make(map[string]bool)
+	var hosts []string
+	for _, source := range sources {
+		u, err := url.Parse(source.uri)
+		if err != nil || u.Scheme != "ar+https" || seen[u.Host] {
+			continue
+		}
+		seen[u.Host] = true
+		hosts = append(hosts, u.Host)
+	}
+	return hosts
+}
@@ -0,0 +1,221 @@
+//  Copyright 2021 Google LLC
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package apt
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testSourcesList = `# A comment.
+deb http://deb.debian.org/debian bullseye main
+deb [arch=amd64,arm64 signed-by=/usr/share/keyrings/ar.gpg] ar+https://us-apt.pkg.dev/projects/p repo main
+deb-src ar+https://europe-apt.pkg.dev/projects/p repo main # Trailing comment.
+`
+
+const testDeb822Sources = `Types: deb
+URIs: ar+https://us-apt.pkg.dev/projects/p ar+https://asia-apt.pkg.dev/projects/p
+Suites: repo
+Components: main
+Architectures: amd64
+Signed-By:
+ -----BEGIN PGP PUBLIC KEY BLOCK-----
+ .
+ abc
+ -----END PGP PUBLIC KEY BLOCK-----
+
+# Disabled.
+Types: deb
+URIs: ar+https://disabled-apt.pkg.dev/projects/p
+Suites: repo
+Enabled: no
+`
+
+func TestParseOneLineSources(t *testing.T) {
+	sources := parseOneLineSources(strings.NewReader(testSourcesList))
+	if len(sources) != 3 {
+		t.Fatalf("expected 3 sources, got %d: %v", len(sources), sources)
+	}
+	expected := aptSource{
+		uri:        "ar+https://us-apt.pkg.dev/projects/p",
+		suites:     []string{"repo"},
+		components: []string{"main"},
+		options:    map[string]string{"architectures": "amd64 arm64", "signed-by": "/usr/share/keyrings/ar.gpg"},
+	}
+	if !reflect.DeepEqual(sources[1], expected) {
+		t.Errorf("expected %v, got %v", expected, sources[1])
+	}
+	if sources[2].uri != "ar+https://europe-apt.pkg.dev/projects/p" || len(sources[2].components) != 1 {
+		t.Errorf("unexpected source %v", sources[2])
+	}
+}
+
+func TestParseDeb822Sources(t *testing.T) {
+	sources := parseDeb822Sources(strings.NewReader(testDeb822Sources))
+	if len(sources) != 2 {
+		t.Fatalf("expected 2 sources, got %d: %v", len(sources), sources)
+	}
+	if sources[0].uri != "ar+https://us-apt.pkg.dev/projects/p" || sources[1].uri != "ar+https://asia-apt.pkg.dev/projects/p" {
+		t.Errorf("unexpected URIs %q and %q", sources[0].uri, sources[1].uri)
+	}
+	if sources[0].options["architectures"] != "amd64" {
+		t.Errorf("unexpected architectures %q", sources[0].options["architectures"])
+	}
+	if !strings.HasSuffix(sources[0].options["signed-by"], "-----END PGP PUBLIC KEY BLOCK-----") {
+		t.Errorf("expected embedded key to be kept, got %q", sources[0].options["signed-by"])
+	}
+}
+
+func TestSourceHosts(t *testing.T) {
+	dir := t.TempDir()
+	etc := filepath.Join(dir, "etc", "apt")
+	if err := os.MkdirAll(filepath.Join(etc, "sources.list.d"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(filepath.Join(etc, "sources.list"), []byte(testSourcesList), 0644)
+	os.WriteFile(filepath.Join(etc, "sources.list.d", "ar.sources"), []byte(testDeb822Sources), 0644)
+	os.WriteFile(filepath.Join(etc, "sources.list.d", "ignored.txt"), []byte(testSourcesList), 0644)
+
+	dirs := aptDirs{root: dir, etc: "etc/apt", sourceList: "sources.list", sourceParts: "sources.list.d"}
+	hosts := sourceHosts(readSources(dirs.sourceFiles()))
+	expected := []string{"us-apt.pkg.dev", "europe-apt.pkg.dev", "asia-apt.pkg.dev"}
+	if !reflect.DeepEqual(hosts, expected) {
+		t.Errorf("expected hosts %v, got %v", expected, hosts)
+	}
+}
+
+// recordingHTTPClient records the hosts it is asked to contact.
+type recordingHTTPClient struct {
+	mu    sync.Mutex
+	hosts []string
+	done  chan struct{}
+}
+
+func (c *recordingHTTPClient) Do(req *http.Request) (*http.Response, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.hosts = append(c.hosts, req.URL.Host)
+	if c.done != nil {
+		c.done <- struct{}{}
+	}
+	return &http.Response{StatusCode: 200, Body: io.NopCloser(strings.NewReader(""))}, nil
+}
+
+func TestWarmup(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "sources.list"), []byte(testSourcesList), 0644)
+
+	var buffer bytes.Buffer
+	method := NewAptMethod(bufio.NewReader(&bytes.Buffer{}), &buffer)
+	client := &recordingHTTPClient{done: make(chan struct{}, 2)}
+	method.client = client
+	method.handleConfigure(&Message{
+		code:        601,
+		description: "Configuration",
+		fields: map[string][]string{"Config-Item": {
+			"Acquire::gar::Warmup=true",
+			"Dir::Etc=" + dir,
+		}},
+	})
+	method.startWarmup(context.Background())
+
+	for i := 0; i < 2; i++ {
+		select {
+		case <-client.done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for warmup")
+		}
+	}
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	if len(client.hosts) != 2 {
+		t.Errorf("expected 2 hosts to be warmed up, got %v", client.hosts)
+	}
+}
+
+// releaseHTTPClient serves a Release file listing the given architectures.
+type releaseHTTPClient struct {
+	architectures string
+}
+
+func (c releaseHTTPClient) Do(req *http.Request) (*http.Response, error) {
+	if !strings.HasSuffix(req.URL.Path, "/dists/repo/Release") {
+		return &http.Response{StatusCode: 404, Body: io.NopCloser(strings.NewReader(""))}, nil
+	}
+	body := "Origin: Artifact Registry\nArchitectures: " + c.architectures + "\nSuite: repo\n"
+	return &http.Response{StatusCode: 200, Body: io.NopCloser(strings.NewReader(body))}, nil
+}
+
+func TestValidateSource(t *testing.T) {
+	keyring := filepath.Join(t.TempDir(), "ar.gpg")
+	os.WriteFile(keyring, []byte("key"), 0644)
+
+	var tests = []struct {
+		name     string
+		source   aptSource
+		served   string
+		expected []string
+	}{
+		{
+			"valid",
+			aptSource{uri: "ar+https://us-apt.pkg.dev/projects/p", suites: []string{"repo"}, options: map[string]string{"architectures": "amd64 all", "signed-by": keyring}},
+			"amd64 arm64",
+			nil,
+		},
+		{
+			"missing architecture",
+			aptSource{uri: "ar+https://us-apt.pkg.dev/projects/p", suites: []string{"repo"}, options: map[string]string{"architectures": "amd64 riscv64"}},
+			"amd64 arm64",
+			[]string{"ar+https://us-apt.pkg.dev/projects/p: architecture riscv64 is not served by suite repo"},
+		},
+		{
+			"missing keyring",
+			aptSource{uri: "ar+https://us-apt.pkg.dev/projects/p", suites: []string{"repo"}, options: map[string]string{"signed-by": "/nonexistent/ar.gpg"}},
+			"amd64",
+			[]string{"ar+https://us-apt.pkg.dev/projects/p: Signed-By keyring is not readable: stat /nonexistent/ar.gpg: no such file or directory"},
+		},
+		{
+			"inline key",
+			aptSource{uri: "ar+https://us-apt.pkg.dev/projects/p", suites: []string{"repo"}, options: map[string]string{"signed-by": "-----BEGIN PGP PUBLIC KEY BLOCK----- /abc"}},
+			"amd64",
+			nil,
+		},
+		{
+			"missing suite",
+			aptSource{uri: "ar+https://us-apt.pkg.dev/projects/p", suites: []string{"other"}, options: map[string]string{"architectures": "amd64"}},
+			"amd64",
+			[]string{"ar+https://us-apt.pkg.dev/projects/p/dists/other/Release: could not fetch Release file: code 404"},
+		},
+	}
+
+	for _, tt := range tests {
+		method := NewAptMethod(bufio.NewReader(&bytes.Buffer{}), &bytes.Buffer{})
+		method.client = releaseHTTPClient{architectures: tt.served}
+		warnings := method.validateSource(context.Background(), tt.source)
+		if !reflect.DeepEqual(warnings, tt.expected) {
+			t.Errorf("%s: expected warnings %q, got %q", tt.name, tt.expected, warnings)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+//  Copyright 2021 Google LLC
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package apt
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DumpState sends the state of the method's reliability features as 101
+// Log messages, one line per item, so that tuning them is a matter of
+// observation: hosts failing fast after a definitive failure, whether the
+// fallback endpoint is in use, the cached token and its refresh, hosts
+// prewarmed, and the acquires in progress and deferred for retry. It is
+// safe to call while Run is running.
+func (m *Method) DumpState() {
+	m.writer.logSequenced(0, strings.Join(m.stateLines(), "\n"))
+}
+
+// stateLines describes the method's state for DumpState. The options it
+// reports are read under configMu, as a configuration may be replacing
+// them meanwhile.
+func (m *Method) stateLines() []string {
+	now := m.timeSource().Now()
+	lines := []string{"state:"}
+
+	m.configMu.RLock()
+	workers, scope := m.config.workers(), "per host"
+	if m.config.sharedQueue {
+		scope = "in all"
+	}
+	fallbackEndpoint := m.config.fallbackEndpoint
+	retryQueueFile := m.config.retryQueueFile
+	m.configMu.RUnlock()
+
+	var running, queued int
+	m.queueMu.Lock()
+	if m.queue != nil {
+		running, queued = m.queue.running, len(m.queue.pending)
+	}
+	m.queueMu.Unlock()
+	lines = append(lines, fmt.Sprintf("acquires in progress: %d running, %d queued, %d workers %s", running, queued, workers, scope))
+
+	m.hostMu.Lock()
+	var failing []string
+	for key, err := range m.hostFailures {
+		if key.identity != "" {
+			failing = append(failing, fmt.Sprintf("host %s failing fast with %s: %v", key.host, key.identity, err))
+			continue
+		}
+		failing = append(failing, fmt.Sprintf("host %s failing fast: %v", key.host, err))
+	}
+	m.hostMu.Unlock()
+	sort.Strings(failing)
+	lines = append(lines, failing...)
+
+	if fallbackEndpoint != "" {
+		m.fallbackMu.Lock()
+		active := m.fallbackActive
+		m.fallbackMu.Unlock()
+		lines = append(lines, fmt.Sprintf("fallback endpoint %s active: %v", fallbackEndpoint, active))
+	}
+	m.clientMu.Lock()
+	tokens := m.tokens
+	m.clientMu.Unlock()
+	if tm, ok := tokens.(*tokenManager); ok {
+		lines = append(lines, "token: "+tm.state(now))
+	}
+
+	m.prewarmMu.Lock()
+	var prewarmed []string
+	for host := range m.prewarmGates {
+		prewarmed = append(prewarmed, host)
+	}
+	m.prewarmMu.Unlock()
+	if len(prewarmed) > 0 {
+		sort.Strings(prewarmed)
+		lines = append(lines, "prewarmed hosts: "+strings.Join(prewarmed, ", "))
+	}
+
+	if retryQueueFile != "" {
+		m.retryMu.Lock()
+		lines = append(lines, fmt.Sprintf("deferred for retry: %d URIs", len(m.retryFailed)))
+		m.retryMu.Unlock()
+	}
+	return lines
+}
+
+// state describes the cached token as of now: when it expires and is
+// refreshed, and whether a fetch is in flight.
+func (tm *tokenManager) state(now time.Time) string {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	var parts []string
+	switch {
+	case tm.token == nil:
+		parts = append(parts, "none cached")
+	case tm.token.Expiry.IsZero():
+		parts = append(parts, "cached without expiry")
+	default:
+		parts = append(parts, fmt.Sprintf("expires in %v", tm.token.Expiry.Sub(now).Round(time.Second)))
+	}
+	if !tm.refreshAt.IsZero() {
+		parts = append(parts, fmt.Sprintf("refresh in %v", tm.refreshAt.Sub(now).Round(time.Second)))
+	}
+	if tm.fetch != nil {
+		parts = append(parts, "fetch in progress")
+	}
+	return strings.Join(parts, ", ")
+}
@@ -0,0 +1,75 @@
+//  Copyright 2021 Google LLC
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package apt
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+func TestDumpState(t *testing.T) {
+	var buffer bytes.Buffer
+	method := NewAptMethod(bufio.NewReader(&bytes.Buffer{}), &buffer)
+	clock := newFakeClock()
+	method.SetClock(clock)
+	method.config.fallbackEndpoint = "artifactregistry-psc.p.googleapis.com"
+	method.config.retryQueueFile = "queue.json"
+	method.hostFailures = map[hostFailureKey]error{{host: "us-apt.pkg.dev"}: errors.New("TLS failure")}
+	method.prewarmGates = map[string]*prewarmGate{"europe-apt.pkg.dev": {}}
+	method.retryFailed = map[string]DeferredRetry{"ar+https://us-apt.pkg.dev/a.deb": {Failures: 1}}
+	tm := newTokenManager(oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "token", Expiry: clock.Now().Add(time.Hour)}), clock)
+	if _, err := tm.Token(); err != nil {
+		t.Fatalf("failed, %v", err)
+	}
+	method.tokens = tm
+
+	method.DumpState()
+	for _, expected := range []string{
+		"] state:\n",
+		"] acquires in progress: 0 running, 0 queued, 10 workers per host\n",
+		"] host us-apt.pkg.dev failing fast: TLS failure\n",
+		"] fallback endpoint artifactregistry-psc.p.googleapis.com active: false\n",
+		"] token: expires in 1h0m0s, refresh in 55m0s\n",
+		"] prewarmed hosts: europe-apt.pkg.dev\n",
+		"] deferred for retry: 1 URIs\n",
+	} {
+		if !strings.Contains(buffer.String(), expected) {
+			t.Errorf("failed, expected %q in %q", expected, buffer.String())
+		}
+	}
+}
+
+func TestDumpStateDuringConfigure(t *testing.T) {
+	method := NewAptMethod(bufio.NewReader(&bytes.Buffer{}), &bytes.Buffer{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 20; i++ {
+			method.DumpState()
+		}
+	}()
+	for i := 0; i < 20; i++ {
+		method.handleConfigure(&Message{code: 601, description: "Configuration", fields: map[string][]string{
+			"Config-Item": {"Acquire::gar::Fallback-Endpoint=artifactregistry-psc.p.googleapis.com", "Acquire::gar::Retry-Queue-File=queue.json"},
+		}})
+	}
+	<-done
+}
@@ -0,0 +1,119 @@
+//  Copyright 2021 Google LLC
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package apt
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// defaultStatusInterval is how often the progress of a download is reported
+// to apt unless Status-Interval says otherwise.
+const defaultStatusInterval = 5 * time.Second
+
+// statusReporter reports how much of a download has been written in 102
+// Status messages, at most once per interval, so that apt's progress line
+// doesn't appear stalled during long downloads.
+type statusReporter struct {
+	writer   *MessageWriter
+	clock    Clock
+	uri      string
+	interval time.Duration
+	// total is the expected length of the file, or not positive if
+	// unknown.
+	total int64
+	next  time.Time
+}
+
+// newStatusReporter returns a reporter for the download of uri, or nil if
+// status messages are disabled.
+func (m *Method) newStatusReporter(uri string, total int64) *statusReporter {
+	if m.config.statusInterval <= 0 {
+		return nil
+	}
+	clock := m.timeSource()
+	return &statusReporter{
+		writer:   m.writer,
+		clock:    clock,
+		uri:      uri,
+		interval: m.config.statusInterval,
+		total:    total,
+		next:     clock.Now().Add(m.config.statusInterval),
+	}
+}
+
+// report is called with the bytes of the file written so far.
+func (r *statusReporter) report(written int64) {
+	now := r.clock.Now()
+	if now.Before(r.next) {
+		return
+	}
+	r.next = now.Add(r.interval)
+	msg := "Downloaded " + formatBytes(written)
+	if r.total > 0 {
+		msg += fmt.Sprintf(" of %s (%d%%)", formatBytes(r.total), written*100/r.total)
+	}
+	r.writer.URIStatus(r.uri, msg)
+}
+
+// downloadProgress returns the function a download of uri, expected to be
+// total bytes long or not positive if unknown, reports the bytes written to
+// its file to: its 102 Status messages and the Progress of Fetch. It is nil
+// if neither is wanted. Each download gets its own, which never reports
+// fewer bytes than it has, as a restarted download writes the file again
+// from the start.
+func (m *Method) downloadProgress(uri string, total int64) func(written int64) {
+	status := m.newStatusReporter(uri, total)
+	progress := m.config.progress
+	if status == nil && progress == nil {
+		return nil
+	}
+	return monotonicProgress(func(written int64) {
+		if status != nil {
+			status.report(written)
+		}
+		if progress != nil {
+			progress(written)
+		}
+	})
+}
+
+// expectedLength returns the length of the file resp downloads, given its
+// size as reported to apt, or -1 if it isn't known, as when the body must
+// be decompressed.
+func expectedLength(resp *http.Response, size string) int64 {
+	n, err := strconv.ParseInt(size, 10, 64)
+	if err != nil || gzipEncoded(resp) {
+		return -1
+	}
+	return n
+}
+
+// formatBytes formats n like apt does, in decimal units.
+func formatBytes(n int64) string {
+	if n < 1000 {
+		return fmt.Sprintf("%d B", n)
+	}
+	value := float64(n)
+	for _, unit := range []string{"kB", "MB", "GB", "TB"} {
+		value /= 1000
+		if value < 1000 {
+			return fmt.Sprintf("%.1f %s", value, unit)
+		}
+	}
+	return fmt.Sprintf("%.1f PB", value/1000)
+}
@@ -0,0 +1,143 @@
+//  Copyright 2021 Google LLC
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package apt
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAptMethodStatusFollowsFile(t *testing.T) {
+	content := strings.Repeat("0123456789", 10)
+	modtime := time.Date(2021, 3, 1, 3, 5, 6, 0, time.UTC)
+	var tests = []struct {
+		name, partial string
+		client        httpClient
+		expectedFirst int64
+	}{
+		// Resumed after the 40 bytes already in the file, which are
+		// reported as they are hashed again.
+		{"resumed", content[:40], &serveContentClient{content: content, modtime: modtime}, 40},
+		// Reset after 30 bytes, then sent whole again, so the file is
+		// written from the start.
+		{"restarted", "", &rangeHTTPClient{content: content, chunk: 30, resets: 1, rangeCode: 200}, 10},
+	}
+
+	for _, tt := range tests {
+		filename := filepath.Join(t.TempDir(), "p.deb")
+		if tt.partial != "" {
+			os.WriteFile(filename, []byte(tt.partial), 0644)
+			setLastModified(filename, modtime.Format(http.TimeFormat))
+		}
+		var buffer bytes.Buffer
+		method := NewAptMethod(bufio.NewReader(&bytes.Buffer{}), &buffer)
+		method.client = tt.client
+		method.config.writeChunkSize = 10
+		// Report every chunk written.
+		method.config.statusInterval = time.Nanosecond
+		msg := &Message{
+			code:        600,
+			description: "URI Acquire",
+			fields:      map[string][]string{"URI": {"ar+https://fake.uri/pool/p.deb"}, "Filename": {filename}},
+		}
+		if err := method.handleAcquire(context.Background(), msg); err != nil {
+			t.Fatalf("%s: failed, %v", tt.name, err)
+		}
+
+		var reported []int64
+		reader := NewAptMessageReader(bufio.NewReader(&buffer))
+		for {
+			msg, err := reader.ReadMessage(context.Background())
+			if err != nil {
+				break
+			}
+			var n int64
+			if msg.code == 102 && strings.HasPrefix(msg.Get("Message"), "Downloaded") {
+				fmt.Sscanf(msg.Get("Message"), "Downloaded %d B", &n)
+				reported = append(reported, n)
+			}
+		}
+		if len(reported) == 0 || reported[0] != tt.expectedFirst || reported[len(reported)-1] != 100 {
+			t.Errorf("%s: failed, expected status from %d to 100 bytes, got %v", tt.name, tt.expectedFirst, reported)
+		}
+		for i := 1; i < len(reported); i++ {
+			if reported[i] <= reported[i-1] {
+				t.Errorf("%s: failed, status went from %d to %d bytes", tt.name, reported[i-1], reported[i])
+			}
+		}
+	}
+}
+
+func TestDownloadProgress(t *testing.T) {
+	var tests = []struct {
+		interval time.Duration
+		total    int64
+		expected []string
+	}{
+		{5 * time.Second, 1000, []string{"Downloaded 500 B of 1.0 kB (50%)", "Downloaded 1.0 kB of 1.0 kB (100%)"}},
+		{3 * time.Second, -1, []string{"Downloaded 300 B", "Downloaded 600 B", "Downloaded 900 B"}},
+		{0, 1000, nil},
+	}
+
+	for _, tt := range tests {
+		var buffer bytes.Buffer
+		method := NewAptMethod(bufio.NewReader(&bytes.Buffer{}), &buffer)
+		clock := newFakeClock()
+		method.clock = clock
+		method.config.statusInterval = tt.interval
+		progress := method.downloadProgress("ar+https://us-apt.pkg.dev/pool/pkg.deb", tt.total)
+		if (progress == nil) != (tt.interval == 0) {
+			t.Fatalf("failed, interval %v: expected progress to be reported only with an interval", tt.interval)
+		}
+		// A chunk of 100 bytes is written each second.
+		for written := int64(100); progress != nil && written <= 1000; written += 100 {
+			clock.Advance(time.Second)
+			progress(written)
+		}
+		var expected string
+		for _, msg := range tt.expected {
+			expected += "102 Status\nMessage: " + msg + "\nURI: ar+https://us-apt.pkg.dev/pool/pkg.deb\n\n"
+		}
+		if res := buffer.String(); res != expected {
+			t.Errorf("failed, interval %v: expected %q, got %q", tt.interval, expected, res)
+		}
+	}
+}
+
+func TestFormatBytes(t *testing.T) {
+	var tests = []struct {
+		n        int64
+		expected string
+	}{
+		{0, "0 B"},
+		{999, "999 B"},
+		{1500, "1.5 kB"},
+		{52_300_000, "52.3 MB"},
+		{3_000_000_000, "3.0 GB"},
+	}
+	for _, tt := range tests {
+		if res := formatBytes(tt.n); res != tt.expected {
+			t.Errorf("failed, %d: expected %q, got %q", tt.n, tt.expected, res)
+		}
+	}
+}
@@ -0,0 +1,232 @@
+//  Copyright 2021 Google LLC
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package apt
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Telemetry receives measurements from the method, so that they can be
+// sent to whatever monitoring system is in use. Implementations must be
+// safe for concurrent use. The method reports:
+//
+//	acquire           Timer, per URI Acquire, labelled with its result
+//	http_request      Timer, per request, labelled with host and status
+//	download          Timer, per file written by the downloader
+//	downloaded_bytes  Counter, bytes written to files by the downloader
+//	egress_bytes      Counter, bytes transferred, labelled with repository
+//	mmap_unavailable  Event, when a mapped write falls back to plain writes
+//	anonymous_access  Event, when no credentials are found
+//	fallback_endpoint Event, when requests switch to Fallback-Endpoint
+type Telemetry interface {
+	// Counter adds delta to the counter name.
+	Counter(name string, delta int64, labels map[string]string)
+	// Timer records an observation of d for name.
+	Timer(name string, d time.Duration, labels map[string]string)
+	// Event records that name happened.
+	Event(name string, labels map[string]string)
+}
+
+// TelemetryFlusher is implemented by Telemetry which buffers measurements.
+// Flush is called when Run returns.
+type TelemetryFlusher interface {
+	Flush() error
+}
+
+// NopTelemetry discards all measurements.
+type NopTelemetry struct{}
+
+// Counter implements Telemetry.
+func (NopTelemetry) Counter(string, int64, map[string]string) {}
+
+// Timer implements Telemetry.
+func (NopTelemetry) Timer(string, time.Duration, map[string]string) {}
+
+// Event implements Telemetry.
+func (NopTelemetry) Event(string, map[string]string) {}
+
+// LogTelemetry passes each measurement to Log as a line of text.
+type LogTelemetry struct {
+	Log func(string)
+}
+
+// Counter implements Telemetry.
+func (t LogTelemetry) Counter(name string, delta int64, labels map[string]string) {
+	t.Log(fmt.Sprintf("telemetry counter %s%s +%d", name, formatLabels(labels), delta))
+}
+
+// Timer implements Telemetry.
+func (t LogTelemetry) Timer(name string, d time.Duration, labels map[string]string) {
+	t.Log(fmt.Sprintf("telemetry timer %s%s %v", name, formatLabels(labels), d))
+}
+
+// Event implements Telemetry.
+func (t LogTelemetry) Event(name string, labels map[string]string) {
+	t.Log(fmt.Sprintf("telemetry event %s%s", name, formatLabels(labels)))
+}
+
+// TextfileTelemetry accumulates measurements and writes them on Flush to
+// Path in the Prometheus text format, for node_exporter's textfile
+// collector. Counters become apt_gar_<name>, timers apt_gar_<name>_seconds
+// summaries and events apt_gar_<name>_total; each Flush replaces the file
+// with the totals so far.
+type TextfileTelemetry struct {
+	Path string
+
+	mu      sync.Mutex
+	samples map[string]float64
+}
+
+// NewTextfileTelemetry returns a TextfileTelemetry writing to path.
+func NewTextfileTelemetry(path string) *TextfileTelemetry {
+	return &TextfileTelemetry{Path: path}
+}
+
+func (t *TextfileTelemetry) add(metric string, labels map[string]string, v float64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.samples == nil {
+		t.samples = make(map[string]float64)
+	}
+	t.samples["apt_gar_"+sanitizeMetricName(metric)+formatLabels(labels)] += v
+}
+
+// Counter implements Telemetry.
+func (t *TextfileTelemetry) Counter(name string, delta int64, labels map[string]string) {
+	t.add(name, labels, float64(delta))
+}
+
+// Timer implements Telemetry.
+func (t *TextfileTelemetry) Timer(name string, d time.Duration, labels map[string]string) {
+	t.add(name+"_seconds_sum", labels, d.Seconds())
+	t.add(name+"_seconds_count", labels, 1)
+}
+
+// Event implements Telemetry.
+func (t *TextfileTelemetry) Event(name string, labels map[string]string) {
+	t.add(name+"_total", labels, 1)
+}
+
+// Flush implements TelemetryFlusher. The file is replaced atomically, so
+// that the collector never reads it half written.
+func (t *TextfileTelemetry) Flush() error {
+	t.mu.Lock()
+	lines := make([]string, 0, len(t.samples))
+	for sample, v := range t.samples {
+		lines = append(lines, fmt.Sprintf("%s %g\n", sample, v))
+	}
+	t.mu.Unlock()
+	sort.Strings(lines)
+
+	tmp, err := os.CreateTemp(filepath.Dir(t.Path), ".telemetry-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.WriteString(strings.Join(lines, "")); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), t.Path)
+}
+
+// sanitizeMetricName replaces the characters Prometheus doesn't allow in
+// metric and label names.
+func sanitizeMetricName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '_' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' {
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+// formatLabels formats labels as {name="value",...}, sorted by name, or
+// returns "" if there are none.
+func formatLabels(labels map[string]string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, "%s=%q", sanitizeMetricName(name), labels[name])
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+// metrics returns the Telemetry measurements are sent to.
+func (m *Method) metrics() Telemetry {
+	if m.telemetry == nil {
+		return NopTelemetry{}
+	}
+	return m.telemetry
+}
+
+// SetTelemetry replaces the Telemetry measurements are sent to, taking
+// precedence over the Telemetry option. It must be called before Run.
+func (m *Method) SetTelemetry(t Telemetry) {
+	m.telemetry = t
+}
+
+// initTelemetry sets up the Telemetry chosen by the configuration, unless
+// one was set with SetTelemetry.
+func (m *Method) initTelemetry() error {
+	if m.telemetry != nil {
+		return nil
+	}
+	switch m.config.telemetry {
+	case "", "none":
+	case "log":
+		m.telemetry = LogTelemetry{Log: func(msg string) { m.writer.Log(msg) }}
+	case "textfile":
+		if m.config.telemetryFile == "" {
+			return fmt.Errorf("telemetry %q needs Telemetry-File", m.config.telemetry)
+		}
+		m.telemetry = NewTextfileTelemetry(m.config.telemetryFile)
+	default:
+		return fmt.Errorf("unknown Telemetry %q, expected none, log or textfile", m.config.telemetry)
+	}
+	return nil
+}
+
+// flushTelemetry writes out measurements buffered by the Telemetry.
+func (m *Method) flushTelemetry() error {
+	if f, ok := m.telemetry.(TelemetryFlusher); ok {
+		return f.Flush()
+	}
+	return nil
+}
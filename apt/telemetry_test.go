@@ -0,0 +1,141 @@
+//  Copyright 2021 Google LLC
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package apt
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingTelemetry records measurements as "kind name labels".
+type recordingTelemetry struct {
+	mu      sync.Mutex
+	records []string
+}
+
+func (t *recordingTelemetry) record(s string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.records = append(t.records, s)
+}
+
+func (t *recordingTelemetry) Counter(name string, delta int64, labels map[string]string) {
+	t.record("counter " + name + formatLabels(labels))
+}
+
+func (t *recordingTelemetry) Timer(name string, d time.Duration, labels map[string]string) {
+	t.record("timer " + name + formatLabels(labels))
+}
+
+func (t *recordingTelemetry) Event(name string, labels map[string]string) {
+	t.record("event " + name + formatLabels(labels))
+}
+
+func TestAptMethodTelemetry(t *testing.T) {
+	dir := t.TempDir()
+	input := "601 Configuration\nConfig-Item: Acquire::gar::Telemetry=log\n\n" +
+		"600 URI Acquire\nURI: ar+https://us-apt.pkg.dev/projects/p/dists/stable/Release\nFilename: " + filepath.Join(dir, "Release") + "\n\n"
+	var buffer bytes.Buffer
+	method := NewAptMethod(bufio.NewReader(strings.NewReader(input)), &buffer)
+	method.client = fakeHTTPClient{header: map[string][]string{"Content-Length": {"8"}}, body: "contents"}
+	telemetry := &recordingTelemetry{}
+	method.SetTelemetry(telemetry)
+	if err := method.Run(context.Background()); err != nil {
+		t.Fatalf("failed, %v", err)
+	}
+
+	expected := []string{
+		`timer http_request{host="us-apt.pkg.dev",status="200"}`,
+		`timer download`,
+		`counter downloaded_bytes`,
+		`counter egress_bytes{repository="us-apt.pkg.dev/projects/p"}`,
+		`timer acquire{result="done"}`,
+	}
+	if strings.Join(telemetry.records, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("failed, got %q, expected %q", telemetry.records, expected)
+	}
+	if strings.Contains(buffer.String(), "telemetry ") {
+		t.Errorf("failed, expected SetTelemetry to take precedence over the Telemetry option, got %q", buffer.String())
+	}
+}
+
+func TestInitTelemetry(t *testing.T) {
+	var tests = []struct {
+		telemetry, file string
+		expected        Telemetry
+		expectErr       bool
+	}{
+		{"", "", nil, false},
+		{"none", "", nil, false},
+		{"log", "", LogTelemetry{}, false},
+		{"textfile", "/tmp/apt-gar.prom", NewTextfileTelemetry("/tmp/apt-gar.prom"), false},
+		{"textfile", "", nil, true},
+		{"statsd", "", nil, true},
+	}
+	for _, tt := range tests {
+		method := NewAptMethod(bufio.NewReader(&bytes.Buffer{}), &bytes.Buffer{})
+		method.config.telemetry, method.config.telemetryFile = tt.telemetry, tt.file
+		err := method.initTelemetry()
+		if (err != nil) != tt.expectErr {
+			t.Errorf("%q: failed, unexpected error %v", tt.telemetry, err)
+		}
+		switch expected := tt.expected.(type) {
+		case nil:
+			if method.telemetry != nil {
+				t.Errorf("%q: failed, expected no telemetry, got %T", tt.telemetry, method.telemetry)
+			}
+		case *TextfileTelemetry:
+			if got, ok := method.telemetry.(*TextfileTelemetry); !ok || got.Path != expected.Path {
+				t.Errorf("%q: failed, expected textfile telemetry writing %s, got %#v", tt.telemetry, expected.Path, method.telemetry)
+			}
+		case LogTelemetry:
+			if _, ok := method.telemetry.(LogTelemetry); !ok {
+				t.Errorf("%q: failed, expected log telemetry, got %T", tt.telemetry, method.telemetry)
+			}
+		}
+	}
+}
+
+func TestTextfileTelemetry(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "apt-gar.prom")
+	telemetry := NewTextfileTelemetry(path)
+	telemetry.Counter("egress_bytes", 100, map[string]string{"repository": "us-apt.pkg.dev/projects/p"})
+	telemetry.Counter("egress_bytes", 50, map[string]string{"repository": "us-apt.pkg.dev/projects/p"})
+	telemetry.Timer("acquire", 1500*time.Millisecond, map[string]string{"result": "done"})
+	telemetry.Timer("acquire", 500*time.Millisecond, map[string]string{"result": "done"})
+	telemetry.Event("fallback-endpoint", map[string]string{"host": "us-apt.pkg.dev"})
+	if err := telemetry.Flush(); err != nil {
+		t.Fatalf("failed, %v", err)
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed, %v", err)
+	}
+	expected := `apt_gar_acquire_seconds_count{result="done"} 2
+apt_gar_acquire_seconds_sum{result="done"} 2
+apt_gar_egress_bytes{repository="us-apt.pkg.dev/projects/p"} 150
+apt_gar_fallback_endpoint_total{host="us-apt.pkg.dev"} 1
+`
+	if string(b) != expected {
+		t.Errorf("failed, got %q, expected %q", b, expected)
+	}
+}
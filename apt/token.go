@@ -0,0 +1,102 @@
+//  Copyright 2021 Google LLC
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package apt
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"cloud.google.com/go/compute/metadata"
+	"golang.org/x/oauth2"
+)
+
+const (
+	defaultTokenAttempts = 5
+	defaultTokenBackoff  = 500 * time.Millisecond
+)
+
+// retryTokenSource retries token fetches which failed transiently with
+// exponential backoff; see transientTokenError. The GCE metadata server can
+// briefly return errors right after VM start, which would otherwise fail the
+// first `apt update` in a startup script. It stops waiting to retry once ctx
+// is cancelled.
+type retryTokenSource struct {
+	ctx      context.Context
+	base     oauth2.TokenSource
+	attempts int
+	backoff  time.Duration
+	log      func(string)
+	// warn, if set, is told when a fetch succeeds only on retry.
+	warn  func(string)
+	clock Clock
+}
+
+func newRetryTokenSource(ctx context.Context, base oauth2.TokenSource, clock Clock, log func(string)) *retryTokenSource {
+	return &retryTokenSource{
+		ctx:      ctx,
+		base:     base,
+		attempts: defaultTokenAttempts,
+		backoff:  defaultTokenBackoff,
+		log:      log,
+		clock:    clock,
+	}
+}
+
+// Token implements oauth2.TokenSource.
+func (ts *retryTokenSource) Token() (*oauth2.Token, error) {
+	backoff := ts.backoff
+	for attempt := 1; ; attempt++ {
+		tok, err := ts.base.Token()
+		if err == nil {
+			if attempt > 1 && ts.warn != nil {
+				ts.warn(fmt.Sprintf("fetching an access token succeeded after %d attempts", attempt))
+			}
+			return tok, nil
+		}
+		if attempt >= ts.attempts || !transientTokenError(err) {
+			return nil, err
+		}
+		ts.log(fmt.Sprintf("retrying token fetch (%d/%d) in %v: %v", attempt+1, ts.attempts, backoff, err))
+		timer := ts.clock.NewTimer(backoff)
+		select {
+		case <-timer.C():
+		case <-ts.ctx.Done():
+			timer.Stop()
+			return nil, err
+		}
+		backoff *= 2
+	}
+}
+
+// transientTokenError reports whether a token fetch which failed with err
+// may succeed if retried: one the metadata server or token endpoint failed
+// with a transient status, or which failed to reach it at all. Anything
+// else, such as an invalid_grant for a revoked key, fails the same way
+// however often it is retried.
+func transientTokenError(err error) bool {
+	var retrieveErr *oauth2.RetrieveError
+	if errors.As(err, &retrieveErr) {
+		return transientStatus(retrieveErr.Response.StatusCode)
+	}
+	var metadataErr *metadata.Error
+	if errors.As(err, &metadataErr) {
+		return transientStatus(metadataErr.Code)
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
@@ -0,0 +1,157 @@
+//  Copyright 2021 Google LLC
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package apt
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/compute/metadata"
+	"golang.org/x/oauth2"
+)
+
+// fakeTokenSource fails the first `failures` calls to Token with err, or
+// with a 503 from the metadata server if err is nil.
+type fakeTokenSource struct {
+	failures, calls int
+	err             error
+}
+
+func (ts *fakeTokenSource) Token() (*oauth2.Token, error) {
+	ts.calls++
+	if ts.calls <= ts.failures {
+		if ts.err != nil {
+			return nil, ts.err
+		}
+		return nil, &metadata.Error{Code: 503, Message: "unavailable"}
+	}
+	return &oauth2.Token{AccessToken: "token"}, nil
+}
+
+func TestRetryTokenSource(t *testing.T) {
+	var tests = []struct {
+		failures, expectedCalls int
+		expectedSleeps          []time.Duration
+		expectErr               bool
+	}{
+		{0, 1, nil, false},
+		{2, 3, []time.Duration{time.Second, 2 * time.Second}, false},
+		{10, 4, []time.Duration{time.Second, 2 * time.Second, 4 * time.Second}, true},
+	}
+
+	for _, tt := range tests {
+		base := &fakeTokenSource{failures: tt.failures}
+		var logs, warnings []string
+		clock := newFakeClock()
+		clock.advanceTimers = true
+		ts := &retryTokenSource{
+			ctx:      context.Background(),
+			base:     base,
+			attempts: 4,
+			backoff:  time.Second,
+			log:      func(msg string) { logs = append(logs, msg) },
+			warn:     func(msg string) { warnings = append(warnings, msg) },
+			clock:    clock,
+		}
+
+		tok, err := ts.Token()
+		sleeps := clock.sleeps
+		if tt.expectErr != (err != nil) {
+			t.Errorf("unexpected error result: %v", err)
+		}
+		if !tt.expectErr && tok.AccessToken != "token" {
+			t.Errorf("unexpected token %q", tok.AccessToken)
+		}
+		if base.calls != tt.expectedCalls {
+			t.Errorf("got %d calls, expected %d", base.calls, tt.expectedCalls)
+		}
+		if len(logs) != len(tt.expectedSleeps) || len(sleeps) != len(tt.expectedSleeps) {
+			t.Fatalf("got %d logs and %d sleeps, expected %d", len(logs), len(sleeps), len(tt.expectedSleeps))
+		}
+		if len(logs) > 0 && !strings.HasPrefix(logs[0], "retrying token fetch (2/4) in 1s: ") {
+			t.Errorf("unexpected retry message %q", logs[0])
+		}
+		if expectWarning := tt.failures > 0 && !tt.expectErr; (len(warnings) == 1) != expectWarning {
+			t.Errorf("got warnings %q, expected one: %v", warnings, expectWarning)
+		}
+		for i, d := range sleeps {
+			if d != tt.expectedSleeps[i] {
+				t.Errorf("sleep %d was %v, expected %v", i, d, tt.expectedSleeps[i])
+			}
+		}
+	}
+}
+
+func TestRetryTokenSourcePermanentError(t *testing.T) {
+	var tests = []struct {
+		err       error
+		transient bool
+	}{
+		{&metadata.Error{Code: 503}, true},
+		{&metadata.Error{Code: 429}, true},
+		{&metadata.Error{Code: 403}, false},
+		{&oauth2.RetrieveError{Response: &http.Response{StatusCode: 500}}, true},
+		{&oauth2.RetrieveError{Response: &http.Response{StatusCode: 400}, Body: []byte(`{"error":"invalid_grant"}`)}, false},
+		{&net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}, true},
+		{errors.New("no credentials found"), false},
+	}
+
+	for _, tt := range tests {
+		base := &fakeTokenSource{failures: 10, err: tt.err}
+		clock := newFakeClock()
+		clock.advanceTimers = true
+		ts := newRetryTokenSource(context.Background(), base, clock, func(string) {})
+		if _, err := ts.Token(); err == nil {
+			t.Errorf("failed for %v, expected an error", tt.err)
+		}
+		expected := 1
+		if tt.transient {
+			expected = defaultTokenAttempts
+		}
+		if base.calls != expected {
+			t.Errorf("failed for %v, got %d calls, expected %d", tt.err, base.calls, expected)
+		}
+	}
+}
+
+func TestRetryTokenSourceCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	base := &fakeTokenSource{failures: 10}
+	clock := newFakeClock()
+	ts := newRetryTokenSource(ctx, base, clock, func(string) {})
+	errChan := make(chan error)
+	go func() {
+		_, err := ts.Token()
+		errChan <- err
+	}()
+	clock.waitForTimers(1)
+	cancel()
+	select {
+	case err := <-errChan:
+		if err == nil {
+			t.Errorf("failed, expected an error")
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("failed, still waiting to retry after cancellation")
+	}
+	if base.calls != 1 {
+		t.Errorf("got %d calls, expected 1", base.calls)
+	}
+}
@@ -0,0 +1,150 @@
+//  Copyright 2021 Google LLC
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package apt
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+const (
+	// tokenRefreshWindow is how long before expiry a token is refreshed in
+	// the background, while it is still handed out.
+	tokenRefreshWindow = 5 * time.Minute
+	// tokenExpiryDelta is how long before expiry a token is no longer
+	// handed out, as with oauth2.Token.Valid.
+	tokenExpiryDelta = 10 * time.Second
+	// tokenRefreshRetry is how long to wait after a failed background
+	// refresh before trying again.
+	tokenRefreshRetry = 30 * time.Second
+)
+
+// tokenManager caches the token from base. Callers arriving while a token is
+// being fetched wait for that fetch rather than starting their own, so that
+// a burst of acquires exchanges credentials once. A token close to expiry is
+// refreshed in the background while it is still handed out, so that
+// requests don't stall on the exchange.
+type tokenManager struct {
+	base  oauth2.TokenSource
+	clock Clock
+	// warn, if set, is told of slow and failed refreshes, and of tokens
+	// which expired before they were refreshed.
+	warn func(string)
+
+	mu        sync.Mutex
+	token     *oauth2.Token
+	refreshAt time.Time
+	fetch     *tokenFetch
+}
+
+// tokenFetch is a token fetch in flight, whose result is available once
+// done is closed.
+type tokenFetch struct {
+	done  chan struct{}
+	token *oauth2.Token
+	err   error
+}
+
+func newTokenManager(base oauth2.TokenSource, clock Clock) *tokenManager {
+	return &tokenManager{base: base, clock: clock}
+}
+
+// Token implements oauth2.TokenSource.
+func (tm *tokenManager) Token() (*oauth2.Token, error) {
+	tm.mu.Lock()
+	now := tm.clock.Now()
+	if tm.token != nil && !tm.expired(now) {
+		token := tm.token
+		if tm.fetch == nil && !tm.refreshAt.IsZero() && !now.Before(tm.refreshAt) {
+			tm.start()
+		}
+		tm.mu.Unlock()
+		return token, nil
+	}
+	stale := tm.token != nil
+	fetch := tm.fetch
+	if fetch == nil {
+		fetch = tm.start()
+	}
+	tm.mu.Unlock()
+	if stale {
+		tm.notify("the access token expired before it was refreshed, and requests waited for a new one")
+	}
+	<-fetch.done
+	return fetch.token, fetch.err
+}
+
+// notify passes msg to warn, if set. It must not be called with mu held.
+func (tm *tokenManager) notify(msg string) {
+	if tm.warn != nil {
+		tm.warn(msg)
+	}
+}
+
+// expired reports whether the cached token is too close to expiry to hand
+// out. Tokens without an expiry never expire.
+func (tm *tokenManager) expired(now time.Time) bool {
+	return !tm.token.Expiry.IsZero() && !now.Add(tokenExpiryDelta).Before(tm.token.Expiry)
+}
+
+// start fetches a token in the background. It must be called with mu held.
+func (tm *tokenManager) start() *tokenFetch {
+	fetch := &tokenFetch{done: make(chan struct{})}
+	tm.fetch = fetch
+	go func() {
+		began := tm.clock.Now()
+		token, err := tm.base.Token()
+		tm.mu.Lock()
+		now := tm.clock.Now()
+		var warnings []string
+		if took := now.Sub(began); took >= slowTokenFetch {
+			warnings = append(warnings, fmt.Sprintf("fetching an access token took %v", took.Round(time.Second)))
+		}
+		if err == nil {
+			tm.token = token
+			tm.refreshAt = refreshTime(now, token.Expiry)
+		} else if tm.token != nil {
+			// Keep the token in hand while it lasts.
+			tm.refreshAt = now.Add(tokenRefreshRetry)
+			warnings = append(warnings, fmt.Sprintf("failed to refresh the access token, using the current one while it lasts: %v", err))
+		}
+		tm.fetch = nil
+		tm.mu.Unlock()
+		fetch.token, fetch.err = token, err
+		close(fetch.done)
+		for _, msg := range warnings {
+			tm.notify(msg)
+		}
+	}()
+	return fetch
+}
+
+// refreshTime returns when a token fetched at now and expiring at expiry
+// should be refreshed: tokenRefreshWindow before expiry, or half way through
+// the lifetimes of tokens shorter than twice that. Tokens without an expiry
+// are never refreshed.
+func refreshTime(now, expiry time.Time) time.Time {
+	if expiry.IsZero() {
+		return time.Time{}
+	}
+	window := tokenRefreshWindow
+	if lifetime := expiry.Sub(now); lifetime < 2*window {
+		window = lifetime / 2
+	}
+	return expiry.Add(-window)
+}
@@ -0,0 +1,242 @@
+//  Copyright 2021 Google LLC
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package apt
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// gatedTokenSource hands out numbered tokens expiring after lifetime, each
+// fetch waiting for a value on release, which is sent back on fetched
+// once the token is returned.
+type gatedTokenSource struct {
+	clock    Clock
+	lifetime time.Duration
+	release  chan error
+	fetched  chan int
+
+	mu    sync.Mutex
+	count int
+}
+
+func newGatedTokenSource(clock Clock, lifetime time.Duration) *gatedTokenSource {
+	return &gatedTokenSource{clock: clock, lifetime: lifetime, release: make(chan error), fetched: make(chan int, 10)}
+}
+
+func (ts *gatedTokenSource) Token() (*oauth2.Token, error) {
+	err := <-ts.release
+	ts.mu.Lock()
+	ts.count++
+	n := ts.count
+	ts.mu.Unlock()
+	defer func() { ts.fetched <- n }()
+	if err != nil {
+		return nil, err
+	}
+	return &oauth2.Token{AccessToken: fmt.Sprintf("token-%d", n), Expiry: ts.clock.Now().Add(ts.lifetime)}, nil
+}
+
+func TestTokenManagerSingleflight(t *testing.T) {
+	clock := newFakeClock()
+	base := newGatedTokenSource(clock, time.Hour)
+	tm := newTokenManager(base, clock)
+
+	const callers = 20
+	tokens := make(chan string, callers)
+	for i := 0; i < callers; i++ {
+		go func() {
+			token, err := tm.Token()
+			if err != nil {
+				tokens <- err.Error()
+				return
+			}
+			tokens <- token.AccessToken
+		}()
+	}
+	base.release <- nil
+	for i := 0; i < callers; i++ {
+		if token := <-tokens; token != "token-1" {
+			t.Errorf("failed, got %q, expected token-1", token)
+		}
+	}
+	select {
+	case base.release <- nil:
+		t.Errorf("failed, expected a single token fetch")
+	default:
+	}
+}
+
+func TestTokenManagerProactiveRefresh(t *testing.T) {
+	clock := newFakeClock()
+	base := newGatedTokenSource(clock, time.Hour)
+	tm := newTokenManager(base, clock)
+	get := func() string {
+		t.Helper()
+		token, err := tm.Token()
+		if err != nil {
+			t.Fatalf("failed, %v", err)
+		}
+		return token.AccessToken
+	}
+
+	go func() { base.release <- nil }()
+	if token := get(); token != "token-1" {
+		t.Fatalf("failed, got %q, expected token-1", token)
+	}
+	<-base.fetched
+
+	// Within the refresh window the token in hand is still returned, while
+	// a new one is fetched in the background.
+	clock.Advance(time.Hour - tokenRefreshWindow + time.Second)
+	if token := get(); token != "token-1" {
+		t.Errorf("failed, got %q, expected token-1 during the refresh", token)
+	}
+	if token := get(); token != "token-1" {
+		t.Errorf("failed, got %q, expected token-1 during the refresh", token)
+	}
+	base.release <- nil
+	<-base.fetched
+	waitFor(t, func() bool { return get() == "token-2" })
+
+	// A failed background refresh keeps the token in hand, and is retried
+	// after tokenRefreshRetry.
+	clock.Advance(time.Hour - tokenRefreshWindow + time.Second)
+	get()
+	base.release <- errors.New("metadata server unavailable")
+	<-base.fetched
+	waitFor(t, func() bool {
+		tm.mu.Lock()
+		defer tm.mu.Unlock()
+		return tm.fetch == nil
+	})
+	if token := get(); token != "token-2" {
+		t.Errorf("failed, got %q, expected token-2 after a failed refresh", token)
+	}
+	clock.Advance(tokenRefreshRetry)
+	get()
+	base.release <- nil
+	<-base.fetched
+	waitFor(t, func() bool { return get() == "token-4" })
+}
+
+func TestTokenManagerExpired(t *testing.T) {
+	clock := newFakeClock()
+	base := newGatedTokenSource(clock, time.Hour)
+	tm := newTokenManager(base, clock)
+
+	go func() { base.release <- nil }()
+	if _, err := tm.Token(); err != nil {
+		t.Fatalf("failed, %v", err)
+	}
+	// An expired token is never handed out; callers wait for the fetch and
+	// see its error.
+	clock.Advance(time.Hour)
+	go func() { base.release <- errors.New("refused") }()
+	if token, err := tm.Token(); err == nil {
+		t.Errorf("failed, expected an error, got %v", token)
+	}
+}
+
+func TestRefreshTime(t *testing.T) {
+	now := newFakeClock().Now()
+	var tests = []struct {
+		expiry, expected time.Time
+	}{
+		{time.Time{}, time.Time{}},
+		{now.Add(time.Hour), now.Add(time.Hour - tokenRefreshWindow)},
+		{now.Add(2 * time.Minute), now.Add(time.Minute)},
+	}
+	for _, tt := range tests {
+		if res := refreshTime(now, tt.expiry); !res.Equal(tt.expected) {
+			t.Errorf("failed, refreshTime(%v) = %v, expected %v", tt.expiry, res, tt.expected)
+		}
+	}
+}
+
+// waitFor polls cond until it holds, failing after a second.
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second); !cond(); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("failed, condition not met in time")
+		}
+	}
+}
+
+// slowTokenSource advances clock by delay for each token fetched, failing
+// once err is set.
+type slowTokenSource struct {
+	clock *fakeClock
+	delay time.Duration
+	err   error
+}
+
+func (ts *slowTokenSource) Token() (*oauth2.Token, error) {
+	ts.clock.Advance(ts.delay)
+	if ts.err != nil {
+		return nil, ts.err
+	}
+	return &oauth2.Token{AccessToken: "token", Expiry: ts.clock.Now().Add(time.Hour)}, nil
+}
+
+func TestTokenManagerWarnings(t *testing.T) {
+	clock := newFakeClock()
+	base := &slowTokenSource{clock: clock, delay: slowTokenFetch}
+	tm := newTokenManager(base, clock)
+	var mu sync.Mutex
+	var warnings []string
+	tm.warn = func(msg string) {
+		mu.Lock()
+		defer mu.Unlock()
+		warnings = append(warnings, msg)
+	}
+	expect := func(expected ...string) {
+		t.Helper()
+		waitFor(t, func() bool {
+			mu.Lock()
+			defer mu.Unlock()
+			return len(warnings) >= len(expected)
+		})
+		mu.Lock()
+		defer mu.Unlock()
+		if fmt.Sprint(warnings) != fmt.Sprint(expected) {
+			t.Errorf("failed, expected warnings %q, got %q", expected, warnings)
+		}
+		warnings = nil
+	}
+
+	if _, err := tm.Token(); err != nil {
+		t.Fatalf("failed, %v", err)
+	}
+	expect("fetching an access token took 5s")
+
+	base.delay, base.err = 0, errors.New("metadata server unavailable")
+	clock.Advance(time.Hour - tokenRefreshWindow)
+	tm.Token()
+	expect("failed to refresh the access token, using the current one while it lasts: metadata server unavailable")
+
+	base.err = nil
+	clock.Advance(tokenRefreshWindow)
+	if _, err := tm.Token(); err != nil {
+		t.Fatalf("failed, %v", err)
+	}
+	expect("the access token expired before it was refreshed, and requests waited for a new one")
+}
@@ -0,0 +1,56 @@
+//  Copyright 2021 Google LLC
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package apt
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// redirectChain returns the URLs requested to obtain resp, oldest first. A
+// virtual repository may redirect to the member repository which holds the
+// artifact, possibly on another host.
+func redirectChain(resp *http.Response) []string {
+	var chain []string
+	for req := resp.Request; req != nil; {
+		chain = append([]string{req.URL.String()}, chain...)
+		if req.Response == nil {
+			break
+		}
+		req = req.Response.Request
+	}
+	return chain
+}
+
+// describeUpstream describes where resp was served from, for debug logs: the
+// redirects followed and any proxies reported in Via headers, e.g. by a
+// virtual repository fetching from a member repository.
+func describeUpstream(resp *http.Response) string {
+	if resp.Request == nil {
+		return ""
+	}
+	var parts []string
+	if chain := redirectChain(resp); len(chain) > 1 {
+		parts = append(parts, "redirected "+strings.Join(chain, " -> "))
+	}
+	if via := resp.Header.Values("Via"); len(via) > 0 {
+		parts = append(parts, "via "+strings.Join(via, ", "))
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	return fmt.Sprintf("served by %s: %s", resp.Request.URL.Host, strings.Join(parts, "; "))
+}
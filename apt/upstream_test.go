@@ -0,0 +1,90 @@
+//  Copyright 2021 Google LLC
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package apt
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestVirtualRepositoryUpstream(t *testing.T) {
+	member := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Via", "1.1 member-repo")
+		w.Header().Set("Last-Modified", "Mon, 01 Mar 2021 03:05:06 GMT")
+		fmt.Fprintf(w, "contents of %s", r.URL.Path)
+	}))
+	defer member.Close()
+	// The virtual repository redirects some artifacts to a member on another
+	// host, some via a relative redirect first, and serves others itself.
+	virtual := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasPrefix(r.URL.Path, "/v/relative/"):
+			http.Redirect(w, r, "/v/member/"+filepath.Base(r.URL.Path), http.StatusTemporaryRedirect)
+		case strings.HasPrefix(r.URL.Path, "/v/member/"):
+			http.Redirect(w, r, member.URL+"/m/"+filepath.Base(r.URL.Path), http.StatusFound)
+		default:
+			fmt.Fprintf(w, "contents of %s", r.URL.Path)
+		}
+	}))
+	defer virtual.Close()
+	host := strings.TrimPrefix(virtual.URL, "https://")
+
+	var tests = []struct {
+		path             string
+		expectedContents string
+		expectedLogs     []string
+	}{
+		{"/v/local/a.deb", "contents of /v/local/a.deb", nil},
+		{"/v/member/b.deb", "contents of /m/b.deb", []string{
+			fmt.Sprintf("served by %s: redirected %s/v/member/b.deb -> %s/m/b.deb; via 1.1 member-repo", strings.TrimPrefix(member.URL, "https://"), virtual.URL, member.URL),
+		}},
+		{"/v/relative/c.deb", "contents of /m/c.deb", []string{
+			fmt.Sprintf("redirected %s/v/relative/c.deb -> %s/v/member/c.deb -> %s/m/c.deb", virtual.URL, virtual.URL, member.URL),
+		}},
+	}
+
+	for _, tt := range tests {
+		var buffer bytes.Buffer
+		method := NewAptMethod(bufio.NewReader(&bytes.Buffer{}), &buffer)
+		method.client = virtual.Client()
+		method.config.debug = true
+		filename := filepath.Join(t.TempDir(), "file")
+		method.handleAcquire(context.Background(), &Message{
+			code:        600,
+			description: "URI Acquire",
+			fields:      map[string][]string{"URI": {"ar+https://" + host + tt.path}, "Filename": {filename}},
+		})
+
+		if contents, err := os.ReadFile(filename); err != nil || string(contents) != tt.expectedContents {
+			t.Errorf("failed for %s, expected %q got %q, %v", tt.path, tt.expectedContents, contents, err)
+		}
+		if tt.expectedLogs == nil && strings.Contains(buffer.String(), "served by") {
+			t.Errorf("failed for %s, unexpected upstream log in %q", tt.path, buffer.String())
+		}
+		for _, expected := range tt.expectedLogs {
+			if !strings.Contains(buffer.String(), expected) {
+				t.Errorf("failed for %s, expected log %q in %q", tt.path, expected, buffer.String())
+			}
+		}
+	}
+}
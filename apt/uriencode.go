@@ -0,0 +1,53 @@
+//  Copyright 2021 Google LLC
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package apt
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// encodeURI percent-encodes the bytes of uri which may not appear in a URI
+// as they are, such as spaces, leaving the escapes already in it alone. The
+// method asks apt for encoded URIs with Send-URI-Encoded, which this leaves
+// unchanged; older releases of apt ignore it and send file names as they
+// are, which this encodes. A "%" begins an escape only if two hex digits
+// follow it, and a "#" is always part of a file name, as apt never sends
+// fragments.
+func encodeURI(uri string) string {
+	var b strings.Builder
+	for i := 0; i < len(uri); i++ {
+		c := uri[i]
+		switch {
+		case c == '%' && i+2 < len(uri) && isHex(uri[i+1]) && isHex(uri[i+2]):
+			b.WriteByte(c)
+		case c <= ' ' || c >= 0x7f || strings.IndexByte("\"#%<>\\^`{|}", c) >= 0:
+			fmt.Fprintf(&b, "%%%02X", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+func isHex(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'
+}
+
+// parseAptURI parses a URI apt sent, encoded or not; see encodeURI.
+func parseAptURI(uri string) (*url.URL, error) {
+	return url.Parse(encodeURI(uri))
+}
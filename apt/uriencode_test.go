@@ -0,0 +1,87 @@
+//  Copyright 2021 Google LLC
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package apt
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"net/http"
+	"testing"
+)
+
+func TestEncodeURI(t *testing.T) {
+	var tests = []struct {
+		uri      string
+		expected string
+	}{
+		{"ar+https://fake.uri/pool/p_1.0_amd64.deb", "ar+https://fake.uri/pool/p_1.0_amd64.deb"},
+		{"ar+https://fake.uri/pool/p_1.0+dfsg_amd64.deb", "ar+https://fake.uri/pool/p_1.0+dfsg_amd64.deb"},
+		{"ar+https://fake.uri/pool/p_1.0%2bdfsg_amd64.deb", "ar+https://fake.uri/pool/p_1.0%2bdfsg_amd64.deb"},
+		{"ar+https://fake.uri/pool/my file.deb", "ar+https://fake.uri/pool/my%20file.deb"},
+		{"ar+https://fake.uri/pool/my%20file.deb", "ar+https://fake.uri/pool/my%20file.deb"},
+		{"ar+https://fake.uri/pool/100%.deb", "ar+https://fake.uri/pool/100%25.deb"},
+		{"ar+https://fake.uri/pool/p%zz.deb", "ar+https://fake.uri/pool/p%25zz.deb"},
+		{"ar+https://fake.uri/pool/a#b.deb", "ar+https://fake.uri/pool/a%23b.deb"},
+		{"ar+https://fake.uri/pool/café.deb", "ar+https://fake.uri/pool/caf%C3%A9.deb"},
+	}
+
+	for _, tt := range tests {
+		if actual := encodeURI(tt.uri); actual != tt.expected {
+			t.Errorf("failed, encodeURI(%q): expected %q, got %q", tt.uri, tt.expected, actual)
+		}
+	}
+}
+
+type pathRecordingClient struct {
+	paths *[]string
+}
+
+func (c pathRecordingClient) Do(req *http.Request) (*http.Response, error) {
+	*c.paths = append(*c.paths, req.URL.EscapedPath())
+	return fakeHTTPClient{}.Do(req)
+}
+
+func TestAptMethodEncodedURIs(t *testing.T) {
+	var tests = []struct {
+		uri      string
+		expected string
+	}{
+		{"ar+https://fake.uri/pool/my file_1.0+b1.deb", "/pool/my%20file_1.0+b1.deb"},
+		{"ar+https://fake.uri/pool/my%20file_1.0%2Bb1.deb", "/pool/my%20file_1.0%2Bb1.deb"},
+		{"ar+https://fake.uri/pool/50%off.deb", "/pool/50%25off.deb"},
+	}
+
+	for _, tt := range tests {
+		var buffer bytes.Buffer
+		var paths []string
+		method := NewAptMethod(bufio.NewReader(&bytes.Buffer{}), &buffer)
+		method.client = pathRecordingClient{&paths}
+		method.dl = fakeDownloader{}
+		msg := &Message{code: 600, description: "URI Acquire", fields: map[string][]string{"URI": {tt.uri}, "Filename": {"/path/to/file"}}}
+		if err := method.handleAcquire(context.Background(), msg); err != nil {
+			t.Errorf("failed, %s: unexpected error %v", tt.uri, err)
+			continue
+		}
+		if len(paths) != 1 || paths[0] != tt.expected {
+			t.Errorf("failed, %s: expected request for %s, got %v", tt.uri, tt.expected, paths)
+		}
+		reader := NewAptMessageReader(bufio.NewReader(&buffer))
+		reader.ReadMessage(context.Background())
+		if done, _ := reader.ReadMessage(context.Background()); done == nil || done.code != 201 || done.Get("URI") != tt.uri {
+			t.Errorf("failed, %s: expected URI Done for the URI apt sent, got %v", tt.uri, done)
+		}
+	}
+}
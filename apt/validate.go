@@ -0,0 +1,159 @@
+//  Copyright 2021 Google LLC
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package apt
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// maxReleaseSize bounds how much of a Release file is read while validating
+// sources; the Architectures field is near the top.
+const maxReleaseSize = 1 << 20
+
+// startValidation checks the sources using this method against what their
+// repositories serve in the background, warning about any mismatch before
+// apt runs into it mid-update. It only runs once per session.
+func (m *Method) startValidation(ctx context.Context) {
+	if !m.config.validateSources || m.validationStarted {
+		return
+	}
+	m.validationStarted = true
+	var sources []aptSource
+	for _, source := range readSources(m.config.dirs.sourceFiles()) {
+		if strings.HasPrefix(source.uri, "ar+https://") {
+			sources = append(sources, source)
+		}
+	}
+	if len(sources) == 0 {
+		return
+	}
+	m.background.Add(1)
+	go func() {
+		defer m.background.Done()
+		defer m.failOnPanic()
+		m.validateSources(ctx, sources)
+	}()
+}
+
+func (m *Method) validateSources(ctx context.Context, sources []aptSource) {
+	if err := m.initClient(ctx); err != nil {
+		if ctx.Err() != nil {
+			return
+		}
+		m.writer.Warning(fmt.Sprintf("could not validate sources: %v", err))
+		return
+	}
+	for _, source := range sources {
+		warnings := m.validateSource(ctx, source)
+		if ctx.Err() != nil {
+			// Failures to reach the repository are no news.
+			return
+		}
+		for _, warning := range warnings {
+			m.writer.Warning(warning)
+		}
+	}
+}
+
+// validateSource returns warnings for the options of source which don't
+// match its repository.
+func (m *Method) validateSource(ctx context.Context, source aptSource) []string {
+	var warnings []string
+	for _, keyring := range signedByFiles(source.options["signed-by"]) {
+		if _, err := os.Stat(keyring); err != nil {
+			warnings = append(warnings, fmt.Sprintf("%s: Signed-By keyring is not readable: %v", source.uri, err))
+		}
+	}
+
+	wanted := strings.Fields(source.options["architectures"])
+	if len(wanted) == 0 {
+		return warnings
+	}
+	for _, suite := range source.suites {
+		uri := strings.TrimSuffix(source.uri, "/") + "/dists/" + suite + "/Release"
+		served, err := m.releaseArchitectures(ctx, uri)
+		if err != nil {
+			warnings = append(warnings, fmt.Sprintf("%s: could not fetch Release file: %v", uri, err))
+			continue
+		}
+		for _, arch := range wanted {
+			if !served[arch] {
+				warnings = append(warnings, fmt.Sprintf("%s: architecture %s is not served by suite %s", source.uri, arch, suite))
+			}
+		}
+	}
+	return warnings
+}
+
+// signedByFiles returns the keyring paths in a Signed-By option, which may
+// instead hold fingerprints or an inline key.
+func signedByFiles(signedBy string) []string {
+	if strings.Contains(signedBy, "BEGIN PGP") {
+		return nil
+	}
+	var files []string
+	for _, field := range strings.Fields(signedBy) {
+		if strings.HasPrefix(field, "/") {
+			files = append(files, field)
+		}
+	}
+	return files
+}
+
+// releaseArchitectures fetches a Release file and returns the architectures
+// it lists. "all" is always included, as apt never requires it to be listed.
+func (m *Method) releaseArchitectures(ctx context.Context, uri string) (map[string]bool, error) {
+	realuri := strings.Replace(m.regionURI(encodeURI(uri)), "ar+https", "https", 1)
+	req, err := http.NewRequest("GET", realuri, nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	for name, values := range m.config.extraHeaders(req.URL.Host) {
+		for _, value := range values {
+			req.Header.Add(name, value)
+		}
+	}
+	resp, err := m.do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("code %d", resp.StatusCode)
+	}
+
+	archs := map[string]bool{"all": true}
+	scanner := bufio.NewScanner(io.LimitReader(resp.Body, maxReleaseSize))
+	for scanner.Scan() {
+		parts := strings.SplitN(scanner.Text(), ":", 2)
+		if len(parts) == 2 && strings.EqualFold(parts[0], "Architectures") {
+			for _, arch := range strings.Fields(parts[1]) {
+				archs[arch] = true
+			}
+			return archs, nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return nil, fmt.Errorf("no Architectures field")
+}
@@ -0,0 +1,108 @@
+//  Copyright 2021 Google LLC
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package apt
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// artifactRegistryEndpoint is the Artifact Registry API, replaced in tests.
+var artifactRegistryEndpoint = "https://artifactregistry.googleapis.com/v1/"
+
+// maxFileResponseSize bounds the response describing a file.
+const maxFileResponseSize = 1 << 20
+
+// arFileName returns the Artifact Registry file resource name for a package
+// URI of the form ar+https://LOCATION-apt.pkg.dev/projects/PROJECT/REPOSITORY/PATH,
+// whose file ID is PATH with slashes escaped.
+func arFileName(uri string) (string, bool) {
+	project, location, ok := parseRepositoryURI(uri)
+	if !ok {
+		return "", false
+	}
+	u, err := parseAptURI(uri)
+	if err != nil {
+		return "", false
+	}
+	parts := strings.SplitN(strings.TrimPrefix(u.Path, "/"), "/", 4)
+	if len(parts) < 4 || parts[2] == "" || parts[3] == "" {
+		return "", false
+	}
+	return fmt.Sprintf("projects/%s/locations/%s/repositories/%s/files/%s", project, location, parts[2], url.PathEscape(parts[3])), true
+}
+
+// verifyChecksum compares the SHA256 of filename, downloaded from uri,
+// against the checksum Artifact Registry recorded for the file when it was
+// uploaded. This is independent of the repository indexes, so it also
+// catches a package and index which were changed together.
+func (m *Method) verifyChecksum(ctx context.Context, uri, filename string) error {
+	name, ok := arFileName(uri)
+	if !ok {
+		return fmt.Errorf("cannot determine the Artifact Registry file for %s to verify its checksum", uri)
+	}
+	req, err := http.NewRequest("GET", artifactRegistryEndpoint+name, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := m.do(req.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("failed to look up checksum of %s: %v", uri, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to look up checksum of %s: code %d", uri, resp.StatusCode)
+	}
+	var file struct {
+		Hashes []struct {
+			Type  string `json:"type"`
+			Value []byte `json:"value"`
+		} `json:"hashes"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxFileResponseSize)).Decode(&file); err != nil {
+		return fmt.Errorf("malformed file description of %s: %v", uri, err)
+	}
+	var want []byte
+	for _, h := range file.Hashes {
+		if h.Type == "SHA256" {
+			want = h.Value
+		}
+	}
+	if want == nil {
+		return fmt.Errorf("no SHA256 checksum recorded for %s", uri)
+	}
+
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return err
+	}
+	if got := hash.Sum(nil); !bytes.Equal(got, want) {
+		return fmt.Errorf("checksum mismatch for %s: Artifact Registry recorded SHA256 %x, downloaded %x", uri, want, got)
+	}
+	return nil
+}
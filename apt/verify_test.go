@@ -0,0 +1,96 @@
+//  Copyright 2021 Google LLC
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package apt
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestARFileName(t *testing.T) {
+	var tests = []struct {
+		uri, expected string
+	}{
+		{"ar+https://us-apt.pkg.dev/projects/p/repo/pool/main/h/hello_1.0_amd64.deb", "projects/p/locations/us/repositories/repo/files/pool%2Fmain%2Fh%2Fhello_1.0_amd64.deb"},
+		{"ar+https://europe-west1-apt.pkg.dev/projects/p/repo/hello.deb", "projects/p/locations/europe-west1/repositories/repo/files/hello.deb"},
+		{"ar+https://us-apt.pkg.dev/projects/p/repo", ""},
+		{"ar+https://example.com/projects/p/repo/hello.deb", ""},
+	}
+
+	for _, tt := range tests {
+		if res, ok := arFileName(tt.uri); res != tt.expected || ok != (tt.expected != "") {
+			t.Errorf("failed, arFileName(%q) = %q, %v", tt.uri, res, ok)
+		}
+	}
+}
+
+// checksumHTTPClient serves a package and the Artifact Registry API's
+// description of it, with the given recorded checksum.
+type checksumHTTPClient struct {
+	hashes string
+}
+
+func (c checksumHTTPClient) Do(req *http.Request) (*http.Response, error) {
+	if req.URL.Host == "ar.test" {
+		body := fmt.Sprintf(`{"name": %q, "hashes": %s}`, strings.TrimPrefix(req.URL.Path, "/v1/"), c.hashes)
+		return &http.Response{StatusCode: 200, Header: http.Header{}, Body: io.NopCloser(strings.NewReader(body))}, nil
+	}
+	return &http.Response{StatusCode: 200, Header: http.Header{}, Body: io.NopCloser(strings.NewReader("package contents"))}, nil
+}
+
+func TestAptMethodVerifyChecksums(t *testing.T) {
+	defer func(endpoint string) { artifactRegistryEndpoint = endpoint }(artifactRegistryEndpoint)
+	artifactRegistryEndpoint = "https://ar.test/v1/"
+	sum := sha256.Sum256([]byte("package contents"))
+	other := sha256.Sum256([]byte("other contents"))
+
+	var tests = []struct {
+		name, uri, hashes string
+		expectedCode      string
+	}{
+		{"match", "ar+https://us-apt.pkg.dev/projects/p/repo/pool/hello.deb", fmt.Sprintf(`[{"type": "MD5", "value": "AAAA"}, {"type": "SHA256", "value": %q}]`, base64.StdEncoding.EncodeToString(sum[:])), "201 URI Done"},
+		{"mismatch", "ar+https://us-apt.pkg.dev/projects/p/repo/pool/hello.deb", fmt.Sprintf(`[{"type": "SHA256", "value": %q}]`, base64.StdEncoding.EncodeToString(other[:])), "400 URI Failure"},
+		{"no checksum", "ar+https://us-apt.pkg.dev/projects/p/repo/pool/hello.deb", `[]`, "400 URI Failure"},
+		{"unknown file", "ar+https://mirror.example.com/pool/hello.deb", `[]`, "400 URI Failure"},
+		{"index", "ar+https://us-apt.pkg.dev/projects/p/repo/dists/repo/Release", `[]`, "201 URI Done"},
+	}
+
+	for _, tt := range tests {
+		var buffer bytes.Buffer
+		method := NewAptMethod(bufio.NewReader(&bytes.Buffer{}), &buffer)
+		method.client = checksumHTTPClient{hashes: tt.hashes}
+		method.handleConfigure(&Message{code: 601, description: "Configuration", fields: map[string][]string{
+			"Config-Item": {"Acquire::gar::Verify-Checksums=true"},
+		}})
+		msg := &Message{
+			code:        600,
+			description: "URI Acquire",
+			fields:      map[string][]string{"URI": {tt.uri}, "Filename": {filepath.Join(t.TempDir(), "file")}},
+		}
+		method.handleAcquire(context.Background(), msg)
+		if !strings.Contains(buffer.String(), tt.expectedCode) {
+			t.Errorf("%s: failed, expected %s, got %q", tt.name, tt.expectedCode, buffer.String())
+		}
+	}
+}
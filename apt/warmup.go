@@ -0,0 +1,67 @@
+//  Copyright 2021 Google LLC
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package apt
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// startWarmup begins connecting to the hosts found in the sources files in
+// the background, so that TLS handshakes and minting a token overlap with
+// apt's own startup. It only runs once per session.
+func (m *Method) startWarmup(ctx context.Context) {
+	if !m.config.warmup || m.warmupStarted {
+		return
+	}
+	m.warmupStarted = true
+	hosts := sourceHosts(readSources(m.config.dirs.sourceFiles()))
+	if len(hosts) == 0 {
+		return
+	}
+	m.background.Add(1)
+	go func() {
+		defer m.background.Done()
+		defer m.failOnPanic()
+		m.warmup(ctx, hosts, m.config.debug)
+	}()
+}
+
+func (m *Method) warmup(ctx context.Context, hosts []string, debug bool) {
+	if err := m.initClient(ctx); err != nil {
+		if debug && ctx.Err() == nil {
+			m.writer.logSequenced(0, fmt.Sprintf("warmup failed: %v", err))
+		}
+		return
+	}
+	var wg sync.WaitGroup
+	for _, host := range hosts {
+		wg.Add(1)
+		go func(host string) {
+			defer wg.Done()
+			latency, err := m.probeHost(ctx, host)
+			if !debug || ctx.Err() != nil {
+				return
+			}
+			if err != nil {
+				m.writer.logSequenced(0, fmt.Sprintf("warmup of %s failed: %v", host, err))
+			} else {
+				m.writer.logSequenced(0, fmt.Sprintf("warmed up connection to %s in %v", host, latency))
+			}
+		}(host)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,62 @@
+//  Copyright 2021 Google LLC
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package apt
+
+import (
+	"context"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// slowTokenFetch is how long fetching a token may take before the method
+// warns that the token endpoint, typically the metadata server, is slow.
+const slowTokenFetch = 5 * time.Second
+
+// warn surfaces a problem the method recovered from as a 104 Warning, which
+// apt shows to the user. Each distinct warning is sent once per session, so
+// that a problem affecting every acquire doesn't drown out apt's output. It
+// is safe to call from any goroutine.
+func (m *Method) warn(msg string) {
+	m.warnMu.Lock()
+	if m.warned[msg] {
+		m.warnMu.Unlock()
+		return
+	}
+	if m.warned == nil {
+		m.warned = make(map[string]bool)
+	}
+	m.warned[msg] = true
+	m.warnMu.Unlock()
+	m.metrics().Event("warning", nil)
+	m.writer.Warning(msg)
+}
+
+// retryTokens wraps ts to retry transiently failed fetches until ctx is
+// cancelled, reporting each retry as the status of the method and warning
+// if a fetch only succeeded on retry.
+func (m *Method) retryTokens(ctx context.Context, ts oauth2.TokenSource) oauth2.TokenSource {
+	rts := newRetryTokenSource(ctx, ts, m.timeSource(), func(msg string) { m.writer.Status(msg) })
+	rts.warn = m.warn
+	return rts
+}
+
+// manageTokens caches the tokens of ts in a tokenManager which warns about
+// slow, failed and late refreshes.
+func (m *Method) manageTokens(ts oauth2.TokenSource) *tokenManager {
+	tm := newTokenManager(ts, m.timeSource())
+	tm.warn = m.warn
+	return tm
+}
@@ -0,0 +1,46 @@
+//  Copyright 2021 Google LLC
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package apt
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"testing"
+)
+
+func TestMethodWarnOnce(t *testing.T) {
+	var buffer bytes.Buffer
+	method := NewAptMethod(bufio.NewReader(&bytes.Buffer{}), &buffer)
+	method.warn("retried")
+	method.warn("slow")
+	method.warn("retried")
+
+	reader := NewAptMessageReader(bufio.NewReader(&buffer))
+	var warnings []string
+	for {
+		msg, err := reader.ReadMessage(context.Background())
+		if err != nil || msg == nil {
+			break
+		}
+		if msg.code != 104 {
+			t.Errorf("failed, expected a 104 Warning, got %v", msg)
+		}
+		warnings = append(warnings, msg.Get("Message"))
+	}
+	if len(warnings) != 2 || warnings[0] != "retried" || warnings[1] != "slow" {
+		t.Errorf("failed, expected each warning once, got %q", warnings)
+	}
+}
@@ -0,0 +1,45 @@
+//  Copyright 2021 Google LLC
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/GoogleCloudPlatform/artifact-registry-apt-transport/apt"
+)
+
+// verifyJournal implements the verify-journal subcommand, which checks that
+// a journal written with Journal-File hasn't been tampered with.
+func verifyJournal(args []string, out io.Writer) int {
+	if len(args) != 1 {
+		fmt.Fprintf(out, "usage: verify-journal <file>\n")
+		return exitFailure
+	}
+	f, err := os.Open(args[0])
+	if err != nil {
+		fmt.Fprintf(out, "failed to open journal: %v\n", err)
+		return exitFailure
+	}
+	defer f.Close()
+	entries, err := apt.VerifyJournal(f)
+	if err != nil {
+		fmt.Fprintf(out, "journal %s is not intact after %d entries: %v\n", args[0], entries, err)
+		return exitFailure
+	}
+	fmt.Fprintf(out, "journal %s is intact: %d entries\n", args[0], entries)
+	return 0
+}
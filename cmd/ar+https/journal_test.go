@@ -0,0 +1,32 @@
+//  Copyright 2021 Google LLC
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestVerifyJournal(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal.jsonl")
+	os.WriteFile(path, []byte(`{"uri":"ar+https://us-apt.pkg.dev/a","prev":""}`+"\n"+`{"uri":"ar+https://us-apt.pkg.dev/b","prev":"bad"}`+"\n"), 0644)
+	var out bytes.Buffer
+	if code := verifyJournal([]string{path}, &out); code != exitFailure || !strings.Contains(out.String(), "line 2") {
+		t.Errorf("failed, expected the second line to be rejected, got %d: %s", code, out.String())
+	}
+}
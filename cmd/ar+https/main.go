@@ -18,16 +18,104 @@ import (
 	"bufio"
 	"context"
 	"fmt"
+	"io"
 	"os"
 
 	"github.com/GoogleCloudPlatform/artifact-registry-apt-transport/apt"
 )
 
+// Exit codes, so that wrappers and apt hooks can tell why the method died.
+const (
+	exitFailure  = 100
+	exitConfig   = 101
+	exitAuth     = 102
+	exitProtocol = 103
+	exitIO       = 104
+)
+
+var exitCodes = map[apt.ErrorKind]int{
+	apt.ConfigError:   exitConfig,
+	apt.AuthError:     exitAuth,
+	apt.ProtocolError: exitProtocol,
+	apt.IOError:       exitIO,
+}
+
+func exitCode(err error) int {
+	if code, ok := exitCodes[apt.KindOf(err)]; ok {
+		return code
+	}
+	return exitFailure
+}
+
+// exitUsage is the exit code for a command line naming no known
+// subcommand, as for one the flag package rejects.
+const exitUsage = 2
+
+const usage = `usage: ar+https [subcommand]
+
+Without a subcommand, ar+https runs as an apt method, as apt runs it.
+
+Subcommands:
+  check-update     report whether a newer release is available
+  config-schema    print the config items the method understands, as JSON
+  print-config     print the configuration the method would run with, from
+                   apt-config dump on stdin
+  verify-journal   check that a Journal-File hasn't been tampered with
+  pending-retries  list the URIs in a Retry-Queue-File
+`
+
+// runSubcommand runs the subcommand args name and returns its exit code.
+// It reports false, running nothing, if args are empty, as when apt runs
+// the method. An unknown subcommand is a usage error, rather than reason to
+// run as a method that no apt is talking to.
+func runSubcommand(args []string, in io.Reader, out, errOut io.Writer) (int, bool) {
+	if len(args) == 0 {
+		return 0, false
+	}
+	switch args[0] {
+	case "check-update":
+		return checkUpdate(args[1:], out), true
+	case "config-schema":
+		return configSchema(out), true
+	case "print-config":
+		return printConfig(in, out), true
+	case "verify-journal":
+		return verifyJournal(args[1:], out), true
+	case "pending-retries":
+		return pendingRetries(args[1:], out), true
+	}
+	fmt.Fprintf(errOut, "unknown subcommand %q\n\n%s", args[0], usage)
+	return exitUsage, true
+}
+
 func main() {
-	apt := apt.NewAptMethod(bufio.NewReader(os.Stdin), os.Stdout)
-	err := apt.Run(context.Background())
+	if code, ok := runSubcommand(os.Args[1:], os.Stdin, os.Stdout, os.Stderr); ok {
+		os.Exit(code)
+	}
+	ctx := context.Background()
+	method := apt.NewAptMethod(bufio.NewReader(os.Stdin), os.Stdout)
+	// Monitoring wrappers can send SIGUSR2 to have the method check that it
+	// can authenticate and reach its hosts, and log the result. SIGHUP is
+	// left to end the method, as it does one whose terminal has gone;
+	// otherwise it exits once apt closes its standard input.
+	usr2 := make(chan os.Signal, 1)
+	notifyHealthCheck(usr2)
+	go func() {
+		for range usr2 {
+			method.HealthCheck(ctx)
+		}
+	}()
+	// SIGUSR1 logs the state of the method's reliability features.
+	usr1 := make(chan os.Signal, 1)
+	notifyDumpState(usr1)
+	go func() {
+		for range usr1 {
+			method.DumpState()
+		}
+	}()
+	err := method.Run(ctx)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "%+v\n", err)
-		os.Exit(100)
+		os.Exit(exitCode(err))
 	}
 }
@@ -0,0 +1,46 @@
+//  Copyright 2021 Google LLC
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestRunSubcommand(t *testing.T) {
+	var tests = []struct {
+		args        []string
+		expectedRun bool
+		expected    int
+	}{
+		// apt runs the method without arguments.
+		{nil, false, 0},
+		{[]string{"chek-update"}, true, exitUsage},
+		{[]string{"--help"}, true, exitUsage},
+		{[]string{"config-schema"}, true, 0},
+	}
+
+	for _, tt := range tests {
+		var out, errOut bytes.Buffer
+		code, ok := runSubcommand(tt.args, strings.NewReader(""), &out, &errOut)
+		if ok != tt.expectedRun || code != tt.expected {
+			t.Errorf("%q: failed, expected %v, %d got %v, %d", tt.args, tt.expectedRun, tt.expected, ok, code)
+		}
+		if tt.expected == exitUsage && !strings.Contains(errOut.String(), "usage: ar+https") {
+			t.Errorf("%q: failed, expected usage, got %q", tt.args, errOut.String())
+		}
+	}
+}
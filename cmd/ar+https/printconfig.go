@@ -0,0 +1,73 @@
+//  Copyright 2021 Google LLC
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/GoogleCloudPlatform/artifact-registry-apt-transport/apt"
+)
+
+// printConfig implements the print-config subcommand, which reads the
+// output of apt-config dump and prints the configuration the method would
+// run with, including environment overrides and defaults, e.g.
+//
+//	apt-config dump | /usr/lib/apt/methods/ar+https print-config
+func printConfig(in io.Reader, out io.Writer) int {
+	items, err := readConfigDump(in)
+	if err != nil {
+		fmt.Fprintf(out, "failed to read apt-config dump: %v\n", err)
+		return exitFailure
+	}
+	lines, err := apt.EffectiveConfig(items)
+	if err != nil {
+		fmt.Fprintf(out, "invalid configuration: %v\n", err)
+		return exitConfig
+	}
+	for _, line := range lines {
+		fmt.Fprintln(out, line)
+	}
+	return 0
+}
+
+// readConfigDump turns the lines of apt-config dump, such as
+//
+//	Acquire::gar::Auth-Hosts:: "apt-mirror.example.com";
+//
+// into config items as apt sends them to methods. The empty values dumped
+// for the parents of other items are left out.
+func readConfigDump(in io.Reader) ([]string, error) {
+	var items []string
+	scanner := bufio.NewScanner(in)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		parts := strings.SplitN(line, " ", 2)
+		if len(parts) != 2 || !strings.HasPrefix(parts[1], "\"") || !strings.HasSuffix(parts[1], "\";") {
+			return nil, fmt.Errorf("malformed line: %s", line)
+		}
+		value := strings.TrimSuffix(strings.TrimPrefix(parts[1], "\""), "\";")
+		if value == "" {
+			continue
+		}
+		items = append(items, parts[0]+"="+value)
+	}
+	return items, scanner.Err()
+}
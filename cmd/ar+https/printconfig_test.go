@@ -0,0 +1,59 @@
+//  Copyright 2021 Google LLC
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestPrintConfig(t *testing.T) {
+	dump := strings.Join([]string{
+		`Acquire "";`,
+		`Acquire::gar "";`,
+		`Acquire::gar::Pipeline-Depth "4";`,
+		`Acquire::gar::Access-Token "ya29.secret";`,
+		`Acquire::gar::Auth-Hosts "";`,
+		`Acquire::gar::Auth-Hosts:: "a.example.com";`,
+		`Acquire::gar::Auth-Hosts:: "b.example.com";`,
+		`APT::Architecture "amd64";`,
+	}, "\n")
+	var out bytes.Buffer
+	if code := printConfig(strings.NewReader(dump), &out); code != 0 {
+		t.Fatalf("failed, exit code %d: %s", code, out.String())
+	}
+	for _, expected := range []string{
+		"Acquire::gar::Pipeline-Depth=4 (apt)\n",
+		"Acquire::gar::Access-Token=[REDACTED] (apt)\n",
+		"Acquire::gar::Auth-Hosts=a.example.com,b.example.com (apt)\n",
+		"Acquire::gar::Expected-Size-Mismatch=fail (default)\n",
+	} {
+		if !strings.Contains(out.String(), expected) {
+			t.Errorf("failed, expected %q in:\n%s", expected, out.String())
+		}
+	}
+	if strings.Contains(out.String(), "ya29.secret") {
+		t.Errorf("failed, secret printed:\n%s", out.String())
+	}
+}
+
+func TestPrintConfigStrict(t *testing.T) {
+	dump := "Acquire::gar::Strict-Config \"true\";\nAcquire::gar::Pipeline-Depth \"many\";\n"
+	var out bytes.Buffer
+	if code := printConfig(strings.NewReader(dump), &out); code != exitConfig {
+		t.Errorf("failed, expected exit code %d, got %d: %s", exitConfig, code, out.String())
+	}
+}
@@ -0,0 +1,52 @@
+//  Copyright 2021 Google LLC
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/GoogleCloudPlatform/artifact-registry-apt-transport/apt"
+)
+
+// Exit codes of the pending-retries subcommand, chosen so that it can be a
+// systemd ExecCondition of a unit which reruns apt.
+const (
+	retriesPending = 0
+	retriesNone    = 1
+)
+
+// pendingRetries implements the pending-retries subcommand, which lists the
+// URIs in a Retry-Queue-File, those best retried first, and exits with
+// retriesPending if there are any.
+func pendingRetries(args []string, out io.Writer) int {
+	if len(args) != 1 {
+		fmt.Fprintf(out, "usage: pending-retries <file>\n")
+		return exitFailure
+	}
+	entries, err := apt.LoadRetryQueue(args[0])
+	if err != nil {
+		fmt.Fprintf(out, "failed to read retry queue: %v\n", err)
+		return exitFailure
+	}
+	for _, entry := range entries {
+		fmt.Fprintf(out, "%s\t%d failures since %s: %s\n", entry.URI, entry.Failures, entry.FirstFailed.Format(time.RFC3339), entry.LastError)
+	}
+	if len(entries) == 0 {
+		return retriesNone
+	}
+	return retriesPending
+}
@@ -0,0 +1,44 @@
+//  Copyright 2021 Google LLC
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPendingRetries(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queue.json")
+	var out bytes.Buffer
+	if code := pendingRetries([]string{path}, &out); code != retriesNone || out.Len() != 0 {
+		t.Errorf("failed, expected no pending retries without a queue, got %d: %s", code, out.String())
+	}
+
+	os.WriteFile(path, []byte(`{
+  "ar+https://us-apt.pkg.dev/a": {"failures": 1, "first_failed": "2021-03-01T00:00:00Z", "last_error": "code 503"},
+  "ar+https://us-apt.pkg.dev/b": {"failures": 3, "first_failed": "2021-03-02T00:00:00Z", "last_error": "connection reset"}
+}`), 0644)
+	out.Reset()
+	if code := pendingRetries([]string{path}, &out); code != retriesPending {
+		t.Errorf("failed, expected pending retries, got %d: %s", code, out.String())
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 || !strings.HasPrefix(lines[0], "ar+https://us-apt.pkg.dev/b\t3 failures") {
+		t.Errorf("failed, expected the URI failing most first, got %q", lines)
+	}
+}
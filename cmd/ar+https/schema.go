@@ -0,0 +1,40 @@
+//  Copyright 2021 Google LLC
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/GoogleCloudPlatform/artifact-registry-apt-transport/apt"
+)
+
+// configSchema implements the config-schema subcommand, which prints the
+// config items the method understands as JSON, for config management tools
+// to validate settings against.
+func configSchema(out io.Writer) int {
+	schema := struct {
+		Version string             `json:"version"`
+		Options []apt.ConfigOption `json:"options"`
+	}{version, apt.ConfigOptions()}
+	b, err := json.MarshalIndent(schema, "", "  ")
+	if err != nil {
+		fmt.Fprintf(out, "failed to encode config schema: %v\n", err)
+		return exitFailure
+	}
+	fmt.Fprintf(out, "%s\n", b)
+	return 0
+}
@@ -0,0 +1,48 @@
+//  Copyright 2021 Google LLC
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+)
+
+func TestConfigSchema(t *testing.T) {
+	var out bytes.Buffer
+	if code := configSchema(&out); code != 0 {
+		t.Fatalf("failed, exit code %d: %s", code, out.String())
+	}
+	var schema struct {
+		Version string
+		Options []map[string]interface{}
+	}
+	if err := json.Unmarshal(out.Bytes(), &schema); err != nil {
+		t.Fatalf("failed, invalid JSON: %v", err)
+	}
+	options := make(map[string]map[string]interface{})
+	for _, option := range schema.Options {
+		options[option["key"].(string)] = option
+	}
+	if option := options["Acquire::gar::Access-Token"]; option == nil || option["secret"] != true {
+		t.Errorf("failed, expected Access-Token to be marked secret, got %v", option)
+	}
+	if option := options["Acquire::gar::Timeout"]; option == nil || option["scope"] != "host" {
+		t.Errorf("failed, expected Timeout to be host-scoped, got %v", option)
+	}
+	if option := options["Acquire::gar::Expected-Size-Mismatch"]; option == nil || option["default"] != "fail" {
+		t.Errorf("failed, expected Expected-Size-Mismatch to default to fail, got %v", option)
+	}
+}
@@ -0,0 +1,41 @@
+//  Copyright 2021 Google LLC
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+//go:build linux || darwin || freebsd || netbsd || openbsd
+// +build linux darwin freebsd netbsd openbsd
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestNotifyHealthCheck(t *testing.T) {
+	c := make(chan os.Signal, 1)
+	notifyHealthCheck(c)
+	defer signal.Stop(c)
+	syscall.Kill(os.Getpid(), syscall.SIGUSR2)
+	select {
+	case sig := <-c:
+		if sig != syscall.SIGUSR2 {
+			t.Errorf("failed, expected SIGUSR2 got %v", sig)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("failed, SIGUSR2 was not relayed")
+	}
+}
@@ -0,0 +1,132 @@
+//  Copyright 2021 Google LLC
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// version is set at build time with -ldflags "-X main.version=...".
+var version = devVersion
+
+// devVersion is the version of a build which wasn't given one, which can't
+// be compared with releases.
+const devVersion = "dev"
+
+const latestReleaseURL = "https://api.github.com/repos/GoogleCloudPlatform/artifact-registry-apt-transport/releases/latest"
+
+// Exit codes of the check-update subcommand.
+const (
+	updateCurrent   = 0
+	updateAvailable = 1
+	updateFailed    = 2
+)
+
+// checkUpdate implements the check-update subcommand, which reports whether
+// a newer release is available. It never updates anything itself.
+func checkUpdate(args []string, out io.Writer) int {
+	flags := flag.NewFlagSet("check-update", flag.ContinueOnError)
+	flags.SetOutput(out)
+	url := flags.String("url", latestReleaseURL, "URL of the latest release, in GitHub's release JSON format")
+	if err := flags.Parse(args); err != nil {
+		return updateFailed
+	}
+	if version == devVersion {
+		fmt.Fprintln(out, `can't check for updates: this is a development build without a version; release builds set one with -ldflags "-X main.version=..."`)
+		return updateFailed
+	}
+
+	latest, err := latestRelease(&http.Client{Timeout: 30 * time.Second}, *url)
+	if err != nil {
+		fmt.Fprintf(out, "failed to check for updates: %v\n", err)
+		return updateFailed
+	}
+	if newer, err := isNewer(latest, version); err != nil {
+		fmt.Fprintf(out, "failed to compare version %q with latest %q: %v\n", version, latest, err)
+		return updateFailed
+	} else if newer {
+		fmt.Fprintf(out, "update available: running %s, latest is %s\n", version, latest)
+		return updateAvailable
+	}
+	fmt.Fprintf(out, "up to date: running %s, latest is %s\n", version, latest)
+	return updateCurrent
+}
+
+// latestRelease returns the tag of the latest release described at url.
+func latestRelease(client *http.Client, url string) (string, error) {
+	resp, err := client.Get(url)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("code %d from %s", resp.StatusCode, url)
+	}
+	var release struct {
+		TagName string `json:"tag_name"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&release); err != nil {
+		return "", err
+	}
+	if release.TagName == "" {
+		return "", fmt.Errorf("no tag_name in release from %s", url)
+	}
+	return release.TagName, nil
+}
+
+// isNewer reports whether version a is newer than b. Versions are dotted
+// numbers such as 20210304.00, optionally prefixed with "v".
+func isNewer(a, b string) (bool, error) {
+	pa, err := parseVersion(a)
+	if err != nil {
+		return false, err
+	}
+	pb, err := parseVersion(b)
+	if err != nil {
+		return false, err
+	}
+	for i := 0; i < len(pa) || i < len(pb); i++ {
+		var x, y int
+		if i < len(pa) {
+			x = pa[i]
+		}
+		if i < len(pb) {
+			y = pb[i]
+		}
+		if x != y {
+			return x > y, nil
+		}
+	}
+	return false, nil
+}
+
+func parseVersion(v string) ([]int, error) {
+	var parts []int
+	for _, s := range strings.Split(strings.TrimPrefix(v, "v"), ".") {
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return nil, fmt.Errorf("malformed version %q", v)
+		}
+		parts = append(parts, n)
+	}
+	return parts, nil
+}
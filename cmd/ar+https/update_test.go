@@ -0,0 +1,78 @@
+//  Copyright 2021 Google LLC
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestIsNewer(t *testing.T) {
+	var tests = []struct {
+		a, b      string
+		expected  bool
+		expectErr bool
+	}{
+		{"20210304.01", "20210304.00", true, false},
+		{"v20210401.00", "20210304.00", true, false},
+		{"20210304.00", "20210304.00", false, false},
+		{"20210304", "20210304.00", false, false},
+		{"20210204.00", "20210304.00", false, false},
+		{"20210304.00", "dev", false, true},
+	}
+
+	for _, tt := range tests {
+		res, err := isNewer(tt.a, tt.b)
+		if res != tt.expected || tt.expectErr != (err != nil) {
+			t.Errorf("failed, isNewer(%q, %q) = %v, %v", tt.a, tt.b, res, err)
+		}
+	}
+}
+
+func TestCheckUpdate(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/latest":
+			fmt.Fprint(w, `{"tag_name": "v20210401.00", "name": "Release"}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+	defer func(v string) { version = v }(version)
+
+	var tests = []struct {
+		version, path string
+		expected      int
+		expectedOut   string
+	}{
+		{"20210304.00", "/latest", updateAvailable, "update available"},
+		{"20210401.00", "/latest", updateCurrent, "up to date"},
+		{"20210304.00", "/missing", updateFailed, "failed to check for updates"},
+		{"dev", "/latest", updateFailed, "development build"},
+	}
+
+	for _, tt := range tests {
+		version = tt.version
+		var out bytes.Buffer
+		if code := checkUpdate([]string{"-url", server.URL + tt.path}, &out); code != tt.expected || !strings.Contains(out.String(), tt.expectedOut) {
+			t.Errorf("failed for %s from %s, expected %d and %q got %d: %s", tt.version, tt.path, tt.expected, tt.expectedOut, code, out.String())
+		}
+	}
+}
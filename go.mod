@@ -2,4 +2,7 @@ module github.com/GoogleCloudPlatform/artifact-registry-apt-transport
 
 go 1.16
 
-require golang.org/x/oauth2 v0.0.0-20210220000619-9bb904979d93
+require (
+	cloud.google.com/go v0.65.0
+	golang.org/x/oauth2 v0.0.0-20210220000619-9bb904979d93
+)